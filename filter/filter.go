@@ -0,0 +1,37 @@
+// Package filter is the interface of dnsfilter plugins, built with
+// go build -buildmode=plugin and exporting a Filter variable of this type.
+// Messages are in wire format, to be parsed with any DNS library.
+package filter
+
+import "net"
+
+// Verdict tells dnsfilter what to do with a query or response
+type Verdict int
+
+const (
+	Continue Verdict = iota // go on with the next plugins, then as usual
+	Accept                  // as is, skipping rules for responses though not -rebind
+	Drop
+	Block // NXDOMAIN
+	Reply // send the message returned instead, rules skipped
+)
+
+// Query is a query from a client
+type Query struct {
+	Client net.IP
+	Msg    []byte
+}
+
+// Response is an answer of a nameserver to a query
+type Response struct {
+	Client net.IP
+	Server int // index of the nameserver, from 1
+	Msg    []byte
+}
+
+// Filter is called for every query, and every response before rules. Calls come from
+// many goroutines at once. Msg must not be kept after returning.
+type Filter interface {
+	OnQuery(q *Query) (Verdict, []byte)
+	OnResponse(r *Response) (Verdict, []byte)
+}
@@ -1,10 +1,17 @@
 module dnsfilter
 
-go 1.13
+go 1.18
 
 require (
-	github.com/smartystreets/goconvey v0.0.0-20190731233626-505e41936337 // indirect
-	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
+	go.etcd.io/bbolt v1.3.7
+	go.starlark.net v0.0.0-20230525235612-a134d8f9ddca
+	golang.org/x/net v0.35.0
+	golang.org/x/sys v0.30.0
 	gopkg.in/go-ini/ini.v1 v1.51.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/smartystreets/goconvey v0.0.0-20190731233626-505e41936337 // indirect
 	gopkg.in/ini.v1 v1.49.0 // indirect
 )
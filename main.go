@@ -1,16 +1,15 @@
 package main
 
 import (
-	"context"
+	"dnsfilter/pkg/dnsfilter"
+	"dnsfilter/pkg/testserver"
 	"flag"
 	"fmt"
-	"golang.org/x/net/dns/dnsmessage"
-	"gopkg.in/go-ini/ini.v1"
 	"log"
-	"net"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -19,220 +18,423 @@ const ( //TODO
 	buildDate = ""
 )
 
+type entries []string
+
+func (e *entries) String() string {
+	var strBuilder strings.Builder
+	for i, entry := range *e {
+		if i > 0 {
+			strBuilder.WriteByte(',')
+		}
+		strBuilder.WriteString(entry)
+	}
+	return strBuilder.String()
+}
+
+func (e *entries) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		*e = append(*e, entry)
+	}
+	return nil
+}
+
 var (
-	serversStr    entries
-	ipsetFiles    entries
-	listenAddrStr = flag.String("b", "localhost:5353", "Local binding address and UDP port (e.g. 127.0.0.1:5353 [::1]:5353)")
-	configFile    = flag.String("c", "", "Config file containing rules for filtering.")
-	timeout       = flag.Duration("t", time.Second, "Waiting timeout per query")
-	showVer       = flag.Bool("V", false, "Show version")
-	verbose       = flag.Bool("v", false, "Verbose mode")
+	cfg     = dnsfilter.DefaultConfig()
+	showVer = flag.Bool("V", false, "Show version")
+	logTo   = flag.String("log", "", "Log to syslog (local daemon), udp://host[:port] or tcp://host[:port] (remote syslog) or eventlog (Windows). Stdout and stderr if empty")
+	logFac  = flag.String("syslog-facility", "daemon", "Syslog facility of log messages")
+	check   = flag.Bool("check", false, "Check servers, lists and the config file, reporting every problem, print the rule table and exit. Exits 1 on problems")
+	logStd  = log.New(os.Stdout, "", log.Ldate|log.Lmicroseconds)
+	logErr  = log.New(os.Stderr, "", log.Ldate|log.Lmicroseconds)
 )
 
 func init() {
-	flag.Var(&serversStr, "d", "Nameservers. Use format [IP]:port for IPv6.")
-	flag.Var(&ipsetFiles, "l", "ipset files. Can be set multiple times or in comma-separated form")
+	flag.StringVar(&cfg.Listen, "b", cfg.Listen, "Local binding address and UDP port (e.g. 127.0.0.1:5353 [::1]:5353)")
+	flag.StringVar(&cfg.ConfigFile, "c", cfg.ConfigFile, "Config file containing rules for filtering.")
+	flag.DurationVar(&cfg.Timeout, "t", cfg.Timeout, "Waiting timeout per upstream query, unless set in its [server.xxx] section")
+	flag.DurationVar(&cfg.Deadline, "deadline", cfg.Deadline, "Time to answer a client in, whatever the upstreams. The longest timeout of the upstreams asked if 0")
+	flag.BoolVar(&cfg.Verbose, "v", cfg.Verbose, "Verbose mode")
+	flag.BoolVar(&cfg.Trace, "trace", cfg.Trace, "Verbose mode also logging why each rule considered did or didn't match")
+	flag.IntVar(&cfg.CacheSize, "cache", cfg.CacheSize, "Maximum number of cached answers. 0 disables caching")
+	flag.StringVar(&cfg.DNS64, "dns64", cfg.DNS64, "Synthesize AAAA records from A ones under this prefix (RFC 6147) for names without any, like 64:ff9b::/96. Disabled if empty")
+	flag.StringVar(&cfg.MDNSIface, "mdns-iface", cfg.MDNSIface, "Interface to send mDNS queries of -mdns on. The default multicast one if empty")
+	flag.BoolVar(&cfg.Recursive, "recursive", cfg.Recursive, "Resolve from the root servers instead of forwarding to nameservers, which are then used by [forward] zones only")
+	flag.StringVar(&cfg.Any, "any", cfg.Any, "Answer ANY queries: forward to upstreams, hinfo with an HINFO record as of RFC 8482, or notimp with NOTIMP")
+	flag.DurationVar(&cfg.MinTTL, "min-ttl", cfg.MinTTL, "Raise TTLs of relayed answers to at least this. 0 disables")
+	flag.DurationVar(&cfg.MaxTTL, "max-ttl", cfg.MaxTTL, "Lower TTLs of relayed answers to at most this. 0 disables")
+	flag.StringVar(&cfg.CacheFile, "cache-file", cfg.CacheFile, "File to save the cache in at shutdown and load it from at startup. Disabled if empty")
+	flag.DurationVar(&cfg.CacheSave, "cache-save", cfg.CacheSave, "Interval of saving the cache to -cache-file besides shutdown. 0 disables")
+	flag.Float64Var(&cfg.QPS, "qps", cfg.QPS, "Queries per second allowed per client IP. 0 disables rate limiting")
+	flag.IntVar(&cfg.Burst, "burst", cfg.Burst, "Burst size of per-client rate limiting")
+	flag.BoolVar(&cfg.QPSDrop, "qps-drop", cfg.QPSDrop, "Silently drop over-limit queries instead of replying REFUSED")
+	flag.Float64Var(&cfg.RRL, "rrl", cfg.RRL, "Responses per second per client network, name and type (response rate limiting). 0 disables")
+	flag.DurationVar(&cfg.RRLWindow, "rrl-window", cfg.RRLWindow, "Window over which response rate limiting accounts")
+	flag.IntVar(&cfg.RRLSlip, "rrl-slip", cfg.RRLSlip, "Every Nth rate limited response is sent truncated, for clients to retry over TCP. 0, or -tcp=false, never slips")
+	flag.IntVar(&cfg.RRLLeak, "rrl-leak", cfg.RRLLeak, "Every Nth rate limited response is sent in full. 0 never leaks")
+	flag.StringVar(&cfg.CacheDir, "cachedir", cfg.CacheDir, "Directory keeping downloaded lists")
+	flag.DurationVar(&cfg.Refresh, "refresh", cfg.Refresh, "Interval to refresh ipsets downloaded from URLs and built-in ones. 0 disables")
+	flag.StringVar(&cfg.GeoIP, "geoip", cfg.GeoIP, "MaxMind DB (.mmdb) file for geoip matching in rules")
+	flag.StringVar(&cfg.Strategy, "strategy", cfg.Strategy, "Upstream selection: all (race every one), failover, roundrobin, weighted or fastest")
+	flag.IntVar(&cfg.Subset, "subset", cfg.Subset, "With -strategy all, number of upstreams asked per query, picked at random, to spread load and what each one learns. 0 asks all of them")
+	flag.DurationVar(&cfg.Failover, "failover", cfg.Failover, "Time to wait before trying the next upstream, for strategies other than all")
+	flag.StringVar(&cfg.Pick, "pick", cfg.Pick, "Answer to send: earliest (first one accepted, after its delay) or best (highest scoring within -race-window)")
+	flag.IntVar(&cfg.Consensus, "consensus", cfg.Consensus, "With -pick best and -strategy all, answers to wait for past -race-window, then send the best having the addresses most upstreams agree on, a trusted one first, and log diverging ones. Disabled if 0")
+	flag.DurationVar(&cfg.RaceWindow, "race-window", cfg.RaceWindow, "With -pick best, time to collect answers before picking, unless all upstreams answered earlier")
+	flag.BoolVar(&cfg.Flatten, "flatten", cfg.Flatten, "Flatten CNAME chains resolved within answers into records of the query name")
+	flag.IntVar(&cfg.Retries, "retries", cfg.Retries, "Times to retransmit a query to an upstream not answering")
+	flag.DurationVar(&cfg.RetryAfter, "retry-after", cfg.RetryAfter, "Wait before the first retransmission, doubled each time after")
+	flag.IntVar(&cfg.EDNS, "edns", cfg.EDNS, "EDNS0 UDP payload size advertised to upstreams, also sizing read buffers")
+	flag.IntVar(&cfg.MaxSize, "max-size", cfg.MaxSize, "Largest answer taken from upstreams over TCP, asking again that way for answers truncated over UDP if above -edns")
+	flag.StringVar(&cfg.FastAnswers, "fast-answers", cfg.FastAnswers, "Log or drop answers arriving in under half the lowest RTT learned of their upstream, as injected on path, and log answers to no query in flight")
+	flag.BoolVar(&cfg.Case0x20, "0x20", cfg.Case0x20, "Randomize letter case of query names to upstreams and check it in answers. Disable for upstreams not preserving case")
+	flag.BoolVar(&cfg.DNSSEC, "dnssec", cfg.DNSSEC, "Validate DNSSEC signatures of answers: set AD on secure ones and drop bogus ones")
+	flag.DurationVar(&cfg.Drain, "drain", cfg.Drain, "On SIGTERM or SIGINT, time to wait for queries in flight to be answered")
+	flag.StringVar(&cfg.User, "user", cfg.User, "User to switch to after binding sockets, when started as root")
+	flag.StringVar(&cfg.Group, "group", cfg.Group, "Group to switch to after binding sockets. Defaults to the primary group of -user")
+	flag.StringVar(&cfg.Chroot, "chroot", cfg.Chroot, "Directory to chroot into after binding sockets. Files reloaded later are looked up inside it")
+	flag.StringVar(&cfg.XFR, "xfr", cfg.XFR, "Server to pass AXFR and IXFR queries over TCP to. Disabled if empty")
+	flag.StringVar(&cfg.XFRClients, "xfr-clients", cfg.XFRClients, "Comma-separated addresses and networks allowed zone transfers through -xfr")
+	flag.StringVar(&cfg.OutboundIP, "outbound-ip", cfg.OutboundIP, "Source address of queries to upstreams, like that of a VPN. Any if empty")
+	flag.StringVar(&cfg.OutboundIface, "outbound-iface", cfg.OutboundIface, "On Linux, send queries to upstreams on this interface or VRF only (SO_BINDTODEVICE). Any if empty")
+	flag.BoolVar(&cfg.Transparent, "transparent", cfg.Transparent, "On Linux, accept queries diverted by an iptables TPROXY rule and answer them from their original destination. Needs CAP_NET_ADMIN")
+	flag.BoolVar(&cfg.TCP, "tcp", cfg.TCP, "Answer queries over TCP on the listening port too, for clients retrying answers truncated over UDP")
+	flag.BoolVar(&cfg.ReusePort, "reuseport", cfg.ReusePort, "On Linux, open one listening socket per CPU with SO_REUSEPORT so the kernel spreads queries across them")
+	flag.IntVar(&cfg.Sockets, "sockets", cfg.Sockets, "Number of long-lived sockets shared by queries to upstreams")
+	flag.IntVar(&cfg.Workers, "workers", cfg.Workers, "Number of goroutines handling queries, bounding concurrency")
+	flag.IntVar(&cfg.Queue, "queue", cfg.Queue, "Number of queries waiting for a worker before dropping")
+	flag.StringVar(&cfg.QueuePolicy, "queue-policy", cfg.QueuePolicy, "When the queue is full, drop the new query (drop) or the oldest queued one (oldest)")
+	flag.StringVar(&cfg.Script, "script", cfg.Script, "Starlark script defining verdict(query, answer) and/or upstreams(query). Disabled if empty")
+	flag.StringVar(&cfg.Profile, "profile", cfg.Profile, "Rule profile active at start, switched with SIGUSR1 or the admin API. None if empty")
+	flag.StringVar(&cfg.Admin, "admin", cfg.Admin, "Admin HTTP API binding address (e.g. 127.0.0.1:8080). Disabled if empty")
+	flag.BoolVar(&cfg.Tunnel, "tunnel", cfg.Tunnel, "Score queries for DNS tunneling by subdomain entropy and length, distinct subdomains and NXDOMAIN ratio of their domain, matched by rules with tunnel = N")
+	flag.IntVar(&cfg.TunnelAlert, "tunnel-alert", cfg.TunnelAlert, "Log queries scoring at least this for DNS tunneling, out of 100, with -tunnel. Disabled if 0")
+	flag.BoolVar(&cfg.Stats, "stats", cfg.Stats, "Keep top domains, blocked domains, clients and verdicts of the last 24 hours, served by the admin API")
+	flag.DurationVar(&cfg.StatsEvery, "stats-every", cfg.StatsEvery, "Interval to take the snapshot of statistics served")
+	flag.StringVar(&cfg.StatsDB, "stats-db", cfg.StatsDB, "Database file saving hourly counts of -stats every -stats-every and at shutdown, restored at start and queried by the stats subcommand. Disabled if empty")
+	flag.DurationVar(&cfg.StatsKeep, "stats-keep", cfg.StatsKeep, "Age of hours removed from -stats-db. 0 keeps all of them")
+	flag.StringVar(&cfg.OTLP, "otlp", cfg.OTLP, "OpenTelemetry collector to export traces of queries to by OTLP/HTTP (e.g. http://localhost:4318). Disabled if empty")
+	flag.StringVar(&cfg.Webhook, "webhook", cfg.Webhook, "URL to post JSON to, in batches, for answers judged by rules with notify = true, like a Slack, Matrix or ntfy webhook. Disabled if empty")
+	flag.Float64Var(&cfg.OTLPSample, "otlp-sample", cfg.OTLPSample, "Ratio of queries traced, between 0 and 1")
+	flag.StringVar(&cfg.QueryLog, "querylog", cfg.QueryLog, "File to log replies to clients in, as JSON lines. Disabled if empty")
+	flag.IntVar(&cfg.QueryLogSize, "querylog-size", cfg.QueryLogSize, "Size in MB to rotate the query log at. 0 disables")
+	flag.DurationVar(&cfg.QueryLogRotate, "querylog-rotate", cfg.QueryLogRotate, "Age to rotate the query log at. 0 disables")
+	flag.DurationVar(&cfg.QueryLogKeep, "querylog-keep", cfg.QueryLogKeep, "Time to keep rotated query logs, compressed with gzip. 0 keeps them forever")
+
+	flag.Var((*entries)(&cfg.Servers), "d", "Nameservers. Use format [IP]:port for IPv6, or system for those of the system, followed as they change. More can be named in config file as [server.xxx] sections")
+	flag.StringVar(&cfg.Bootstrap, "bootstrap", cfg.Bootstrap, "Nameserver resolving hostnames given as upstreams, like dns.quad9.net, instead of the system one")
+	flag.DurationVar(&cfg.BootstrapRefresh, "bootstrap-refresh", cfg.BootstrapRefresh, "Interval to resolve hostnames of upstreams again, keeping their last address on failure. 0 disables")
+	flag.DurationVar(&cfg.Stagger, "stagger", cfg.Stagger, "Delay before asking upstreams given by hostname at an address of their other family too if still unanswered, racing both, 0 to disable")
+	flag.StringVar(&cfg.PreferFamily, "prefer-family", cfg.PreferFamily, "Family of addresses to reach upstreams given by hostname at: v4 or v6, falling back to the other one if unreachable at start or after timeouts in a row")
+	flag.Var((*entries)(&cfg.OpCodes), "opcode", "Policy for queries of an opcode other than QUERY as opcode=policy, like notify=forward:192.0.2.1 or update=refuse. Policies are forward:address, refuse, drop and notimp, the default. Can be set multiple times or in comma-separated form")
+	flag.StringVar(&cfg.Rebind, "rebind", cfg.Rebind, "Protect from DNS rebinding: strip or drop answers giving private, link-local or loopback addresses for public names")
+	flag.StringVar(&cfg.SinkholePTR, "sinkhole-ptr", cfg.SinkholePTR, "Name answering PTR queries for the addresses of block_with, like blocked.dnsfilter.local, so that tools show why connections to them fail. Disabled if empty")
+	flag.Var((*entries)(&cfg.RebindAllow), "rebind-allow", "Domains allowed private addresses with -rebind, at split DNS. Can be set multiple times or in comma-separated form")
+	flag.Var((*entries)(&cfg.SVCBStrip), "svcb-strip", "Parameters removed from SVCB and HTTPS answers: ipv4hint and ipv6hint, so that clients look up A and AAAA records judged by rules, or ech. Can be set multiple times or in comma-separated form")
+	flag.Var((*entries)(&cfg.SelfTest), "selftest", "Canaries as name=VERDICT, like example.com=ACCEPT or ads.example=BLOCK, queried through the listener at start, exiting 1 if a verdict of the rules differs. Can be set multiple times or in comma-separated form")
+	flag.BoolVar(&cfg.SelfTestMock, "selftest-mock", cfg.SelfTestMock, "Answer -selftest canaries by a built-in mock, with 192.0.2.1 and 2001:db8::1, instead of asking upstreams")
+	flag.Var((*entries)(&cfg.MDNS), "mdns", "Domain suffixes resolved by multicast DNS on the local link instead of upstreams, like local. Can be set multiple times or in comma-separated form")
+	flag.Var((*entries)(&cfg.Hosts), "hosts", "hosts(5) files whose names are answered locally with A, AAAA and PTR records. Can be set multiple times or in comma-separated form")
+	flag.Var((*entries)(&cfg.Blocklists), "blocklist", "Blocklists matched by rules with blocklist = N: files or http(s) URLs in hosts, plain domain or adblock format. Can be set multiple times or in comma-separated form")
+	flag.Var((*entries)(&cfg.Allowlists), "allowlist", "Allowlists matched by rules with allowlist = N, in the formats of -blocklist. Can be set multiple times or in comma-separated form")
+	flag.Var((*entries)(&cfg.RPZs), "rpz", "Response Policy Zones matched by rules with rpz = N: zone files or axfr://host[:port]/zone to transfer. Can be set multiple times or in comma-separated form")
+	flag.Var((*entries)(&cfg.Plugins), "plugin", "Filter plugins: Go plugins (.so) exporting Filter, or unix:/path of a sidecar socket. Can be set multiple times or in comma-separated form")
+	flag.Var((*entries)(&cfg.IPsets), "l", "ipset files, http(s) URLs or built-in lists as builtin:gfw, as path[#format[=filter+...]], format being plain, apnic, geolite or route. Can be set multiple times or in comma-separated form")
 }
 
-var (
-	servers      []*net.UDPAddr
-	listenerConn *net.UDPConn
-	rules        []*rule
-	logStd       = log.New(os.Stdout, "", log.Ldate|log.Lmicroseconds)
-	logErr       = log.New(os.Stderr, "", log.Ldate|log.Lmicroseconds)
-)
+// testFlags adds the options of the test subcommand, describing the answer simulated
+func testFlags(sim *dnsfilter.Simulation) {
+	flag.StringVar(&sim.Name, "qname", "", "Name queried")
+	flag.StringVar(&sim.Type, "type", "A", "Type queried")
+	flag.Var((*entries)(&sim.IPs), "ip", "Addresses answered as A or AAAA records of -qname. Can be set multiple times or in comma-separated form")
+	flag.StringVar(&sim.Server, "server", "1", "Name or 1-based index of the server answering")
+	flag.StringVar(&sim.Client, "client", "127.0.0.1", "IP of the client asking")
+	flag.StringVar(&sim.RCode, "rcode", "NOERROR", "Rcode answered")
+}
 
-func parseUdpAddr(str string) (*net.UDPAddr, error) {
-	_, _, err := net.SplitHostPort(str)
-	if err == nil {
-		return net.ResolveUDPAddr("udp", str)
-	}
-	if _, _, err := net.SplitHostPort(str + ":53"); err == nil { // further try
-		return net.ResolveUDPAddr("udp", str+":53")
-	}
-	if _, _, err := net.SplitHostPort("[" + str + "]:53"); err == nil {
-		return net.ResolveUDPAddr("udp", "["+str+"]:53")
-	}
-	return nil, err
+// searchFlags adds the options of the log search subcommand
+func searchFlags(search *dnsfilter.LogSearch) {
+	flag.StringVar(&search.Domain, "domain", "", "Domain queried, subdomains included")
+	flag.StringVar(&search.Client, "client", "", "IP or CIDR of clients")
+	flag.Func("from", "Start time, as 2006-01-02T15:04, 2006-01-02 or a duration ago (1h)", func(s string) (err error) {
+		search.From, err = parseTime(s)
+		return
+	})
+	flag.Func("to", "End time, in the forms of -from", func(s string) (err error) {
+		search.To, err = parseTime(s)
+		return
+	})
 }
 
-func lookupServer(addr *net.UDPAddr) (int, bool) {
-	for i, server := range servers {
-		if server.IP.Equal(addr.IP) && server.Port == addr.Port && server.Zone == addr.Zone {
-			return i, true
-		}
-	}
-	return -1, false
+// statsFlags adds the options of the stats subcommand
+func statsFlags(query *dnsfilter.StatsQuery) {
+	flag.StringVar(&query.Domain, "domain", "", "Domain queried, subdomains included, counting only its queries")
+	flag.StringVar(&query.Client, "client", "", "IP or CIDR of clients, counting only their queries")
+	flag.StringVar(&query.By, "by", "", "Period to count queries by: hour or day. Their total only if empty")
+	flag.IntVar(&query.Top, "n", 10, "Entries of top lists, up to 100")
+	flag.Func("from", "Start time, as 2006-01-02T15:04, 2006-01-02 or a duration ago (1h)", func(s string) (err error) {
+		query.From, err = parseTime(s)
+		return
+	})
+	flag.Func("to", "End time, in the forms of -from", func(s string) (err error) {
+		query.To, err = parseTime(s)
+		return
+	})
 }
 
-func parseServers() {
-	for _, serverStr := range serversStr {
-		addr, err := parseUdpAddr(serverStr)
+// serveMock runs the mockdns subcommand, answering at -b by answers until interrupted
+func serveMock(answers []string) error {
+	var script []testserver.Answer
+	for _, spec := range answers {
+		answer, err := testserver.ParseAnswer(spec)
 		if err != nil {
-			logErr.Fatalf("Invalid nameserver: %s", serverStr)
-		}
-
-		if addr.Zone != "" { // normalize zone to name instead of index
-			if zoneid, err := strconv.Atoi(addr.Zone); err == nil {
-				if ifi, err := net.InterfaceByIndex(zoneid); err == nil {
-					addr.Zone = ifi.Name
-				} else {
-					logErr.Fatalf("IPv6 zone invalid: %s", serverStr)
-				}
-			} else if _, err := net.InterfaceByName(addr.Zone); err != nil {
-				logErr.Fatalf("IPv6 zone invalid: %s", serverStr)
-			}
+			return err
 		}
+		script = append(script, answer)
+	}
+	server, err := testserver.Listen(cfg.Listen, script)
+	if err != nil {
+		return err
+	}
+	if cfg.Verbose {
+		server.Log = logStd
+	}
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		server.Close()
+	}()
+	logStd.Printf("Mock nameserver listening on UDP %s with %d answer(s)", server.Addr(), len(script))
+	return server.Serve()
+}
+
+// cacheFlags adds the options of the cache subcommands
+func cacheFlags(sel *dnsfilter.CacheSelector) {
+	flag.StringVar(&sel.Name, "name", "", "Names matching a pattern, like *.example.com")
+	flag.StringVar(&sel.Suffix, "suffix", "", "Domain, subdomains included")
+	flag.StringVar(&sel.Type, "type", "", "Type queried")
+}
 
-		if _, exist := lookupServer(addr); !exist {
-			servers = append(servers, addr)
-			logStd.Printf("Using nameserver %s", addr)
-		} else {
-			logErr.Fatalf("Nameserver exists: %s", serverStr)
+// parseTime reads a local time in RFC 3339 or shorter, or a duration ago
+func parseTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
 		}
 	}
+	return time.Time{}, fmt.Errorf("invalid time %s", s)
 }
 
-func parseConfig() {
-	answerTypeValues := map[string]dnsmessage.Type{ // map config strings back to value
-		"A":     dnsmessage.TypeA,
-		"NS":    dnsmessage.TypeNS,
-		"CNAME": dnsmessage.TypeCNAME,
-		"SOA":   dnsmessage.TypeSOA,
-		"PTR":   dnsmessage.TypePTR,
-		"MX":    dnsmessage.TypeMX,
-		"TXT":   dnsmessage.TypeTXT,
-		"AAAA":  dnsmessage.TypeAAAA,
-		"SRV":   dnsmessage.TypeSRV,
-		"OPT":   dnsmessage.TypeOPT,
-		"WKS":   dnsmessage.TypeWKS,
-		"HINFO": dnsmessage.TypeHINFO,
-		"MINFO": dnsmessage.TypeMINFO,
-		"AXFR":  dnsmessage.TypeAXFR,
-		"ALL":   dnsmessage.TypeALL,
-	}
-
-	cfg, err := ini.Load(*configFile)
+// globalAliases are [global] keys naming one-letter flags
+var globalAliases = map[string]string{"listen": "b", "servers": "d", "timeout": "t", "verbose": "v", "ipsets": "l"}
+
+// loadGlobal sets flags from the [global] section of the config file, keys being flag
+// names or their aliases. Flags given on the command line take precedence.
+func loadGlobal() error {
+	if cfg.ConfigFile == "" {
+		return nil
+	}
+	file, err := dnsfilter.LoadConfigFile(cfg.ConfigFile)
 	if err != nil {
-		logErr.Fatalln("Failed to load config file:", err)
+		return nil // reported when rules are loaded
+	}
+	section, err := file.GetSection("global")
+	if err != nil {
+		return nil
 	}
 
-	ruleSections := cfg.ChildSections("rule")
-	rules = make([]*rule, len(ruleSections))
-
-	for i, ruleSection := range ruleSections { //one rule each time
-		ruleName := ruleSection.Name()
-		var logBuf strings.Builder
-		fmt.Fprintf(&logBuf, "%s:", ruleName)
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, key := range section.Keys() {
+		name := key.Name()
+		if alias, ok := globalAliases[name]; ok {
+			name = alias
+		}
+		if name == "c" || name == "V" || flag.Lookup(name) == nil {
+			return fmt.Errorf("[global] unknown option %s!", key.Name())
+		}
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, strings.Join(key.Strings(","), ",")); err != nil { // spaces around commas trimmed
+			return fmt.Errorf("[global] invalid %s: %s", key.Name(), err)
+		}
+	}
+	return nil
+}
 
-		targetKey, err := ruleSection.GetKey("target")
-		if err != nil {
-			logErr.Fatalf("%s target must exist in a rule!", ruleName)
-		} // target is mandatory
+func main() {
+	var sim *dnsfilter.Simulation
+	var replay bool
+	var pcapFile string
+	var search *dnsfilter.LogSearch
+	var cacheCommand string
+	var cacheSel dnsfilter.CacheSelector
+	var statsQuery *dnsfilter.StatsQuery
+	var mockAnswers []string
+	mockdns := false
+	selftest := make(chan error, 1)
+	if len(os.Args) > 1 && os.Args[1] == "test" { // dnsfilter test [options]
+		sim = new(dnsfilter.Simulation)
+		testFlags(sim)
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	} else if len(os.Args) > 2 && os.Args[1] == "log" && os.Args[2] == "search" { // dnsfilter log search [options]
+		search = new(dnsfilter.LogSearch)
+		searchFlags(search)
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	} else if len(os.Args) > 2 && os.Args[1] == "cache" { // dnsfilter cache list|flush [options]
+		cacheCommand = os.Args[2]
+		cacheFlags(&cacheSel)
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	} else if len(os.Args) > 1 && os.Args[1] == "mockdns" { // dnsfilter mockdns -answer spec... [-b addr] [-v]
+		mockdns = true
+		flag.Func("answer", "Answer scripted, the first matching a query answering it: a name, subdomains included or any if *, followed by ip=ADDR[,ADDR...], poison=ADDR[,ADDR...] answered at once ahead, rcode=NXDOMAIN, type=AAAA, ttl=SECONDS, delay=DURATION or drop. Can be set multiple times", func(s string) error {
+			mockAnswers = append(mockAnswers, s)
+			return nil
+		})
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	} else if len(os.Args) > 1 && os.Args[1] == "stats" { // dnsfilter stats [options]
+		statsQuery = new(dnsfilter.StatsQuery)
+		statsFlags(statsQuery)
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	} else if len(os.Args) > 1 && os.Args[1] == "replay" { // dnsfilter replay file.pcap [options] or [options] file.pcap
+		replay = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+			pcapFile = os.Args[1]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+	flag.Parse()
 
-		var rule rule
+	if *showVer {
+		fmt.Printf("dnsfilter version %s (built %s)\n", version, buildDate)
+		return
+	}
 
-		if serverKey, err := ruleSection.GetKey("server"); err == nil {
-			if server, err := serverKey.Uint(); err == nil && server > 0 && server <= uint(len(servers)) {
-				rule.match.server = server
-				fmt.Fprintf(&logBuf, " SERVER %d", server)
-			} else {
-				logErr.Printf("%s invalid server index! Assume matching any", ruleName)
-			}
+	if err := loadGlobal(); err != nil {
+		if *check {
+			logErr.Println(err)
+			dnsfilter.Check(cfg)
+			os.Exit(1)
 		}
+		logErr.Fatalln(err)
+	}
 
-		if ipsetKey, err := ruleSection.GetKey("ipset"); err == nil {
-			if ipset, err := ipsetKey.Uint(); err == nil && ipset > 0 && ipset <= uint(len(ipsets)) {
-				rule.match.ipset = ipset
-				fmt.Fprintf(&logBuf, " IPSET %d", ipset)
-			} else {
-				logErr.Printf("%s invalid ipset index! Assume matching any", ruleName)
-			}
+	if *logTo != "" {
+		var err error
+		if cfg.Log, cfg.ErrorLog, err = dnsfilter.LogBackend(*logTo, *logFac); err != nil {
+			logErr.Fatalln(err)
 		}
+		logStd, logErr = cfg.Log, cfg.ErrorLog
+	}
 
-		if answerTypeKey, err := ruleSection.GetKey("type"); err == nil {
-			if answerType, ok := answerTypeValues[strings.ToUpper(strings.TrimSpace(answerTypeKey.String()))]; ok {
-				rule.match.answerType = answerType
-				fmt.Fprintf(&logBuf, " %s", answerType)
-			} else {
-				logErr.Printf("%s invalid type! Assume matching any", ruleName)
-			}
+	if sim != nil {
+		if !dnsfilter.Simulate(cfg, *sim) {
+			os.Exit(1)
 		}
+		return
+	}
 
-		if nameKey, err := ruleSection.GetKey("name"); err == nil {
-			if name := strings.Trim(nameKey.String(), " ."); 0 != len(name) {
-				rule.match.name = name
-				fmt.Fprintf(&logBuf, " DOMAIN NAME %s", name)
-			} else {
-				logErr.Printf("%s empty domain name! Assume matching any", ruleName)
-			}
+	if search != nil {
+		if cfg.QueryLog == "" {
+			logErr.Fatalln("Usage: dnsfilter log search -querylog file [options]")
 		}
-
-		switch target := strings.TrimSpace(targetKey.String()); { //TARGET
-		case strings.EqualFold(target, "DROP"):
-			rule.delay = -1
-			logBuf.WriteString(" [DROP]")
-
-		case strings.EqualFold(target, "ACCEPT"):
-			rule.delay = 0
-			logBuf.WriteString(" [ACCEPT]")
-
-		case strings.EqualFold(target, "DELAY"):
-			if delayKey, err := ruleSection.GetKey("delay"); err == nil {
-				if delay, err := delayKey.Duration(); err == nil {
-					rule.delay = delay
-					fmt.Fprintf(&logBuf, " [DELAY %s]", delay)
-				} else {
-					rule.delay = 0
-					logBuf.WriteString(" [ACCEPT]")
-					logErr.Printf("%s delay parse error:[%s] Assume ACCEPT!", ruleName, err)
-				}
-			} else {
-				rule.delay = 0
-				logBuf.WriteString(" [ACCEPT]")
-				logErr.Printf("%s delay must be specified when target is delay! Assume ACCEPT!", ruleName)
-			}
-
-		default:
-			logErr.Fatalf("%s unknown target!", ruleName)
+		if err := dnsfilter.SearchQueryLog(cfg.QueryLog, *search, os.Stdout); err != nil {
+			logErr.Fatalln(err)
 		}
+		return
+	}
 
-		logStd.Println(logBuf.String())
-
-		rules[i] = &rule
+	if mockdns {
+		if err := serveMock(mockAnswers); err != nil {
+			logErr.Fatalln(err)
+		}
+		return
 	}
-}
 
-func main() {
-	flag.Parse()
+	if statsQuery != nil {
+		if cfg.StatsDB == "" {
+			logErr.Fatalln("Usage: dnsfilter stats -stats-db file [options]")
+		}
+		if err := dnsfilter.StatsHistory(cfg.StatsDB, *statsQuery, os.Stdout); err != nil {
+			logErr.Fatalln(err)
+		}
+		return
+	}
 
-	if *showVer {
-		fmt.Printf("dnsfilter version %s (built %s)\n", version, buildDate)
+	if cacheCommand != "" {
+		if cfg.Admin == "" {
+			logErr.Fatalln("Usage: dnsfilter cache list|flush -admin addr [options]")
+		}
+		if err := dnsfilter.CacheCommand(cfg.Admin, cacheCommand, cacheSel, os.Stdout); err != nil {
+			logErr.Fatalln(err)
+		}
 		return
 	}
 
-	parseServers()
-	parseIPsets()
-	parseConfig()
+	if replay {
+		if pcapFile == "" {
+			pcapFile = flag.Arg(0)
+		}
+		if pcapFile == "" {
+			logErr.Fatalln("Usage: dnsfilter replay file.pcap [options]")
+		}
+		if err := dnsfilter.Replay(cfg, pcapFile); err != nil {
+			logErr.Fatalln(err)
+		}
+		return
+	}
 
-	listenAddr, err := parseUdpAddr(*listenAddrStr)
-	if err != nil {
-		logErr.Fatalf("Invalid binding address: %s", *listenAddrStr)
+	if *check {
+		if !dnsfilter.Check(cfg) {
+			os.Exit(1)
+		}
+		return
 	}
-	listenerConn, err = net.ListenUDP("udp", listenAddr)
+
+	server, err := dnsfilter.New(cfg)
 	if err != nil {
 		logErr.Fatalln(err)
 	}
-	defer listenerConn.Close()
-	logStd.Printf("Listening on UDP %s", listenAddr)
 
-	for {
-		payload := make([]byte, 1500)
-		if n, clientAddr, err := listenerConn.ReadFromUDP(payload); err != nil {
-			logErr.Println(err)
-			continue
-		} else {
-			go handle(context.WithValue(context.Background(), clientAddrKey, clientAddr), payload[:n])
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		if profileSignal != nil {
+			signal.Notify(sigs, profileSignal)
+		}
+		for sig := range sigs {
+			if sig == profileSignal {
+				server.NextProfile()
+				continue
+			}
+			logStd.Printf("Got %s, shutting down", sig)
+			server.Shutdown()
+			return
+		}
+	}()
+
+	if len(cfg.SelfTest) > 0 {
+		go func() {
+			err := server.SelfTest()
+			selftest <- err
+			if err != nil {
+				logErr.Println(err)
+				server.Shutdown()
+			}
+		}()
+	}
+
+	server.Serve()
+	select {
+	case err := <-selftest:
+		if err != nil {
+			os.Exit(1)
 		}
+	default:
 	}
 }
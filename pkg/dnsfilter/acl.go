@@ -0,0 +1,47 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"gopkg.in/go-ini/ini.v1"
+	"net"
+	"strings"
+)
+
+type acl struct {
+	allow *ipset
+	drop  bool // silently drop instead of REFUSED
+}
+
+func (s *Server) loadACL(cfg *ini.File) (*acl, error) {
+	section, err := cfg.GetSection("allow_clients")
+	if err != nil { // no such section, open to all
+		return nil, nil
+	}
+
+	var acl acl
+	if acl.allow, err = parseIPList(section.Key("cidr").String()); err != nil {
+		return nil, fmt.Errorf("allow_clients: %s", err)
+	}
+
+	switch action := strings.TrimSpace(section.Key("action").String()); {
+	case action == "", strings.EqualFold(action, "REFUSE"):
+	case strings.EqualFold(action, "DROP"):
+		acl.drop = true
+	default:
+		return nil, fmt.Errorf("allow_clients: unknown action %s!", action)
+	}
+
+	s.logStd.Printf("Clients allowed: %s", section.Key("cidr").String())
+	return &acl, nil
+}
+
+// clientAllowed tells whether ip may query, and if not, whether to drop silently
+func (s *Server) clientAllowed(ip net.IP) (allowed, drop bool) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	if s.clientACL == nil || s.clientACL.allow.containsIP(ip) {
+		return true, false
+	}
+	return false, s.clientACL.drop
+}
@@ -0,0 +1,229 @@
+package dnsfilter
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+var dashboard, _ = fs.Sub(dashboardFiles, "dashboard")
+
+// serveAdmin binds addr right away so that it's done before dropping privileges
+func (s *Server) serveAdmin(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upstreams", s.adminUpstreams)
+	mux.HandleFunc("/rules", s.adminRules)
+	mux.HandleFunc("/ipsets", s.adminIPsets)
+	mux.HandleFunc("/queue", s.adminQueue)
+	mux.HandleFunc("/reload", adminPost(s.adminReload))
+	mux.HandleFunc("/cache", s.adminCache)
+	mux.HandleFunc("/cache/flush", adminPost(s.adminCacheFlush))
+	mux.HandleFunc("/verbose", adminPost(s.adminVerbose))
+	mux.HandleFunc("/profile", s.adminProfile)
+	mux.HandleFunc("/events", s.adminEvents)
+	mux.HandleFunc("/stats", s.adminStats)
+	mux.Handle("/dashboard/", http.StripPrefix("/dashboard/", http.FileServer(http.FS(dashboard))))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/dashboard/", http.StatusFound)
+	})
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.logStd.Printf("Admin API listening on %s", addr)
+	go func() {
+		s.logErr.Println(http.Serve(ln, mux))
+	}()
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminPost rejects methods other than POST, and cross-site requests, for endpoints
+// changing state
+func adminPost(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if crossSite(r) {
+			http.Error(w, "Cross-site request", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// crossSite tells if a browser sent r for a page of another site, by Sec-Fetch-Site
+// or else Origin, so that pages of the admin's browser can't POST to the API. Other
+// clients send neither.
+func crossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none": // the dashboard, or typed in
+		return false
+	case "":
+	default:
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
+
+func (s *Server) adminUpstreams(w http.ResponseWriter, r *http.Request) {
+	type upstreamInfo struct {
+		Index      int     `json:"index"`
+		Name       string  `json:"name,omitempty"`
+		Address    string  `json:"address"`
+		Mismatched uint64  `json:"mismatched"`
+		RTT        float64 `json:"rtt_ms"` // moving average, timeouts counting as -t
+		upstreamStats
+	}
+
+	list := make([]upstreamInfo, len(s.servers))
+	for i, server := range s.servers {
+		rtt := float64(atomic.LoadInt64(&server.rtt)) / float64(time.Millisecond)
+		var counts upstreamCounts
+		for counter := range counts {
+			counts[counter] = atomic.LoadUint64(&server.counts[counter])
+		}
+		list[i] = upstreamInfo{i + 1, server.name, server.addr().String(), atomic.LoadUint64(&server.mismatched), rtt,
+			newUpstreamStats(server, &counts)}
+	}
+	writeJSON(w, list)
+}
+
+func (s *Server) adminRules(w http.ResponseWriter, r *http.Request) {
+	type ruleInfo struct {
+		Name string `json:"name"`
+		Rule string `json:"rule"`
+		Hits uint64 `json:"hits"`
+	}
+
+	s.configLock.RLock()
+	list := make([]ruleInfo, len(s.rules))
+	for i, rule := range s.rules {
+		list[i] = ruleInfo{rule.name, rule.desc, atomic.LoadUint64(&rule.hits)}
+	}
+	s.configLock.RUnlock()
+	writeJSON(w, list)
+}
+
+func (s *Server) adminIPsets(w http.ResponseWriter, r *http.Request) {
+	type ipsetInfo struct {
+		Index int    `json:"index"`
+		File  string `json:"file"`
+		Size  int    `json:"size"`
+	}
+
+	s.configLock.RLock()
+	list := make([]ipsetInfo, len(s.ipsets))
+	for i, ipset := range s.ipsets {
+		list[i] = ipsetInfo{i + 1, s.opts.IPsets[i], ipset.size}
+	}
+	s.configLock.RUnlock()
+	writeJSON(w, list)
+}
+
+func (s *Server) adminQueue(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"depth":      len(s.jobs),
+		"capacity":   cap(s.jobs),
+		"workers":    s.opts.Workers,
+		"dropped":    atomic.LoadUint64(&s.jobsDropped),
+		"duplicates": atomic.LoadUint64(&s.duplicatesSuppressed), // answers to a query beyond the first, not sent
+		"unexpected": atomic.LoadUint64(&s.answersUnexpected),    // from addresses a query wasn't sent to, dropped
+		"fast":       atomic.LoadUint64(&s.answersFast),          // under half the RTT floor of their upstream
+		"divergent":  atomic.LoadUint64(&s.answersDivergent),     // queries answered differently by upstreams with -consensus
+		"unnotified": atomic.LoadUint64(&s.webhookDropped),       // events of rules with notify lost to a full queue or failed posts
+		"panics":     atomic.LoadUint64(&s.panicsRecovered),      // recovered in handlers, costing the query
+		"restarts":   atomic.LoadUint64(&s.listenerRestarts),     // of listeners failing to read
+	})
+}
+
+func (s *Server) adminReload(w http.ResponseWriter, r *http.Request) {
+	if err := s.reload(); err != nil {
+		s.logErr.Println("Reload failed:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logStd.Println("Config reloaded")
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+// cacheSelector reads the name, suffix and type parameters of a cache request
+func cacheSelector(r *http.Request) CacheSelector {
+	query := r.URL.Query()
+	return CacheSelector{query.Get("name"), query.Get("suffix"), query.Get("type")}
+}
+
+func (s *Server) adminCache(w http.ResponseWriter, r *http.Request) {
+	list, err := s.cacheList(cacheSelector(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// adminCacheFlush flushes the answers selected, all without parameters
+func (s *Server) adminCacheFlush(w http.ResponseWriter, r *http.Request) {
+	sel := cacheSelector(r)
+	if sel.empty() {
+		writeJSON(w, map[string]int{"flushed": s.cacheFlush()})
+		return
+	}
+	n, err := s.cacheFlushSelected(sel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logStd.Printf("Flushed %d cached answers", n)
+	writeJSON(w, map[string]int{"flushed": n})
+}
+
+func (s *Server) adminVerbose(w http.ResponseWriter, r *http.Request) {
+	on := s.toggleVerbose()
+	s.logStd.Printf("Verbose mode set to %t", on)
+	writeJSON(w, map[string]bool{"verbose": on})
+}
+
+// adminProfile shows the active profile, and switches to ?name= on POST
+func (s *Server) adminProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if crossSite(r) {
+			http.Error(w, "Cross-site request", http.StatusForbidden)
+			return
+		}
+		if err := s.setProfile(r.URL.Query().Get("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.configLock.RLock()
+	info := map[string]interface{}{"profile": s.activeProfile, "profiles": s.profiles}
+	s.configLock.RUnlock()
+	writeJSON(w, info)
+}
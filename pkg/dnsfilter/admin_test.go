@@ -0,0 +1,34 @@
+package dnsfilter
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// POSTs of pages of other sites are told apart from the dashboard's and other clients'
+func TestCrossSite(t *testing.T) {
+	for _, test := range []struct {
+		site, origin string
+		cross        bool
+	}{
+		{"", "", false},
+		{"same-origin", "http://127.0.0.1:8080", false},
+		{"none", "", false},
+		{"cross-site", "https://example.com", true},
+		{"same-site", "http://other.localhost:8080", true},
+		{"", "https://example.com", true},
+		{"", "null", true},
+		{"", "http://127.0.0.1:8080", false},
+	} {
+		r := httptest.NewRequest("POST", "http://127.0.0.1:8080/reload", nil)
+		if test.site != "" {
+			r.Header.Set("Sec-Fetch-Site", test.site)
+		}
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if got := crossSite(r); got != test.cross {
+			t.Errorf("Sec-Fetch-Site %q, Origin %q: cross-site %t, want %t", test.site, test.origin, got, test.cross)
+		}
+	}
+}
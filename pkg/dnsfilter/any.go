@@ -0,0 +1,43 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const anyTTL = 3600
+
+// anyAnswer answers ANY queries by -any: a synthesized HINFO record of RFC 8482 for
+// hinfo, NOTIMP for notimp. nil for other queries and forward, the default.
+func (s *Server) anyAnswer(hdr dnsmessage.Header, qs []dnsmessage.Question) []byte {
+	if s.opts.Any == "forward" || len(qs) != 1 || qs[0].Type != dnsmessage.TypeALL {
+		return nil
+	}
+	if s.opts.Any == "notimp" {
+		msg, err := reply(hdr, qs, dnsmessage.RCodeNotImplemented)
+		if err != nil {
+			return nil
+		}
+		return msg
+	}
+
+	hdr.Response, hdr.Authoritative, hdr.RecursionAvailable, hdr.Truncated = true, false, true, false
+	hdr.RCode = dnsmessage.RCodeSuccess
+	b := dnsmessage.NewBuilder(nil, hdr)
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(qs[0])
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: qs[0].Name, Class: qs[0].Class, TTL: anyTTL}
+	cpu, system := "RFC8482", "" // character-strings of HINFO
+	data := append([]byte{byte(len(cpu))}, cpu...)
+	data = append(data, byte(len(system)))
+	data = append(data, system...)
+	if err := b.UnknownResource(rh, dnsmessage.UnknownResource{Type: dnsmessage.TypeHINFO, Data: data}); err != nil {
+		return nil
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
@@ -0,0 +1,210 @@
+package dnsfilter
+
+import (
+	"context"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"sync"
+)
+
+const batchSize = 64
+
+// batchConn reads and writes a listening socket with recvmmsg / sendmmsg on Linux,
+// one packet per syscall elsewhere. Concurrent writes are batched by a single writer,
+// kept when the socket is reopened until close.
+type batchConn struct {
+	srv         *Server
+	lock        sync.Mutex // of pc and pktinfo, swapped by reset
+	pc          packetConn
+	pktinfo     bool // telling the local destination of queries, on a wildcard address
+	port        int  // of the socket, the listening one
+	out         chan ipv4.Message
+	transparent bool // telling the original destination of queries
+
+	closeLock sync.RWMutex // of closed, held by writes queueing
+	closed    bool
+}
+
+type packetConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func (s *Server) newBatchConn(conn *net.UDPConn) *batchConn {
+	bc := &batchConn{srv: s, port: conn.LocalAddr().(*net.UDPAddr).Port, out: make(chan ipv4.Message, batchSize), transparent: s.opts.Transparent}
+	bc.reset(conn)
+	go bc.writeLoop()
+	return bc
+}
+
+// reset makes bc read and write conn, reopened at the same address, answers queued
+// for the old socket included
+func (bc *batchConn) reset(conn *net.UDPConn) {
+	var pc packetConn
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	if addr.IP.To4() != nil {
+		pc = ipv4.NewPacketConn(conn)
+	} else {
+		pc = ipv6.NewPacketConn(conn) // ipv6.Message is the same type
+	}
+	pktinfo := !bc.transparent && addr.IP.IsUnspecified() && recvDst(conn)
+	bc.lock.Lock()
+	bc.pc, bc.pktinfo = pc, pktinfo
+	bc.lock.Unlock()
+}
+
+func (bc *batchConn) socket() (packetConn, bool) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.pc, bc.pktinfo
+}
+
+// close stops the writer, answers still coming being dropped
+func (bc *batchConn) close() {
+	bc.closeLock.Lock()
+	defer bc.closeLock.Unlock()
+	if !bc.closed {
+		bc.closed = true
+		close(bc.out)
+	}
+}
+
+// recvDst asks for the destination address of queries with IP_PKTINFO and
+// IPV6_RECVPKTINFO, as those of a dual-stack socket may be of either family. It tells
+// if the platform supports any.
+func recvDst(conn *net.UDPConn) bool {
+	err4 := ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagDst, true)
+	err6 := ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagDst, true)
+	return err4 == nil || err6 == nil
+}
+
+// pktinfoDst returns the destination address of a query from its control messages,
+// nil if absent
+func pktinfoDst(oob []byte) net.IP {
+	var cm4 ipv4.ControlMessage
+	if cm4.Parse(oob) == nil && cm4.Dst != nil {
+		return cm4.Dst
+	}
+	var cm6 ipv6.ControlMessage
+	if cm6.Parse(oob) == nil && cm6.Dst != nil {
+		return cm6.Dst
+	}
+	return nil
+}
+
+// serve reads queries in batches until quit, nil being returned then, or until
+// reading fails for good
+func (bc *batchConn) serve(quit chan struct{}) error {
+	pc, pktinfo := bc.socket()
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{getBuf()}
+		if bc.transparent || pktinfo {
+			msgs[i].OOB = make([]byte, 128)
+		}
+	}
+
+	failures := 0 // in a row
+	for {
+		n, err := pc.ReadBatch(msgs, 0)
+		if err != nil {
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
+			if failures++; fatalReadError(err, failures) {
+				return err
+			}
+			bc.srv.logErr.Println(err)
+			continue
+		}
+		failures = 0
+
+		for i := range msgs[:n] {
+			clientAddr, payload := msgs[i].Addr.(*net.UDPAddr), msgs[i].Buffers[0][:msgs[i].N]
+			msgs[i].Buffers = [][]byte{getBuf()} // the old one is handed over
+
+			ctx := context.WithValue(context.Background(), clientAddrKey, clientAddr)
+			if bc.transparent {
+				if dst := origDst(msgs[i].OOB[:msgs[i].NN]); dst != nil {
+					ctx = context.WithValue(ctx, dstAddrKey, dst)
+				}
+			} else if pktinfo {
+				if dst := pktinfoDst(msgs[i].OOB[:msgs[i].NN]); dst != nil {
+					ctx = context.WithValue(ctx, dstAddrKey, &net.UDPAddr{IP: dst, Port: bc.port})
+				}
+			}
+			bc.srv.enqueue(context.WithValue(ctx, listenerKey, bc), payload)
+		}
+	}
+}
+
+// writeTo queues msg to be sent along with others, counted as in flight until then
+func (bc *batchConn) writeTo(msg []byte, addr *net.UDPAddr) {
+	bc.queue(ipv4.Message{Buffers: [][]byte{msg}, Addr: addr})
+}
+
+// writeFrom sends msg like writeTo from src, the address the query was sent to, which
+// the client expects the answer from: the original destination of a query diverted by
+// TPROXY, or the local address it came in on, for multihomed hosts. A source address
+// is given with IP_PKTINFO, but a source port other than the listening one takes
+// another socket, bound to src.
+func (bc *batchConn) writeFrom(msg []byte, addr, src *net.UDPAddr) {
+	if src.Port != bc.port {
+		if err := bc.srv.replyFrom(src, addr, msg); err != nil {
+			bc.srv.logErr.Println("Failed to answer from", src, err)
+		}
+		putBuf(msg)
+		return
+	}
+	var oob []byte
+	if addr.IP.To4() != nil {
+		oob = (&ipv4.ControlMessage{Src: src.IP}).Marshal()
+	} else {
+		oob = (&ipv6.ControlMessage{Src: src.IP}).Marshal()
+	}
+	bc.queue(ipv4.Message{Buffers: [][]byte{msg}, OOB: oob, Addr: addr})
+}
+
+func (bc *batchConn) queue(m ipv4.Message) {
+	bc.closeLock.RLock()
+	defer bc.closeLock.RUnlock()
+	if bc.closed {
+		putBuf(m.Buffers[0])
+		return
+	}
+	bc.srv.inflight.Add(1)
+	bc.out <- m
+}
+
+func (bc *batchConn) writeLoop() {
+	msgs := make([]ipv4.Message, 0, batchSize)
+	for m := range bc.out {
+		msgs = append(msgs[:0], m)
+	collect: // whatever else is waiting, without waiting for more
+		for len(msgs) < batchSize {
+			select {
+			case m := <-bc.out:
+				msgs = append(msgs, m)
+			default:
+				break collect
+			}
+		}
+
+		pc, _ := bc.socket()
+		for sent := 0; sent < len(msgs); {
+			n, err := pc.WriteBatch(msgs[sent:], 0)
+			sent += n
+			if err != nil { // the next one failed, skip it
+				bc.srv.logErr.Println(err)
+				sent++
+			}
+		}
+		for _, m := range msgs {
+			putBuf(m.Buffers[0])
+			bc.srv.inflight.Done()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/ipv4"
+	"net"
+	"testing"
+)
+
+var benchPacket = make([]byte, 100) // a typical answer
+
+func benchConns(b *testing.B) (*net.UDPConn, *net.UDPConn) {
+	from, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	to, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	to.SetReadBuffer(1 << 20)
+	b.Cleanup(func() {
+		from.Close()
+		to.Close()
+	})
+	return from, to
+}
+
+// answers sent by concurrent handlers, one syscall each
+func BenchmarkWriteToUDP(b *testing.B) {
+	from, to := benchConns(b)
+	addr := to.LocalAddr().(*net.UDPAddr)
+	b.SetParallelism(batchSize) // many queries in flight
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := from.WriteToUDP(benchPacket, addr); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// answers sent by concurrent handlers through the batching writer
+func BenchmarkBatchWrite(b *testing.B) {
+	from, to := benchConns(b)
+	s := quietServer()
+	bc, addr := s.newBatchConn(from), to.LocalAddr().(*net.UDPAddr)
+	b.SetParallelism(batchSize)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			bc.writeTo(benchPacket, addr)
+		}
+	})
+	s.inflight.Wait() // until all are sent
+}
+
+// sendBurst sends batchSize packets, returning how many
+func sendBurst(b *testing.B, pc *ipv4.PacketConn, addr net.Addr) int {
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i] = ipv4.Message{Buffers: [][]byte{benchPacket}, Addr: addr}
+	}
+	for sent := 0; sent < len(msgs); {
+		n, err := pc.WriteBatch(msgs[sent:], 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sent += n
+	}
+	return len(msgs)
+}
+
+func BenchmarkReadFromUDP(b *testing.B) {
+	from, to := benchConns(b)
+	pc, buf := ipv4.NewPacketConn(from), make([]byte, 1232)
+	b.ResetTimer()
+	for i := 0; i < b.N; {
+		b.StopTimer()
+		n := sendBurst(b, pc, to.LocalAddr())
+		b.StartTimer()
+		for j := 0; j < n; j++ {
+			if _, _, err := to.ReadFromUDP(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+		i += n
+	}
+}
+
+func BenchmarkReadBatch(b *testing.B) {
+	from, to := benchConns(b)
+	pc := ipv4.NewPacketConn(from)
+	bc := quietServer().newBatchConn(to)
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, 1232)}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; {
+		b.StopTimer()
+		n := sendBurst(b, pc, to.LocalAddr())
+		b.StartTimer()
+		for n > 0 {
+			got, err := bc.pc.ReadBatch(msgs[:n], 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			n -= got
+			i += got
+		}
+	}
+}
+
+// buffers taken and given back per packet, which should not allocate
+func BenchmarkBufPool(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			putBuf(getBuf())
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package dnsfilter
+
+import (
+	"context"
+	"golang.org/x/net/dns/dnsmessage"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// candidate is an accepted answer waiting for the race window to close with -pick best
+type candidate struct {
+	msg      []byte // from bufPool
+	score    int    // from PREFER and PENALIZE rules
+	rank     int    // position of the rule accepting it
+	inIPsets bool   // all its addresses are in ipsets
+	rtt      time.Duration
+	server   int // index of the upstream
+}
+
+// scoreAnswer applies rules to msg like sendBack, nil if it is to be dropped
+func (s *Server) scoreAnswer(ctx context.Context, serverIndex int, msg []byte, rtt time.Duration) *candidate {
+	if s.opts.DNSSEC && !s.validated(serverIndex, msg) { // before rules, like sendBack
+		return nil
+	}
+	out, delay, rank, score := s.determine(ctx, serverIndex, msg)
+	if delay < 0 {
+		return nil
+	}
+	return &candidate{out, score, rank, s.allInIPsets(out), rtt, serverIndex}
+}
+
+// beats tells if c scores higher than o: by PREFER and PENALIZE rules, then accepted
+// by an earlier rule, then with addresses known to ipsets, then answered faster
+func (c *candidate) beats(o *candidate) bool {
+	if c.score != o.score {
+		return c.score > o.score
+	}
+	if c.rank != o.rank {
+		return c.rank < o.rank
+	}
+	if c.inIPsets != o.inIPsets {
+		return c.inIPsets
+	}
+	return c.rtt < o.rtt
+}
+
+// allInIPsets tells if msg has A/AAAA answers, each contained in one of the ipsets
+func (s *Server) allInIPsets(msg []byte) bool {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(msg); err != nil {
+		return false
+	}
+	parser.SkipAllQuestions()
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return false
+	}
+
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	found := false
+	for _, ans := range answers {
+		ip := answerIP(ans)
+		if ip == nil {
+			continue
+		}
+		contained := false
+		for _, set := range s.ipsets {
+			if set.containsIP(ip) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// addressSet describes the rcode and the A/AAAA addresses of msg, sorted, hints
+// included, for answers to compare equal if upstreams agree on them
+func addressSet(msg []byte) string {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return ""
+	}
+	var ips []string
+	for _, ans := range m.Answers {
+		for _, ip := range answerIPs(ans) {
+			ips = append(ips, ip.String())
+		}
+	}
+	sort.Strings(ips)
+	return m.RCode.String() + " " + strings.Join(ips, ",")
+}
+
+// consensus picks among candidates of -consensus the best answer with the addresses
+// most upstreams agree on, those of a trusted upstream if any. Diverging answers are
+// logged and counted, and buffers of those not picked put back.
+func (s *Server) consensus(ctx context.Context, name string, candidates []*candidate) *candidate {
+	var sets []string // in order of arrival
+	groups := make(map[string][]*candidate)
+	for _, c := range candidates {
+		set := addressSet(c.msg)
+		if groups[set] == nil {
+			sets = append(sets, set)
+		}
+		groups[set] = append(groups[set], c)
+	}
+
+	trusted := func(set string) bool {
+		for _, c := range groups[set] {
+			if s.servers[c.server-1].trusted {
+				return true
+			}
+		}
+		return false
+	}
+	bestOf := func(set string) *candidate {
+		best := groups[set][0]
+		for _, c := range groups[set][1:] {
+			if c.beats(best) {
+				best = c
+			}
+		}
+		return best
+	}
+	// better tells if set wins over other: answered by a trusted upstream, then by
+	// more upstreams, then with the best answer
+	better := func(set, other string) bool {
+		if trusted(set) != trusted(other) {
+			return trusted(set)
+		}
+		if len(groups[set]) != len(groups[other]) {
+			return len(groups[set]) > len(groups[other])
+		}
+		return bestOf(set).beats(bestOf(other))
+	}
+	agreed := sets[0]
+	for _, set := range sets[1:] {
+		if better(set, agreed) {
+			agreed = set
+		}
+	}
+
+	if len(sets) > 1 {
+		s.startSpan(ctx, "dns.divergent").finish()
+		atomic.AddUint64(&s.answersDivergent, 1)
+		var diverging []string
+		for _, set := range sets {
+			var from []string
+			for _, c := range groups[set] {
+				from = append(from, s.servers[c.server-1].String())
+			}
+			diverging = append(diverging, strings.Join(from, ",")+": "+set)
+		}
+		s.logErr.Printf("Answers for %s diverge, picked %s of %s", name, agreed, strings.Join(diverging, "; "))
+	}
+
+	picked := bestOf(agreed)
+	for _, c := range candidates {
+		if c != picked {
+			putBuf(c.msg)
+		}
+	}
+	return picked
+}
@@ -0,0 +1,222 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// domainTrie holds blocked and allowed names by label, from the top level domain down
+type domainTrie struct {
+	children map[string]*domainTrie
+	flags    uint8
+	size     int // names added, at the root only
+}
+
+const (
+	blockExact   uint8 = 1 << iota // the name itself
+	blockSubtree                   // the name and names below it
+	allowExact                     // exceptions, as adblock @@ rules
+	allowSubtree
+)
+
+func (t *domainTrie) add(name string, kind uint8) {
+	labels := strings.Split(strings.ToLower(strings.Trim(name, ".")), ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := node.children[labels[i]]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*domainTrie)
+			}
+			child = new(domainTrie)
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.flags |= kind
+	t.size++
+}
+
+// blocked tells if name is blocked, the most specific entry deciding, allowing first
+func (t *domainTrie) blocked(name string) bool {
+	labels := strings.Split(strings.ToLower(strings.Trim(name, ".")), ".")
+	blocked, node := false, t
+	for i := len(labels) - 1; i >= 0 && node != nil; i-- {
+		if node = node.children[labels[i]]; node == nil {
+			break
+		}
+		last := i == 0
+		switch {
+		case node.flags&allowSubtree != 0 || last && node.flags&allowExact != 0:
+			blocked = false
+		case node.flags&blockSubtree != 0 || last && node.flags&blockExact != 0:
+			blocked = true
+		}
+	}
+	return blocked
+}
+
+// loadBlocklists loads blocklists, or allowlists of the same formats, kind naming them in logs
+func (s *Server) loadBlocklists(files []string, kind string) ([]*domainTrie, error) {
+	lists := make([]*domainTrie, len(files))
+	for i, spec := range files {
+		list, _, err := s.loadBlocklist(spec, false)
+		if err != nil {
+			return nil, err
+		}
+		lists[i] = list
+		s.logStd.Printf("%s %d loaded from %s, %d names", kind, i+1, spec, list.size)
+	}
+	return lists, nil
+}
+
+// loadBlocklist reads one list, downloading it first if it's an URL. With onlyChanged,
+// nil is returned if a downloaded list has not changed since last time.
+func (s *Server) loadBlocklist(spec string, onlyChanged bool) (*domainTrie, bool, error) {
+	filename := spec
+	if isURL(filename) {
+		var changed bool
+		var err error
+		if filename, changed, err = s.fetch(filename); err != nil {
+			return nil, false, err
+		}
+		if onlyChanged && !changed {
+			return nil, false, nil
+		}
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	list := new(domainTrie)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() { // one line per loop
+		parseBlocklistLine(list, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	return list, true, nil
+}
+
+// parseBlocklistLine takes a line in any of the common formats, skipping others:
+// hosts ("0.0.0.0 ads.example.com"), plain domains ("ads.example.com"),
+// and adblock filters for whole domains ("||example.com^", "@@||example.com^").
+func parseBlocklistLine(list *domainTrie, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return
+	}
+
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+		kind := blockSubtree
+		if strings.HasPrefix(line, "@@") {
+			kind, line = allowSubtree, line[2:]
+		}
+		line = line[2:]
+		end := strings.IndexByte(line, '^')
+		if end < 0 {
+			end = len(line)
+		}
+		if rest := line[end:]; rest != "" && rest != "^" && rest != "^|" && !strings.HasPrefix(rest, "^$important") {
+			return // path, options or wildcards, not for DNS
+		}
+		if name := line[:end]; validDomain(name) {
+			list.add(name, kind)
+		}
+		return
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) >= 2 && net.ParseIP(fields[0]) != nil: // hosts
+		for _, name := range fields[1:] {
+			if validDomain(name) && name != "localhost" && !strings.HasPrefix(name, "localhost.") {
+				list.add(name, blockExact)
+			}
+		}
+	case len(fields) == 1 && validDomain(fields[0]):
+		list.add(fields[0], blockExact)
+	}
+}
+
+func validDomain(name string) bool {
+	name = strings.Trim(name, ".")
+	if name == "" || len(name) > 253 || !strings.Contains(name, ".") {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// blockedReply answers NXDOMAIN if addrs is nil, else those of the family of A and
+// AAAA queries and no records for other types
+func blockedReply(hdr dnsmessage.Header, qs []dnsmessage.Question, addrs []net.IP) ([]byte, error) {
+	if addrs == nil {
+		return reply(hdr, qs, dnsmessage.RCodeNameError)
+	}
+
+	hdr.Response, hdr.Authoritative, hdr.Truncated, hdr.RecursionAvailable = true, false, false, true
+	hdr.RCode = dnsmessage.RCodeSuccess
+	msg := dnsmessage.Message{Header: hdr, Questions: qs}
+	for _, q := range qs {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: hostsTTL}
+		for _, ip := range addrs {
+			switch ip4 := ip.To4(); {
+			case q.Type == dnsmessage.TypeA && ip4 != nil:
+				var a dnsmessage.AResource
+				copy(a.A[:], ip4)
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: rh, Body: &a})
+			case q.Type == dnsmessage.TypeAAAA && ip4 == nil:
+				var aaaa dnsmessage.AAAAResource
+				copy(aaaa.AAAA[:], ip)
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: rh, Body: &aaaa})
+			}
+		}
+	}
+	return msg.Pack()
+}
+
+func (s *Server) refreshBlocklists() {
+	for range time.Tick(s.opts.Refresh) {
+		s.refreshLists(s.opts.Blocklists, &s.blocklists, "blocklist")
+		s.refreshLists(s.opts.Allowlists, &s.allowlists, "allowlist")
+	}
+}
+
+func (s *Server) refreshLists(files []string, lists *[]*domainTrie, kind string) {
+	for i, spec := range files {
+		if !isURL(spec) {
+			continue
+		}
+
+		list, changed, err := s.loadBlocklist(spec, true)
+		if err != nil {
+			s.logErr.Printf("Failed to refresh %s %s: %s", kind, spec, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		s.configLock.Lock()
+		(*lists)[i] = list
+		s.configLock.Unlock()
+		s.cacheFlush()
+		s.logStd.Printf("%s %d refreshed from %s, %d names", kind, i+1, spec, list.size)
+	}
+}
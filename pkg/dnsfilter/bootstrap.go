@@ -0,0 +1,84 @@
+package dnsfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseBootstrap sets the resolver of -bootstrap, asked over UDP or TCP as the Go
+// resolver does, instead of the system one
+func (s *Server) parseBootstrap() error {
+	if s.opts.Bootstrap == "" {
+		return nil
+	}
+	addr, err := parseUdpAddr(s.opts.Bootstrap)
+	if err != nil || addr.IP == nil {
+		return fmt.Errorf("Invalid bootstrap nameserver: %s", s.opts.Bootstrap)
+	}
+	s.bootstrapResolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr.String())
+	}}
+	return nil
+}
+
+// upstreamHost splits serverStr into a hostname and port of an upstream, port 53 if
+// absent. ok is false for addresses.
+func upstreamHost(serverStr string) (host, port string, ok bool) {
+	host, port, err := net.SplitHostPort(serverStr)
+	if err != nil {
+		host, port = serverStr, "53"
+	}
+	if strings.ContainsAny(host, ":%[]") || net.ParseIP(host) != nil {
+		return "", "", false
+	}
+	return host, port, true
+}
+
+// resolveUpstream looks up the addresses of hostPort by -bootstrap
+func (s *Server) resolveUpstream(hostPort string) ([]*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port: %s", portStr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+	ips, err := s.bootstrapResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]*net.UDPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &net.UDPAddr{IP: ip, Port: int(port)}
+	}
+	return addrs, nil
+}
+
+// refreshUpstreamHosts resolves hostnames of upstreams again every -bootstrap-refresh,
+// back to their preferred family if reachable again, keeping the address they had if
+// that fails
+func (s *Server) refreshUpstreamHosts() {
+	for range time.Tick(s.opts.BootstrapRefresh) {
+		for _, server := range s.servers {
+			if server.host == "" {
+				continue
+			}
+			addrs, err := s.resolveUpstream(server.host)
+			if err != nil {
+				s.logErr.Printf("Failed to resolve nameserver %s: %s. Keeping %s", server.host, err, server.addr())
+				continue
+			}
+			if server.moveToAddrs(addrs) {
+				s.logStd.Printf("Nameserver %s moved to %s", server.host, server.addr())
+			}
+		}
+	}
+}
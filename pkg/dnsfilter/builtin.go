@@ -0,0 +1,44 @@
+package dnsfilter
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+//go:embed builtin
+var builtinFiles embed.FS
+
+// builtinIPsets are lists shipped in builtin/, given to -l as builtin:name, by the
+// URL they're refreshed from
+var builtinIPsets = map[string]string{
+	"gfw": "https://raw.githubusercontent.com/shadowsocks/ChinaDNS/master/iplist.txt",
+}
+
+// builtinName returns the name of a builtin:name path, false for others
+func builtinName(path string) (string, bool) {
+	name := strings.TrimPrefix(path, "builtin:")
+	return strings.ToLower(name), name != path
+}
+
+// openBuiltin opens the last copy downloaded of a built-in list, the shipped one if
+// none. With refresh, it's downloaded first, nil being returned if unchanged.
+func (s *Server) openBuiltin(name string, refresh bool) (io.ReadCloser, error) {
+	url, ok := builtinIPsets[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown built-in ipset: %s", name)
+	}
+	if refresh {
+		path, changed, err := s.fetch(url)
+		if err != nil || !changed {
+			return nil, err
+		}
+		return os.Open(path)
+	}
+	if file, err := os.Open(s.cachePath(url)); err == nil {
+		return file, nil
+	}
+	return builtinFiles.Open("builtin/" + name + ".txt")
+}
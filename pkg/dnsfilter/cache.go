@@ -0,0 +1,377 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type cacheKey struct {
+	client string // only set when some rule matches on client
+	view   string // of the client, answers differing between views
+	name   string // lower case
+	qtype  dnsmessage.Type
+	class  dnsmessage.Class
+	do     bool // client set DO, getting DNSSEC records
+	cd     bool // client set CD, getting answers not validated
+}
+
+type cacheEntry struct {
+	msg     []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func (s *Server) newCacheKey(q dnsmessage.Question, client net.IP, do, cd bool) cacheKey {
+	key := cacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, class: q.Class, do: do, cd: cd}
+
+	s.configLock.RLock()
+	for _, rule := range s.rules { // verdicts may differ between clients
+		if rule.match.client != nil {
+			key.client = client.String()
+			break
+		}
+	}
+	if v := s.viewOf(client); v != nil {
+		key.view = v.name
+	}
+	s.configLock.RUnlock()
+	return key
+}
+
+// cacheStore keeps an answer sent back to a client until its smallest TTL expires
+func (s *Server) cacheStore(msg []byte, client net.IP, dnssecOK bool) {
+	if s.opts.CacheSize <= 0 {
+		return
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil || len(m.Questions) != 1 || m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) == 0 {
+		return
+	}
+
+	ttl := m.Answers[0].Header.TTL
+	for _, ans := range m.Answers {
+		if ans.Header.TTL < ttl {
+			ttl = ans.Header.TTL
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	key := s.newCacheKey(m.Questions[0], client, dnssecOK, m.CheckingDisabled)
+	entry := &cacheEntry{append([]byte(nil), msg...), now, now.Add(time.Duration(ttl) * time.Second)}
+
+	s.cacheLock.Lock()
+	if len(s.cache) >= s.opts.CacheSize {
+		for k, v := range s.cache { // purge expired ones first
+			if now.After(v.expires) {
+				delete(s.cache, k)
+			}
+		}
+		for k := range s.cache { // still full, evict an arbitrary one
+			if len(s.cache) < s.opts.CacheSize {
+				break
+			}
+			delete(s.cache, k)
+		}
+	}
+	s.cache[key] = entry
+	s.cacheLock.Unlock()
+}
+
+// cacheLookup returns a packed answer with the given ID and TTLs decreased, or nil if missed
+func (s *Server) cacheLookup(hdr dnsmessage.Header, qs []dnsmessage.Question, client net.IP, dnssecOK bool) []byte {
+	if s.opts.CacheSize <= 0 || len(qs) != 1 {
+		return nil
+	}
+
+	key := s.newCacheKey(qs[0], client, dnssecOK, hdr.CheckingDisabled)
+	now := time.Now()
+
+	s.cacheLock.Lock()
+	entry, ok := s.cache[key]
+	if ok && now.After(entry.expires) {
+		delete(s.cache, key)
+		ok = false
+	}
+	s.cacheLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	m, err := entry.aged(now)
+	if err != nil {
+		return nil
+	}
+	m.ID = hdr.ID
+	m.Questions = qs // keep the letter case the client asked with
+
+	packed, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+// aged unpacks the answer with TTLs decreased by the time it was kept
+func (entry *cacheEntry) aged(now time.Time) (*dnsmessage.Message, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(entry.msg); err != nil {
+		return nil, err
+	}
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			if section[i].Header.Type == dnsmessage.TypeOPT { // TTL field of OPT holds flags
+				continue
+			}
+			if section[i].Header.TTL > elapsed {
+				section[i].Header.TTL -= elapsed
+			} else {
+				section[i].Header.TTL = 0
+			}
+		}
+	}
+	return &m, nil
+}
+
+// CacheSelector picks cached answers by name pattern as of path.Match (*.example.com),
+// by a domain and its subdomains, and by type. Empty fields match any.
+type CacheSelector struct {
+	Name   string
+	Suffix string
+	Type   string
+}
+
+func (sel CacheSelector) empty() bool {
+	return sel.Name == "" && sel.Suffix == "" && sel.Type == ""
+}
+
+// matcher returns the function telling if a key is selected
+func (sel CacheSelector) matcher() (func(key cacheKey) bool, error) {
+	pattern := strings.TrimSuffix(strings.ToLower(sel.Name), ".")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid name pattern: %s", sel.Name)
+	}
+	suffix := strings.TrimSuffix(strings.ToLower(sel.Suffix), ".")
+	var qtype dnsmessage.Type
+	if sel.Type != "" {
+		var ok bool
+		if qtype, ok = parseType(sel.Type); !ok {
+			return nil, fmt.Errorf("Unknown type: %s", sel.Type)
+		}
+	}
+
+	return func(key cacheKey) bool {
+		name := strings.TrimSuffix(key.name, ".")
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, name); !ok {
+				return false
+			}
+		}
+		if suffix != "" && name != suffix && !strings.HasSuffix(name, "."+suffix) {
+			return false
+		}
+		return qtype == 0 || key.qtype == qtype
+	}, nil
+}
+
+// cachedAnswer describes a cache entry for GET /cache
+type cachedAnswer struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Client  string   `json:"client,omitempty"`
+	View    string   `json:"view,omitempty"`
+	DO      bool     `json:"do,omitempty"`
+	CD      bool     `json:"cd,omitempty"`
+	TTL     int      `json:"ttl"`     // seconds left
+	Records []string `json:"records"` // answers, with their TTLs left
+}
+
+// cacheList returns the answers selected not expired, sorted by name and type
+func (s *Server) cacheList(sel CacheSelector) ([]cachedAnswer, error) {
+	selected, err := sel.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	type keyEntry struct {
+		key   cacheKey
+		entry *cacheEntry
+	}
+	var picked []keyEntry
+	s.cacheLock.Lock()
+	for key, entry := range s.cache {
+		if now.Before(entry.expires) && selected(key) {
+			picked = append(picked, keyEntry{key, entry})
+		}
+	}
+	s.cacheLock.Unlock()
+	sort.Slice(picked, func(i, j int) bool {
+		a, b := picked[i].key, picked[j].key
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if a.qtype != b.qtype {
+			return a.qtype < b.qtype
+		}
+		if a.view != b.view {
+			return a.view < b.view
+		}
+		if a.client != b.client {
+			return a.client < b.client
+		}
+		return !a.do && b.do || a.do == b.do && !a.cd && b.cd
+	})
+
+	list := make([]cachedAnswer, 0, len(picked))
+	for _, p := range picked {
+		m, err := p.entry.aged(now)
+		if err != nil {
+			continue
+		}
+		answer := cachedAnswer{Name: p.key.name, Type: typeName(p.key.qtype), Client: p.key.client, View: p.key.view, DO: p.key.do, CD: p.key.cd,
+			TTL: int(p.entry.expires.Sub(now) / time.Second), Records: make([]string, len(m.Answers))}
+		for i, ans := range m.Answers {
+			answer.Records[i] = fmt.Sprintf("%s %d %s %s", ans.Header.Name, ans.Header.TTL, typeName(ans.Header.Type), recordData(ans))
+		}
+		list = append(list, answer)
+	}
+	return list, nil
+}
+
+// cacheFlushSelected removes the answers selected, returning how many
+func (s *Server) cacheFlushSelected(sel CacheSelector) (int, error) {
+	selected, err := sel.matcher()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	s.cacheLock.Lock()
+	for key := range s.cache {
+		if selected(key) {
+			delete(s.cache, key)
+			n++
+		}
+	}
+	s.cacheLock.Unlock()
+	return n, nil
+}
+
+// savedEntry is a line of the cache file
+type savedEntry struct {
+	Client  string           `json:"client,omitempty"`
+	View    string           `json:"view,omitempty"`
+	Name    string           `json:"name"`
+	Type    dnsmessage.Type  `json:"type"`
+	Class   dnsmessage.Class `json:"class"`
+	DO      bool             `json:"do,omitempty"`
+	CD      bool             `json:"cd,omitempty"`
+	Msg     []byte           `json:"msg"`
+	Stored  time.Time        `json:"stored"`
+	Expires time.Time        `json:"expires"`
+}
+
+// cacheLoad reads the cache saved in opts.CacheFile, skipping expired answers. TTLs
+// are decreased by the time since they were stored, restart time included.
+func (s *Server) cacheLoad() error {
+	file, err := os.Open(s.opts.CacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := time.Now()
+	n := 0
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+	for len(s.cache) < s.opts.CacheSize {
+		var saved savedEntry
+		if err := decoder.Decode(&saved); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("Invalid cache file %s: %s", s.opts.CacheFile, err)
+		}
+		if !now.Before(saved.Expires) {
+			continue
+		}
+		key := cacheKey{saved.Client, saved.View, saved.Name, saved.Type, saved.Class, saved.DO, saved.CD}
+		s.cache[key] = &cacheEntry{saved.Msg, saved.Stored, saved.Expires}
+		n++
+	}
+	s.logStd.Printf("Loaded %d cached answers from %s", n, s.opts.CacheFile)
+	return nil
+}
+
+// cacheSave writes the answers not expired to opts.CacheFile, through a temporary file
+// renamed over it not to leave a truncated one
+func (s *Server) cacheSave() error {
+	now := time.Now()
+	s.cacheLock.Lock()
+	saved := make([]savedEntry, 0, len(s.cache))
+	for key, entry := range s.cache {
+		if now.Before(entry.expires) {
+			saved = append(saved, savedEntry{key.client, key.view, key.name, key.qtype, key.class, key.do, key.cd, entry.msg, entry.stored, entry.expires})
+		}
+	}
+	s.cacheLock.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.opts.CacheFile), filepath.Base(s.opts.CacheFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	for i := range saved {
+		if err = encoder.Encode(&saved[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.opts.CacheFile)
+}
+
+// saveCache saves the cache every interval
+func (s *Server) saveCache(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := s.cacheSave(); err != nil {
+			s.logErr.Println("Failed to save cache:", err)
+		}
+	}
+}
+
+func (s *Server) cacheFlush() int {
+	s.cacheLock.Lock()
+	n := len(s.cache)
+	s.cache = make(map[cacheKey]*cacheEntry)
+	s.cacheLock.Unlock()
+	return n
+}
@@ -0,0 +1,77 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CacheCommand runs the cache subcommand list or flush against the admin API at admin,
+// on the answers selected, writing the outcome to w
+func CacheCommand(admin, command string, sel CacheSelector, w io.Writer) error {
+	host, port, err := net.SplitHostPort(admin)
+	if err != nil {
+		return fmt.Errorf("Invalid admin address: %s", admin)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" { // listening on any
+		host = "localhost"
+	}
+	query := url.Values{}
+	for key, value := range map[string]string{"name": sel.Name, "suffix": sel.Suffix, "type": sel.Type} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	base := "http://" + net.JoinHostPort(host, port)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	switch command {
+	case "list":
+		var list []cachedAnswer
+		if err := adminRequest(client, http.MethodGet, base+"/cache?"+query.Encode(), &list); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTYPE\tTTL\tCLIENT\tRECORDS")
+		for _, answer := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", answer.Name, answer.Type, answer.TTL, answer.Client, strings.Join(answer.Records, ", "))
+		}
+		tw.Flush()
+		fmt.Fprintf(w, "%d answer(s)\n", len(list))
+	case "flush":
+		var flushed struct {
+			Flushed int `json:"flushed"`
+		}
+		if err := adminRequest(client, http.MethodPost, base+"/cache/flush?"+query.Encode(), &flushed); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Flushed %d answer(s)\n", flushed.Flushed)
+	default:
+		return fmt.Errorf("Unknown cache command: %s", command)
+	}
+	return nil
+}
+
+// adminRequest calls the admin API, decoding the JSON answered into v
+func adminRequest(client *http.Client, method, target string, v interface{}) error {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,126 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// errorList gathers errors of a config checked in full
+type errorList []error
+
+func (e errorList) Error() string {
+	strs := make([]string, len(e))
+	for i, err := range e {
+		strs[i] = err.Error()
+	}
+	return strings.Join(strs, "\n")
+}
+
+// countingWriter counts the lines logged through it
+type countingWriter struct {
+	w     io.Writer
+	lines int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.lines += strings.Count(string(p), "\n")
+	return c.w.Write(p)
+}
+
+// Check loads everything cfg names as New does, without binding sockets, reporting every
+// problem found to the error log, then prints the compiled rule table. It tells false
+// if there was a problem, warnings of settings assumed included.
+func Check(cfg Config) bool {
+	s := newServer(cfg)
+	s.logStd = log.New(io.Discard, "", 0) // only problems and the rule table are shown
+	errOut := io.Writer(os.Stderr)
+	if cfg.ErrorLog != nil {
+		errOut = cfg.ErrorLog.Writer()
+	}
+	problems := &countingWriter{w: errOut}
+	s.logErr = log.New(problems, "", 0)
+	report := func(err error) {
+		if list, ok := err.(errorList); ok {
+			for _, err := range list {
+				s.logErr.Println(err)
+			}
+		} else if err != nil {
+			s.logErr.Println(err)
+		}
+	}
+
+	report(s.checkOptions())
+	if _, err := parseUdpAddr(s.opts.Listen); err != nil {
+		report(fmt.Errorf("Invalid binding address: %s", s.opts.Listen))
+	}
+	if s.opts.DNSSEC {
+		report(s.loadAnchors())
+	}
+	report(s.loadPlugins())
+	report(s.parseServers())
+
+	newIPsets, err := s.loadIPsets()
+	report(err)
+	var hasGeoIP bool
+	if s.opts.GeoIP != "" {
+		if _, err := openMMDB(s.opts.GeoIP); err != nil {
+			report(fmt.Errorf("Failed to load geoip database: %s", err))
+		} else {
+			hasGeoIP = true
+		}
+	}
+	newBlocklists, err := s.loadBlocklists(s.opts.Blocklists, "blocklist")
+	if err != nil {
+		report(fmt.Errorf("Failed to load blocklist: %s", err))
+	}
+	newAllowlists, err := s.loadBlocklists(s.opts.Allowlists, "allowlist")
+	if err != nil {
+		report(fmt.Errorf("Failed to load allowlist: %s", err))
+	}
+	newRPZs, err := s.loadRPZs()
+	report(err)
+	_, err = s.loadScript()
+	report(err)
+	if _, err := s.loadHosts(); err != nil {
+		report(fmt.Errorf("Failed to load hosts file: %s", err))
+	}
+
+	var newRules []*rule
+	if cfg, err := LoadConfigFile(s.opts.ConfigFile); err != nil {
+		report(fmt.Errorf("Failed to load config file: %s", err))
+	} else {
+		newRules, err = s.loadRules(cfg, len(newIPsets), len(newBlocklists), len(newAllowlists), len(newRPZs), hasGeoIP)
+		report(err)
+		_, err = s.loadACL(cfg)
+		report(err)
+		_, err = s.loadForwards(cfg)
+		report(err)
+		newZones, err := s.loadZones(cfg)
+		report(err)
+		_, err = s.loadReverses(cfg)
+		report(err)
+		_, err = s.loadViews(cfg, newZones, profilesOf(newRules))
+		report(err)
+	}
+	if s.opts.Profile != "" && newRules != nil && !containsString(profilesOf(newRules), s.opts.Profile) {
+		report(fmt.Errorf("Unknown profile %s", s.opts.Profile))
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "#\tRULE\tMATCH [TARGET]")
+	for i, rule := range newRules {
+		fmt.Fprintf(table, "%d\t%s\t%s\n", i+1, rule.name, rule.desc)
+	}
+	table.Flush()
+
+	if problems.lines > 0 {
+		fmt.Printf("%d problem(s) found\n", problems.lines)
+		return false
+	}
+	fmt.Println("Config OK")
+	return true
+}
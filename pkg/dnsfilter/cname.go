@@ -0,0 +1,96 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+)
+
+const maxCNAMEs = 16 // CNAMEs followed at most, against loops
+
+// aliasesOf maps CNAME targets to the names pointing at them, lower case
+func aliasesOf(answers []dnsmessage.Resource) map[string][]dnsmessage.Name {
+	var aliases map[string][]dnsmessage.Name
+	for _, ans := range answers {
+		if cname, ok := ans.Body.(*dnsmessage.CNAMEResource); ok {
+			if aliases == nil {
+				aliases = make(map[string][]dnsmessage.Name)
+			}
+			target := strings.ToLower(cname.CNAME.String())
+			aliases[target] = append(aliases[target], ans.Header.Name)
+		}
+	}
+	return aliases
+}
+
+// matchChainName tells if name, or any name leading to it through CNAMEs, is in domain
+func matchChainName(name dnsmessage.Name, domain string, aliases map[string][]dnsmessage.Name, depth int) bool {
+	if matchName(name, domain) {
+		return true
+	}
+	if depth >= maxCNAMEs {
+		return false
+	}
+	for _, alias := range aliases[strings.ToLower(name.String())] {
+		if matchChainName(alias, domain, aliases, depth+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// flattenCNAME replaces a CNAME chain resolved within msg by the final records,
+// renamed to the question name. msg is returned as is if there is nothing to flatten,
+// the chain is incomplete or signed.
+func flattenCNAME(msg []byte) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil || len(m.Questions) != 1 || m.Questions[0].Type == dnsmessage.TypeCNAME {
+		return msg
+	}
+	q := m.Questions[0]
+
+	name, ttl := q.Name, ^uint32(0)
+	for i := 0; i < maxCNAMEs; i++ {
+		next := -1
+		for j, ans := range m.Answers {
+			if ans.Header.Type == dnsmessage.TypeCNAME && strings.EqualFold(ans.Header.Name.String(), name.String()) {
+				next = j
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		if m.Answers[next].Header.TTL < ttl {
+			ttl = m.Answers[next].Header.TTL
+		}
+		name = m.Answers[next].Body.(*dnsmessage.CNAMEResource).CNAME
+	}
+	if ttl == ^uint32(0) { // no CNAME
+		return msg
+	}
+
+	var flat []dnsmessage.Resource
+	for _, ans := range m.Answers {
+		if ans.Header.Type == typeRRSIG {
+			return msg // signatures would no longer match
+		}
+		if ans.Header.Type == q.Type && strings.EqualFold(ans.Header.Name.String(), name.String()) {
+			ans.Header.Name = q.Name
+			if ans.Header.TTL > ttl {
+				ans.Header.TTL = ttl
+			}
+			flat = append(flat, ans)
+		}
+	}
+	if len(flat) == 0 { // not resolved here, the client has to follow it
+		return msg
+	}
+
+	m.Answers = flat
+	out, err := m.Pack()
+	if err != nil {
+		return msg
+	}
+	putBuf(msg)
+	return out
+}
@@ -0,0 +1,818 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/go-ini/ini.v1"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func parseUdpAddr(str string) (*net.UDPAddr, error) {
+	_, _, err := net.SplitHostPort(str)
+	if err == nil {
+		return net.ResolveUDPAddr("udp", str)
+	}
+	if _, _, err := net.SplitHostPort(str + ":53"); err == nil { // further try
+		return net.ResolveUDPAddr("udp", str+":53")
+	}
+	if _, _, err := net.SplitHostPort("[" + str + "]:53"); err == nil {
+		return net.ResolveUDPAddr("udp", "["+str+"]:53")
+	}
+	return nil, err
+}
+
+func (s *Server) lookupServer(addr *net.UDPAddr) (int, bool) {
+	for i, server := range s.servers {
+		if a := server.addr(); a.IP.Equal(addr.IP) && a.Port == addr.Port && a.Zone == addr.Zone {
+			return i, true
+		}
+		if a := server.altAddr(); a != nil && a.IP.Equal(addr.IP) && a.Port == addr.Port && a.Zone == addr.Zone {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// lookupServerName finds the 1-based index of a server by its name or index
+func (s *Server) lookupServerName(str string) (uint, bool) {
+	str = strings.TrimSpace(str)
+	if index, err := strconv.ParseUint(str, 10, 0); err == nil {
+		return uint(index), index > 0 && index <= uint64(len(s.servers))
+	}
+	for i, server := range s.servers {
+		if server.name != "" && strings.EqualFold(server.name, str) {
+			return uint(i + 1), true
+		}
+	}
+	return 0, false
+}
+
+// parseServers takes nameservers from -d, then [server.xxx] sections of the config file
+func (s *Server) parseServers() error {
+	if err := s.parseBootstrap(); err != nil {
+		return err
+	}
+	for _, serverStr := range s.opts.Servers {
+		if strings.EqualFold(strings.TrimSpace(serverStr), "system") {
+			if err := s.addSystemServers(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.addServer(&upstream{srv: s, weight: 1}, serverStr); err != nil {
+			return err
+		}
+	}
+
+	if cfg, err := LoadConfigFile(s.opts.ConfigFile); err == nil { // failure is reported in reload()
+		for _, section := range cfg.ChildSections("server") {
+			address := strings.TrimSpace(section.Key("address").String())
+			if address == "" {
+				return fmt.Errorf("%s address must exist in a server!", section.Name())
+			}
+			server := &upstream{srv: s, name: strings.TrimPrefix(section.Name(), "server."), weight: section.Key("weight").MustInt(1),
+				trusted: section.Key("trusted").MustBool(false)}
+			if server.weight < 1 {
+				return fmt.Errorf("%s weight must be positive!", section.Name())
+			}
+			if server.family = strings.ToLower(strings.TrimSpace(section.Key("family").String())); server.family != "" &&
+				server.family != "v4" && server.family != "v6" {
+				return fmt.Errorf("%s family must be v4 or v6!", section.Name())
+			}
+			if proxyStr := strings.TrimSpace(section.Key("proxy").String()); proxyStr != "" {
+				if server.proxy, err = parseProxy(proxyStr); err != nil {
+					return fmt.Errorf("%s %s", section.Name(), err)
+				}
+			}
+			if section.HasKey("timeout") {
+				if server.timeout, err = section.Key("timeout").Duration(); err != nil || server.timeout <= 0 {
+					return fmt.Errorf("%s timeout must be a positive duration!", section.Name())
+				}
+			}
+			if err := s.addServer(server, address); err != nil {
+				return err
+			}
+		}
+	}
+	if s.opts.Recursive {
+		return s.addRecursor()
+	}
+	return nil
+}
+
+// addServer adds server, with the other fields set, at the address of serverStr, or
+// that its hostname resolves to by -bootstrap
+func (s *Server) addServer(server *upstream, serverStr string) error {
+	var addr *net.UDPAddr
+	var err error
+	if host, port, ok := upstreamHost(strings.TrimSpace(serverStr)); ok {
+		server.host = net.JoinHostPort(host, port)
+		addrs, err := s.resolveUpstream(server.host)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve nameserver %s: %s", serverStr, err)
+		}
+		var alt *net.UDPAddr
+		addr, alt = server.pickAddr(addrs)
+		server.alt.Store(alt)
+	} else if addr, err = parseUdpAddr(serverStr); err != nil {
+		return fmt.Errorf("Invalid nameserver: %s", serverStr)
+	}
+
+	if addr.Zone != "" { // normalize zone to name instead of index
+		if zoneid, err := strconv.Atoi(addr.Zone); err == nil {
+			if ifi, err := net.InterfaceByIndex(zoneid); err == nil {
+				addr.Zone = ifi.Name
+			} else {
+				return fmt.Errorf("IPv6 zone invalid: %s", serverStr)
+			}
+		} else if _, err := net.InterfaceByName(addr.Zone); err != nil {
+			return fmt.Errorf("IPv6 zone invalid: %s", serverStr)
+		}
+	}
+
+	if _, exist := s.lookupServer(addr); exist {
+		return fmt.Errorf("Nameserver exists: %s", serverStr)
+	}
+	if _, exist := s.lookupServerName(server.name); server.name != "" && exist {
+		return fmt.Errorf("Nameserver name exists: %s", server.name)
+	}
+
+	server.setAddr(addr)
+	s.servers = append(s.servers, server)
+	if server.proxy != nil {
+		s.logStd.Printf("Using nameserver %s through %s", server, server.proxy.Redacted())
+	} else {
+		s.logStd.Printf("Using nameserver %s", server)
+	}
+	return nil
+}
+
+// reload parses ipset files and the config file, then swaps them in atomically
+func (s *Server) reload() error {
+	newIPsets, err := s.loadIPsets()
+	if err != nil {
+		return err
+	}
+
+	var newGeoIP *mmdb
+	if s.opts.GeoIP != "" {
+		if newGeoIP, err = openMMDB(s.opts.GeoIP); err != nil {
+			return fmt.Errorf("Failed to load geoip database: %s", err)
+		}
+	}
+
+	newBlocklists, err := s.loadBlocklists(s.opts.Blocklists, "blocklist")
+	if err != nil {
+		return fmt.Errorf("Failed to load blocklist: %s", err)
+	}
+
+	newAllowlists, err := s.loadBlocklists(s.opts.Allowlists, "allowlist")
+	if err != nil {
+		return fmt.Errorf("Failed to load allowlist: %s", err)
+	}
+
+	newRPZs, err := s.loadRPZs()
+	if err != nil {
+		return err
+	}
+
+	newHook, err := s.loadScript()
+	if err != nil {
+		return err
+	}
+
+	newHosts, err := s.loadHosts()
+	if err != nil {
+		return fmt.Errorf("Failed to load hosts file: %s", err)
+	}
+
+	cfg, err := LoadConfigFile(s.opts.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load config file: %s", err)
+	}
+
+	newRules, err := s.loadRules(cfg, len(newIPsets), len(newBlocklists), len(newAllowlists), len(newRPZs), newGeoIP != nil)
+	if err != nil {
+		return err
+	}
+
+	newACL, err := s.loadACL(cfg)
+	if err != nil {
+		return err
+	}
+
+	newForwards, err := s.loadForwards(cfg)
+	if err != nil {
+		return err
+	}
+
+	newZones, err := s.loadZones(cfg)
+	if err != nil {
+		return err
+	}
+
+	newReverses, err := s.loadReverses(cfg)
+	if err != nil {
+		return err
+	}
+
+	newViews, err := s.loadViews(cfg, newZones, profilesOf(newRules))
+	if err != nil {
+		return err
+	}
+
+	s.configLock.Lock()
+	s.ipsets, s.geoipDB, s.rules, s.clientACL, s.forwards, s.hosts, s.zones = newIPsets, newGeoIP, newRules, newACL, newForwards, newHosts, newZones
+	s.reverses, s.views = newReverses, newViews
+	s.blocklists, s.allowlists, s.rpzs, s.hook = newBlocklists, newAllowlists, newRPZs, newHook
+	s.profiles, s.sinkholes = profilesOf(newRules), sinkholesOf(newRules)
+	if s.activeProfile != "" && !containsString(s.profiles, s.activeProfile) {
+		s.logErr.Printf("Profile %s no longer named by any rule", s.activeProfile)
+	}
+	s.configLock.Unlock()
+
+	s.cacheFlush() // cached answers were judged by the old rules
+	return nil
+}
+
+// typeValues maps config strings back to value, for types dnsmessage knows and
+// those of the IANA registry in use
+var typeValues = map[string]dnsmessage.Type{
+	"A":          dnsmessage.TypeA,
+	"NS":         dnsmessage.TypeNS,
+	"CNAME":      dnsmessage.TypeCNAME,
+	"SOA":        dnsmessage.TypeSOA,
+	"PTR":        dnsmessage.TypePTR,
+	"MX":         dnsmessage.TypeMX,
+	"TXT":        dnsmessage.TypeTXT,
+	"AAAA":       dnsmessage.TypeAAAA,
+	"SRV":        dnsmessage.TypeSRV,
+	"OPT":        dnsmessage.TypeOPT,
+	"WKS":        dnsmessage.TypeWKS,
+	"HINFO":      dnsmessage.TypeHINFO,
+	"MINFO":      dnsmessage.TypeMINFO,
+	"AXFR":       dnsmessage.TypeAXFR,
+	"ALL":        dnsmessage.TypeALL,
+	"ANY":        dnsmessage.TypeALL,
+	"RP":         17,
+	"AFSDB":      18,
+	"LOC":        29,
+	"NAPTR":      35,
+	"KX":         36,
+	"CERT":       37,
+	"DNAME":      39,
+	"APL":        42,
+	"DS":         typeDS,
+	"SSHFP":      44,
+	"IPSECKEY":   45,
+	"RRSIG":      typeRRSIG,
+	"NSEC":       typeNSEC,
+	"DNSKEY":     typeDNSKEY,
+	"DHCID":      49,
+	"NSEC3":      typeNSEC3,
+	"NSEC3PARAM": 51,
+	"TLSA":       52,
+	"SMIMEA":     53,
+	"HIP":        55,
+	"CDS":        59,
+	"CDNSKEY":    60,
+	"OPENPGPKEY": 61,
+	"CSYNC":      62,
+	"ZONEMD":     63,
+	"SVCB":       typeSVCB,
+	"HTTPS":      typeHTTPS,
+	"SPF":        typeSPF,
+	"EUI48":      108,
+	"EUI64":      109,
+	"TKEY":       249,
+	"TSIG":       250,
+	"IXFR":       typeIXFR,
+	"URI":        256,
+	"CAA":        257,
+}
+
+// parseType reads a type by name or as TYPE and its number (RFC 3597 section 5)
+func parseType(s string) (dnsmessage.Type, bool) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if t, ok := typeValues[s]; ok {
+		return t, true
+	}
+	if number := strings.TrimPrefix(s, "TYPE"); number != s {
+		if n, err := strconv.ParseUint(number, 10, 16); err == nil {
+			return dnsmessage.Type(n), true
+		}
+	}
+	return 0, false
+}
+
+// loadRules compiles the rule sections of cfg. On errors, those of every rule are
+// returned along with the rules compiled without one.
+func (s *Server) loadRules(cfg *ini.File, ipsetCount, blocklistCount, allowlistCount, rpzCount int, hasGeoIP bool) ([]*rule, error) {
+	ruleSections := cfg.ChildSections("rule")
+	rules := make([]*rule, len(ruleSections))
+	var errs errorList // all rules are checked before failing
+
+	for i, ruleSection := range ruleSections { //one rule each time
+		ruleName := ruleSection.Name()
+		var logBuf strings.Builder
+		fmt.Fprintf(&logBuf, "%s:", ruleName)
+
+		targetKey, err := ruleSection.GetKey("target")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s target must exist in a rule!", ruleName))
+			continue
+		} // target is mandatory
+
+		rule := rule{name: ruleName}
+		rule.match.sections, rule.match.maxAnswers = sectionAnswer, -1
+
+		if clientKey, err := ruleSection.GetKey("client"); err == nil {
+			if client, err := parseIPList(clientKey.String()); err == nil && client.size > 0 {
+				rule.match.client = client
+				fmt.Fprintf(&logBuf, " CLIENT %s", strings.Join(strings.Fields(clientKey.String()), ""))
+			} else {
+				s.logErr.Printf("%s invalid client CIDR! Assume matching any", ruleName)
+			}
+		}
+
+		if serverKey, err := ruleSection.GetKey("server"); err == nil {
+			if server, ok := s.lookupServerName(serverKey.String()); ok {
+				rule.match.server = server
+				fmt.Fprintf(&logBuf, " SERVER %s", strings.TrimSpace(serverKey.String()))
+			} else {
+				s.logErr.Printf("%s invalid server index! Assume matching any", ruleName)
+			}
+		}
+
+		if ipsetKey, err := ruleSection.GetKey("ipset"); err == nil {
+			if ipset, ok := s.ipsetIndex(ipsetKey.String(), ipsetCount); ok {
+				rule.match.ipset = ipset
+				fmt.Fprintf(&logBuf, " IPSET %s", strings.TrimSpace(ipsetKey.String()))
+			} else {
+				s.logErr.Printf("%s invalid ipset index! Assume matching any", ruleName)
+			}
+		}
+
+		if blocklistKey, err := ruleSection.GetKey("blocklist"); err == nil {
+			if blocklist, err := blocklistKey.Uint(); err == nil && blocklist > 0 && blocklist <= uint(blocklistCount) {
+				rule.match.blocklist = blocklist
+				fmt.Fprintf(&logBuf, " BLOCKLIST %d", blocklist)
+			} else {
+				s.logErr.Printf("%s invalid blocklist index! Assume matching any", ruleName)
+			}
+		}
+
+		if allowlistKey, err := ruleSection.GetKey("allowlist"); err == nil {
+			if allowlist, err := allowlistKey.Uint(); err == nil && allowlist > 0 && allowlist <= uint(allowlistCount) {
+				rule.match.allowlist = allowlist
+				fmt.Fprintf(&logBuf, " ALLOWLIST %d", allowlist)
+			} else {
+				s.logErr.Printf("%s invalid allowlist index! Assume matching any", ruleName)
+			}
+		}
+
+		if rpzKey, err := ruleSection.GetKey("rpz"); err == nil {
+			if rpz, err := rpzKey.Uint(); err == nil && rpz > 0 && rpz <= uint(rpzCount) {
+				rule.match.rpz = rpz
+				fmt.Fprintf(&logBuf, " RPZ %d", rpz)
+			} else {
+				s.logErr.Printf("%s invalid rpz index! Assume matching any", ruleName)
+			}
+		}
+
+		if geoipKey, err := ruleSection.GetKey("geoip"); err == nil {
+			if codes := geoipKey.Strings(","); hasGeoIP && len(codes) > 0 {
+				rule.match.geoip = codes
+				fmt.Fprintf(&logBuf, " GEOIP %s", strings.Join(codes, ","))
+			} else {
+				s.logErr.Printf("%s geoip needs -geoip database and country codes! Assume matching any", ruleName)
+			}
+		}
+
+		if answerTypeKey, err := ruleSection.GetKey("type"); err == nil {
+			if answerType, ok := parseType(answerTypeKey.String()); ok {
+				rule.match.answerType = answerType
+				fmt.Fprintf(&logBuf, " Type%s", typeName(answerType))
+			} else {
+				s.logErr.Printf("%s invalid type! Assume matching any", ruleName)
+			}
+		}
+
+		if txtKey, err := ruleSection.GetKey("txt_contains"); err == nil {
+			if text := txtKey.String(); text != "" {
+				rule.match.txtContains = strings.ToLower(text)
+				fmt.Fprintf(&logBuf, " TXT CONTAINS %q", text)
+			} else {
+				s.logErr.Printf("%s empty txt_contains! Assume matching any", ruleName)
+			}
+		}
+
+		if regexKey, err := ruleSection.GetKey("txt_regex"); err == nil {
+			re, err := regexp.Compile(regexKey.String())
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s invalid txt_regex: %s!", ruleName, err))
+				continue
+			}
+			rule.match.txtRegex = re
+			fmt.Fprintf(&logBuf, " TXT REGEX %s", re)
+		}
+
+		if nameKey, err := ruleSection.GetKey("name"); err == nil {
+			if name := strings.Trim(nameKey.String(), " ."); 0 != len(name) {
+				rule.match.name = name
+				fmt.Fprintf(&logBuf, " DOMAIN NAME %s", name)
+			} else {
+				s.logErr.Printf("%s empty domain name! Assume matching any", ruleName)
+			}
+		}
+
+		if followKey, err := ruleSection.GetKey("follow_cname"); err == nil {
+			if follow, err := followKey.Bool(); err == nil && rule.match.name != "" {
+				rule.match.followCNAME = follow
+				if follow {
+					logBuf.WriteString(" FOLLOWING CNAME")
+				}
+			} else {
+				s.logErr.Printf("%s follow_cname needs a domain name and a boolean! Assume not following", ruleName)
+			}
+		}
+
+		if sectionKey, err := ruleSection.GetKey("section"); err == nil {
+			if sections, ok := parseSections(sectionKey.Strings(",")); ok {
+				rule.match.sections = sections
+				fmt.Fprintf(&logBuf, " SECTION %s", strings.ToUpper(strings.Join(sectionKey.Strings(","), ",")))
+			} else {
+				s.logErr.Printf("%s invalid section! Assume answer", ruleName)
+			}
+		}
+
+		if profileKey, err := ruleSection.GetKey("profile"); err == nil {
+			if names := profileKey.Strings(","); len(names) > 0 {
+				rule.match.profiles = names
+				fmt.Fprintf(&logBuf, " PROFILE %s", strings.Join(names, ","))
+			}
+		}
+
+		if timeKey, err := ruleSection.GetKey("time"); err == nil {
+			if from, to, ok := parseTimeRange(timeKey.String()); ok {
+				rule.match.timeFrom, rule.match.timeTo = from, to
+				fmt.Fprintf(&logBuf, " TIME %s", timeKey.String())
+			} else {
+				errs = append(errs, fmt.Errorf("%s invalid time, use HH:MM-HH:MM!", ruleName))
+				continue
+			}
+		}
+
+		if daysKey, err := ruleSection.GetKey("days"); err == nil {
+			if days, ok := parseDays(daysKey.Strings(",")); ok {
+				rule.match.days = days
+				fmt.Fprintf(&logBuf, " DAYS %s", daysKey.String())
+			} else {
+				errs = append(errs, fmt.Errorf("%s invalid days, use Mon-Fri or Sat,Sun!", ruleName))
+				continue
+			}
+		}
+
+		if rcodeKey, err := ruleSection.GetKey("rcode"); err == nil {
+			if rcodes, ok := parseRCodes(rcodeKey.Strings(",")); ok {
+				rule.match.rcodes = rcodes
+				fmt.Fprintf(&logBuf, " RCODE %s", strings.ToUpper(strings.Join(rcodeKey.Strings(","), ",")))
+			} else {
+				s.logErr.Printf("%s invalid rcode! Assume matching any", ruleName)
+			}
+		}
+
+		if minKey, err := ruleSection.GetKey("min_answers"); err == nil {
+			if min, err := minKey.Uint(); err == nil {
+				rule.match.minAnswers = int(min)
+				fmt.Fprintf(&logBuf, " MIN ANSWERS %d", min)
+			} else {
+				s.logErr.Printf("%s invalid min_answers! Assume matching any", ruleName)
+			}
+		}
+
+		if maxKey, err := ruleSection.GetKey("max_answers"); err == nil {
+			if max, err := maxKey.Uint(); err == nil {
+				rule.match.maxAnswers = int(max)
+				fmt.Fprintf(&logBuf, " MAX ANSWERS %d", max)
+			} else {
+				s.logErr.Printf("%s invalid max_answers! Assume matching any", ruleName)
+			}
+		}
+
+		if scoreKey, err := ruleSection.GetKey("tunnel"); err == nil {
+			score, err := scoreKey.Int()
+			if err != nil || score < 1 || score > 100 {
+				errs = append(errs, fmt.Errorf("%s tunnel must be a score from 1 to 100!", ruleName))
+				continue
+			}
+			if !s.opts.Tunnel {
+				errs = append(errs, fmt.Errorf("%s tunnel needs -tunnel!", ruleName))
+				continue
+			}
+			rule.match.tunnel = score
+			fmt.Fprintf(&logBuf, " TUNNEL %d", score)
+		}
+
+		switch target := strings.TrimSpace(targetKey.String()); { //TARGET
+		case strings.EqualFold(target, "DROP"):
+			rule.target = targetDrop
+			rule.delay = -1
+			logBuf.WriteString(" [DROP]")
+
+		case strings.EqualFold(target, "ACCEPT"):
+			rule.delay = 0
+			logBuf.WriteString(" [ACCEPT]")
+
+		case strings.EqualFold(target, "ALLOW"):
+			rule.target = targetAllow
+			rule.delay = 0
+			logBuf.WriteString(" [ALLOW]")
+
+		case strings.EqualFold(target, "DELAY"):
+			if delayKey, err := ruleSection.GetKey("delay"); err == nil {
+				if delay, err := delayKey.Duration(); err == nil {
+					rule.target = targetDelay
+					rule.delay = delay
+					fmt.Fprintf(&logBuf, " [DELAY %s]", delay)
+				} else {
+					rule.delay = 0
+					logBuf.WriteString(" [ACCEPT]")
+					s.logErr.Printf("%s delay parse error:[%s] Assume ACCEPT!", ruleName, err)
+				}
+			} else {
+				rule.delay = 0
+				logBuf.WriteString(" [ACCEPT]")
+				s.logErr.Printf("%s delay must be specified when target is delay! Assume ACCEPT!", ruleName)
+			}
+
+		case strings.EqualFold(target, "IPSET_ADD"):
+			kset, err := parseKernelSet(ruleSection)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %s", ruleName, err))
+				continue
+			}
+			rule.target = targetIPSetAdd
+			rule.kset = kset
+			fmt.Fprintf(&logBuf, " [IPSET_ADD %s]", ruleSection.Key("setname").String())
+
+		case strings.EqualFold(target, "FILTER"):
+			if !rule.match.onAnswers() {
+				errs = append(errs, fmt.Errorf("%s FILTER needs conditions on records!", ruleName))
+				continue
+			}
+			rule.target = targetFilter
+			logBuf.WriteString(" [FILTER]")
+
+		case strings.EqualFold(target, "BLOCK"):
+			rule.target = targetBlock
+			blockWith := strings.TrimSpace(ruleSection.Key("block_with").String())
+			var ok bool
+			if rule.blockWith, ok = parseBlockWith(blockWith); !ok {
+				errs = append(errs, fmt.Errorf("%s block_with must be nxdomain, null or addresses!", ruleName))
+				continue
+			}
+			switch {
+			case rule.blockWith == nil:
+				logBuf.WriteString(" [BLOCK]")
+			case strings.EqualFold(blockWith, "null"):
+				logBuf.WriteString(" [BLOCK NULL]")
+			default:
+				fmt.Fprintf(&logBuf, " [BLOCK %s]", strings.Join(strings.Fields(blockWith), ""))
+			}
+
+		case strings.EqualFold(target, "RPZ"):
+			if rule.match.rpz == 0 {
+				errs = append(errs, fmt.Errorf("%s RPZ needs rpz = N!", ruleName))
+				continue
+			}
+			rule.target = targetRPZ
+			logBuf.WriteString(" [RPZ]")
+
+		case strings.EqualFold(target, "STRIP_AAAA"), strings.EqualFold(target, "STRIP_A"):
+			rule.target = targetStripAAAA
+			if strings.EqualFold(target, "STRIP_A") {
+				rule.target = targetStripA
+			}
+			rule.ifOther = ruleSection.Key("if_other").MustBool(false)
+			if rule.ifOther {
+				logBuf.WriteString(" IF OTHER FAMILY")
+			}
+			fmt.Fprintf(&logBuf, " [%s]", strings.ToUpper(target))
+
+		case strings.EqualFold(target, "PREFER"), strings.EqualFold(target, "PENALIZE"):
+			score, err := ruleSection.Key("score").Int()
+			if err != nil || score <= 0 {
+				errs = append(errs, fmt.Errorf("%s score must be a positive integer for %s!", ruleName, target))
+				continue
+			}
+			rule.target, rule.score = targetPrefer, score
+			if strings.EqualFold(target, "PENALIZE") {
+				rule.target, rule.score = targetPenalize, -score
+			}
+			fmt.Fprintf(&logBuf, " [%s %d]", strings.ToUpper(target), score)
+
+		default:
+			errs = append(errs, fmt.Errorf("%s unknown target!", ruleName))
+			continue
+		}
+
+		if priorityKey, err := ruleSection.GetKey("priority"); err == nil {
+			if rule.priority, err = priorityKey.Int(); err != nil {
+				errs = append(errs, fmt.Errorf("%s invalid priority!", ruleName))
+				continue
+			}
+			fmt.Fprintf(&logBuf, " PRIORITY %d", rule.priority)
+		}
+
+		if ruleSection.Key("continue").MustBool(false) {
+			switch rule.target {
+			case targetAccept, targetIPSetAdd:
+				rule.cont = true
+				logBuf.WriteString(" CONTINUE")
+			case targetPrefer, targetPenalize, targetFilter, targetStripAAAA, targetStripA: // always do
+			default:
+				errs = append(errs, fmt.Errorf("%s only ACCEPT and IPSET_ADD can continue!", ruleName))
+				continue
+			}
+		}
+
+		if ruleSection.Key("notify").MustBool(false) {
+			if s.opts.Webhook == "" {
+				errs = append(errs, fmt.Errorf("%s notify needs -webhook!", ruleName))
+				continue
+			}
+			rule.notify = true
+			logBuf.WriteString(" NOTIFY")
+		}
+
+		s.logStd.Println(logBuf.String())
+		rule.desc = strings.TrimPrefix(logBuf.String(), ruleName+": ")
+
+		rules[i] = &rule
+	}
+	compiled := rules[:0] // rules failing are left out
+	for _, rule := range rules {
+		if rule != nil {
+			compiled = append(compiled, rule)
+		}
+	}
+	rules = compiled
+
+	sort.SliceStable(rules, func(i, j int) bool { // ALLOW rules first, then by priority
+		if allowI, allowJ := rules[i].target == targetAllow, rules[j].target == targetAllow; allowI != allowJ {
+			return allowI
+		}
+		return rules[i].priority > rules[j].priority
+	})
+	if len(errs) > 0 {
+		return rules, errs
+	}
+	return rules, nil
+}
+
+// parseRCodes reads rcodes by name (NXDOMAIN) or number, telling false if one is unknown
+func parseRCodes(strs []string) ([]dnsmessage.RCode, bool) {
+	rcodeValues := map[string]dnsmessage.RCode{
+		"NOERROR":  dnsmessage.RCodeSuccess,
+		"FORMERR":  dnsmessage.RCodeFormatError,
+		"SERVFAIL": dnsmessage.RCodeServerFailure,
+		"NXDOMAIN": dnsmessage.RCodeNameError,
+		"NOTIMP":   dnsmessage.RCodeNotImplemented,
+		"REFUSED":  dnsmessage.RCodeRefused,
+	}
+
+	var rcodes []dnsmessage.RCode
+	for _, str := range strs {
+		if rcode, ok := rcodeValues[strings.ToUpper(str)]; ok {
+			rcodes = append(rcodes, rcode)
+		} else if n, err := strconv.ParseUint(str, 10, 4); err == nil {
+			rcodes = append(rcodes, dnsmessage.RCode(n))
+		} else {
+			return nil, false
+		}
+	}
+	return rcodes, len(rcodes) > 0
+}
+
+// rcodeName names rcodes as parseRCodes reads them
+func rcodeName(rcode dnsmessage.RCode) string {
+	name, ok := map[dnsmessage.RCode]string{dnsmessage.RCodeSuccess: "NOERROR", dnsmessage.RCodeFormatError: "FORMERR",
+		dnsmessage.RCodeServerFailure: "SERVFAIL", dnsmessage.RCodeNameError: "NXDOMAIN",
+		dnsmessage.RCodeNotImplemented: "NOTIMP", dnsmessage.RCodeRefused: "REFUSED"}[rcode]
+	if !ok {
+		return strconv.Itoa(int(rcode))
+	}
+	return name
+}
+
+// parseSections reads answer, authority, additional or any, telling false if one is unknown
+func parseSections(strs []string) (uint8, bool) {
+	sectionValues := map[string]uint8{
+		"ANSWER":     sectionAnswer,
+		"AUTHORITY":  sectionAuthority,
+		"ADDITIONAL": sectionAdditional,
+		"ANY":        sectionAnswer | sectionAuthority | sectionAdditional,
+	}
+
+	var sections uint8
+	for _, str := range strs {
+		section, ok := sectionValues[strings.ToUpper(str)]
+		if !ok {
+			return 0, false
+		}
+		sections |= section
+	}
+	return sections, sections != 0
+}
+
+// parseTimeRange reads HH:MM-HH:MM as minutes of the day, the range going over
+// midnight if it ends before it starts
+func parseTimeRange(str string) (int, int, bool) {
+	fromTo := strings.Split(str, "-")
+	if len(fromTo) != 2 {
+		return 0, 0, false
+	}
+	var minutes [2]int
+	for i, s := range fromTo {
+		t, err := time.Parse("15:04", strings.TrimSpace(s))
+		if err != nil {
+			return 0, 0, false
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return minutes[0], minutes[1], minutes[0] != minutes[1]
+}
+
+// parseDays reads day names (Mon) and ranges of them (Mon-Fri, Fri-Mon) as bits by time.Weekday
+func parseDays(strs []string) (uint8, bool) {
+	dayValues := map[string]time.Weekday{"SUN": time.Sunday, "MON": time.Monday, "TUE": time.Tuesday,
+		"WED": time.Wednesday, "THU": time.Thursday, "FRI": time.Friday, "SAT": time.Saturday}
+
+	var days uint8
+	for _, str := range strs {
+		fromTo := strings.Split(str, "-")
+		if len(fromTo) > 2 {
+			return 0, false
+		}
+		from, ok := dayValues[strings.ToUpper(strings.TrimSpace(fromTo[0]))]
+		if !ok {
+			return 0, false
+		}
+		to := from
+		if len(fromTo) == 2 {
+			if to, ok = dayValues[strings.ToUpper(strings.TrimSpace(fromTo[1]))]; !ok {
+				return 0, false
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			days |= 1 << day
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, days != 0
+}
+
+func containsRCode(list []dnsmessage.RCode, rcode dnsmessage.RCode) bool {
+	for _, r := range list {
+		if r == rcode {
+			return true
+		}
+	}
+	return false
+}
+
+// parseKernelSet reads "setname = name" for an ipset, or "setname = family table name" for nftables
+func parseKernelSet(section *ini.Section) (*kernelSet, error) {
+	nftFamilies := map[string]uint8{"inet": 1, "ip": 2, "ip6": 10}
+
+	var kset kernelSet
+	switch fields := strings.Fields(section.Key("setname").String()); len(fields) {
+	case 1:
+		kset.name = fields[0]
+	case 3:
+		family, ok := nftFamilies[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown nftables family %s!", fields[0])
+		}
+		kset.family, kset.table, kset.name = family, fields[1], fields[2]
+	default:
+		return nil, fmt.Errorf("setname must be given for IPSET_ADD!")
+	}
+
+	if timeoutKey, err := section.GetKey("set_timeout"); err == nil {
+		timeout, err := timeoutKey.Duration()
+		if err != nil {
+			return nil, fmt.Errorf("set_timeout parse error:[%s]", err)
+		}
+		kset.timeout = timeout
+	}
+	return &kset, nil
+}
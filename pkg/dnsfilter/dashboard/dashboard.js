@@ -0,0 +1,117 @@
+"use strict";
+
+const refreshEvery = 5000; // ms
+const recentKept = 50;
+
+function cell(text, cls) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (cls) {
+    td.className = cls;
+  }
+  return td;
+}
+
+function fillTable(id, rows) {
+  const tbody = document.querySelector("#" + id + " tbody");
+  tbody.replaceChildren(...rows.map(cells => {
+    const tr = document.createElement("tr");
+    tr.append(...cells);
+    return tr;
+  }));
+}
+
+async function getJSON(path) {
+  const resp = await fetch(path);
+  if (!resp.ok) {
+    throw new Error(path + ": " + resp.status);
+  }
+  return resp.json();
+}
+
+async function refreshStats() {
+  let stats;
+  try {
+    stats = await getJSON("../stats");
+  } catch (e) {
+    document.getElementById("stats-disabled").hidden = false;
+    return;
+  }
+  document.getElementById("stats-disabled").hidden = true;
+
+  const totals = [["Queries", stats.queries]];
+  for (const [verdict, n] of Object.entries(stats.verdicts).sort()) {
+    totals.push([verdict, n]);
+  }
+  document.getElementById("totals").replaceChildren(...totals.map(([label, n]) => {
+    const span = document.createElement("span");
+    const b = document.createElement("b");
+    b.textContent = n;
+    span.append(b, label);
+    return span;
+  }));
+
+  const counts = list => list.map(c => [cell(c.key), cell(c.count, "num")]);
+  fillTable("top-domains", counts(stats.top_domains));
+  fillTable("top-blocked", counts(stats.top_blocked));
+  fillTable("top-clients", counts(stats.top_clients));
+}
+
+function percent(ratio) {
+  return (ratio * 100).toFixed(1) + " %";
+}
+
+async function refreshUpstreams() {
+  const upstreams = await getJSON("../upstreams");
+  fillTable("upstreams", upstreams.map(u => [
+    cell(u.index, "num"),
+    cell(u.name ? u.name + " (" + u.address + ")" : u.address),
+    cell(u.rtt_ms.toFixed(1) + " ms", "num"),
+    cell(percent(u.timeout_rate), "num"),
+    cell(percent(u.drop_rate), "num"),
+    cell(u.mismatched, "num"),
+  ]));
+}
+
+async function refreshRules() {
+  const rules = await getJSON("../rules");
+  fillTable("rules", rules.map((r, i) => [cell(i + 1, "num"), cell(r.name), cell(r.rule), cell(r.hits, "num")]));
+}
+
+async function refresh() {
+  const status = document.getElementById("status");
+  try {
+    await Promise.all([refreshStats(), refreshUpstreams(), refreshRules()]);
+    status.textContent = "Updated " + new Date().toLocaleTimeString();
+    status.className = "";
+  } catch (e) {
+    status.textContent = e.message;
+    status.className = "error";
+  }
+}
+
+function streamRecent() {
+  const tbody = document.querySelector("#recent tbody");
+  const events = new EventSource("../events");
+  events.addEventListener("answer", e => {
+    const a = JSON.parse(e.data);
+    const tr = document.createElement("tr");
+    tr.append(
+      cell(new Date().toLocaleTimeString()),
+      cell(a.name || ""),
+      cell(a.type || ""),
+      cell(a.server),
+      cell(a.verdict, "verdict-" + a.verdict),
+      cell(a.rule || ""),
+      cell((a.records || []).join(", ")),
+    );
+    tbody.prepend(tr);
+    while (tbody.rows.length > recentKept) {
+      tbody.deleteRow(-1);
+    }
+  });
+}
+
+refresh();
+setInterval(refresh, refreshEvery);
+streamRecent();
@@ -0,0 +1,422 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+)
+
+// maxNSEC3Iterations above which NSEC3 denials are deemed insecure, as RFC 9276 advises
+const maxNSEC3Iterations = 150
+
+var errInsecureDenial = errors.New("insecure denial")
+
+type nsec struct {
+	zone, owner, next string
+	bitmap            []byte
+}
+
+type nsec3 struct {
+	zone       string
+	hash, next []byte
+	salt       []byte
+	iterations uint16
+	optOut     bool
+	bitmap     []byte
+}
+
+// parseNSEC3 decodes the NSEC3 record of owner, telling if its hash algorithm is supported
+func parseNSEC3(owner string, d []byte) (nsec3, bool, error) {
+	var r nsec3
+	if len(d) < 5 { // hash algorithm, flags, iterations, salt, next hashed owner, bitmap
+		return r, false, errDNSSECFormat
+	}
+	saltEnd := 5 + int(d[4])
+	if len(d) < saltEnd+1 || len(d) < saltEnd+1+int(d[saltEnd]) {
+		return r, false, errDNSSECFormat
+	}
+	if d[0] != 1 { // SHA-1
+		return r, false, nil
+	}
+	nextEnd := saltEnd + 1 + int(d[saltEnd])
+	labels := strings.SplitN(owner, ".", 2)
+	hash, err := base32.HexEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(labels[0]))
+	if err != nil || len(labels) < 2 {
+		return r, false, errDNSSECFormat
+	}
+	r = nsec3{zone: labels[1], hash: hash, next: d[saltEnd+1 : nextEnd], salt: d[5:saltEnd],
+		iterations: binary.BigEndian.Uint16(d[2:]), optOut: d[1]&1 != 0, bitmap: d[nextEnd:]}
+	if r.zone == "" {
+		r.zone = "."
+	}
+	return r, true, nil
+}
+
+// denialsOf decodes the NSEC and NSEC3 records of validated sets, skipping NSEC3
+// ones hashed for another zone than their signer
+func denialsOf(sets []*rrset) ([]nsec, []nsec3, error) {
+	var nsecs []nsec
+	var nsec3s []nsec3
+	for _, set := range sets {
+		if set.typ != typeNSEC && set.typ != typeNSEC3 || len(set.sigs) == 0 {
+			continue
+		}
+		zone := set.sigs[0].signer
+		for _, rr := range set.rrs {
+			body, ok := rr.Body.(*dnsmessage.UnknownResource)
+			if !ok {
+				return nil, nil, errDNSSECFormat
+			}
+			if set.typ == typeNSEC {
+				next, bitmap, err := readName(body.Data)
+				if err != nil {
+					return nil, nil, err
+				}
+				nsecs = append(nsecs, nsec{zone: zone, owner: set.name, next: next, bitmap: bitmap})
+				continue
+			}
+			r, ok, err := parseNSEC3(set.name, body.Data)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok || r.iterations > maxNSEC3Iterations {
+				return nil, nil, errInsecureDenial
+			}
+			if r.zone == zone {
+				nsec3s = append(nsec3s, r)
+			}
+		}
+	}
+	return nsecs, nsec3s, nil
+}
+
+// proveDenial checks that the validated NSEC and NSEC3 records of m prove its
+// denials, after RFC 4035 section 5.4 and RFC 5155 section 8: that the name asked
+// (at the end of CNAMEs) exists neither as such nor through a wildcard for NXDOMAIN,
+// that neither has the type asked for NODATA, and that answers expanded from a
+// wildcard were not asked for a name that exists. It tells if the denials are
+// secure, or returns an error if bogus.
+func proveDenial(m *dnsmessage.Message, answers, authorities []*rrset) (bool, error) {
+	q := m.Questions[0]
+	name, qtype := strings.ToLower(q.Name.String()), q.Type
+	nsecs, nsec3s, err := denialsOf(authorities)
+	if err == errInsecureDenial {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	secure := true
+	check := func(err error) error {
+		if err == errInsecureDenial {
+			secure = false
+			return nil
+		}
+		return err
+	}
+
+	for _, set := range answers {
+		if ce, ok := wildcardSource(set); ok {
+			if err := check(denyExpanded(set.name, ce, nsecs, nsec3s)); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	for i := 0; qtype != dnsmessage.TypeCNAME && i < len(answers); i++ {
+		cname := findSet(answers, name, dnsmessage.TypeCNAME)
+		if cname == nil {
+			break
+		}
+		body, ok := cname.rrs[0].Body.(*dnsmessage.CNAMEResource)
+		if !ok {
+			return false, errDNSSECFormat
+		}
+		name = strings.ToLower(body.CNAME.String())
+	}
+	switch {
+	case m.RCode == dnsmessage.RCodeNameError:
+		err = denyName(name, nsecs, nsec3s)
+	case findSet(answers, name, qtype) == nil && (qtype != dnsmessage.TypeALL || !hasSetAt(answers, name)):
+		err = denyType(name, qtype, nsecs, nsec3s)
+	}
+	if err := check(err); err != nil {
+		return false, err
+	}
+	return secure, nil
+}
+
+func findSet(sets []*rrset, name string, t dnsmessage.Type) *rrset {
+	for _, set := range sets {
+		if set.name == name && set.typ == t {
+			return set
+		}
+	}
+	return nil
+}
+
+func hasSetAt(sets []*rrset, name string) bool {
+	for _, set := range sets {
+		if set.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardSource returns the closest encloser of set if it was expanded from a wildcard
+func wildcardSource(set *rrset) (string, bool) {
+	labels := labelsOf(set.name)
+	if len(labels) > 0 && labels[0] == "*" { // asked as such
+		labels = labels[1:]
+	}
+	for _, sig := range set.sigs {
+		if int(sig.labels) < len(labels) {
+			return joinLabels(labels[len(labels)-int(sig.labels):]), true
+		}
+	}
+	return "", false
+}
+
+// denyExpanded checks that name, answered from the wildcard of ce, doesn't exist
+func denyExpanded(name, ce string, nsecs []nsec, nsec3s []nsec3) error {
+	for _, n := range nsecs {
+		if n.covers(name) && n.closestEncloser(name) == ce {
+			return nil
+		}
+	}
+	if len(nsec3s) > 0 {
+		if r := coveringNSEC3(nsec3s, nextCloser(name, ce)); r != nil {
+			if r.optOut {
+				return errInsecureDenial
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no proof that %s doesn't exist for its wildcard answer", name)
+}
+
+// denyName checks that name doesn't exist, nor a wildcard at its closest encloser
+func denyName(name string, nsecs []nsec, nsec3s []nsec3) error {
+	if len(nsec3s) > 0 && len(nsecs) == 0 {
+		ce, covering, err := closestEncloser(name, nsec3s)
+		if err != nil {
+			return err
+		}
+		if ce == name {
+			return fmt.Errorf("NXDOMAIN for %s though it exists", name)
+		}
+		if coveringNSEC3(nsec3s, wildcardOf(ce)) == nil {
+			return fmt.Errorf("no proof of missing wildcard for %s", name)
+		}
+		if covering.optOut { // an unsigned delegation may be there
+			return errInsecureDenial
+		}
+		return nil
+	}
+
+	for _, n := range nsecs {
+		if !n.covers(name) {
+			continue
+		}
+		ce := n.closestEncloser(name)
+		if ce == name {
+			return fmt.Errorf("NXDOMAIN for %s though it exists", name)
+		}
+		for _, w := range nsecs {
+			if w.covers(wildcardOf(ce)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no proof of missing wildcard for %s", name)
+	}
+	return fmt.Errorf("no proof that %s doesn't exist", name)
+}
+
+// denyType checks that name exists without the type t, or that a wildcard standing for it does
+func denyType(name string, t dnsmessage.Type, nsecs []nsec, nsec3s []nsec3) error {
+	if len(nsec3s) > 0 && len(nsecs) == 0 {
+		if r := matchingNSEC3(nsec3s, name); r != nil {
+			return lacksType(name, t, r.bitmap)
+		}
+		ce, covering, err := closestEncloser(name, nsec3s)
+		if err != nil {
+			return err
+		}
+		if covering == nil {
+			return fmt.Errorf("no proof of missing %s for %s", typeName(t), name)
+		}
+		if t == typeDS && covering.optOut { // an unsigned delegation
+			return errInsecureDenial
+		}
+		if r := matchingNSEC3(nsec3s, wildcardOf(ce)); r != nil {
+			return lacksType(wildcardOf(ce), t, r.bitmap)
+		}
+		return fmt.Errorf("no proof of missing %s for %s", typeName(t), name)
+	}
+
+	for _, n := range nsecs {
+		if n.owner == name && isSubdomain(name, n.zone) {
+			return lacksType(name, t, n.bitmap)
+		}
+	}
+	for _, n := range nsecs {
+		if !n.covers(name) {
+			continue
+		}
+		if n.next != name && isSubdomain(n.next, name) { // an empty non-terminal
+			return nil
+		}
+		wildcard := wildcardOf(n.closestEncloser(name))
+		for _, w := range nsecs {
+			if w.owner == wildcard && isSubdomain(wildcard, w.zone) {
+				return lacksType(wildcard, t, w.bitmap)
+			}
+		}
+	}
+	return fmt.Errorf("no proof of missing %s for %s", typeName(t), name)
+}
+
+// lacksType checks the type bitmap of name lists neither t nor CNAME. A delegation
+// only proves a missing DS, as its other records are the child's, where an apex
+// proves anything but a DS.
+func lacksType(name string, t dnsmessage.Type, bitmap []byte) error {
+	switch {
+	case hasType(bitmap, t) || hasType(bitmap, dnsmessage.TypeCNAME):
+		return fmt.Errorf("%s denied for %s though listed", typeName(t), name)
+	case t != typeDS && hasType(bitmap, dnsmessage.TypeNS) && !hasType(bitmap, dnsmessage.TypeSOA):
+		return fmt.Errorf("%s denied for %s by its parent", typeName(t), name)
+	case t == typeDS && hasType(bitmap, dnsmessage.TypeSOA):
+		return fmt.Errorf("DS denied for %s by the child zone", name)
+	}
+	return nil
+}
+
+// covers tells if name falls strictly between the owner and next name of n, in its
+// zone and not below a delegation or DNAME of owner
+func (n nsec) covers(name string) bool {
+	if !isSubdomain(name, n.zone) {
+		return false
+	}
+	if name != n.owner && isSubdomain(name, n.owner) &&
+		(hasType(n.bitmap, dnsmessage.TypeNS) && !hasType(n.bitmap, dnsmessage.TypeSOA) || hasType(n.bitmap, typeDNAME)) {
+		return false
+	}
+	if canonicalCompare(n.owner, n.next) < 0 {
+		return canonicalCompare(n.owner, name) < 0 && canonicalCompare(name, n.next) < 0
+	}
+	return canonicalCompare(n.owner, name) < 0 // the last NSEC, next is the apex
+}
+
+// closestEncloser returns the longest ancestor of name, covered by n, that exists
+func (n nsec) closestEncloser(name string) string {
+	ce := commonAncestor(name, n.owner)
+	if next := commonAncestor(name, n.next); len(next) > len(ce) {
+		ce = next
+	}
+	return ce
+}
+
+// closestEncloser finds the closest encloser proof of name, RFC 5155 section 8.3: the
+// NSEC3 matching its longest existing ancestor, and the one covering the next closer
+// name, returned as well. The closest encloser is name itself if it exists.
+func closestEncloser(name string, nsec3s []nsec3) (string, *nsec3, error) {
+	closer := ""
+	for ce := name; ; ce = parentOf(ce) {
+		if r := matchingNSEC3(nsec3s, ce); r != nil {
+			if hasType(r.bitmap, typeDNAME) || ce != r.zone && hasType(r.bitmap, dnsmessage.TypeNS) && !hasType(r.bitmap, dnsmessage.TypeSOA) {
+				return "", nil, fmt.Errorf("closest encloser of %s is a delegation", name)
+			}
+			if closer == "" {
+				return ce, nil, nil
+			}
+			if covering := coveringNSEC3(nsec3s, closer); covering != nil {
+				return ce, covering, nil
+			}
+			return "", nil, fmt.Errorf("no proof of missing %s", closer)
+		}
+		if ce == "." {
+			break
+		}
+		closer = ce
+	}
+	return "", nil, fmt.Errorf("no closest encloser proof for %s", name)
+}
+
+// matchingNSEC3 returns the NSEC3 record of name, if any
+func matchingNSEC3(nsec3s []nsec3, name string) *nsec3 {
+	for i, r := range nsec3s {
+		if isSubdomain(name, r.zone) && bytes.Equal(r.hash, nsec3Hash(name, r.salt, r.iterations)) {
+			return &nsec3s[i]
+		}
+	}
+	return nil
+}
+
+// coveringNSEC3 returns the NSEC3 record whose span name falls in, if any
+func coveringNSEC3(nsec3s []nsec3, name string) *nsec3 {
+	for i, r := range nsec3s {
+		if isSubdomain(name, r.zone) && covers(r.hash, r.next, nsec3Hash(name, r.salt, r.iterations)) {
+			return &nsec3s[i]
+		}
+	}
+	return nil
+}
+
+// nextCloser returns the ancestor of name one label longer than its ancestor ce
+func nextCloser(name, ce string) string {
+	labels := labelsOf(name)
+	return joinLabels(labels[len(labels)-len(labelsOf(ce))-1:])
+}
+
+func wildcardOf(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+func parentOf(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 && i+1 < len(name) {
+		return name[i+1:]
+	}
+	return "."
+}
+
+func labelsOf(name string) []string {
+	if name = strings.TrimSuffix(name, "."); name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// commonAncestor returns the longest name both a and b are within
+func commonAncestor(a, b string) string {
+	la, lb := labelsOf(a), labelsOf(b)
+	i := 0
+	for i < len(la) && i < len(lb) && la[len(la)-1-i] == lb[len(lb)-1-i] {
+		i++
+	}
+	return joinLabels(la[len(la)-i:])
+}
+
+func joinLabels(labels []string) string {
+	if len(labels) == 0 {
+		return "."
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// canonicalCompare orders lower-case names as RFC 4034 section 6.1 does, by labels from the right
+func canonicalCompare(a, b string) int {
+	la, lb := labelsOf(a), labelsOf(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
@@ -0,0 +1,102 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"encoding/base32"
+	"golang.org/x/net/dns/dnsmessage"
+	"sort"
+	"testing"
+)
+
+func bitmapOf(types ...dnsmessage.Type) []byte {
+	bits := make([]byte, 32)
+	for _, t := range types {
+		bits[t/8] |= 0x80 >> (t % 8)
+	}
+	n := len(bits)
+	for n > 0 && bits[n-1] == 0 {
+		n--
+	}
+	return append([]byte{0, byte(n)}, bits[:n]...)
+}
+
+func signedSet(name string, t dnsmessage.Type, labels uint8, data []byte) *rrset {
+	return &rrset{name: name, typ: t, sigs: []*rrsig{{signer: "example.", labels: labels}},
+		rrs: []dnsmessage.Resource{{Body: &dnsmessage.UnknownResource{Type: t, Data: data}}}}
+}
+
+func nsecSet(owner, next string, types ...dnsmessage.Type) *rrset {
+	return signedSet(owner, typeNSEC, uint8(len(labelsOf(owner))), append(nameWire(next), bitmapOf(types...)...))
+}
+
+// nsec3Chain hashes names of example. into a chain of NSEC3 sets
+func nsec3Chain(iterations uint16, optOut bool, names map[string][]dnsmessage.Type) []*rrset {
+	var hashes [][]byte
+	types := map[string][]dnsmessage.Type{}
+	for name, t := range names {
+		h := nsec3Hash(name, []byte{0xab}, iterations)
+		hashes = append(hashes, h)
+		types[string(h)] = t
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i], hashes[j]) < 0 })
+	var flags byte
+	if optOut {
+		flags = 1
+	}
+	var sets []*rrset
+	for i, h := range hashes {
+		next := hashes[(i+1)%len(hashes)]
+		data := append([]byte{1, flags, byte(iterations >> 8), byte(iterations), 1, 0xab, byte(len(next))}, next...)
+		owner := base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(h) + ".example."
+		sets = append(sets, signedSet(owner, typeNSEC3, 2, append(data, bitmapOf(types[string(h)]...)...)))
+	}
+	return sets
+}
+
+func TestProveDenial(t *testing.T) {
+	apex := nsecSet("example.", "a.example.", dnsmessage.TypeSOA, dnsmessage.TypeNS)
+	a := nsecSet("a.example.", "c.example.", dnsmessage.TypeA)
+	c := nsecSet("c.example.", "example.", dnsmessage.TypeA)
+	ent := nsecSet("a.example.", "x.b.example.", dnsmessage.TypeA)
+	wildA := signedSet("x.example.", dnsmessage.TypeA, 1, []byte{192, 0, 2, 1})
+	existing := map[string][]dnsmessage.Type{"example.": {dnsmessage.TypeSOA, dnsmessage.TypeNS}, "a.example.": {dnsmessage.TypeA}}
+
+	for _, c := range []struct {
+		what                 string
+		name                 string
+		qtype                dnsmessage.Type
+		rcode                dnsmessage.RCode
+		answers, authorities []*rrset
+		secure, bogus        bool
+	}{
+		{"NSEC name error", "b.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, []*rrset{a, apex}, true, false},
+		{"NSEC name error without wildcard proof", "b.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, []*rrset{a}, false, true},
+		{"NSEC name error for an existing name", "a.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, []*rrset{a, apex}, false, true},
+		{"NSEC name error for an empty non-terminal", "b.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, []*rrset{ent, apex}, false, true},
+		{"NSEC no data", "a.example.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil, []*rrset{a}, true, false},
+		{"NSEC no data for a listed type", "a.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, []*rrset{a}, false, true},
+		{"NSEC no data of an empty non-terminal", "b.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, []*rrset{ent}, true, false},
+		{"NSEC no data of a delegation", "a.example.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil,
+			[]*rrset{nsecSet("a.example.", "c.example.", dnsmessage.TypeNS)}, false, true},
+		{"NSEC wildcard answer", "x.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []*rrset{wildA}, []*rrset{c}, true, false},
+		{"NSEC wildcard answer without proof", "x.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []*rrset{wildA}, nil, false, true},
+		{"NSEC3 name error", "b.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, nsec3Chain(1, false, existing), true, false},
+		{"NSEC3 name error for an existing name", "a.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, nsec3Chain(1, false, existing), false, true},
+		{"NSEC3 name error with opt-out", "b.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, nsec3Chain(1, true, existing), false, false},
+		{"NSEC3 name error with many iterations", "b.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, nsec3Chain(200, false, existing), false, false},
+		{"NSEC3 no data", "a.example.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil, nsec3Chain(1, false, existing), true, false},
+		{"NSEC3 no data for a listed type", "a.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, nsec3Chain(1, false, existing), false, true},
+		{"NSEC3 wildcard answer", "x.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []*rrset{wildA}, nsec3Chain(1, false, existing), true, false},
+		{"NSEC3 wildcard answer for an existing name", "a.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess,
+			[]*rrset{signedSet("a.example.", dnsmessage.TypeA, 1, []byte{192, 0, 2, 1})}, nsec3Chain(1, false, existing), false, true},
+		{"positive answer", "a.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess,
+			[]*rrset{signedSet("a.example.", dnsmessage.TypeA, 2, []byte{192, 0, 2, 1})}, nil, true, false},
+	} {
+		m := dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: c.rcode},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(c.name), Type: c.qtype, Class: dnsmessage.ClassINET}}}
+		secure, err := proveDenial(&m, c.answers, c.authorities)
+		if secure != c.secure || (err != nil) != c.bogus {
+			t.Errorf("%s: got secure %v, error %v, want secure %v, bogus %v", c.what, secure, err, c.secure, c.bogus)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package dnsfilter
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+)
+
+// parseDNS64 checks the prefix of -dns64, of a length allowed by RFC 6052
+func (s *Server) parseDNS64() error {
+	_, prefix, err := net.ParseCIDR(s.opts.DNS64)
+	if err != nil || prefix.IP.To4() != nil {
+		return fmt.Errorf("Invalid DNS64 prefix: %s", s.opts.DNS64)
+	}
+	switch ones, _ := prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return fmt.Errorf("DNS64 prefix length must be 32, 40, 48, 56, 64 or 96: %s", s.opts.DNS64)
+	}
+	if prefix.IP[8] != 0 {
+		return fmt.Errorf("DNS64 prefix must have bits 64 to 71 zero: %s", s.opts.DNS64)
+	}
+	s.dns64Prefix = prefix
+	return nil
+}
+
+// embedIPv4 makes the IPv6 address of ip under prefix, skipping the octet of bits 64
+// to 71 (RFC 6052 section 2.2)
+func embedIPv4(prefix *net.IPNet, ip net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, prefix.IP)
+	pos := ones / 8
+	for _, b := range ip.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip6[pos] = b
+		pos++
+	}
+	return ip6
+}
+
+// synthesizeAAAA answers an AAAA query accepted without AAAA records, mapped IPv4
+// addresses aside, by AAAA records made of the A records of the name under the -dns64
+// prefix (RFC 6147 section 5.1). The A answer is asked to the same upstream and goes
+// through rules too. msg is returned as is if there are none, for queries with the CD
+// bit, or on failure.
+func (s *Server) synthesizeAAAA(ctx context.Context, serverIndex int, msg []byte) []byte {
+	if s.dns64Prefix == nil {
+		return msg
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return msg
+	}
+	if len(m.Questions) != 1 || m.Questions[0].Type != dnsmessage.TypeAAAA || m.Questions[0].Class != dnsmessage.ClassINET ||
+		m.RCode != dnsmessage.RCodeSuccess || m.CheckingDisabled {
+		return msg
+	}
+	for _, ans := range m.Answers {
+		if aaaa, ok := ans.Body.(*dnsmessage.AAAAResource); ok && net.IP(aaaa.AAAA[:]).To4() == nil {
+			return msg
+		}
+	}
+	ttl := ^uint32(0) // capped by the negative caching TTL of the SOA, if any
+	for _, auth := range m.Authorities {
+		if soa, ok := auth.Body.(*dnsmessage.SOAResource); ok {
+			ttl = soa.MinTTL
+			if auth.Header.TTL < ttl {
+				ttl = auth.Header.TTL
+			}
+		}
+	}
+
+	a, err := s.lookup(ctx, m.Questions[0].Name.String(), dnsmessage.TypeA, []*upstream{s.servers[serverIndex-1]}, false)
+	if err != nil {
+		s.logErr.Println("DNS64 lookup failed:", err)
+		return msg
+	}
+	a.Header = m.Header
+	packed, err := a.Pack()
+	if err != nil {
+		return msg
+	}
+	judged, delay, _, _ := s.determine(ctx, serverIndex, packed)
+	if delay < 0 || a.Unpack(judged) != nil {
+		return msg
+	}
+
+	var answers []dnsmessage.Resource
+	synthesized := false
+	for _, ans := range a.Answers {
+		switch body := ans.Body.(type) {
+		case *dnsmessage.CNAMEResource:
+			answers = append(answers, ans)
+		case *dnsmessage.AResource:
+			ans.Header.Type = dnsmessage.TypeAAAA
+			if ans.Header.TTL > ttl {
+				ans.Header.TTL = ttl
+			}
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], embedIPv4(s.dns64Prefix, body.A[:]))
+			answers = append(answers, dnsmessage.Resource{Header: ans.Header, Body: &aaaa})
+			synthesized = true
+		}
+	}
+	if !synthesized {
+		return msg
+	}
+	m.Answers, m.Authorities = answers, nil
+	out, err := m.Pack()
+	if err != nil {
+		s.logErr.Println(err)
+		return msg
+	}
+	putBuf(msg)
+	return out
+}
@@ -0,0 +1,998 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// types and flags not in dnsmessage, see RFC 4034 and RFC 5155
+const (
+	typeDNAME  dnsmessage.Type = 39
+	typeDS     dnsmessage.Type = 43
+	typeRRSIG  dnsmessage.Type = 46
+	typeNSEC   dnsmessage.Type = 47
+	typeDNSKEY dnsmessage.Type = 48
+	typeNSEC3  dnsmessage.Type = 50
+
+	dnskeyZone   = 0x100
+	dnskeyRevoke = 0x80
+	dnskeySEP    = 1
+
+	algRSASHA256 = 8
+	algRSASHA512 = 10
+	algECDSAP256 = 13
+	algECDSAP384 = 14
+	algED25519   = 15
+
+	flagAD = 0x20 // in the 4th byte of header
+	flagCD = 0x10
+
+	maxChain     = 16
+	maxKeysTTL   = time.Hour
+	holdDownTime = 30 * 24 * time.Hour // RFC 5011 add hold-down
+)
+
+type rrsig struct {
+	covered   dnsmessage.Type
+	alg       uint8
+	labels    uint8
+	origTTL   uint32
+	expire    uint32
+	inception uint32
+	keyTag    uint16
+	signer    string
+	signature []byte
+	rdata     []byte // RDATA without signature, in canonical form
+}
+
+type dnskey struct {
+	flags uint16
+	alg   uint8
+	tag   uint16
+	key   []byte
+	rdata []byte
+}
+
+type ds struct {
+	keyTag     uint16
+	alg        uint8
+	digestType uint8
+	digest     []byte
+}
+
+type rrset struct {
+	name string // lower case
+	typ  dnsmessage.Type
+	rrs  []dnsmessage.Resource
+	sigs []*rrsig
+}
+
+const (
+	anchorValid = iota
+	anchorPending
+	anchorRevoked
+)
+
+type trustAnchor struct {
+	ds
+	state int
+	since time.Time // first seen while pending
+}
+
+type zoneKeys struct {
+	keys   []dnskey // nil if the zone is provably unsigned
+	expire time.Time
+}
+
+var (
+
+	// root KSK-2017 and KSK-2024, see https://data.iana.org/root-anchors/root-anchors.xml
+	builtinAnchors = []*trustAnchor{
+		{ds: ds{20326, algRSASHA256, 2, mustHex("E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D")}},
+		{ds: ds{38696, algRSASHA256, 2, mustHex("683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16")}},
+	}
+
+	errDNSSECFormat = errors.New("Malformed DNSSEC record")
+	errUnsupported  = errors.New("Unsupported DNSSEC algorithm")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// validated sets AD on secure answers, clears it on insecure ones and tells false for bogus ones
+func (s *Server) validated(serverIndex int, msg []byte) bool {
+	if len(msg) < 4 || msg[3]&flagCD != 0 { // client asked not to check
+		return true
+	}
+
+	secure, err := s.validate(msg)
+	if err != nil {
+		if s.verbose() {
+			s.logStd.Printf("%d %s DNSSEC bogus: %s, dropped", binary.BigEndian.Uint16(msg), s.servers[serverIndex-1], err)
+		}
+		return false
+	}
+	if secure {
+		msg[3] |= flagAD
+	} else {
+		msg[3] &^= flagAD
+	}
+	return true
+}
+
+// withoutDNSSEC strips the RRSIG, NSEC and NSEC3 records upstreams send for
+// validation from answers to clients without DO, but answers of the type asked,
+// and clears DO in the OPT record (RFC 4035 section 3.2.1)
+func withoutDNSSEC(msg []byte) ([]byte, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return nil, err
+	}
+	var qtype dnsmessage.Type
+	if len(m.Questions) > 0 {
+		qtype = m.Questions[0].Type
+	}
+
+	stripped := false
+	strip := func(rrs []dnsmessage.Resource, asked dnsmessage.Type) []dnsmessage.Resource {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header.Type; {
+			case t == dnsmessage.TypeOPT && rr.Header.DNSSECAllowed():
+				rr.Header.TTL &^= 1 << 15
+				stripped = true
+			case (t == typeRRSIG || t == typeNSEC || t == typeNSEC3) && t != asked:
+				stripped = true
+				continue
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	m.Answers = strip(m.Answers, qtype)
+	m.Authorities = strip(m.Authorities, 0)
+	m.Additionals = strip(m.Additionals, 0)
+	if !stripped {
+		return msg, nil
+	}
+	return m.Pack()
+}
+
+// validate checks signatures of the answer and of the SOA / NSEC / NSEC3 records of
+// negative answers, then that NSEC or NSEC3 records prove the denials. It tells if
+// the answer is secure, or returns an error if bogus.
+func (s *Server) validate(msg []byte) (bool, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return false, err
+	}
+	if m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError || len(m.Questions) != 1 {
+		return false, nil
+	}
+
+	answers, err := rrsetsOf(m.Answers)
+	if err != nil {
+		return false, err
+	}
+	authorities, err := rrsetsOf(m.Authorities)
+	if err != nil {
+		return false, err
+	}
+	sets := append([]*rrset(nil), answers...)
+	for _, set := range authorities {
+		if set.typ == dnsmessage.TypeSOA || set.typ == typeNSEC || set.typ == typeNSEC3 {
+			sets = append(sets, set)
+		}
+	}
+
+	if len(sets) == 0 {
+		qname := strings.ToLower(m.Questions[0].Name.String())
+		insecure, err := s.provenInsecure(qname)
+		if err == nil && !insecure {
+			err = fmt.Errorf("missing signatures for %s", qname)
+		}
+		return false, err
+	}
+
+	secure := true
+	for _, set := range sets {
+		ok, err := s.validateRRset(set)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+	}
+	if !secure {
+		return false, nil
+	}
+	return proveDenial(&m, answers, authorities)
+}
+
+func (s *Server) validateRRset(set *rrset) (bool, error) {
+	if len(set.sigs) == 0 {
+		insecure, err := s.provenInsecure(set.name)
+		if err == nil && !insecure {
+			err = fmt.Errorf("missing signatures for %s %s", set.name, typeName(set.typ))
+		}
+		return false, err
+	}
+
+	signer := set.sigs[0].signer
+	if !isSubdomain(set.name, signer) {
+		return false, fmt.Errorf("%s signed by %s", set.name, signer)
+	}
+	keys, err := s.keysOf(signer, 0)
+	if err != nil || keys == nil {
+		return false, err
+	}
+	if err := verifyRRset(set, keys); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// keysOf returns the validated DNSKEYs of zone, following DS records up to the
+// root trust anchors. It returns nil if the zone is provably unsigned.
+func (s *Server) keysOf(zone string, depth int) ([]dnskey, error) {
+	if depth > maxChain {
+		return nil, errors.New("DNSSEC chain too long")
+	}
+	s.dnssecLock.Lock()
+	entry, ok := s.zoneCache[zone]
+	s.dnssecLock.Unlock()
+	if ok && time.Now().Before(entry.expire) {
+		return entry.keys, nil
+	}
+
+	ttl := maxKeysTTL
+	var dss []ds
+	if zone == "." {
+		dss = s.rootAnchors()
+	} else {
+		resp, err := s.dnssecQuery(zone, typeDS)
+		if err != nil {
+			return nil, err
+		}
+		set, err := findRRset(resp.Answers, zone, typeDS)
+		if err != nil {
+			return nil, err
+		}
+		if set == nil {
+			insecure, err := s.noDSProof(zone, resp, depth)
+			if err != nil {
+				return nil, err
+			}
+			if !insecure {
+				return nil, fmt.Errorf("%s is not a zone", zone)
+			}
+			s.cacheZone(zone, nil, ttl)
+			return nil, nil
+		}
+
+		if len(set.sigs) == 0 {
+			return nil, fmt.Errorf("unsigned DS for %s", zone)
+		}
+		parent := set.sigs[0].signer
+		if parent == zone || !isSubdomain(zone, parent) {
+			return nil, fmt.Errorf("DS of %s signed by %s", zone, parent)
+		}
+		parentKeys, err := s.keysOf(parent, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if parentKeys == nil {
+			s.cacheZone(zone, nil, ttl)
+			return nil, nil
+		}
+		if err := verifyRRset(set, parentKeys); err != nil {
+			return nil, err
+		}
+
+		for _, rr := range set.rrs {
+			body, ok := rr.Body.(*dnsmessage.UnknownResource)
+			if !ok || len(body.Data) < 4 {
+				return nil, errDNSSECFormat
+			}
+			d := ds{binary.BigEndian.Uint16(body.Data), body.Data[2], body.Data[3], body.Data[4:]}
+			if supportedAlg(d.alg) && (d.digestType == 1 || d.digestType == 2 || d.digestType == 4) {
+				dss = append(dss, d)
+			}
+		}
+		if len(dss) == 0 { // treated as unsigned, RFC 4035 section 5.2
+			s.cacheZone(zone, nil, ttl)
+			return nil, nil
+		}
+		ttl = minTTL(set, ttl)
+	}
+
+	resp, err := s.dnssecQuery(zone, typeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	set, err := findRRset(resp.Answers, zone, typeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, fmt.Errorf("no DNSKEY for %s", zone)
+	}
+
+	var keys, sep []dnskey
+	for _, rr := range set.rrs {
+		key, err := parseDNSKEY(rr)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		if key.flags&dnskeyRevoke != 0 {
+			continue
+		}
+		for _, d := range dss {
+			if key.tag == d.keyTag && key.alg == d.alg && bytes.Equal(key.digest(zone, d.digestType), d.digest) {
+				sep = append(sep, key)
+				break
+			}
+		}
+	}
+	if err := verifyRRset(set, sep); err != nil {
+		return nil, err
+	}
+
+	if zone == "." {
+		s.updateAnchors(keys, set)
+	}
+	s.cacheZone(zone, keys, minTTL(set, ttl))
+	return keys, nil
+}
+
+// provenInsecure walks down from the root looking for an unsigned delegation above name
+func (s *Server) provenInsecure(name string) (bool, error) {
+	if name == "." {
+		return false, nil
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := strings.Join(labels[i:], ".") + "."
+
+		s.dnssecLock.Lock()
+		entry, ok := s.zoneCache[zone]
+		s.dnssecLock.Unlock()
+		if ok && time.Now().Before(entry.expire) {
+			if entry.keys == nil {
+				return true, nil
+			}
+			continue
+		}
+
+		resp, err := s.dnssecQuery(zone, typeDS)
+		if err != nil {
+			return false, err
+		}
+		if set, err := findRRset(resp.Answers, zone, typeDS); err != nil {
+			return false, err
+		} else if set != nil { // a signed zone, unless it uses unsupported algorithms
+			keys, err := s.keysOf(zone, 0)
+			if err != nil || keys == nil {
+				return keys == nil && err == nil, err
+			}
+			continue
+		}
+
+		insecure, err := s.noDSProof(zone, resp, 0)
+		if err != nil {
+			return false, err
+		}
+		if insecure {
+			s.cacheZone(zone, nil, maxKeysTTL)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// noDSProof checks the signed denial of DS at name, telling if name is an
+// unsigned delegation or not a zone cut at all
+func (s *Server) noDSProof(name string, resp *dnsmessage.Message, depth int) (bool, error) {
+	if resp.RCode == dnsmessage.RCodeNameError { // answers below it would be bogus anyway
+		return false, nil
+	}
+
+	sets, err := rrsetsOf(resp.Authorities)
+	if err != nil {
+		return false, err
+	}
+	for _, set := range sets {
+		if set.typ != typeNSEC && set.typ != typeNSEC3 || len(set.sigs) == 0 {
+			continue
+		}
+		keys, err := s.keysOf(set.sigs[0].signer, depth+1)
+		if err != nil {
+			return false, err
+		}
+		if keys == nil { // the parent is unsigned as well
+			return true, nil
+		}
+		if err := verifyRRset(set, keys); err != nil {
+			return false, err
+		}
+
+		for _, rr := range set.rrs {
+			body, ok := rr.Body.(*dnsmessage.UnknownResource)
+			if !ok {
+				return false, errDNSSECFormat
+			}
+			if set.typ == typeNSEC {
+				if set.name != name {
+					continue
+				}
+				_, bitmap, err := readName(body.Data)
+				if err != nil {
+					return false, err
+				}
+				return nsecCut(bitmap)
+			}
+
+			r, ok, err := parseNSEC3(set.name, body.Data)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				continue
+			}
+
+			h := nsec3Hash(name, r.salt, r.iterations)
+			if bytes.Equal(h, r.hash) {
+				return nsecCut(r.bitmap)
+			}
+			if r.optOut && covers(r.hash, r.next, h) { // opt-out, delegations in the span may be unsigned
+				return true, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("no proof of missing DS for %s", name)
+}
+
+func nsecCut(bitmap []byte) (bool, error) {
+	if hasType(bitmap, typeDS) {
+		return false, errors.New("DS denied though listed in NSEC")
+	}
+	return hasType(bitmap, dnsmessage.TypeNS) && !hasType(bitmap, dnsmessage.TypeSOA), nil
+}
+
+func hasType(bitmap []byte, t dnsmessage.Type) bool {
+	for len(bitmap) >= 2 {
+		window, n := bitmap[0], int(bitmap[1])
+		if len(bitmap) < 2+n {
+			return false
+		}
+		if window == byte(t>>8) {
+			i := int(t & 0xff)
+			return i/8 < n && bitmap[2+i/8]&(0x80>>uint(i%8)) != 0
+		}
+		bitmap = bitmap[2+n:]
+	}
+	return false
+}
+
+func nsec3Hash(name string, salt []byte, iterations uint16) []byte {
+	h := sha1.Sum(append(nameWire(name), salt...))
+	for i := 0; i < int(iterations); i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return h[:]
+}
+
+// covers tells if h falls between owner and next of an NSEC3 record, the last one wrapping around
+func covers(owner, next, h []byte) bool {
+	if bytes.Compare(owner, next) < 0 {
+		return bytes.Compare(owner, h) < 0 && bytes.Compare(h, next) < 0
+	}
+	return bytes.Compare(owner, h) < 0 || bytes.Compare(h, next) < 0
+}
+
+// verifyRRset succeeds if any current signature of set is made by one of keys
+func verifyRRset(set *rrset, keys []dnskey) error {
+	now := uint32(time.Now().Unix())
+	for _, sig := range set.sigs {
+		if int32(now-sig.inception) < 0 || int32(sig.expire-now) < 0 || !isSubdomain(set.name, sig.signer) {
+			continue
+		}
+		data, err := signedData(set, sig)
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			key := &keys[i]
+			if key.alg == sig.alg && key.tag == sig.keyTag && key.flags&dnskeyZone != 0 && verifySig(key, data, sig.signature) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no valid signature for %s %s", set.name, typeName(set.typ))
+}
+
+// signedData builds what RRSIG signs, RFC 4034 section 3.1.8.1
+func signedData(set *rrset, sig *rrsig) ([]byte, error) {
+	owner := set.name
+	if labels := strings.Split(strings.TrimSuffix(owner, "."), "."); owner != "." && int(sig.labels) < len(labels) {
+		owner = strings.Join(append([]string{"*"}, labels[len(labels)-int(sig.labels):]...), ".") + "." // wildcard expansion
+	}
+	ownerWire := nameWire(owner)
+
+	var rdatas [][]byte
+	for _, rr := range set.rrs {
+		rdata, err := canonicalRData(rr)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	data := append([]byte(nil), sig.rdata...)
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		data = append(data, ownerWire...)
+		var hdr [10]byte
+		binary.BigEndian.PutUint16(hdr[0:], uint16(set.typ))
+		binary.BigEndian.PutUint16(hdr[2:], uint16(set.rrs[0].Header.Class))
+		binary.BigEndian.PutUint32(hdr[4:], sig.origTTL)
+		binary.BigEndian.PutUint16(hdr[8:], uint16(len(rdata)))
+		data = append(append(data, hdr[:]...), rdata...)
+	}
+	return data, nil
+}
+
+// canonicalRData packs RDATA uncompressed with names in lower case, RFC 4034 section 6.2
+func canonicalRData(rr dnsmessage.Resource) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.StartAnswers()
+
+	h := rr.Header
+	var err error
+	switch body := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		err = b.AResource(h, *body)
+	case *dnsmessage.AAAAResource:
+		err = b.AAAAResource(h, *body)
+	case *dnsmessage.TXTResource:
+		err = b.TXTResource(h, *body)
+	case *dnsmessage.CNAMEResource:
+		err = b.CNAMEResource(h, dnsmessage.CNAMEResource{CNAME: lowerName(body.CNAME)})
+	case *dnsmessage.NSResource:
+		err = b.NSResource(h, dnsmessage.NSResource{NS: lowerName(body.NS)})
+	case *dnsmessage.PTRResource:
+		err = b.PTRResource(h, dnsmessage.PTRResource{PTR: lowerName(body.PTR)})
+	case *dnsmessage.MXResource:
+		err = b.MXResource(h, dnsmessage.MXResource{Pref: body.Pref, MX: lowerName(body.MX)})
+	case *dnsmessage.SRVResource:
+		srv := *body
+		srv.Target = lowerName(srv.Target)
+		err = b.SRVResource(h, srv)
+	case *dnsmessage.SOAResource:
+		soa := *body
+		soa.NS, soa.MBox = lowerName(soa.NS), lowerName(soa.MBox)
+		err = b.SOAResource(h, soa)
+	case *dnsmessage.UnknownResource: // types unknown to dnsmessage have no compression
+		err = b.UnknownResource(h, *body)
+	default:
+		return nil, fmt.Errorf("Can't canonicalize %s record", typeName(h.Type))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	return msg[12+len(nameWire(h.Name.String()))+10:], nil // skip header, owner, type, class, TTL and length
+}
+
+func verifySig(key *dnskey, data, sig []byte) error {
+	switch key.alg {
+	case algRSASHA256, algRSASHA512:
+		pub, err := rsaKey(key.key)
+		if err != nil {
+			return err
+		}
+		h := crypto.SHA256
+		if key.alg == algRSASHA512 {
+			h = crypto.SHA512
+		}
+		return rsa.VerifyPKCS1v15(pub, h, hashOf(h, data), sig)
+
+	case algECDSAP256, algECDSAP384:
+		curve, h := elliptic.P256(), crypto.SHA256
+		if key.alg == algECDSAP384 {
+			curve, h = elliptic.P384(), crypto.SHA384
+		}
+		size := curve.Params().BitSize / 8
+		if len(key.key) != 2*size || len(sig) != 2*size {
+			return errDNSSECFormat
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(key.key[:size]), Y: new(big.Int).SetBytes(key.key[size:])}
+		if !ecdsa.Verify(pub, hashOf(h, data), new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+			return errors.New("ECDSA verification failed")
+		}
+		return nil
+
+	case algED25519:
+		if len(key.key) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(key.key), data, sig) {
+			return errors.New("Ed25519 verification failed")
+		}
+		return nil
+	}
+	return errUnsupported
+}
+
+func supportedAlg(alg uint8) bool {
+	return alg == algRSASHA256 || alg == algRSASHA512 || alg == algECDSAP256 || alg == algECDSAP384 || alg == algED25519
+}
+
+func hashOf(h crypto.Hash, data []byte) []byte {
+	hash := h.New()
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+// rsaKey parses the RFC 3110 public key format
+func rsaKey(b []byte) (*rsa.PublicKey, error) {
+	if len(b) < 3 {
+		return nil, errDNSSECFormat
+	}
+	elen := int(b[0])
+	b = b[1:]
+	if elen == 0 {
+		elen = int(b[0])<<8 | int(b[1])
+		b = b[2:]
+	}
+	if elen > 4 || len(b) <= elen {
+		return nil, errDNSSECFormat
+	}
+	e := 0
+	for _, c := range b[:elen] {
+		e = e<<8 | int(c)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(b[elen:]), E: e}, nil
+}
+
+// digest of the key as in its DS record
+func (k *dnskey) digest(owner string, digestType uint8) []byte {
+	data := append(nameWire(owner), k.rdata...)
+	switch digestType {
+	case 1:
+		sum := sha1.Sum(data)
+		return sum[:]
+	case 2:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	case 4:
+		sum := sha512.Sum384(data)
+		return sum[:]
+	}
+	return nil
+}
+
+func parseDNSKEY(rr dnsmessage.Resource) (dnskey, error) {
+	body, ok := rr.Body.(*dnsmessage.UnknownResource)
+	if !ok || len(body.Data) < 4 {
+		return dnskey{}, errDNSSECFormat
+	}
+	d := body.Data
+	return dnskey{flags: binary.BigEndian.Uint16(d), alg: d[3], tag: keyTag(d), key: d[4:], rdata: d}, nil
+}
+
+// keyTag computes the tag of DNSKEY RDATA, RFC 4034 appendix B
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+func parseRRSIG(rr dnsmessage.Resource) (*rrsig, error) {
+	body, ok := rr.Body.(*dnsmessage.UnknownResource)
+	if !ok || len(body.Data) < 19 {
+		return nil, errDNSSECFormat
+	}
+	d := body.Data
+	signer, signature, err := readName(d[18:])
+	if err != nil {
+		return nil, err
+	}
+	return &rrsig{
+		covered:   dnsmessage.Type(binary.BigEndian.Uint16(d)),
+		alg:       d[2],
+		labels:    d[3],
+		origTTL:   binary.BigEndian.Uint32(d[4:]),
+		expire:    binary.BigEndian.Uint32(d[8:]),
+		inception: binary.BigEndian.Uint32(d[12:]),
+		keyTag:    binary.BigEndian.Uint16(d[16:]),
+		signer:    signer,
+		signature: signature,
+		rdata:     append(append([]byte(nil), d[:18]...), nameWire(signer)...),
+	}, nil
+}
+
+// rrsetsOf groups records by owner and type, attaching their signatures
+func rrsetsOf(rrs []dnsmessage.Resource) ([]*rrset, error) {
+	var sets []*rrset
+	find := func(name string, t dnsmessage.Type) *rrset {
+		for _, set := range sets {
+			if set.name == name && set.typ == t {
+				return set
+			}
+		}
+		return nil
+	}
+
+	for _, rr := range rrs {
+		if rr.Header.Type == typeRRSIG || rr.Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		name := strings.ToLower(rr.Header.Name.String())
+		set := find(name, rr.Header.Type)
+		if set == nil {
+			set = &rrset{name: name, typ: rr.Header.Type}
+			sets = append(sets, set)
+		}
+		set.rrs = append(set.rrs, rr)
+	}
+
+	for _, rr := range rrs {
+		if rr.Header.Type != typeRRSIG {
+			continue
+		}
+		sig, err := parseRRSIG(rr)
+		if err != nil {
+			return nil, err
+		}
+		if set := find(strings.ToLower(rr.Header.Name.String()), sig.covered); set != nil {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+	return sets, nil
+}
+
+func findRRset(rrs []dnsmessage.Resource, name string, t dnsmessage.Type) (*rrset, error) {
+	sets, err := rrsetsOf(rrs)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		if set.name == name && set.typ == t {
+			return set, nil
+		}
+	}
+	return nil, nil
+}
+
+func minTTL(set *rrset, ttl time.Duration) time.Duration {
+	for _, rr := range set.rrs {
+		if t := time.Duration(rr.Header.TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	return ttl
+}
+
+func (s *Server) cacheZone(zone string, keys []dnskey, ttl time.Duration) {
+	s.dnssecLock.Lock()
+	s.zoneCache[zone] = zoneKeys{keys, time.Now().Add(ttl)}
+	s.dnssecLock.Unlock()
+}
+
+// askDNSSEC asks upstreams for records needed to validate, with DO and CD set
+func (s *Server) askDNSSEC(name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	return s.lookup(context.Background(), name, qtype, s.pickUpstreams(s.activeUpstreams(s.servers), s.opts.Strategy), true)
+}
+
+func (s *Server) rootAnchors() []ds {
+	s.dnssecLock.Lock()
+	defer s.dnssecLock.Unlock()
+
+	var dss []ds
+	for _, a := range s.anchors {
+		if a.state == anchorValid {
+			dss = append(dss, a.ds)
+		}
+	}
+	return dss
+}
+
+// updateAnchors follows RFC 5011 rollover with a validated root DNSKEY set: new
+// SEP keys are trusted after the hold-down time, self-revoked ones no longer
+func (s *Server) updateAnchors(keys []dnskey, set *rrset) {
+	s.dnssecLock.Lock()
+	defer s.dnssecLock.Unlock()
+
+	changed := false
+	seen := make(map[*trustAnchor]bool)
+	for i := range keys {
+		key := keys[i]
+		if key.flags&dnskeySEP == 0 {
+			continue
+		}
+
+		unrevoked := key // the DS of a key doesn't carry its REVOKE bit
+		unrevoked.rdata = append([]byte(nil), key.rdata...)
+		unrevoked.rdata[1] &^= dnskeyRevoke
+		unrevoked.tag = keyTag(unrevoked.rdata)
+		digest := unrevoked.digest(".", 2)
+
+		var anchor *trustAnchor
+		for _, a := range s.anchors {
+			if a.digestType == 2 && bytes.Equal(a.digest, digest) {
+				anchor = a
+			}
+		}
+
+		switch {
+		case key.flags&dnskeyRevoke != 0:
+			if anchor != nil && anchor.state != anchorRevoked && verifyRRset(set, keys[i:i+1]) == nil {
+				s.logStd.Printf("Root key %d revoked", unrevoked.tag)
+				anchor.state = anchorRevoked
+				changed = true
+			}
+		case anchor == nil:
+			s.logStd.Printf("New root key %d, trusted after hold-down", unrevoked.tag)
+			anchor = &trustAnchor{ds: ds{unrevoked.tag, key.alg, 2, digest}, state: anchorPending, since: time.Now()}
+			s.anchors = append(s.anchors, anchor)
+			changed = true
+		case anchor.state == anchorPending && time.Since(anchor.since) >= holdDownTime:
+			s.logStd.Printf("Root key %d trusted", unrevoked.tag)
+			anchor.state = anchorValid
+			changed = true
+		}
+		if anchor != nil {
+			seen[anchor] = true
+		}
+	}
+
+	kept := s.anchors[:0]
+	for _, a := range s.anchors {
+		if a.state == anchorPending && !seen[a] { // gone before hold-down ended
+			changed = true
+			continue
+		}
+		kept = append(kept, a)
+	}
+	s.anchors = kept
+
+	if changed {
+		if err := s.saveAnchors(); err != nil {
+			s.logErr.Println(err)
+		}
+	}
+}
+
+func (s *Server) anchorsFile() string {
+	return filepath.Join(s.opts.CacheDir, "root-s.anchors")
+}
+
+// loadAnchors reads trust anchor state kept by saveAnchors, the built-in ones are used without it
+func (s *Server) loadAnchors() error {
+	f, err := os.Open(s.anchorsFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var loaded []*trustAnchor
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() { // key tag, algorithm, digest type, digest, state, since
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 {
+			continue
+		}
+		tag, err1 := strconv.ParseUint(fields[0], 10, 16)
+		alg, err2 := strconv.ParseUint(fields[1], 10, 8)
+		digestType, err3 := strconv.ParseUint(fields[2], 10, 8)
+		digest, err4 := hex.DecodeString(fields[3])
+		state, err5 := strconv.Atoi(fields[4])
+		since, err6 := strconv.ParseInt(fields[5], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil || err6 != nil {
+			return fmt.Errorf("Invalid trust anchor in %s: %s", s.anchorsFile(), scanner.Text())
+		}
+		loaded = append(loaded, &trustAnchor{ds{uint16(tag), uint8(alg), uint8(digestType), digest}, state, time.Unix(since, 0)})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.dnssecLock.Lock()
+	s.anchors = loaded
+	s.dnssecLock.Unlock()
+	return nil
+}
+
+func (s *Server) saveAnchors() error {
+	var buf bytes.Buffer
+	for _, a := range s.anchors {
+		fmt.Fprintf(&buf, "%d %d %d %X %d %d\n", a.keyTag, a.alg, a.digestType, a.digest, a.state, a.since.Unix())
+	}
+	if err := os.MkdirAll(s.opts.CacheDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.anchorsFile(), buf.Bytes(), 0644)
+}
+
+// nameWire encodes name in lower case uncompressed wire format
+func nameWire(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.Trim(strings.ToLower(name), "."), ".") {
+		if label != "" {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+// readName decodes an uncompressed name in lower case, returning what follows it
+func readName(b []byte) (string, []byte, error) {
+	var labels []string
+	for {
+		if len(b) == 0 {
+			return "", nil, errDNSSECFormat
+		}
+		l := int(b[0])
+		if l == 0 {
+			break
+		}
+		if l > 63 || len(b) < 1+l {
+			return "", nil, errDNSSECFormat
+		}
+		labels = append(labels, string(b[1:1+l]))
+		b = b[1+l:]
+	}
+	return strings.ToLower(strings.Join(labels, ".")) + ".", b[1:], nil
+}
+
+func lowerName(n dnsmessage.Name) dnsmessage.Name {
+	copy(n.Data[:], bytes.ToLower(n.Data[:n.Length]))
+	return n
+}
+
+// isSubdomain tells if name equals zone or is below it, both lower case with trailing dot
+func isSubdomain(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
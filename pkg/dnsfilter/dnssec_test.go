@@ -0,0 +1,157 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// zoneKey is the single key of a test zone, signing its records
+type zoneKey struct {
+	zone   string
+	priv   ed25519.PrivateKey
+	dnskey dnsmessage.Resource
+	tag    uint16
+}
+
+func newZoneKey(zone string, seed byte) *zoneKey {
+	priv := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	rdata := append([]byte{1, 1, 3, algED25519}, priv.Public().(ed25519.PublicKey)...) // zone key and SEP
+	return &zoneKey{zone, priv, unknownRecord(zone, typeDNSKEY, rdata), keyTag(rdata)}
+}
+
+func unknownRecord(name string, t dnsmessage.Type, data []byte) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: t, Class: dnsmessage.ClassINET, TTL: 3600},
+		Body: &dnsmessage.UnknownResource{Type: t, Data: data}}
+}
+
+// ds is the DS record of the key, SHA-256
+func (k *zoneKey) ds() dnsmessage.Resource {
+	key, _ := parseDNSKEY(k.dnskey)
+	return unknownRecord(k.zone, typeDS, append([]byte{byte(k.tag >> 8), byte(k.tag), algED25519, 2}, key.digest(k.zone, 2)...))
+}
+
+// sign returns the records of a set followed by their RRSIG, valid from inception until expire
+func (k *zoneKey) sign(t *testing.T, rrs []dnsmessage.Resource, inception, expire time.Time) []dnsmessage.Resource {
+	set := &rrset{name: strings.ToLower(rrs[0].Header.Name.String()), typ: rrs[0].Header.Type, rrs: rrs}
+	head := make([]byte, 18)
+	binary.BigEndian.PutUint16(head, uint16(set.typ))
+	head[2], head[3] = algED25519, byte(len(labelsOf(set.name)))
+	binary.BigEndian.PutUint32(head[4:], rrs[0].Header.TTL)
+	binary.BigEndian.PutUint32(head[8:], uint32(expire.Unix()))
+	binary.BigEndian.PutUint32(head[12:], uint32(inception.Unix()))
+	binary.BigEndian.PutUint16(head[16:], k.tag)
+	sig := &rrsig{labels: head[3], origTTL: rrs[0].Header.TTL, rdata: append(head, nameWire(k.zone)...)}
+	data, err := signedData(set, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]dnsmessage.Resource(nil), rrs...), unknownRecord(set.name, typeRRSIG, append(sig.rdata, ed25519.Sign(k.priv, data)...)))
+}
+
+// zonesServer makes a Server answering dnssecQuery from answers, "name TYPE" to the
+// message answering it, trusting root as the root key
+func zonesServer(root *zoneKey, answers map[string]*dnsmessage.Message) *Server {
+	s := quietServer()
+	key, _ := parseDNSKEY(root.dnskey)
+	s.anchors = []*trustAnchor{{ds: ds{root.tag, algED25519, 2, key.digest(".", 2)}}}
+	s.dnssecQuery = func(name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+		if m, ok := answers[name+" "+typeName(qtype)]; ok {
+			return m, nil
+		}
+		return nil, fmt.Errorf("no answer for %s %s", name, typeName(qtype))
+	}
+	return s
+}
+
+// an answer of example. signed along the chain of trust from the root key, or not
+func TestValidate(t *testing.T) {
+	root, example := newZoneKey(".", 1), newZoneKey("example.", 2)
+	otherRoot, otherExample := newZoneKey(".", 3), newZoneKey("example.", 4)
+	now := time.Now()
+	valid := func(k *zoneKey, rrs ...dnsmessage.Resource) []dnsmessage.Resource {
+		return k.sign(t, rrs, now.Add(-time.Hour), now.Add(time.Hour))
+	}
+	www := dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}
+	badSig := valid(example, www)
+	badSig[1].Body.(*dnsmessage.UnknownResource).Data[30] ^= 0xff
+	dsProof := valid(root, unknownRecord("example.", typeNSEC, append(nameWire("next."), bitmapOf(dnsmessage.TypeNS)...)))
+	noCut := valid(example, unknownRecord("www.example.", typeNSEC, append(nameWire("x.example."), bitmapOf(dnsmessage.TypeA)...)))
+
+	for _, test := range []struct {
+		what          string
+		answers       []dnsmessage.Resource
+		ds            []dnsmessage.Resource // answering DS example., with authorities
+		dsAuthorities []dnsmessage.Resource
+		secure, bogus bool
+	}{
+		{"good chain", valid(example, www), valid(root, example.ds()), nil, true, false},
+		{"bad signature", badSig, valid(root, example.ds()), nil, false, true},
+		{"expired RRSIG", example.sign(t, []dnsmessage.Resource{www}, now.Add(-2*time.Hour), now.Add(-time.Hour)), valid(root, example.ds()), nil, false, true},
+		{"RRSIG not yet valid", example.sign(t, []dnsmessage.Resource{www}, now.Add(time.Hour), now.Add(2*time.Hour)), valid(root, example.ds()), nil, false, true},
+		{"missing DS", valid(example, www), nil, nil, false, true},
+		{"DS of another key", valid(example, www), valid(root, otherExample.ds()), nil, false, true},
+		{"DS signed by another root key", valid(example, www), valid(otherRoot, example.ds()), nil, false, true},
+		{"missing DS proven by NSEC", valid(example, www), nil, dsProof, false, false},
+		{"unsigned answer of a signed zone", []dnsmessage.Resource{www}, valid(root, example.ds()), nil, false, true},
+	} {
+		s := zonesServer(root, map[string]*dnsmessage.Message{
+			". DNSKEY":        {Answers: valid(root, root.dnskey)},
+			"example. DS":     {Answers: test.ds, Authorities: test.dsAuthorities},
+			"example. DNSKEY": {Answers: valid(example, example.dnskey)},
+			"www.example. DS": {Authorities: noCut},
+		})
+		m := dnsmessage.Message{Header: dnsmessage.Header{Response: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("www.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+			Answers:   test.answers}
+		msg, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		secure, err := s.validate(msg)
+		if secure != test.secure || (err != nil) != test.bogus {
+			t.Errorf("%s: got secure %v, error %v, want secure %v, bogus %v", test.what, secure, err, test.secure, test.bogus)
+		}
+	}
+}
+
+// clients without DO get no RRSIG, NSEC or NSEC3 records they didn't ask for
+func TestWithoutDNSSEC(t *testing.T) {
+	example := newZoneKey("example.", 2)
+	now := time.Now()
+	www := dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, true)
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, typeRRSIG} {
+		m := dnsmessage.Message{Header: dnsmessage.Header{Response: true},
+			Questions:   []dnsmessage.Question{{Name: dnsmessage.MustNewName("www.example."), Type: qtype, Class: dnsmessage.ClassINET}},
+			Answers:     example.sign(t, []dnsmessage.Resource{www}, now, now.Add(time.Hour)),
+			Authorities: []dnsmessage.Resource{unknownRecord("www.example.", typeNSEC, append(nameWire("x.example."), bitmapOf(dnsmessage.TypeA)...))},
+			Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}}
+		msg, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg, err = withoutDNSSEC(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Unpack(msg); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[dnsmessage.Type]int{dnsmessage.TypeA: 1, typeRRSIG: 2}[qtype]; len(m.Answers) != want {
+			t.Errorf("%s: %d answers, want %d", typeName(qtype), len(m.Answers), want)
+		}
+		if len(m.Authorities) != 0 || len(m.Additionals) != 1 || m.Additionals[0].Header.DNSSECAllowed() {
+			t.Errorf("%s: %d authorities, %d additionals with DO %v, want none, the OPT record without DO", typeName(qtype),
+				len(m.Authorities), len(m.Additionals), len(m.Additionals) > 0 && m.Additionals[0].Header.DNSSECAllowed())
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const minUDPSize = 512 // RFC 1035 limit for clients without EDNS0
+
+// withOPT makes the query advertise -edns payload size to upstreams, adding an
+// OPT record if the client didn't send one. It returns the new query, the size
+// the client can receive, 0 if it doesn't speak EDNS0, and if it set DO.
+func (s *Server) withOPT(payload []byte) ([]byte, int, bool, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(payload); err != nil {
+		return nil, 0, false, err
+	}
+
+	clientSize, clientDO := 0, false
+	for i := range msg.Additionals {
+		if h := &msg.Additionals[i].Header; h.Type == dnsmessage.TypeOPT {
+			clientSize, clientDO = int(h.Class), h.DNSSECAllowed()
+			if clientSize < minUDPSize {
+				clientSize = minUDPSize
+			}
+			h.Class = dnsmessage.Class(s.opts.EDNS)
+			if s.opts.DNSSEC { // answers need signatures to be validated
+				h.TTL |= 1 << 15
+			}
+		}
+	}
+
+	if clientSize == 0 {
+		var h dnsmessage.ResourceHeader
+		if err := h.SetEDNS0(s.opts.EDNS, dnsmessage.RCodeSuccess, s.opts.DNSSEC); err != nil {
+			return nil, 0, false, err
+		}
+		msg.Additionals = append(msg.Additionals, dnsmessage.Resource{Header: h, Body: &dnsmessage.OPTResource{}})
+	}
+
+	out, err := msg.Pack()
+	return out, clientSize, clientDO, err
+}
+
+// fitClient strips upstream OPT records for clients without EDNS0 and, over UDP,
+// truncates msg if it doesn't fit in what the client can receive
+func fitClient(msg []byte, clientSize int, tcp bool) ([]byte, error) {
+	if clientSize == 0 {
+		var m dnsmessage.Message
+		if err := m.Unpack(msg); err != nil {
+			return nil, err
+		}
+		additionals := m.Additionals[:0]
+		for _, rr := range m.Additionals {
+			if rr.Header.Type != dnsmessage.TypeOPT {
+				additionals = append(additionals, rr)
+			}
+		}
+		if len(additionals) != len(m.Additionals) {
+			m.Additionals = additionals
+			var err error
+			if msg, err = m.Pack(); err != nil {
+				return nil, err
+			}
+		}
+		clientSize = minUDPSize
+	}
+
+	if !tcp && len(msg) > clientSize {
+		return truncated(msg)
+	}
+	return msg, nil
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package dnsfilter
+
+import (
+	"errors"
+	"io"
+)
+
+func openEventLog() (io.Writer, io.Writer, error) {
+	return nil, nil, errors.New("The Event Log is only on Windows")
+}
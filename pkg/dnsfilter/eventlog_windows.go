@@ -0,0 +1,39 @@
+package dnsfilter
+
+import (
+	"golang.org/x/sys/windows/svc/eventlog"
+	"io"
+	"strings"
+)
+
+const eventSource = "dnsfilter"
+
+// openEventLog returns writers to the Windows Event Log, of information and error
+// events. The event source is registered if it isn't, which needs administrator rights.
+func openEventLog() (io.Writer, io.Writer, error) {
+	elog, err := eventlog.Open(eventSource)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := elog.Info(1, "dnsfilter logging to the Event Log"); err != nil {
+		elog.Close()
+		if err := eventlog.InstallAsEventCreate(eventSource, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			return nil, nil, err
+		}
+		if elog, err = eventlog.Open(eventSource); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &eventWriter{elog.Info}, &eventWriter{elog.Error}, nil
+}
+
+type eventWriter struct {
+	report func(eid uint32, msg string) error
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	if err := w.report(1, strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,140 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// eventsWanted tells if anyone listens to /events
+func (s *Server) eventsWanted() bool {
+	return atomic.LoadInt32(&s.streamCount) > 0
+}
+
+// publishEvent sends v as a server-sent event of kind to every listener, those too slow
+// to read missing it
+func (s *Server) publishEvent(kind string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		s.logErr.Println(err)
+		return
+	}
+	event := []byte("event: " + kind + "\ndata: " + string(data) + "\n\n")
+
+	s.streamsLock.Lock()
+	for stream := range s.streams {
+		select {
+		case stream <- event:
+		default:
+		}
+	}
+	s.streamsLock.Unlock()
+}
+
+// adminEvents streams query, answer and reply events as server-sent events
+func (s *Server) adminEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stream := make(chan []byte, 256)
+	s.streamsLock.Lock()
+	s.streams[stream] = true
+	atomic.AddInt32(&s.streamCount, 1)
+	s.streamsLock.Unlock()
+	defer func() {
+		s.streamsLock.Lock()
+		delete(s.streams, stream)
+		atomic.AddInt32(&s.streamCount, -1)
+		s.streamsLock.Unlock()
+	}()
+
+	for {
+		select {
+		case event := <-stream:
+			if _, err := w.Write(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+type queryEvent struct {
+	ID     uint16 `json:"id"`
+	Client string `json:"client"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+}
+
+type answerEvent struct {
+	ID      uint16   `json:"id"`
+	Server  string   `json:"server"`
+	Name    string   `json:"name,omitempty"`
+	Type    string   `json:"type,omitempty"`
+	RCode   string   `json:"rcode,omitempty"`
+	Records []string `json:"records,omitempty"`
+	Rule    string   `json:"rule,omitempty"`
+	Verdict string   `json:"verdict"`
+	Delay   string   `json:"delay,omitempty"`
+}
+
+type replyEvent struct {
+	ID      uint16   `json:"id"`
+	Client  string   `json:"client"`
+	RCode   string   `json:"rcode"`
+	Records []string `json:"records,omitempty"`
+}
+
+// publishQuery sends a query event for every question
+func (s *Server) publishQuery(id uint16, client *net.UDPAddr, qs []dnsmessage.Question) {
+	for _, q := range qs {
+		s.publishEvent("query", queryEvent{id, client.String(), q.Name.String(), typeName(q.Type)})
+	}
+}
+
+// publishAnswer sends the verdict on an answer and what decided on it, see decisionOf
+func (s *Server) publishAnswer(id uint16, serverIndex int, qs []dnsmessage.Question, msgOut []byte, delay time.Duration, ruleName, verdict string) {
+	event := answerEvent{ID: id, Server: s.servers[serverIndex-1].String(), Rule: ruleName, Verdict: verdict}
+	if len(qs) > 0 {
+		event.Name, event.Type = qs[0].Name.String(), typeName(qs[0].Type)
+	}
+	if delay >= 0 {
+		event.RCode, event.Records = messageRecords(msgOut)
+		event.Delay = delay.String()
+	}
+	s.publishEvent("answer", event)
+}
+
+// publishReply sends what a client is answered
+func (s *Server) publishReply(client *net.UDPAddr, msg []byte) {
+	if len(msg) < 12 {
+		return
+	}
+	rcode, records := messageRecords(msg)
+	s.publishEvent("reply", replyEvent{uint16(msg[0])<<8 | uint16(msg[1]), client.String(), rcode, records})
+}
+
+// messageRecords tells the rcode and answer records of msg
+func messageRecords(msg []byte) (string, []string) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return "", nil
+	}
+	records := make([]string, len(m.Answers))
+	for i, ans := range m.Answers {
+		records[i] = ans.Header.Name.String() + " " + typeName(ans.Header.Type) + " " + recordData(ans)
+	}
+	return rcodeName(m.Header.RCode), records
+}
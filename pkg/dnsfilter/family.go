@@ -0,0 +1,121 @@
+package dnsfilter
+
+import (
+	"encoding/binary"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const maxFailures = 3 // timeouts in a row before an upstream given by hostname is probed again
+
+// familyOf returns v4 or v6, as -prefer-family names them
+func familyOf(ip net.IP) string {
+	if ip.To4() != nil {
+		return "v4"
+	}
+	return "v6"
+}
+
+// pickAddr returns the address u is reached at among those of its hostname: the
+// first of its preferred family, or -prefer-family, answering a probe, else the first
+// of the other family doing so, the first of all if none does. alt is the first of
+// the other family, raced with -stagger, nil if none.
+func (u *upstream) pickAddr(addrs []*net.UDPAddr) (addr, alt *net.UDPAddr) {
+	preferred := u.family
+	if preferred == "" {
+		preferred = u.srv.opts.PreferFamily
+	}
+	addrs = append([]*net.UDPAddr(nil), addrs...)
+	if preferred != "" {
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return familyOf(addrs[i].IP) == preferred && familyOf(addrs[j].IP) != preferred
+		})
+	}
+	if len(addrs) == 1 {
+		return addrs[0], nil
+	}
+
+	addr = addrs[0]
+	probed := make(map[string]bool) // one address per family
+	for _, a := range addrs {
+		if family := familyOf(a.IP); !probed[family] {
+			probed[family] = true
+			if u.srv.probe(a) {
+				addr = a
+				break
+			}
+			u.srv.logErr.Printf("Nameserver %s unreachable at %s", u.host, a)
+		}
+	}
+	if u.srv.opts.Stagger > 0 {
+		for _, a := range addrs {
+			if familyOf(a.IP) != familyOf(addr.IP) {
+				return addr, a
+			}
+		}
+	}
+	return addr, nil
+}
+
+// moveToAddrs sets u to the addresses picked among addrs, telling if it moved
+func (u *upstream) moveToAddrs(addrs []*net.UDPAddr) bool {
+	addr, alt := u.pickAddr(addrs)
+	u.alt.Store(alt)
+	return u.moveTo(addr)
+}
+
+// probe tells if a nameserver answers a query for the root NS at addr within -t,
+// from a socket of its own as upstream ones may not be open yet
+func (s *Server) probe(addr *net.UDPAddr) bool {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil { // e.g. no route for the family
+		return false
+	}
+	defer conn.Close()
+
+	id := randomID()
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}
+	m := dnsmessage.Message{Header: dnsmessage.Header{ID: id, RecursionDesired: true}, Questions: []dnsmessage.Question{q}}
+	packed, err := m.Pack()
+	if err != nil {
+		return false
+	}
+	conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	if _, err := conn.Write(packed); err != nil {
+		return false
+	}
+	buf := getBuf()
+	defer putBuf(buf)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return false
+		}
+		if n >= 12 && binary.BigEndian.Uint16(buf) == id && buf[2]&0x80 != 0 {
+			return true
+		}
+	}
+}
+
+// recordFailure counts a timeout of u in a row, probing the addresses of its
+// hostname again once there are maxFailures, for the other family if its own is
+// unreachable
+func (u *upstream) recordFailure() {
+	if u.host == "" || atomic.AddInt32(&u.failures, 1) != maxFailures {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&u.failures, 0)
+		addrs, err := u.srv.resolveUpstream(u.host)
+		if err != nil {
+			u.srv.logErr.Printf("Failed to resolve nameserver %s: %s. Keeping %s", u.host, err, u.addr())
+			return
+		}
+		if u.moveToAddrs(addrs) {
+			u.srv.logStd.Printf("Nameserver %s moved to %s", u.host, u.addr())
+		}
+	}()
+}
@@ -0,0 +1,100 @@
+package dnsfilter
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: time.Minute}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// fetch downloads url into the cache directory, revalidating a previous copy with
+// ETag / If-Modified-Since. It returns the local path and whether content changed.
+// A stale copy is used if the server can't be reached.
+func (s *Server) fetch(url string) (path string, changed bool, err error) {
+	if err := os.MkdirAll(s.opts.CacheDir, 0755); err != nil {
+		return "", false, err
+	}
+	path = s.cachePath(url)
+	metaPath := path + ".meta" // ETag and Last-Modified, one per line
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", false, err
+	}
+	_, statErr := os.Stat(path)
+	if statErr == nil {
+		if meta, err := ioutil.ReadFile(metaPath); err == nil {
+			lines := strings.SplitN(string(meta), "\n", 2)
+			if lines[0] != "" {
+				req.Header.Set("If-None-Match", lines[0])
+			}
+			if len(lines) > 1 && strings.TrimSpace(lines[1]) != "" {
+				req.Header.Set("If-Modified-Since", strings.TrimSpace(lines[1]))
+			}
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if statErr == nil {
+			s.logErr.Printf("Failed to fetch %s: %s. Using cached copy", url, err)
+			return path, false, nil
+		}
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && statErr == nil:
+		return path, false, nil
+	case resp.StatusCode != http.StatusOK:
+		if statErr == nil {
+			s.logErr.Printf("Failed to fetch %s: %s. Using cached copy", url, resp.Status)
+			return path, false, nil
+		}
+		return "", false, fmt.Errorf("Failed to fetch %s: %s", url, resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile(s.opts.CacheDir, "download")
+	if err != nil {
+		return "", false, err
+	}
+	_, err = io.Copy(tmp, resp.Body)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), path) // replace atomically
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", false, err
+	}
+
+	meta := resp.Header.Get("ETag") + "\n" + resp.Header.Get("Last-Modified")
+	ioutil.WriteFile(metaPath, []byte(meta), 0644)
+	return path, true, nil
+}
+
+// cachePath is where fetch keeps the copy of url
+func (s *Server) cachePath(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return filepath.Join(s.opts.CacheDir, hex.EncodeToString(sum[:]))
+}
+
+func defaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "dnsfilter")
+	}
+	return filepath.Join(os.TempDir(), "dnsfilter")
+}
@@ -0,0 +1,86 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/go-ini/ini.v1"
+	"strings"
+)
+
+// forward restricts queries for a domain to some of the upstreams
+type forward struct {
+	name     string
+	servers  []*upstream
+	strategy string // all for parallel, failover for sequential, -strategy if empty
+}
+
+// forwardModes are the strategies of modes of forwards
+var forwardModes = map[string]string{"parallel": "all", "sequential": "failover"}
+
+func (s *Server) loadForwards(cfg *ini.File) ([]*forward, error) {
+	forwardSections := cfg.ChildSections("forward")
+	forwards := make([]*forward, len(forwardSections))
+
+	for i, section := range forwardSections {
+		sectionName := section.Name()
+
+		name := strings.TrimPrefix(strings.Trim(section.Key("name").String(), " ."), "*.")
+		if 0 == len(name) {
+			return nil, fmt.Errorf("%s domain name must exist in a forward!", sectionName)
+		}
+
+		serverStrs := section.Key("server").Strings(",")
+		if len(serverStrs) == 0 {
+			return nil, fmt.Errorf("%s server must exist in a forward!", sectionName)
+		}
+
+		f := forward{name: name}
+		if mode := strings.ToLower(strings.TrimSpace(section.Key("mode").String())); mode != "" {
+			var ok bool
+			if f.strategy, ok = forwardModes[mode]; !ok {
+				return nil, fmt.Errorf("%s mode must be parallel or sequential!", sectionName)
+			}
+		}
+		for _, serverStr := range serverStrs {
+			index, ok := s.lookupServerName(serverStr)
+			if !ok {
+				return nil, fmt.Errorf("%s invalid server %s!", sectionName, serverStr)
+			}
+			f.servers = append(f.servers, s.servers[index-1])
+		}
+
+		if f.strategy == "" {
+			s.logStd.Printf("%s: DOMAIN NAME %s FORWARD %s", sectionName, name, section.Key("server").String())
+		} else {
+			s.logStd.Printf("%s: DOMAIN NAME %s FORWARD %s %s", sectionName, name, strings.ToUpper(section.Key("mode").String()), section.Key("server").String())
+		}
+		forwards[i] = &f
+	}
+	return forwards, nil
+}
+
+// upstreamsFor returns servers of the first forward matching the question and the
+// strategy to ask them by, or those of the view v of the client, or all of them, by
+// -strategy
+func (s *Server) upstreamsFor(qs []dnsmessage.Question, v *view) ([]*upstream, string) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	if len(qs) > 0 {
+		for _, f := range s.forwards {
+			if matchName(qs[0].Name, f.name) {
+				if f.strategy != "" {
+					return f.servers, f.strategy
+				}
+				return f.servers, s.opts.Strategy
+			}
+		}
+	}
+	if v != nil && v.servers != nil {
+		return v.servers, s.opts.Strategy
+	}
+	if s.recursor != nil {
+		return []*upstream{s.recursor}, s.opts.Strategy
+	}
+	return s.servers, s.opts.Strategy
+}
@@ -0,0 +1,218 @@
+package dnsfilter
+
+import (
+	"context"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/go-ini/ini.v1"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// fuzzName is the name of seed messages, foreign for the rules of raceServer
+var fuzzName = dnsmessage.MustNewName("abroad.test.")
+
+func packSeed(f *testing.F, m dnsmessage.Message) []byte {
+	packed, err := m.Pack()
+	if err != nil {
+		f.Fatal(err)
+	}
+	return packed
+}
+
+// seedQueries are queries as clients send them, and the usual malformed ones
+func seedQueries(f *testing.F) [][]byte {
+	q := dnsmessage.Question{Name: fuzzName, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	plain := packSeed(f, dnsmessage.Message{Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{q}})
+
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true)
+	edns := packSeed(f, dnsmessage.Message{Header: dnsmessage.Header{ID: 2, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: fuzzName, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}},
+		Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{
+			Options: []dnsmessage.Option{{Code: 8, Data: []byte{0, 1, 24, 0, 1, 0, 1}}}}}}}) // client subnet
+
+	ptr := packSeed(f, dnsmessage.Message{Header: dnsmessage.Header{ID: 3},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("1.2.0.192.in-addr.arpa."), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}}})
+	notify := packSeed(f, dnsmessage.Message{Header: dnsmessage.Header{ID: 4, OpCode: 4}, Questions: []dnsmessage.Question{q}})
+	two := packSeed(f, dnsmessage.Message{Header: dnsmessage.Header{ID: 5}, Questions: []dnsmessage.Question{q, q}})
+	response := packSeed(f, dnsmessage.Message{Header: dnsmessage.Header{ID: 6, Response: true}, Questions: []dnsmessage.Question{q}})
+	return [][]byte{plain, edns, ptr, notify, two, response, plain[:len(plain)-3], plain[:12], {}}
+}
+
+// seedAnswers are answers as upstreams send them
+func seedAnswers(f *testing.F) [][]byte {
+	hdr := dnsmessage.Header{ID: 1, Response: true, RecursionDesired: true, RecursionAvailable: true}
+	qA := dnsmessage.Question{Name: fuzzName, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	rh := func(name dnsmessage.Name, qtype dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: qtype, Class: dnsmessage.ClassINET, TTL: 300}
+	}
+	alias := dnsmessage.MustNewName("cn.test.")
+
+	a := packSeed(f, dnsmessage.Message{Header: hdr, Questions: []dnsmessage.Question{qA},
+		Answers: []dnsmessage.Resource{{Header: rh(fuzzName, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: [4]byte{1, 0, 1, 1}}}}})
+	cname := packSeed(f, dnsmessage.Message{Header: hdr, Questions: []dnsmessage.Question{qA},
+		Answers: []dnsmessage.Resource{
+			{Header: rh(fuzzName, dnsmessage.TypeCNAME), Body: &dnsmessage.CNAMEResource{CNAME: alias}},
+			{Header: rh(alias, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: [4]byte{8, 8, 8, 8}}}}})
+	aaaa := packSeed(f, dnsmessage.Message{Header: hdr,
+		Questions: []dnsmessage.Question{{Name: fuzzName, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}},
+		Answers: []dnsmessage.Resource{{Header: rh(fuzzName, dnsmessage.TypeAAAA),
+			Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0x24, 0x0e, 15: 1}}}}})
+	txt := packSeed(f, dnsmessage.Message{Header: hdr,
+		Questions: []dnsmessage.Question{{Name: fuzzName, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}},
+		Answers:   []dnsmessage.Resource{{Header: rh(fuzzName, dnsmessage.TypeTXT), Body: &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all"}}}}})
+	nx := hdr
+	nx.RCode = dnsmessage.RCodeNameError
+	nxdomain := packSeed(f, dnsmessage.Message{Header: nx, Questions: []dnsmessage.Question{qA},
+		Authorities: []dnsmessage.Resource{{Header: rh(dnsmessage.MustNewName("test."), dnsmessage.TypeSOA), Body: &dnsmessage.SOAResource{
+			NS: alias, MBox: alias, Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 60}}}})
+	return [][]byte{a, cname, aaaa, txt, nxdomain, a[:len(a)-2], a[:12]}
+}
+
+// stubAnswer answers msg as the domestic upstream of raceServer does names it doesn't
+// know, by an address its rules accept at once whatever the type asked. The foreign
+// one doesn't answer, as the domestic one is trusted.
+func stubAnswer(msg []byte, server *upstream) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil || len(m.Questions) == 0 || server != server.srv.servers[0] {
+		return nil
+	}
+	m.Response, m.RecursionAvailable, m.Truncated = true, true, false
+	m.Answers = []dnsmessage.Resource{{Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET, TTL: 300}, Body: &dnsmessage.AResource{A: [4]byte{1, 0, 1, 2}}}}
+	packed, _ := m.Pack()
+	return packed
+}
+
+// FuzzHandle feeds queries to the Server of raceServer as if read by its listener,
+// upstreams answering in-process by stubAnswer and answers going back to a socket
+// of the test
+func FuzzHandle(f *testing.F) {
+	for _, seed := range seedQueries(f) {
+		f.Add(seed)
+	}
+	raceServer(f)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { conn.Close() })
+	bc, client := raceSrv.newBatchConn(conn), conn.LocalAddr().(*net.UDPAddr)
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		ctx := context.WithValue(context.Background(), clientAddrKey, client)
+		ctx = context.WithValue(ctx, stubKey, upstreamStub(stubAnswer))
+		raceSrv.handle(context.WithValue(ctx, listenerKey, bc), append([]byte(nil), payload...))
+	})
+}
+
+// FuzzDetermine judges answers of either upstream of raceServer by its rules
+func FuzzDetermine(f *testing.F) {
+	for i, seed := range seedAnswers(f) {
+		f.Add(uint8(i), seed)
+	}
+	raceServer(f)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5300}
+
+	f.Fuzz(func(t *testing.T, server uint8, msg []byte) {
+		ctx := context.WithValue(context.Background(), clientAddrKey, client)
+		raceSrv.determine(ctx, int(server)%len(raceSrv.servers)+1, append([]byte(nil), msg...))
+	})
+}
+
+// FuzzIPset loads lists in any format of ipsetParsers, given by its index
+func FuzzIPset(f *testing.F) {
+	formats := make([]string, 0, len(ipsetParsers))
+	for format := range ipsetParsers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	for i, format := range formats {
+		f.Add(uint8(i), "", []byte("# "+format+"\n1.0.1.0/24\n2001:db8::/32\n"))
+	}
+	f.Add(uint8(0), "CN", []byte("apnic|CN|ipv4|1.0.1.0|256|20110414|allocated\napnic|CN|ipv6|2001:250::|35|20000426|allocated\n"))
+	f.Add(uint8(0), "CN", []byte("apnic|CN|ipv4|255.255.255.0|512|20110414|allocated\n")) // past the last address
+	f.Add(uint8(0), "1814991", []byte("network,geoname_id,registered_country_geoname_id\n1.0.1.0/24,1814991,1814991,,0,0\n"))
+	f.Add(uint8(0), "", []byte("1.0.1.0/24, 1.0.2.0/23\n"))
+	file, s := filepath.Join(f.TempDir(), "ipset.txt"), quietServer()
+
+	f.Fuzz(func(t *testing.T, format uint8, filter string, data []byte) {
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		spec := file + "#" + formats[int(format)%len(formats)]
+		if filter != "" {
+			spec += "=" + filter
+		}
+		set, _, err := s.loadIPset(spec, false)
+		if err != nil {
+			return
+		}
+		for _, ip := range []string{"1.0.1.1", "0.0.0.0", "255.255.255.255", "2001:db8::1", "::"} {
+			set.containsIP(net.ParseIP(ip))
+		}
+	})
+}
+
+// FuzzIPList parses comma-separated CIDRs as of -client or allow_clients
+func FuzzIPList(f *testing.F) {
+	for _, seed := range []string{"1.0.1.0/24, 2001:db8::/32", "192.0.2.1", "::ffff:1.2.3.4/120", ",,", "0.0.0.0/0"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, list string) {
+		set, err := parseIPList(list)
+		if err != nil {
+			return
+		}
+		set.containsIP(net.ParseIP("1.0.1.1"))
+		set.containsIP(net.ParseIP("2001:db8::1"))
+	})
+}
+
+// FuzzBlockWith parses the block_with of rules
+func FuzzBlockWith(f *testing.F) {
+	for _, seed := range []string{"nxdomain", "null", "0.0.0.0, ::", "192.0.2.1,2001:db8::1", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, str string) {
+		parseBlockWith(str)
+	})
+}
+
+// FuzzConfig compiles config files in INI, or YAML if yaml is set, as reload does
+func FuzzConfig(f *testing.F) {
+	f.Add(false, []byte(raceRules))
+	f.Add(false, []byte("[allow_clients]\ncidr = 127.0.0.0/8\naction = allow\n\n[forward.lan]\nname = lan\nserver = 192.0.2.53\n\n"+
+		"[zone.lan]\nrouter.lan = 192.0.2.1\n\n[reverse.lan]\nnetworks = 192.0.2.0/24\nname = host-{ip}.lan\n\n"+
+		"[view.kids]\nclients = 192.0.2.0/25\nzones = lan\n\n[rule.block]\nname = ads.test\ntarget = BLOCK\nblock_with = 0.0.0.0\nprofile = night\n"))
+	f.Add(true, []byte("rules:\n  block:\n    name: [ads.test, tracker.test]\n    target: BLOCK\n    block_with: null\nservers:\n  one:\n    address: 192.0.2.53\n"))
+	file, s := filepath.Join(f.TempDir(), "config.yaml"), quietServer()
+
+	f.Fuzz(func(t *testing.T, yaml bool, data []byte) {
+		var cfg *ini.File
+		var err error
+		if yaml {
+			if err := os.WriteFile(file, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err = LoadConfigFile(file)
+		} else {
+			cfg, err = ini.Load(data)
+		}
+		if err != nil {
+			return
+		}
+		rules, _ := s.loadRules(cfg, 1, 1, 1, 1, true)
+		sinkholesOf(rules)
+		s.loadACL(cfg)
+		s.loadForwards(cfg)
+		s.loadReverses(cfg)
+		if zones, err := s.loadZones(cfg); err == nil {
+			s.loadViews(cfg, zones, profilesOf(rules))
+		}
+	})
+}
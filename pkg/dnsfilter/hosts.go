@@ -0,0 +1,162 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const hostsTTL = 60
+
+// hostsZone answers names of hosts(5) files, keys being lower case with a trailing dot
+type hostsZone struct {
+	addrs map[string][]net.IP
+	ptrs  map[string]string // reverse name to the first name of the address
+}
+
+func (s *Server) loadHosts() (*hostsZone, error) {
+	zone := &hostsZone{make(map[string][]net.IP), make(map[string]string)}
+	for _, filename := range s.opts.Hosts {
+		count, err := zone.load(filename)
+		if err != nil {
+			return nil, err
+		}
+		s.logStd.Printf("Loaded %d addresses from hosts file %s", count, filename)
+	}
+	return zone, nil
+}
+
+// load reads lines as "IP name [alias...]", # starting comments, returning the number
+// of addresses
+func (zone *hostsZone) load(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	count := 0
+	for scanner.Scan() { // one line per loop
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if i := strings.IndexByte(fields[0], '%'); i >= 0 { // zone of link-local addresses
+			fields[0] = fields[0][:i]
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+			zone.addrs[name] = append(zone.addrs[name], ip)
+		}
+		if reverse := reverseName(ip); zone.ptrs[reverse] == "" {
+			zone.ptrs[reverse] = strings.ToLower(strings.TrimSuffix(fields[1], ".")) + "."
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip
+func reverseName(ip net.IP) string {
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := 3; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(ip4[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString("in-addr.arpa.")
+		return b.String()
+	}
+
+	const hex = "0123456789abcdef"
+	for i := 15; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+// hostsAnswer builds a response from the hosts files for A, AAAA and PTR queries
+// of names found there, nil for others. Names without records of the type get NODATA.
+func (s *Server) hostsAnswer(hdr dnsmessage.Header, qs []dnsmessage.Question) []byte {
+	if len(qs) != 1 || qs[0].Class != dnsmessage.ClassINET {
+		return nil
+	}
+	q := qs[0]
+	name := strings.ToLower(q.Name.String())
+
+	s.configLock.RLock()
+	zone := s.hosts
+	s.configLock.RUnlock()
+	if zone == nil {
+		return nil
+	}
+
+	hdr.Response, hdr.Authoritative, hdr.RecursionAvailable, hdr.Truncated = true, true, true, false
+	hdr.RCode = dnsmessage.RCodeSuccess
+	b := dnsmessage.NewBuilder(nil, hdr)
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: hostsTTL}
+
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		addrs, ok := zone.addrs[name]
+		if !ok {
+			return nil
+		}
+		for _, ip := range addrs {
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip4)
+				b.AResource(rh, a)
+			} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+				var aaaa dnsmessage.AAAAResource
+				copy(aaaa.AAAA[:], ip)
+				b.AAAAResource(rh, aaaa)
+			}
+		}
+
+	case dnsmessage.TypePTR:
+		ptr, ok := zone.ptrs[name]
+		if !ok {
+			return nil
+		}
+		target, err := dnsmessage.NewName(ptr)
+		if err != nil {
+			return nil
+		}
+		b.PTRResource(rh, dnsmessage.PTRResource{PTR: target})
+
+	default:
+		return nil
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		s.logErr.Println(err)
+		return nil
+	}
+	return msg
+}
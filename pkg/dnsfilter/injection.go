@@ -0,0 +1,56 @@
+package dnsfilter
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minFloorSamples = 20  // answers of an upstream before its RTT floor is trusted
+	floorRise       = 100 // the floor rises by 1/floorRise of the way to slower answers
+)
+
+// learnFloor lowers the RTT floor of u to rtt, or raises it slowly towards it,
+// following route changes without forged answers standing out any less
+func (u *upstream) learnFloor(rtt time.Duration) {
+	for {
+		old := atomic.LoadInt64(&u.floor)
+		floor := int64(rtt)
+		if old != 0 && floor > old {
+			floor = old + (floor-old)/floorRise
+		}
+		if atomic.CompareAndSwapInt64(&u.floor, old, floor) {
+			return
+		}
+	}
+}
+
+// tooFast tells if an answer of u after rtt came in under half its RTT floor, too
+// fast for the upstream to have sent it, as an on-path injection
+func (u *upstream) tooFast(rtt time.Duration) bool {
+	return u.srv.opts.FastAnswers != "" && atomic.LoadUint64(&u.counts[upstreamRTTCount]) >= minFloorSamples &&
+		rtt < time.Duration(atomic.LoadInt64(&u.floor))/2
+}
+
+// fastAnswer flags an answer of u to query id after rtt, telling if it's to drop
+func (s *Server) fastAnswer(ctx context.Context, u *upstream, id uint16, rtt time.Duration) bool {
+	s.startSpan(ctx, "dns.fast_answer").finish()
+	atomic.AddUint64(&s.answersFast, 1)
+	s.logErr.Printf("Answer from %s to query %d after %s, under half its RTT floor of %s, possibly injected",
+		u, id, rtt.Round(time.Microsecond), time.Duration(atomic.LoadInt64(&u.floor)).Round(time.Microsecond))
+	return s.opts.FastAnswers == "drop"
+}
+
+// unsolicited flags an answer from addr to no query in flight, unless from an
+// upstream as late answers are
+func (s *Server) unsolicited(addr *net.UDPAddr) {
+	if _, ok := s.lookupServer(addr); ok {
+		return
+	}
+	atomic.AddUint64(&s.answersUnexpected, 1)
+	if s.opts.FastAnswers != "" {
+		s.logErr.Printf("Answer from %s to no query in flight, possibly injected", addr)
+	}
+}
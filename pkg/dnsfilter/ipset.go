@@ -0,0 +1,311 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ipset is a binary radix trie keyed by prefix bits, one root per address family.
+// Lookups walk at most 32/128 nodes no matter how many or how overlapping the prefixes are.
+type ipset struct {
+	v4, v6 trieNode
+	size   int // number of prefixes added
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	leaf     bool // a prefix ends here, everything below is covered
+}
+
+// An ipsetParser turns one line of a list into networks. filter comes from the
+// list spec (e.g. country codes) and may be empty.
+type ipsetParser func(line string, filter []string, add func(*net.IPNet)) error
+
+var ipsetParsers = map[string]ipsetParser{
+	"plain":   parsePlainLine,
+	"apnic":   parseAPNICLine,
+	"geolite": parseGeoLiteLine,
+	"route":   parseRouteLine,
+}
+
+// parseIPsetSpec splits a -l entry of form path[#format[=filter+filter...]]
+func parseIPsetSpec(spec string) (path string, parser ipsetParser, filter []string, err error) {
+	path, format := spec, "plain"
+	if i := strings.LastIndexByte(spec, '#'); i >= 0 {
+		path, format = spec[:i], spec[i+1:]
+	}
+	if i := strings.IndexByte(format, '='); i >= 0 {
+		format, filter = format[:i], strings.Split(format[i+1:], "+")
+	}
+
+	parser, ok := ipsetParsers[strings.ToLower(format)]
+	if !ok {
+		return "", nil, nil, fmt.Errorf("Unknown ipset format: %s", format)
+	}
+	return path, parser, filter, nil
+}
+
+func (s *Server) loadIPsets() ([]*ipset, error) {
+	ipsets := make([]*ipset, len(s.opts.IPsets))
+
+	for i, spec := range s.opts.IPsets { // one file per loop
+		ipset, _, err := s.loadIPset(spec, false)
+		if err != nil {
+			return nil, err
+		}
+		ipsets[i] = ipset
+	}
+	return ipsets, nil
+}
+
+// loadIPset reads one list, downloading it first if it's an URL. With onlyChanged,
+// nil is returned if a downloaded list has not changed since last time, built-in
+// ones being downloaded only then.
+func (s *Server) loadIPset(spec string, onlyChanged bool) (*ipset, bool, error) {
+	filename, parser, filter, err := parseIPsetSpec(spec)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var file io.ReadCloser
+	if name, ok := builtinName(filename); ok {
+		if file, err = s.openBuiltin(name, onlyChanged); err != nil || file == nil {
+			return nil, false, err
+		}
+	} else {
+		if isURL(filename) {
+			var changed bool
+			if filename, changed, err = s.fetch(filename); err != nil {
+				return nil, false, err
+			}
+			if onlyChanged && !changed {
+				return nil, false, nil
+			}
+		}
+		if file, err = os.Open(filename); err != nil {
+			return nil, false, err
+		}
+	}
+	defer file.Close()
+
+	ipset := new(ipset)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() { // one line per loop
+		line := strings.TrimSpace(scanner.Text())
+
+		if 0 == len(line) || line[0] == '#' { // skip empty line and comment
+			continue
+		}
+
+		if err := parser(line, filter, ipset.add); err != nil {
+			return nil, false, fmt.Errorf("%s in file %s", err, spec)
+		}
+	}
+	return ipset, true, scanner.Err()
+}
+
+// refreshIPsets periodically downloads ipsets given as URLs and swaps in changed ones
+func (s *Server) refreshIPsets() {
+	for range time.Tick(s.opts.Refresh) {
+		for i, spec := range s.opts.IPsets {
+			filename, _, _, _ := parseIPsetSpec(spec)
+			if _, builtin := builtinName(filename); !builtin && !isURL(filename) {
+				continue
+			}
+
+			ipset, changed, err := s.loadIPset(spec, true)
+			if err != nil {
+				s.logErr.Printf("Failed to refresh ipset %s: %s", spec, err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			s.configLock.Lock()
+			s.ipsets[i] = ipset
+			s.configLock.Unlock()
+			s.logStd.Printf("ipset %d refreshed from %s, %d entries", i+1, spec, ipset.size)
+		}
+	}
+}
+
+// ipsetIndex finds the 1-based index of an ipset by its index, or by name for
+// built-in ones given to -l
+func (s *Server) ipsetIndex(str string, ipsetCount int) (uint, bool) {
+	str = strings.TrimSpace(str)
+	if index, err := strconv.ParseUint(str, 10, 0); err == nil {
+		return uint(index), index > 0 && index <= uint64(ipsetCount)
+	}
+	for i, spec := range s.opts.IPsets {
+		filename, _, _, _ := parseIPsetSpec(spec)
+		if name, ok := builtinName(filename); ok && i < ipsetCount && name == strings.ToLower(str) {
+			return uint(i + 1), true
+		}
+	}
+	return 0, false
+}
+
+func parsePlainLine(line string, filter []string, add func(*net.IPNet)) error {
+	ipNet, err := parseIPNet(line)
+	if err != nil {
+		return fmt.Errorf("Invalid CIDR: %s", line)
+	}
+	add(ipNet)
+	return nil
+}
+
+// parseRouteLine reads comma-separated dumps like "1.0.1.0/24, 1.0.2.0/23"
+func parseRouteLine(line string, filter []string, add func(*net.IPNet)) error {
+	for _, field := range strings.Split(line, ",") {
+		if field = strings.TrimSpace(field); 0 == len(field) {
+			continue
+		}
+		if err := parsePlainLine(field, filter, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAPNICLine reads delegated stats, e.g. "apnic|CN|ipv4|1.0.1.0|256|20110414|allocated".
+// Filter is country codes. Skips version, summary and asn lines.
+func parseAPNICLine(line string, filter []string, add func(*net.IPNet)) error {
+	fields := strings.Split(line, "|")
+	if len(fields) < 7 || fields[1] == "*" || fields[2] != "ipv4" && fields[2] != "ipv6" {
+		return nil
+	}
+	if len(filter) > 0 && !containsFold(filter, fields[1]) {
+		return nil
+	}
+
+	start := net.ParseIP(fields[3])
+	value, err := strconv.ParseUint(fields[4], 10, 32)
+	if start == nil || err != nil {
+		return fmt.Errorf("Invalid delegation: %s", line)
+	}
+
+	switch fields[2] {
+	case "ipv4": // value is number of addresses, not necessarily a power of 2
+		if start = start.To4(); start == nil || value == 0 || uint64(binary.BigEndian.Uint32(start))+value > 1<<32 { // past the last address
+			return fmt.Errorf("Invalid delegation: %s", line)
+		}
+		for first, last := uint64(binary.BigEndian.Uint32(start)), uint64(binary.BigEndian.Uint32(start))+value-1; first <= last; {
+			size := 32
+			for size > 0 && first&(1<<uint(33-size)-1) == 0 && first+1<<uint(33-size)-1 <= last {
+				size--
+			} // grow the block while aligned and within range
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, uint32(first))
+			add(&net.IPNet{IP: ip, Mask: net.CIDRMask(size, 32)})
+			first += 1 << uint(32-size)
+		}
+	case "ipv6": // value is prefix length
+		if value > 128 {
+			return fmt.Errorf("Invalid delegation: %s", line)
+		}
+		add(&net.IPNet{IP: start.Mask(net.CIDRMask(int(value), 128)), Mask: net.CIDRMask(int(value), 128)})
+	}
+	return nil
+}
+
+// parseGeoLiteLine reads GeoLite2 Country/City blocks CSV, e.g. "1.0.1.0/24,1814991,1814991,,0,0".
+// Filter is geoname_ids, matching either located or registered country.
+func parseGeoLiteLine(line string, filter []string, add func(*net.IPNet)) error {
+	fields := strings.Split(line, ",")
+	if fields[0] == "network" { // header
+		return nil
+	}
+	if len(filter) > 0 && (len(fields) < 3 || !containsFold(filter, fields[1]) && !containsFold(filter, fields[2])) {
+		return nil
+	}
+	return parsePlainLine(fields[0], filter, add)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPNet accepts both CIDR and bare IP
+func parseIPNet(ipStr string) (*net.IPNet, error) {
+	if !strings.Contains(ipStr, "/") {
+		if strings.Contains(ipStr, ":") {
+			ipStr += "/128"
+		} else {
+			ipStr += "/32"
+		}
+	} // normalize
+
+	_, ipNet, err := net.ParseCIDR(ipStr)
+	return ipNet, err
+}
+
+// parseIPList builds an ipset from comma-separated CIDRs
+func parseIPList(list string) (*ipset, error) {
+	ipset := new(ipset)
+	for _, ipStr := range strings.Split(list, ",") {
+		if ipStr = strings.TrimSpace(ipStr); 0 == len(ipStr) {
+			continue
+		}
+
+		ipNet, err := parseIPNet(ipStr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR: %s", ipStr)
+		}
+		ipset.add(ipNet)
+	}
+	return ipset, nil
+}
+
+func (ipset *ipset) add(ipNet *net.IPNet) {
+	node, ip := &ipset.v6, ipNet.IP.To16()
+	if len(ipNet.Mask) == net.IPv4len {
+		node, ip = &ipset.v4, ipNet.IP.To4()
+	}
+	ipset.size++
+
+	ones, _ := ipNet.Mask.Size()
+	for i := 0; i < ones; i++ {
+		if node.leaf { // covered by a shorter prefix already
+			return
+		}
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = new(trieNode)
+		}
+		node = node.children[bit]
+	}
+	node.leaf = true
+	node.children = [2]*trieNode{} // longer prefixes are redundant now
+}
+
+func (ipset *ipset) containsIP(ip net.IP) bool {
+	node := &ipset.v6
+	if x := ip.To4(); x != nil {
+		node, ip = &ipset.v4, x
+	}
+
+	for i := 0; node != nil; i++ {
+		if node.leaf {
+			return true
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[ip[i/8]>>(7-uint(i%8))&1]
+	}
+	return false
+}
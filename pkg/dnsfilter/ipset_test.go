@@ -0,0 +1,84 @@
+package dnsfilter
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// nested and overlapping prefixes, added shorter or longer first
+func TestIPsetContains(t *testing.T) {
+	set, err := parseIPList("10.0.0.0/8, 10.1.0.0/16, 192.168.1.0/24, 192.168.0.0/16, 172.16.0.0/13, 172.20.0.0/14, 203.0.113.7," +
+		"2001:db8::/32, 2001:db8:1::/48, 2400:cb00:1::/48, 2400:cb00::/32, fd00::/9, fd00:1::/16, 2001:db9::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		ip       string
+		contains bool
+	}{
+		{"10.255.255.255", true},
+		{"10.1.2.3", true},
+		{"11.0.0.0", false},
+		{"192.168.1.1", true},
+		{"192.168.255.255", true},
+		{"192.169.0.0", false},
+		{"172.16.0.0", true},
+		{"172.23.255.255", true},
+		{"172.24.0.0", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"2001:db8:ffff::1", true},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", true},
+		{"2001:db9::2", false},
+		{"2400:cb00:ffff::", true},
+		{"2400:cb01::", false},
+		{"fd7f:ffff::", true},
+		{"fd80::", false},
+		{"::ffff:10.0.0.1", true}, // IPv4-mapped, as an IPv4 address
+		{"::a00:1", false},        // the same bits, of IPv6
+	} {
+		if got := set.containsIP(net.ParseIP(test.ip)); got != test.contains {
+			t.Errorf("%s: contained %t, want %t", test.ip, got, test.contains)
+		}
+	}
+	if set.size != 14 {
+		t.Errorf("size %d, want 14", set.size)
+	}
+}
+
+// delegations of address counts other than powers of 2, or unaligned, split into
+// CIDR blocks
+func TestParseAPNICLine(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		blocks []string
+	}{
+		{"apnic|CN|ipv4|1.0.1.0|256|20110414|allocated", []string{"1.0.1.0/24"}},
+		{"apnic|CN|ipv4|1.0.2.0|768|20110414|allocated", []string{"1.0.2.0/23", "1.0.4.0/24"}},
+		{"apnic|CN|ipv4|1.0.1.0|100|20110414|allocated", []string{"1.0.1.0/26", "1.0.1.64/27", "1.0.1.96/30"}},
+		{"apnic|CN|ipv4|1.0.1.128|384|20110414|allocated", []string{"1.0.1.128/25", "1.0.2.0/24"}},
+		{"apnic|CN|ipv4|1.0.1.3|6|20110414|allocated", []string{"1.0.1.3/32", "1.0.1.4/30", "1.0.1.8/32"}},
+		{"apnic|CN|ipv4|255.255.255.0|256|20110414|allocated", []string{"255.255.255.0/24"}},
+		{"apnic|CN|ipv6|2001:250::|35|20000426|allocated", []string{"2001:250::/35"}},
+		{"apnic|HK|ipv4|1.0.3.0|256|20110414|allocated", nil},
+		{"apnic|CN|asn|4134|1|20000101|allocated", nil},
+		{"apnic|*|ipv4|*|43747|summary", nil},
+	} {
+		var blocks []string
+		err := parseAPNICLine(test.line, []string{"CN"}, func(ipNet *net.IPNet) { blocks = append(blocks, ipNet.String()) })
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+		} else if !reflect.DeepEqual(blocks, test.blocks) {
+			t.Errorf("%s: got %v, want %v", test.line, blocks, test.blocks)
+		}
+	}
+
+	for _, line := range []string{"apnic|CN|ipv4|255.255.255.0|257|20110414|allocated", "apnic|CN|ipv4|1.0.1.0|0|20110414|allocated"} {
+		if err := parseAPNICLine(line, nil, func(*net.IPNet) {}); err == nil {
+			t.Errorf("%s: no error", line)
+		}
+	}
+}
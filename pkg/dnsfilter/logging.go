@@ -0,0 +1,152 @@
+package dnsfilter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// verbose tells if queries and verdicts are logged
+func (s *Server) verbose() bool {
+	return atomic.LoadInt32(&s.verboseMode) != 0
+}
+
+func (s *Server) setVerbose(on bool) {
+	var mode int32
+	if on {
+		mode = 1
+	}
+	atomic.StoreInt32(&s.verboseMode, mode)
+}
+
+// toggleVerbose switches verbose mode, telling if it is on now
+func (s *Server) toggleVerbose() bool {
+	for {
+		mode := atomic.LoadInt32(&s.verboseMode)
+		if atomic.CompareAndSwapInt32(&s.verboseMode, mode, 1-mode) {
+			return mode == 0
+		}
+	}
+}
+
+// syslog severities of the loggers
+const (
+	severityErr  = 3
+	severityInfo = 6
+)
+
+var syslogFacilities = map[string]int{"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23}
+
+// LogBackend makes the loggers for Config.Log and Config.ErrorLog writing to backend:
+// syslog for the local syslog daemon, udp://host[:port] or tcp://host[:port] for a
+// remote one, eventlog for the Windows Event Log. Syslog messages are RFC 5424 ones
+// of facility, errors with severity err and others info.
+func LogBackend(backend, facility string) (*log.Logger, *log.Logger, error) {
+	if backend == "eventlog" {
+		std, errs, err := openEventLog()
+		if err != nil {
+			return nil, nil, err
+		}
+		return log.New(std, "", 0), log.New(errs, "", 0), nil
+	}
+
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unknown syslog facility: %s", facility)
+	}
+	var conn *syslogConn
+	switch {
+	case backend == "syslog":
+		conn = &syslogConn{network: "unixgram"}
+	case strings.HasPrefix(backend, "udp://"), strings.HasPrefix(backend, "tcp://"):
+		addr := backend[len("udp://"):]
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "514")
+		}
+		conn = &syslogConn{network: backend[:3], addr: addr}
+	default:
+		return nil, nil, fmt.Errorf("Unknown log backend: %s", backend)
+	}
+	if err := conn.dial(); err != nil {
+		return nil, nil, err
+	}
+	std := &syslogWriter{conn, code*8 + severityInfo}
+	errs := &syslogWriter{conn, code*8 + severityErr}
+	return log.New(std, "", 0), log.New(errs, "", 0), nil
+}
+
+// syslogConn is a connection to a syslog daemon shared by the writers of each severity
+type syslogConn struct {
+	network  string // unixgram for the local daemon, udp or tcp
+	addr     string
+	hostname string
+	lock     sync.Mutex
+	conn     net.Conn
+}
+
+func (c *syslogConn) dial() error {
+	if c.hostname == "" {
+		if c.hostname, _ = os.Hostname(); c.hostname == "" {
+			c.hostname = "-"
+		}
+	}
+	if c.network != "unixgram" {
+		conn, err := net.DialTimeout(c.network, c.addr, 5*time.Second)
+		c.conn = conn
+		return err
+	}
+	for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+		if conn, err := net.Dial("unixgram", path); err == nil {
+			c.conn = conn
+			return nil
+		}
+	}
+	return errors.New("No local syslog daemon found")
+}
+
+// send writes a message, dialing again once if the connection failed
+func (c *syslogConn) send(priority int, msg string) error {
+	line := fmt.Sprintf("<%d>1 %s %s dnsfilter %d - - %s", priority, time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		c.hostname, os.Getpid(), strings.TrimSuffix(msg, "\n"))
+	if c.network == "tcp" {
+		line = fmt.Sprintf("%d %s", len(line), line) // octet counting framing of RFC 6587
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if c.conn == nil {
+			if err = c.dial(); err != nil {
+				continue
+			}
+		}
+		if _, err = io.WriteString(c.conn, line); err == nil {
+			return nil
+		}
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+type syslogWriter struct {
+	conn     *syslogConn
+	priority int
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	if err := w.conn.send(w.priority, string(p)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s", p) // not to lose it
+	}
+	return len(p), nil
+}
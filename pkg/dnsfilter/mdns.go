@@ -0,0 +1,130 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+	"net"
+	"strings"
+	"time"
+)
+
+const classCacheFlush = 1 << 15 // top bit of the class of mDNS records
+
+var (
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+)
+
+// openMDNS checks the interface of -mdns-iface
+func (s *Server) openMDNS() error {
+	if s.opts.MDNSIface == "" {
+		return nil
+	}
+	ifi, err := net.InterfaceByName(s.opts.MDNSIface)
+	if err != nil {
+		return err
+	}
+	if ifi.Flags&net.FlagMulticast == 0 {
+		return fmt.Errorf("No multicast on interface %s", s.opts.MDNSIface)
+	}
+	s.mdnsIface = ifi
+	return nil
+}
+
+// mdnsAnswer resolves queries for names under -mdns suffixes by a one-shot multicast
+// DNS query (RFC 6762 section 5.1), NXDOMAIN if no device answers with the name in
+// time. It returns nil for other names.
+func (s *Server) mdnsAnswer(hdr dnsmessage.Header, qs []dnsmessage.Question) []byte {
+	if len(qs) != 1 || qs[0].Class != dnsmessage.ClassINET {
+		return nil
+	}
+	q := qs[0]
+	mdnsName := false
+	for _, suffix := range s.opts.MDNS {
+		if matchName(q.Name, strings.ToLower(strings.Trim(suffix, " ."))) {
+			mdnsName = true
+			break
+		}
+	}
+	if !mdnsName {
+		return nil
+	}
+
+	answers, named, err := s.mdnsQuery(q)
+	if err != nil {
+		s.logErr.Println("mDNS query failed:", err)
+	}
+	hdr.Response, hdr.Authoritative, hdr.RecursionAvailable, hdr.Truncated = true, false, true, false
+	switch {
+	case err != nil:
+		hdr.RCode = dnsmessage.RCodeServerFailure
+	case !named:
+		hdr.RCode = dnsmessage.RCodeNameError
+	default:
+		hdr.RCode = dnsmessage.RCodeSuccess
+	}
+	m := dnsmessage.Message{Header: hdr, Questions: qs, Answers: answers}
+	msg, err := m.Pack()
+	if err != nil {
+		s.logErr.Println(err)
+		return nil
+	}
+	return msg
+}
+
+// mdnsQuery asks the local link for q from an ephemeral port, so that responders
+// answer by unicast. It returns the records of q from the first answer having some,
+// and whether any device has the name, waiting up to -t for them.
+func (s *Server) mdnsQuery(q dnsmessage.Question) ([]dnsmessage.Resource, bool, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	if s.mdnsIface != nil {
+		if err := ipv4.NewPacketConn(conn).SetMulticastInterface(s.mdnsIface); err != nil {
+			return nil, false, err
+		}
+	}
+
+	id := randomID()
+	query := dnsmessage.Message{Header: dnsmessage.Header{ID: id}, Questions: []dnsmessage.Question{q}}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := conn.WriteToUDP(packed, mdnsGroup); err != nil {
+		return nil, false, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(s.opts.Timeout))
+	buf := make([]byte, 9000) // mDNS packets may exceed usual DNS sizes
+	named := false
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				return nil, named, nil
+			}
+			return nil, named, err
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(buf[:n]); err != nil || !m.Response || m.ID != id && m.ID != 0 {
+			continue
+		}
+		var answers []dnsmessage.Resource
+		for _, rr := range append(m.Answers, m.Additionals...) {
+			rr.Header.Class &^= classCacheFlush
+			if !strings.EqualFold(rr.Header.Name.String(), q.Name.String()) || rr.Header.Class != dnsmessage.ClassINET {
+				continue
+			}
+			named = true
+			if rr.Header.Type == q.Type || q.Type == dnsmessage.TypeALL {
+				answers = append(answers, rr)
+			}
+		}
+		if len(answers) > 0 {
+			return answers, true, nil
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// mmdb is a minimal reader of MaxMind DB files (GeoLite2 / GeoIP2 / DB-IP .mmdb),
+// see https://maxmind.github.io/MaxMind-DB/
+type mmdb struct {
+	buf        []byte
+	data       []byte // data section
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint // node reached after 96 zero bits in an IPv6 tree
+}
+
+var (
+	errMMDBInvalid = errors.New("Invalid MaxMind DB file")
+)
+
+func openMMDB(filename string) (*mmdb, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := []byte("\xAB\xCD\xEFMaxMind.com")
+	i := bytes.LastIndex(buf, marker)
+	if i < 0 {
+		return nil, errMMDBInvalid
+	}
+	metaStart := i + len(marker)
+
+	meta, _, err := (&mmdb{data: buf[metaStart:]}).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	metaMap, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBInvalid
+	}
+	nodeCount, ok1 := metaMap["node_count"].(uint64)
+	recordSize, ok2 := metaMap["record_size"].(uint64)
+	ipVersion, ok3 := metaMap["ip_version"].(uint64)
+	if !ok1 || !ok2 || !ok3 || recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, errMMDBInvalid
+	}
+
+	treeSize := int(nodeCount * recordSize / 4)
+	if treeSize+16 > i {
+		return nil, errMMDBInvalid
+	}
+	db := &mmdb{
+		buf:        buf,
+		data:       buf[treeSize+16 : i],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+	}
+
+	if ipVersion == 6 {
+		for j := 0; j < 96 && db.ipv4Start < db.nodeCount; j++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record reads the left (bit 0) or right (bit 1) record of a node
+func (db *mmdb) record(node uint, bit byte) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[uint(bit)*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default: // 32
+		return uint(binary.BigEndian.Uint32(b[uint(bit)*4:]))
+	}
+}
+
+// lookup returns the decoded record of ip, nil if not found
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if x := ip.To4(); x != nil {
+		ip, node = x, db.ipv4Start
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, ip[i/8]>>(7-uint(i%8))&1)
+	}
+	if node <= db.nodeCount { // not found
+		return nil, nil
+	}
+
+	offset := int(node-db.nodeCount) - 16
+	if offset < 0 || offset >= len(db.data) {
+		return nil, errMMDBInvalid
+	}
+	v, _, err := db.decode(offset)
+	return v, err
+}
+
+// country returns the ISO code of ip by country, falling back to registered country
+func (db *mmdb) country(ip net.IP) string {
+	v, err := db.lookup(ip)
+	if err != nil {
+		return ""
+	}
+	record, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if m, ok := record[key].(map[string]interface{}); ok {
+			if code, ok := m["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// decode a data field at offset, returning the value and offset of next field
+func (db *mmdb) decode(offset int) (interface{}, int, error) {
+	if offset >= len(db.data) {
+		return nil, 0, errMMDBInvalid
+	}
+	ctrl := db.data[offset]
+	offset++
+
+	typ := int(ctrl >> 5)
+	if typ == 1 { // pointer
+		ss, vvv := int(ctrl>>3&3), int(ctrl&7)
+		if offset+ss+1 > len(db.data) {
+			return nil, 0, errMMDBInvalid
+		}
+		var p int
+		switch b := db.data[offset:]; ss {
+		case 0:
+			p = vvv<<8 | int(b[0])
+		case 1:
+			p = (vvv<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 2:
+			p = (vvv<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		case 3:
+			p = int(binary.BigEndian.Uint32(b))
+		}
+		v, _, err := db.decode(p)
+		return v, offset + ss + 1, err
+	}
+
+	if typ == 0 { // extended
+		if offset >= len(db.data) {
+			return nil, 0, errMMDBInvalid
+		}
+		typ = 7 + int(db.data[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(db.data) {
+			return nil, 0, errMMDBInvalid
+		}
+		v := 0
+		for _, b := range db.data[offset : offset+n] {
+			v = v<<8 | int(b)
+		}
+		size = v + []int{29, 285, 65821}[n-1]
+		offset += n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			k, next, err := db.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBInvalid
+			}
+			if m[key], offset, err = db.decode(next); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, size)
+		for i := range a {
+			var err error
+			if a[i], offset, err = db.decode(offset); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case 14: // boolean, value is the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(db.data) {
+		return nil, 0, errMMDBInvalid
+	}
+	b := db.data[offset : offset+size]
+	offset += size
+
+	switch typ {
+	case 2: // utf-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBInvalid
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBInvalid
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), offset, nil
+	case 4, 10: // bytes, uint128
+		return b, offset, nil
+	}
+	return nil, 0, errMMDBInvalid
+}
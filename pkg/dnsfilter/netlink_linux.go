@@ -0,0 +1,211 @@
+package dnsfilter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// netfilter netlink constants not in syscall, from linux/netfilter/*.h
+const (
+	netlinkNetfilter = 12
+
+	nfnlSubsysIPSet     = 6
+	nfnlSubsysNFTables  = 10
+	nfnlMsgBatchBegin   = 16
+	nfnlMsgBatchEnd     = 17
+	ipsetCmdAdd         = 9
+	ipsetProtocol       = 6
+	ipsetAttrProtocol   = 1
+	ipsetAttrSetName    = 2
+	ipsetAttrData       = 7
+	ipsetAttrIP         = 1
+	ipsetAttrIPAddrIPv4 = 1
+	ipsetAttrIPAddrIPv6 = 2
+	ipsetAttrTimeout    = 6
+	nftMsgNewSetElem    = 12
+	nftaSetElemListTab  = 1
+	nftaSetElemListSet  = 2
+	nftaSetElemListElem = 3
+	nftaListElem        = 1
+	nftaSetElemKey      = 1
+	nftaSetElemTimeout  = 4
+	nftaDataValue       = 1
+
+	nlaFNested       = 1 << 15
+	nlaFNetByteorder = 1 << 14
+)
+
+var (
+	nlSeq  uint32
+	nlLock sync.Mutex
+
+	nativeEndian binary.ByteOrder = binary.LittleEndian // netlink headers are in host byte order
+)
+
+func init() {
+	if x := uint16(1); *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+type nlAttr struct {
+	typ      uint16
+	data     []byte
+	children []nlAttr
+}
+
+func (a nlAttr) encode() []byte {
+	data := a.data
+	if a.children != nil {
+		data = nil
+		for _, child := range a.children {
+			data = append(data, child.encode()...)
+		}
+	}
+
+	b := make([]byte, 4, 4+len(data)+3)
+	nativeEndian.PutUint16(b, uint16(4+len(data)))
+	nativeEndian.PutUint16(b[2:], a.typ)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// nlMessage builds a netlink message carrying nfgenmsg and attributes
+func nlMessage(typ, flags uint16, seq uint32, family uint8, resID uint16, attrs ...nlAttr) []byte {
+	b := make([]byte, 20)
+	nativeEndian.PutUint16(b[4:], typ)
+	nativeEndian.PutUint16(b[6:], flags)
+	nativeEndian.PutUint32(b[8:], seq)
+	b[16] = family // nfgenmsg
+	binary.BigEndian.PutUint16(b[18:], resID)
+	for _, attr := range attrs {
+		b = append(b, attr.encode()...)
+	}
+	nativeEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// nlTalk sends the messages and waits for acks of those requesting one
+func nlTalk(msgs [][]byte, acks int) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkNetfilter)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, msg := range msgs {
+		buf = append(buf, msg...)
+	}
+	if err := syscall.Sendto(fd, buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	rb := make([]byte, syscall.Getpagesize())
+	for acks > 0 {
+		n, _, err := syscall.Recvfrom(fd, rb, 0)
+		if err != nil {
+			return err
+		}
+		replies, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			acks--
+			if errno := int32(nativeEndian.Uint32(reply.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+		}
+	}
+	return nil
+}
+
+// add inserts ips into a kernel ipset or nftables set via netlink
+func (s *kernelSet) add(ips []net.IP) error {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if x := ip.To4(); x != nil {
+			v4 = append(v4, x)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	nlLock.Lock()
+	defer nlLock.Unlock()
+
+	var err error
+	if len(v4) > 0 {
+		err = s.addFamily(syscall.AF_INET, ipsetAttrIPAddrIPv4, v4)
+	}
+	if len(v6) > 0 { // a set holds one family only, so don't let v4 failure stop v6
+		if err6 := s.addFamily(syscall.AF_INET6, ipsetAttrIPAddrIPv6, v6); err == nil {
+			err = err6
+		}
+	}
+	if err != nil && s.table == "" {
+		return fmt.Errorf("ipset %s: %s", s.name, err)
+	} else if err != nil {
+		return fmt.Errorf("nft set %s %s: %s", s.table, s.name, err)
+	}
+	return nil
+}
+
+func (s *kernelSet) addFamily(family uint8, attrType uint16, ips []net.IP) error {
+	var msgs [][]byte
+	for _, ip := range ips {
+		nlSeq++
+		if s.table == "" { // ipset
+			data := []nlAttr{{typ: ipsetAttrIP | nlaFNested, children: []nlAttr{{typ: attrType | nlaFNetByteorder, data: ip}}}}
+			if s.timeout > 0 {
+				timeout := make([]byte, 4)
+				binary.BigEndian.PutUint32(timeout, uint32(s.timeout.Seconds()))
+				data = append(data, nlAttr{typ: ipsetAttrTimeout | nlaFNetByteorder, data: timeout})
+			}
+			// without NLM_F_EXCL, adding an existing entry is fine and refreshes its timeout
+			msgs = append(msgs, nlMessage(nfnlSubsysIPSet<<8|ipsetCmdAdd, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK, nlSeq, family, 0,
+				nlAttr{typ: ipsetAttrProtocol, data: []byte{ipsetProtocol}},
+				nlAttr{typ: ipsetAttrSetName, data: append([]byte(s.name), 0)},
+				nlAttr{typ: ipsetAttrData | nlaFNested, children: data},
+			))
+			continue
+		}
+
+		elem := []nlAttr{{typ: nftaSetElemKey | nlaFNested, children: []nlAttr{{typ: nftaDataValue, data: ip}}}}
+		if s.timeout > 0 {
+			timeout := make([]byte, 8)
+			binary.BigEndian.PutUint64(timeout, uint64(s.timeout.Nanoseconds()/1e6))
+			elem = append(elem, nlAttr{typ: nftaSetElemTimeout, data: timeout})
+		}
+		msgs = append(msgs, nlMessage(nfnlSubsysNFTables<<8|nftMsgNewSetElem, syscall.NLM_F_REQUEST|syscall.NLM_F_CREATE|syscall.NLM_F_ACK, nlSeq, s.family, 0,
+			nlAttr{typ: nftaSetElemListTab, data: append([]byte(s.table), 0)},
+			nlAttr{typ: nftaSetElemListSet, data: append([]byte(s.name), 0)},
+			nlAttr{typ: nftaSetElemListElem | nlaFNested, children: []nlAttr{{typ: nftaListElem | nlaFNested, children: elem}}},
+		))
+	}
+
+	acks := len(msgs)
+	if s.table != "" { // nftables changes must be wrapped in a batch
+		nlSeq++
+		begin := nlMessage(nfnlMsgBatchBegin, syscall.NLM_F_REQUEST, nlSeq, syscall.AF_UNSPEC, nfnlSubsysNFTables)
+		nlSeq++
+		end := nlMessage(nfnlMsgBatchEnd, syscall.NLM_F_REQUEST, nlSeq, syscall.AF_UNSPEC, nfnlSubsysNFTables)
+		msgs = append(append([][]byte{begin}, msgs...), end)
+	}
+	return nlTalk(msgs, acks)
+}
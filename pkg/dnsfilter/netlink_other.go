@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package dnsfilter
+
+import (
+	"errors"
+	"net"
+)
+
+func (s *kernelSet) add(ips []net.IP) error {
+	return errors.New("Kernel sets are only supported on Linux")
+}
@@ -0,0 +1,104 @@
+package dnsfilter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// opcodePolicy is what -opcode does with queries of an opcode other than QUERY
+type opcodePolicy struct {
+	action string       // forward, refuse, drop or notimp
+	addr   *net.UDPAddr // forwarded to
+}
+
+var (
+	opcodeNames = map[string]dnsmessage.OpCode{"iquery": 1, "status": 2, "notify": 4, "update": 5}
+)
+
+// parseOpCodes checks the policies of -opcode, opcodes named or by number
+func (s *Server) parseOpCodes() error {
+	for _, entry := range s.opts.OpCodes {
+		name, policyStr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return fmt.Errorf("Invalid opcode policy: %s", entry)
+		}
+		opcode, known := opcodeNames[strings.ToLower(name)]
+		if n, err := strconv.ParseUint(name, 10, 4); err == nil && n != 0 {
+			opcode, known = dnsmessage.OpCode(n), true
+		}
+		if !known {
+			return fmt.Errorf("Unknown opcode: %s", name)
+		}
+
+		var policy opcodePolicy
+		policy.action, policyStr, _ = strings.Cut(policyStr, ":")
+		switch policy.action {
+		case "forward":
+			addr, err := parseUdpAddr(policyStr)
+			if err != nil || addr.IP == nil {
+				return fmt.Errorf("Invalid address to forward opcode %s to: %s", name, policyStr)
+			}
+			policy.addr = addr
+		case "refuse", "drop", "notimp":
+		default:
+			return fmt.Errorf("Unknown opcode policy: %s", entry)
+		}
+		s.opcodePolicies[opcode] = policy
+	}
+	return nil
+}
+
+// handleOpCode answers a query of an opcode other than QUERY by its -opcode policy
+func (s *Server) handleOpCode(ctx context.Context, hdr dnsmessage.Header, qs []dnsmessage.Question, payload []byte) {
+	clientAddr := ctx.Value(clientAddrKey).(*net.UDPAddr)
+	policy, ok := s.opcodePolicies[hdr.OpCode]
+	if !ok {
+		policy.action = "notimp"
+	}
+	if s.verbose() {
+		s.logStd.Printf("%d %s opcode %d, %s", hdr.ID, clientAddr, hdr.OpCode, strings.ToUpper(policy.action))
+	}
+
+	rcode := dnsmessage.RCodeNotImplemented
+	switch policy.action {
+	case "forward":
+		s.forwardOpCode(ctx, hdr, qs, payload, policy.addr)
+		return
+	case "drop":
+		return
+	case "refuse":
+		rcode = dnsmessage.RCodeRefused
+	}
+	if msg, err := reply(hdr, qs, rcode); err == nil {
+		s.sendToClient(ctx, msg)
+	}
+}
+
+// forwardOpCode relays payload to addr as is but for its ID, a NOTIFY or UPDATE
+// for the authoritative server behind, and its answer back to the client
+func (s *Server) forwardOpCode(ctx context.Context, hdr dnsmessage.Header, qs []dnsmessage.Question, payload []byte, addr *net.UDPAddr) {
+	tx := s.newTransaction(ctx, qs)
+	defer tx.finish()
+	msg := append([]byte(nil), payload...)
+	binary.BigEndian.PutUint16(msg, tx.id)
+	if err := tx.send(msg, addr); err != nil {
+		s.logErr.Println(err)
+		return
+	}
+
+	timer := time.NewTimer(s.opts.Timeout)
+	defer timer.Stop()
+	select {
+	case a := <-tx.answers:
+		binary.BigEndian.PutUint16(a.msg, hdr.ID)
+		s.sendToClient(ctx, a.msg)
+	case <-timer.C:
+		s.logErr.Printf("%d %s timed out for opcode %d", hdr.ID, addr, hdr.OpCode)
+	}
+}
@@ -0,0 +1,59 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"testing"
+	"time"
+)
+
+// updateFrom sends an UPDATE of zone to addr from the local address ip
+func updateFrom(t *testing.T, ip net.IP, addr *net.UDPAddr, zone string) *net.UDPConn {
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: ip}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := dnsmessage.Message{Header: dnsmessage.Header{ID: 4242, OpCode: 5},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(zone), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}}}
+	packed, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(packed); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// an UPDATE of a client allow_clients rejects is refused, not forwarded
+func TestOpCodeRefused(t *testing.T) {
+	addr := raceServer(t)
+	denied := updateFrom(t, net.IPv4(127, 0, 0, 2), addr, "denied.test.")
+	defer denied.Close()
+	denied.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 65535)
+	n, err := denied.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if m.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("got %s, want %s", m.RCode, dnsmessage.RCodeRefused)
+	}
+
+	allowed := updateFrom(t, net.IPv4(127, 0, 0, 1), addr, "allowed.test.")
+	defer allowed.Close()
+	raceRelay.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err = raceRelay.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Questions[0].Name.String(); got != "allowed.test." {
+		t.Errorf("relay got the UPDATE of %s first, want allowed.test.", got)
+	}
+}
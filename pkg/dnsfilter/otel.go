@@ -0,0 +1,234 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spanBatch    = 512
+	spanInterval = 5 * time.Second // longest wait to export a batch
+)
+
+// span is an OpenTelemetry span of the query pipeline. A nil span is one not sampled,
+// its methods doing nothing.
+type span struct {
+	srv     *Server
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	failed  string // status message, if an error
+	lock    sync.Mutex
+}
+
+// startTrace starts the root span of a query, if sampled by its trace ID as OTel's
+// TraceIdRatioBased sampler does, returning ctx with it
+func (s *Server) startTrace(ctx context.Context, name string) (context.Context, *span) {
+	if s.spans == nil {
+		return ctx, nil
+	}
+	sp := &span{srv: s, name: name, start: time.Now()}
+	rand.Read(sp.traceID[:])
+	if float64(binary.BigEndian.Uint64(sp.traceID[8:])>>11)/(1<<53) >= s.opts.OTLPSample {
+		return ctx, nil
+	}
+	rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanKey, sp), sp
+}
+
+// startSpan starts a child of the span of ctx, nil if ctx isn't traced
+func (s *Server) startSpan(ctx context.Context, name string) *span {
+	parent, _ := ctx.Value(spanKey).(*span)
+	if parent == nil {
+		return nil
+	}
+	sp := &span{srv: s, traceID: parent.traceID, parent: parent.spanID, name: name, start: time.Now()}
+	rand.Read(sp.spanID[:])
+	return sp
+}
+
+// traced tells if ctx has a span
+func traced(ctx context.Context) bool {
+	return ctx.Value(spanKey) != nil
+}
+
+func (s *span) set(key, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+	s.lock.Unlock()
+}
+
+func (s *span) fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.failed = msg
+	s.lock.Unlock()
+}
+
+// finish ends the span and queues it for export, dropped if the exporter falls behind
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.end = time.Now()
+	s.lock.Unlock()
+	select {
+	case s.srv.spans <- s:
+	default:
+	}
+}
+
+// startOTLP starts exporting spans to opts.OTLP by OTLP over HTTP with JSON
+func (s *Server) startOTLP() error {
+	endpoint := strings.TrimSuffix(s.opts.OTLP, "/")
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return fmt.Errorf("Invalid OTLP endpoint: %s", s.opts.OTLP)
+	}
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	s.spans = make(chan *span, 4096)
+	s.logStd.Printf("Exporting traces to %s", endpoint)
+	go s.exportSpans(endpoint)
+	return nil
+}
+
+func (s *Server) exportSpans(endpoint string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(spanInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, spanBatch)
+	for {
+		select {
+		case sp := <-s.spans:
+			if batch = append(batch, sp); len(batch) < spanBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := postSpans(client, endpoint, batch); err != nil {
+			s.logErr.Println("Failed to export traces:", err)
+		}
+		batch = batch[:0]
+	}
+}
+
+// OTLP JSON encoding of ExportTraceServiceRequest, IDs in hex and times as strings
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"` // 2 for server, 3 for client
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 for error
+	Message string `json:"message,omitempty"`
+}
+
+func keyValue(key, value string) otlpKeyValue {
+	var kv otlpKeyValue
+	kv.Key, kv.Value.StringValue = key, value
+	return kv
+}
+
+func postSpans(client *http.Client, endpoint string, batch []*span) error {
+	list := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		s.lock.Lock()
+		o := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    3,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent == [8]byte{} {
+			o.Kind = 2
+		} else {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for key, value := range s.attrs {
+			o.Attributes = append(o.Attributes, keyValue(key, value))
+		}
+		if s.failed != "" {
+			o.Status = &otlpStatus{2, s.failed}
+		}
+		s.lock.Unlock()
+		list[i] = o
+	}
+
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	var rs resourceSpans
+	rs.Resource.Attributes = []otlpKeyValue{keyValue("service.name", "dnsfilter")}
+	var ss scopeSpans
+	ss.Scope.Name, ss.Spans = "dnsfilter", list
+	rs.ScopeSpans = []scopeSpans{ss}
+
+	body, err := json.Marshal(map[string][]resourceSpans{"resourceSpans": {rs}})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package dnsfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// parseOutbound checks the address of -outbound-ip
+func (s *Server) parseOutbound() error {
+	if s.opts.OutboundIP == "" {
+		return nil
+	}
+	if s.outboundIP = net.ParseIP(s.opts.OutboundIP); s.outboundIP == nil {
+		return fmt.Errorf("Invalid outbound address: %s", s.opts.OutboundIP)
+	}
+	return nil
+}
+
+// outboundControl binds sockets to upstreams to the interface of -outbound-iface
+func (s *Server) outboundControl(network, address string, c syscall.RawConn) error {
+	if s.opts.OutboundIface == "" {
+		return nil
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = bindToDevice(fd, s.opts.OutboundIface)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// listenOutbound opens a UDP socket to upstreams
+func (s *Server) listenOutbound() (*net.UDPConn, error) {
+	addr := ":0"
+	if s.outboundIP != nil {
+		addr = net.JoinHostPort(s.outboundIP.String(), "0")
+	}
+	lc := net.ListenConfig{Control: s.outboundControl}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// outboundDialer dials upstreams over TCP
+func (s *Server) outboundDialer() *net.Dialer {
+	d := &net.Dialer{Timeout: s.opts.Timeout, Control: s.outboundControl}
+	if s.outboundIP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: s.outboundIP}
+	}
+	return d
+}
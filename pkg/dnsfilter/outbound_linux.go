@@ -0,0 +1,9 @@
+package dnsfilter
+
+import (
+	"syscall"
+)
+
+func bindToDevice(fd uintptr, iface string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+}
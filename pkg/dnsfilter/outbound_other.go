@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package dnsfilter
+
+import (
+	"errors"
+)
+
+func bindToDevice(fd uintptr, iface string) error {
+	return errors.New("-outbound-iface is only supported on Linux")
+}
@@ -0,0 +1,174 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"dnsfilter/filter"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"plugin"
+	"strings"
+	"time"
+)
+
+var verdictNames = [...]string{"CONTINUE", "ACCEPT", "DROP", "BLOCK", "REPLY"}
+
+// loadPlugins opens Go plugins, or connects sidecars for unix:/path specs
+func (s *Server) loadPlugins() error {
+	for _, spec := range s.opts.Plugins {
+		var f filter.Filter
+		if strings.HasPrefix(spec, "unix:") {
+			f = s.newSidecar(strings.TrimPrefix(spec, "unix:"))
+		} else {
+			p, err := plugin.Open(spec)
+			if err != nil {
+				return fmt.Errorf("Failed to load plugin: %s", err)
+			}
+			sym, err := p.Lookup("Filter")
+			if err != nil {
+				return fmt.Errorf("Failed to load plugin %s: %s", spec, err)
+			}
+			switch sym := sym.(type) {
+			case *filter.Filter: // exported variable
+				f = *sym
+			case filter.Filter:
+				f = sym
+			default:
+				return fmt.Errorf("Plugin %s Filter is not a filter.Filter", spec)
+			}
+		}
+		s.plugins = append(s.plugins, f)
+		s.logStd.Printf("Plugin %d loaded from %s", len(s.plugins), spec)
+	}
+	return nil
+}
+
+// pluginsOnQuery asks plugins in turn until one decides
+func (s *Server) pluginsOnQuery(client net.IP, msg []byte) (filter.Verdict, []byte) {
+	for i, p := range s.plugins {
+		if verdict, reply := p.OnQuery(&filter.Query{Client: client, Msg: msg}); s.validVerdict(i, verdict, reply) {
+			return verdict, reply
+		}
+	}
+	return filter.Continue, nil
+}
+
+func (s *Server) pluginsOnResponse(client net.IP, serverIndex int, msg []byte) (filter.Verdict, []byte) {
+	for i, p := range s.plugins {
+		if verdict, reply := p.OnResponse(&filter.Response{Client: client, Server: serverIndex, Msg: msg}); s.validVerdict(i, verdict, reply) {
+			return verdict, reply
+		}
+	}
+	return filter.Continue, nil
+}
+
+// validVerdict tells if plugin i decided, ignoring replies too short to be messages
+func (s *Server) validVerdict(i int, verdict filter.Verdict, reply []byte) bool {
+	switch {
+	case verdict == filter.Continue:
+		return false
+	case verdict < filter.Continue || verdict > filter.Reply || verdict == filter.Reply && len(reply) < 12:
+		s.logErr.Printf("Plugin %d: invalid verdict %d", i+1, verdict)
+		return false
+	}
+	return true
+}
+
+// sidecar is an out-of-process filter, talking JSON lines over a Unix socket: requests
+// {"hook": "query" or "response", "client": IP, "server": N, "msg": base64 message},
+// answered by {"verdict": "continue", "accept", "drop", "block" or "reply", "msg": base64}.
+// Errors count as continue.
+type sidecar struct {
+	srv   *Server
+	path  string
+	conns chan *sidecarConn // idle connections
+}
+
+type sidecarConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+type sidecarRequest struct {
+	Hook   string `json:"hook"`
+	Client string `json:"client"`
+	Server int    `json:"server,omitempty"`
+	Msg    []byte `json:"msg"`
+}
+
+type sidecarResponse struct {
+	Verdict string `json:"verdict"`
+	Msg     []byte `json:"msg,omitempty"`
+}
+
+var sidecarVerdicts = map[string]filter.Verdict{"continue": filter.Continue, "accept": filter.Accept,
+	"drop": filter.Drop, "block": filter.Block, "reply": filter.Reply}
+
+func (s *Server) newSidecar(path string) *sidecar {
+	return &sidecar{srv: s, path: path, conns: make(chan *sidecarConn, 16)}
+}
+
+func (s *sidecar) OnQuery(q *filter.Query) (filter.Verdict, []byte) {
+	return s.call(sidecarRequest{"query", q.Client.String(), 0, q.Msg})
+}
+
+func (s *sidecar) OnResponse(r *filter.Response) (filter.Verdict, []byte) {
+	return s.call(sidecarRequest{"response", r.Client.String(), r.Server, r.Msg})
+}
+
+func (s *sidecar) call(req sidecarRequest) (filter.Verdict, []byte) {
+	resp, err := s.exchange(req)
+	if err != nil {
+		s.srv.logErr.Printf("Plugin %s: %s", s.path, err)
+		return filter.Continue, nil
+	}
+	verdict, ok := sidecarVerdicts[resp.Verdict]
+	if !ok {
+		s.srv.logErr.Printf("Plugin %s: invalid verdict %q", s.path, resp.Verdict)
+		return filter.Continue, nil
+	}
+	return verdict, resp.Msg
+}
+
+// exchange sends req on an idle connection or a new one, keeping it if all went well
+func (s *sidecar) exchange(req sidecarRequest) (*sidecarResponse, error) {
+	var conn *sidecarConn
+	select {
+	case conn = <-s.conns:
+	default:
+		c, err := net.DialTimeout("unix", s.path, s.srv.opts.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		conn = &sidecarConn{c, bufio.NewReader(c)}
+	}
+
+	line, err := json.Marshal(req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(s.srv.opts.Timeout))
+	if _, err := conn.Write(append(line, '\n')); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	answer, err := conn.reader.ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var resp sidecarResponse
+	if err := json.Unmarshal(answer, &resp); err != nil {
+		conn.Close()
+		return nil, errors.New("invalid response")
+	}
+
+	select {
+	case s.conns <- conn:
+	default:
+		conn.Close()
+	}
+	return &resp, nil
+}
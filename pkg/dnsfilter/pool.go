@@ -0,0 +1,60 @@
+package dnsfilter
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// bufSize is the size of pooled buffers, shared by the Servers of the process: the
+// largest -edns of those checked, the largest UDP payload until then. It is accessed
+// atomically, bufSizeLock guarding its updates.
+var (
+	bufSize     int64 = 65535
+	bufSizeLock sync.Mutex
+	bufSized    bool // by a Server
+)
+
+// bufPool recycles packet buffers of bufSize. A buffer has one owner at a time:
+// read loops hand them to handle() or sendBack(), which give them back or pass
+// answers on to the send timer and then the batch writer. Buffers are pooled by
+// pointer, as putting a slice would allocate its header; spare pointers are pooled
+// in turn, so that neither getBuf nor putBuf allocates once warm.
+var (
+	bufPool = sync.Pool{New: func() interface{} {
+		buf := make([]byte, atomic.LoadInt64(&bufSize))
+		return &buf
+	}}
+	bufPtrPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+)
+
+// setBufSize sizes buffers got from now on for a Server of -edns size
+func setBufSize(size int) {
+	bufSizeLock.Lock()
+	defer bufSizeLock.Unlock()
+	if !bufSized || int64(size) > atomic.LoadInt64(&bufSize) {
+		atomic.StoreInt64(&bufSize, int64(size))
+	}
+	bufSized = true
+}
+
+func getBuf() []byte {
+	p := bufPool.Get().(*[]byte)
+	buf := *p
+	*p = nil
+	bufPtrPool.Put(p)
+	size := int(atomic.LoadInt64(&bufSize))
+	if len(buf) < size { // from before setBufSize
+		return make([]byte, size)
+	}
+	return buf[:size]
+}
+
+// putBuf recycles b, which may be any slice big enough
+func putBuf(b []byte) {
+	if cap(b) < int(atomic.LoadInt64(&bufSize)) {
+		return
+	}
+	p := bufPtrPool.Get().(*[]byte)
+	*p = b[:cap(b)]
+	bufPool.Put(p)
+}
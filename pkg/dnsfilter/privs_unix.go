@@ -0,0 +1,64 @@
+//go:build !windows
+// +build !windows
+
+package dnsfilter
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges chroots and switches to -user / -group. Names are looked up
+// before chroot, which needs root as well.
+func (s *Server) dropPrivileges() error {
+	uid, gid := -1, -1
+	if s.opts.User != "" {
+		u, err := user.Lookup(s.opts.User)
+		if _, numErr := strconv.Atoi(s.opts.User); err != nil && numErr == nil {
+			u, err = user.LookupId(s.opts.User)
+		}
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if s.opts.Group != "" {
+		g, err := user.LookupGroup(s.opts.Group)
+		if _, numErr := strconv.Atoi(s.opts.Group); err != nil && numErr == nil {
+			g, err = user.LookupGroupId(s.opts.Group)
+		}
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if s.opts.Chroot != "" {
+		if err := syscall.Chroot(s.opts.Chroot); err != nil {
+			return fmt.Errorf("chroot %s: %s", s.opts.Chroot, err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+		s.logStd.Printf("Chrooted into %s", s.opts.Chroot)
+	}
+
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %s", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid %d: %s", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %s", uid, err)
+		}
+		s.logStd.Printf("Running as %s", s.opts.User)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package dnsfilter
+
+import (
+	"errors"
+)
+
+func (s *Server) dropPrivileges() error {
+	if s.opts.User != "" || s.opts.Group != "" || s.opts.Chroot != "" {
+		return errors.New("-user, -group and -chroot are not supported on Windows")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package dnsfilter
+
+import (
+	"fmt"
+)
+
+// profilesOf lists the profiles named by rules, without duplicates
+func profilesOf(rules []*rule) []string {
+	var names []string
+	for _, rule := range rules {
+		for _, name := range rule.match.profiles {
+			if !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, str := range list {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// setProfile switches to the named profile, none if empty
+func (s *Server) setProfile(name string) error {
+	s.configLock.Lock()
+	if name != "" && !containsString(s.profiles, name) {
+		s.configLock.Unlock()
+		return fmt.Errorf("Unknown profile %s", name)
+	}
+	s.activeProfile = name
+	s.configLock.Unlock()
+
+	s.cacheFlush() // cached answers were judged by the other profile
+	s.logStd.Printf("Profile set to %q", name)
+	return nil
+}
+
+// nextProfile switches to the profile after the active one, none after the last
+func (s *Server) nextProfile() {
+	s.configLock.RLock()
+	next := ""
+	for i, name := range s.profiles {
+		if name == s.activeProfile && i+1 < len(s.profiles) {
+			next = s.profiles[i+1]
+		}
+	}
+	if s.activeProfile == "" && len(s.profiles) > 0 {
+		next = s.profiles[0]
+	}
+	s.configLock.RUnlock()
+	s.setProfile(next)
+}
@@ -0,0 +1,103 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// parseProxy checks the proxy of a [server.xxx] section: socks5://[user:pass@]host:port
+// or http://[user:pass@]host:port for HTTP CONNECT
+func parseProxy(str string) (*url.URL, error) {
+	u, err := url.Parse(str)
+	if err != nil || u.Host == "" || u.Scheme != "socks5" && u.Scheme != "socks5h" && u.Scheme != "http" {
+		return nil, fmt.Errorf("Invalid proxy: %s", str)
+	}
+	return u, nil
+}
+
+// upstreamStub answers msg in-process as server would, nil for no answer
+type upstreamStub func(msg []byte, server *upstream) []byte
+
+// stubOf returns the upstreamStub of the query of ctx: that of tests, or mockAnswer
+// for the self-test with -selftest-mock
+func (s *Server) stubOf(ctx context.Context) upstreamStub {
+	if stub, ok := ctx.Value(stubKey).(upstreamStub); ok {
+		return stub
+	}
+	if s.opts.SelfTestMock && s.selftesting(ctx) {
+		return mockAnswer
+	}
+	return nil
+}
+
+// sendTo sends msg to server, through its proxy if it has one, or has its stub
+// answer it, the answer coming in on tx.answers all the same
+func (tx *transaction) sendTo(ctx context.Context, msg []byte, server *upstream) error {
+	if stub := tx.srv.stubOf(ctx); stub != nil {
+		if packed := stub(msg, server); packed != nil {
+			buf := getBuf()
+			n := copy(buf, packed)
+			select {
+			case tx.answers <- answer{server.addr(), buf[:n]}:
+			default:
+				putBuf(buf)
+			}
+		}
+		return nil
+	}
+	if server.proxy == nil {
+		return tx.send(msg, server.addr())
+	}
+	tx.sendTCP(ctx, msg, server)
+	return nil
+}
+
+// dialProxy connects to addr through the proxy u, returning the connection and a
+// reader of it
+func (s *Server) dialProxy(ctx context.Context, u *url.URL, addr string) (net.Conn, io.Reader, error) {
+	if u.Scheme != "http" {
+		dialer, err := proxy.FromURL(u, s.outboundDialer())
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		return conn, conn, err
+	}
+
+	conn, err := s.outboundDialer().DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: make(http.Header)}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Proxy %s: %s", u.Host, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
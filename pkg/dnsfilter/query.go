@@ -0,0 +1,1328 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"dnsfilter/filter"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func (s *Server) handle(ctx context.Context, payload []byte) {
+	clientAddr := ctx.Value(clientAddrKey).(*net.UDPAddr)
+
+	allowed, drop := s.clientAllowed(clientAddr.IP)
+	if drop {
+		if s.verbose() {
+			s.logStd.Printf("%s not allowed, dropped", clientAddr)
+		}
+		return
+	}
+
+	limited := !s.clientRateOK(clientAddr.IP)
+	if limited && s.opts.QPSDrop {
+		if s.verbose() {
+			s.logStd.Printf("%s over rate limit, dropped", clientAddr)
+		}
+		return
+	}
+
+	var parser dnsmessage.Parser
+	hdr, err := parser.Start(payload)
+	if err != nil || hdr.Response { // nothing to answer, or not to be answered not to loop
+		if s.verbose() {
+			s.logStd.Printf("%s malformed query or a response, dropped", clientAddr)
+		}
+		return
+	}
+
+	qs, err := parser.AllQuestions()
+	if err != nil {
+		qs = nil
+	}
+	if s.refuseClient(ctx, hdr, qs, allowed, limited) { // before anything is answered
+		return
+	}
+	if err == nil && hdr.OpCode != 0 {
+		s.handleOpCode(ctx, hdr, qs, payload)
+		return
+	}
+	var forwarded []byte // to upstreams, with our OPT record
+	var clientSize int
+	var clientDO bool
+	if err == nil {
+		forwarded, clientSize, clientDO, err = s.withOPT(payload) // all sections must parse
+	}
+	if err != nil || len(qs) != 1 {
+		if err != nil {
+			qs = nil
+		}
+		if s.verbose() {
+			s.logStd.Printf("%d %s malformed query or %d questions, format error", hdr.ID, clientAddr, len(qs))
+		}
+		if msg, err := reply(hdr, qs, dnsmessage.RCodeFormatError); err == nil {
+			s.sendToClient(ctx, msg)
+		}
+		return
+	}
+
+	ctx, root := s.startTrace(ctx, "dns.query")
+	defer root.finish()
+	root.set("client.address", clientAddr.IP.String())
+	if len(qs) > 0 {
+		root.set("dns.question.name", qs[0].Name.String())
+		root.set("dns.question.type", typeName(qs[0].Type))
+	}
+
+	if s.eventsWanted() {
+		s.publishQuery(hdr.ID, clientAddr, qs)
+	}
+	if s.opts.Stats {
+		s.recordQuery(clientAddr.IP, qs)
+	}
+	if s.opts.Tunnel {
+		score := s.tunnelScore(qs[0].Name.String())
+		ctx = context.WithValue(ctx, tunnelKey, score)
+		root.set("dnsfilter.tunnel_score", strconv.Itoa(score))
+		if s.opts.TunnelAlert > 0 && score >= s.opts.TunnelAlert {
+			s.logStd.Printf("%d %s possible DNS tunnel, %s scoring %d", hdr.ID, clientAddr, qs[0].Name, score)
+		}
+	}
+
+	if s.verbose() {
+		var logBuf strings.Builder
+		fmt.Fprintf(&logBuf, "%d %s", hdr.ID, clientAddr)
+		for _, q := range qs {
+			fmt.Fprintf(&logBuf, " Query[%s] %s", typeName(q.Type), q.Name.String())
+		}
+		fmt.Fprintf(&logBuf, " len %d", len(payload))
+		if dst, ok := ctx.Value(dstAddrKey).(*net.UDPAddr); ok {
+			fmt.Fprintf(&logBuf, " to %s", dst)
+		}
+		s.logStd.Println(logBuf.String())
+	}
+
+	switch verdict, msg := s.pluginsOnQuery(clientAddr.IP, payload); verdict {
+	case filter.Drop:
+		if s.verbose() {
+			s.logStd.Printf("%d %s dropped by plugin", hdr.ID, clientAddr)
+		}
+		return
+	case filter.Block:
+		msg, err = reply(hdr, qs, dnsmessage.RCodeNameError)
+		fallthrough
+	case filter.Reply:
+		if s.verbose() {
+			s.logStd.Printf("%d %s answered by plugin", hdr.ID, clientAddr)
+		}
+		if err == nil && len(msg) >= 12 { // dropped without a header to give the ID
+			binary.BigEndian.PutUint16(msg, hdr.ID)
+			s.sendToClient(ctx, msg)
+		}
+		return
+	}
+
+	payload = forwarded
+	ctx = context.WithValue(ctx, clientSizeKey, clientSize)
+	ctx = context.WithValue(ctx, clientDOKey, clientDO)
+
+	if msg := s.anyAnswer(hdr, qs); msg != nil {
+		if s.verbose() {
+			s.logStd.Printf("%d %s ANY answered by -any %s", hdr.ID, clientAddr, s.opts.Any)
+		}
+		s.sendToClient(ctx, msg)
+		return
+	}
+
+	if msg := s.hostsAnswer(hdr, qs); msg != nil {
+		if s.verbose() {
+			s.logStd.Printf("%d %s answered from hosts", hdr.ID, clientAddr)
+		}
+		s.sendToClient(ctx, msg)
+		return
+	}
+
+	v := s.clientView(clientAddr.IP)
+	if msg := s.zoneAnswer(hdr, qs, v); msg != nil {
+		if s.verbose() {
+			s.logStd.Printf("%d %s answered from local zone", hdr.ID, clientAddr)
+		}
+		s.sendToClient(ctx, msg)
+		return
+	}
+
+	if msg := s.mdnsAnswer(hdr, qs); msg != nil {
+		if s.verbose() {
+			s.logStd.Printf("%d %s answered by mDNS", hdr.ID, clientAddr)
+		}
+		s.sendToClient(ctx, msg)
+		return
+	}
+
+	if msg := s.reverseAnswer(hdr, qs); msg != nil {
+		if s.verbose() {
+			s.logStd.Printf("%d %s answered from reverse networks", hdr.ID, clientAddr)
+		}
+		s.sendToClient(ctx, msg)
+		return
+	}
+
+	if msg := s.cacheLookup(hdr, qs, clientAddr.IP, clientDO); msg != nil {
+		s.sendToClient(ctx, msg)
+		return
+	}
+
+	upstreams, strategy := s.scriptUpstreams(qs, clientAddr.IP), s.opts.Strategy
+	if upstreams == nil {
+		upstreams, strategy = s.upstreamsFor(qs, v)
+	}
+	upstreams = s.activeUpstreams(upstreams)
+	for _, server := range upstreams {
+		if server == s.recursor {
+			s.queryRecursive(ctx, payload, qs)
+			return
+		}
+	}
+	s.query(ctx, payload, qs, upstreams, strategy)
+}
+
+// refuseClient answers REFUSED to a client not allowed or over its rate limit, telling if it did
+func (s *Server) refuseClient(ctx context.Context, hdr dnsmessage.Header, qs []dnsmessage.Question, allowed, limited bool) bool {
+	clientAddr := ctx.Value(clientAddrKey).(*net.UDPAddr)
+	switch {
+	case !allowed:
+		if s.verbose() {
+			s.logStd.Printf("%d %s not allowed, refused", hdr.ID, clientAddr)
+		}
+	case limited:
+		if s.verbose() {
+			s.logStd.Printf("%d %s over rate limit, refused", hdr.ID, clientAddr)
+		}
+	default:
+		return false
+	}
+	if msg, err := reply(hdr, qs, dnsmessage.RCodeRefused); err == nil {
+		s.sendToClient(ctx, msg)
+	}
+	return true
+}
+
+// sendToClient is the only way out to clients, subject to response rate limiting.
+// msg must not be used afterwards as it may go back to bufPool.
+func (s *Server) sendToClient(ctx context.Context, msg []byte) {
+	clientAddr := ctx.Value(clientAddrKey).(*net.UDPAddr)
+	stream, tcp := ctx.Value(tcpClientKey).(*tcpClient)
+
+	if size, ok := ctx.Value(clientSizeKey).(int); ok { // absent for early refusals
+		var err error
+		if s.opts.DNSSEC && !ctx.Value(clientDOKey).(bool) {
+			if msg, err = withoutDNSSEC(msg); err != nil {
+				s.logErr.Println(err)
+				return
+			}
+		}
+		if msg, err = fitClient(msg, size, tcp); err != nil {
+			s.logErr.Println(err)
+			return
+		}
+	}
+
+	action := rrlPass
+	if !tcp { // no reflection over TCP
+		action = s.rrlCheck(clientAddr.IP, msg)
+	}
+	switch action {
+	case rrlDrop:
+		if s.verbose() {
+			s.logStd.Printf("%s response rate limited, dropped", clientAddr)
+		}
+		return
+	case rrlTruncate:
+		if s.verbose() {
+			s.logStd.Printf("%s response rate limited, slipped", clientAddr)
+		}
+		var err error
+		if msg, err = truncated(msg); err != nil {
+			return
+		}
+	}
+
+	if s.eventsWanted() {
+		s.publishReply(clientAddr, msg)
+	}
+	if s.opts.Tunnel {
+		s.tunnelObserve(msg)
+	}
+	if s.queryLog != nil {
+		s.logQuery(clientAddr.IP, msg)
+	}
+	if sendSpan := s.startSpan(ctx, "dns.send"); sendSpan != nil {
+		if len(msg) >= 12 {
+			sendSpan.set("dns.rcode", rcodeName(dnsmessage.RCode(msg[3]&0x0f)))
+		}
+		defer sendSpan.finish()
+	}
+	if tcp {
+		stream.write(msg)
+		return
+	}
+	if dst, ok := ctx.Value(dstAddrKey).(*net.UDPAddr); ok {
+		ctx.Value(listenerKey).(*batchConn).writeFrom(msg, clientAddr, dst)
+		return
+	}
+	ctx.Value(listenerKey).(*batchConn).writeTo(msg, clientAddr)
+}
+
+// reply builds an answerless response to the query with the given rcode
+func reply(hdr dnsmessage.Header, qs []dnsmessage.Question, rcode dnsmessage.RCode) ([]byte, error) {
+	hdr.Response = true
+	hdr.Authoritative = false
+	hdr.Truncated = false
+	hdr.RecursionAvailable = true
+	hdr.RCode = rcode
+
+	msg := dnsmessage.Message{Header: hdr, Questions: qs}
+	return msg.Pack()
+}
+
+func (s *Server) query(ctx context.Context, clientPayload []byte, qs []dnsmessage.Question, upstreams []*upstream, strategy string) {
+	ctx, cancel := context.WithCancel(ctx) // ends exchanges and timers once answered or past the deadline
+	defer cancel()
+	tx := s.newTransaction(ctx, qs)
+	defer tx.finish()
+
+	// upstreams see a random ID instead of the client's, so that forged answers must guess it
+	clientID := binary.BigEndian.Uint16(clientPayload)
+	payload := append([]byte(nil), clientPayload...)
+	binary.BigEndian.PutUint16(payload, tx.id)
+	sentQs := qs
+	if s.opts.Case0x20 {
+		randomizeCase(payload)
+		var parser dnsmessage.Parser
+		parser.Start(payload)
+		sentQs, _ = parser.AllQuestions()
+	}
+
+	var (
+		clientSendTimer *time.Timer
+		clientSendTime  time.Time
+		clientSendLock  sync.Mutex
+
+		sentTimes = make(map[*upstream]time.Time) // pending ones, guarded by clientSendLock
+		exchanges = make(map[*upstream]*span)     // pending ones of traced queries, guarded by clientSendLock
+		resent    = make(map[*upstream]bool)      // RTT of these is ambiguous, guarded by clientSendLock
+		expiries  = make(chan *upstream)          // sent ones reaching their timeout
+		expired   = make(map[*upstream]bool)      // no longer waited for
+		overTCP   = make(map[*upstream]bool)      // asked again for a truncated answer, guarded by clientSendLock
+		timers    []*time.Timer                   // of expiries, guarded by clientSendLock
+	)
+	defer func() {
+		clientSendLock.Lock()
+		for _, timer := range timers {
+			timer.Stop()
+		}
+		clientSendLock.Unlock()
+	}()
+
+	send := func(server *upstream) {
+		exchange := s.startSpan(ctx, "dns.exchange")
+		exchange.set("server.address", server.String())
+		clientSendLock.Lock()
+		sentTimes[server] = time.Now()
+		if exchange != nil {
+			exchanges[server] = exchange
+		}
+		clientSendLock.Unlock()
+		server.count(upstreamSent, 1)
+		mocked := s.stubOf(ctx) != nil
+		if err := tx.sendTo(ctx, payload, server); err != nil {
+			s.logErr.Println(err)
+		}
+		if alt := server.altAddr(); alt != nil && server.proxy == nil && !mocked {
+			go func() { // race the other family if no answer within -stagger
+				if !sleep(ctx, s.opts.Stagger) {
+					return
+				}
+
+				clientSendLock.Lock()
+				_, pending := sentTimes[server]
+				pending = pending && !overTCP[server]
+				if pending {
+					resent[server] = true
+				}
+				clientSendLock.Unlock()
+				if pending {
+					if err := tx.send(payload, alt); err != nil {
+						s.logErr.Println(err)
+					}
+				}
+			}()
+		}
+		timer := time.AfterFunc(server.queryTimeout(), func() {
+			select {
+			case expiries <- server:
+			case <-ctx.Done():
+			}
+		})
+		clientSendLock.Lock()
+		timers = append(timers, timer)
+		clientSendLock.Unlock()
+
+		if s.opts.Retries <= 0 || server.proxy != nil || mocked { // TCP retransmits by itself
+			return
+		}
+		go func() { // retransmit with exponential backoff until the server answers
+			wait := s.opts.RetryAfter
+			for i := 0; i < s.opts.Retries; i++ {
+				if !sleep(ctx, wait) {
+					return
+				}
+
+				clientSendLock.Lock()
+				_, pending := sentTimes[server]
+				pending = pending && !overTCP[server]
+				if pending {
+					resent[server] = true
+				}
+				clientSendLock.Unlock()
+				if !pending {
+					return
+				}
+				if err := tx.send(payload, server.addr()); err != nil {
+					s.logErr.Println(err)
+					return
+				}
+				wait *= 2
+			}
+		}()
+	}
+
+	// askOverTCP asks server again over TCP for the whole of its answer truncated over
+	// UDP, telling false if it was already or can't be
+	askOverTCP := func(server *upstream) bool {
+		clientSendLock.Lock()
+		defer clientSendLock.Unlock()
+		if overTCP[server] || server.proxy != nil || s.opts.MaxSize <= s.opts.EDNS {
+			return false
+		}
+		overTCP[server], resent[server] = true, true // RTT of the answer is that of both
+		tx.sendTCP(ctx, payload, server)
+		return true
+	}
+
+	sentTime := time.Now()
+	if strategy == "all" {
+		upstreams = s.subsetUpstreams(upstreams)
+		for _, server := range upstreams {
+			send(server)
+		}
+	} else if order := s.pickUpstreams(upstreams, strategy); len(order) > 0 {
+		send(order[0])
+		go func() { // try the next one if nothing accepted within -failover
+			defer s.recoverPanic("failing over")
+			for _, server := range order[1:] {
+				if !sleep(ctx, s.opts.Failover) {
+					return
+				}
+
+				clientSendLock.Lock()
+				accepted := !clientSendTime.IsZero()
+				clientSendLock.Unlock()
+				if accepted {
+					return
+				}
+				send(server)
+			}
+		}()
+	}
+
+	var (
+		window     <-chan time.Time // -pick best only
+		windowOver bool
+		best       *candidate
+		candidates []*candidate // all of them with -consensus
+		answered   int
+	)
+	if s.opts.Pick == "best" {
+		window = time.After(s.opts.RaceWindow)
+	}
+	// agreed tells if enough answers are in to compare with -consensus
+	agreed := func() bool {
+		return s.opts.Consensus == 0 || len(candidates) >= s.opts.Consensus
+	}
+	sendBest := func() {
+		if s.opts.Consensus > 0 {
+			best = s.consensus(ctx, qs[0].Name.String(), candidates)
+		}
+		clientSendLock.Lock()
+		clientSendTime = time.Now() // stops failover
+		clientSendLock.Unlock()
+		if !tx.reply() {
+			putBuf(best.msg)
+			return
+		}
+		defer tx.finish()
+		best.msg = s.synthesizeAAAA(ctx, best.server, best.msg)
+		if s.opts.Flatten {
+			best.msg = flattenCNAME(best.msg)
+		}
+		best.msg = s.stripSVCB(best.msg)
+		best.msg = s.clampTTL(best.msg)
+		s.cacheStore(best.msg, ctx.Value(clientAddrKey).(*net.UDPAddr).IP, ctx.Value(clientDOKey).(bool))
+		s.sendToClient(ctx, best.msg)
+	}
+
+	total := s.opts.Deadline
+	if total <= 0 {
+		for _, server := range upstreams {
+			if server.queryTimeout() > total {
+				total = server.queryTimeout()
+			}
+		}
+	}
+	deadline := time.NewTimer(time.Until(sentTime.Add(total)))
+	defer deadline.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-tx.done: // answer sent
+			waiting = false
+		case <-deadline.C:
+			waiting = false
+			if best != nil {
+				sendBest()
+			}
+		case <-window:
+			windowOver = true
+			if best != nil && agreed() {
+				sendBest()
+				waiting = false
+			}
+		case server := <-expiries: // given up on, counted as slow
+			clientSendLock.Lock()
+			_, pending := sentTimes[server]
+			if pending {
+				delete(sentTimes, server)
+				server.recordRTT(server.queryTimeout())
+				server.count(upstreamTimeouts, 1)
+				if exchange := exchanges[server]; exchange != nil {
+					exchange.fail("timed out")
+					exchange.finish()
+					delete(exchanges, server)
+				}
+			}
+			clientSendLock.Unlock()
+			if !pending {
+				continue
+			}
+			expired[server] = true
+			if s.opts.Pick == "best" {
+				answered++
+				if best != nil && answered >= len(upstreams) {
+					sendBest()
+					waiting = false
+				}
+			}
+		case a := <-tx.answers: // buffer owned by sendBack from then on
+			payload, n := a.msg, len(a.msg)
+			i, ok := s.lookupServer(a.from)
+			if !ok || expired[s.servers[i]] {
+				putBuf(payload)
+				continue
+			}
+			if s.opts.Case0x20 && !answersQuery(payload, tx.id, sentQs, true) { // questions checked already, but not their case
+				s.startSpan(ctx, "dns.mismatch").finish()
+				atomic.AddUint64(&s.servers[i].mismatched, 1)
+				s.logErr.Printf("Answer from %s not matching query %d, possibly spoofed", s.servers[i], clientID)
+				putBuf(payload)
+				continue
+			}
+			clientSendLock.Lock()
+			t, sent := sentTimes[s.servers[i]]
+			elapsed := time.Since(t)
+			fast := sent && !resent[s.servers[i]] && s.servers[i].tooFast(elapsed)
+			clientSendLock.Unlock()
+			if fast && s.fastAnswer(ctx, s.servers[i], clientID, elapsed) {
+				putBuf(payload)
+				continue
+			}
+			if payload[2]&0x02 != 0 && askOverTCP(s.servers[i]) { // TC
+				putBuf(payload)
+				continue
+			}
+			binary.BigEndian.PutUint16(payload, clientID)
+			if end := qnameEnd(clientPayload); s.opts.Case0x20 && end > 0 && end <= n {
+				copy(payload[12:end], clientPayload[12:end]) // the client's own case back
+			}
+
+			rtt := s.servers[i].queryTimeout() // unknown, ranked last
+			clientSendLock.Lock()
+			if t, ok := sentTimes[s.servers[i]]; ok {
+				s.servers[i].count(upstreamAnswered, 1)
+				if s.servers[i].altAddr() != nil {
+					if familyOf(a.from.IP) == "v4" {
+						s.servers[i].count(upstreamWonV4, 1)
+					} else {
+						s.servers[i].count(upstreamWonV6, 1)
+					}
+				}
+				if !resent[s.servers[i]] {
+					rtt = time.Since(t)
+					s.servers[i].recordRTT(rtt)
+					if !fast {
+						s.servers[i].learnFloor(rtt)
+					}
+					s.servers[i].count(upstreamRTTTotal, uint64(rtt))
+					s.servers[i].count(upstreamRTTCount, 1)
+				}
+				delete(sentTimes, s.servers[i])
+			}
+			if exchange := exchanges[s.servers[i]]; exchange != nil {
+				exchange.set("dns.answer.length", strconv.Itoa(n))
+				exchange.finish()
+				delete(exchanges, s.servers[i])
+			}
+			clientSendLock.Unlock()
+
+			if s.opts.Pick == "best" { // scored here, msg kept only if the best so far
+				answered++
+				c := s.scoreAnswer(ctx, i+1, payload, rtt)
+				if c == nil {
+					putBuf(payload)
+				} else if s.opts.Consensus > 0 { // compared once enough are in
+					candidates = append(candidates, c)
+					if best == nil || c.beats(best) {
+						best = c
+					}
+				} else if best == nil || c.beats(best) || s.servers[i].trusted {
+					if best != nil {
+						putBuf(best.msg)
+					}
+					best = c
+				} else {
+					putBuf(payload)
+				}
+				if best != nil && (windowOver && agreed() || answered >= len(upstreams) ||
+					s.opts.Consensus == 0 && s.servers[i].trusted && best == c) {
+					sendBest()
+					waiting = false
+				}
+				continue
+			}
+
+			s.inflight.Add(1)
+			go s.sendBack(ctx, i+1, payload, tx, &clientSendTimer, &clientSendTime, &clientSendLock)
+		}
+	}
+
+	if time.Now().After(sentTime.Add(total)) { // past the deadline, count those unanswered as slow
+		clientSendLock.Lock()
+		for server := range sentTimes {
+			server.recordRTT(server.queryTimeout())
+			server.count(upstreamTimeouts, 1)
+		}
+		clientSendLock.Unlock()
+	}
+
+	clientSendLock.Lock()
+	for _, exchange := range exchanges { // answers too late are not waited for
+		exchange.fail("no answer while waiting")
+		exchange.finish()
+	}
+	clientSendLock.Unlock()
+}
+
+func (s *Server) sendBack(ctx context.Context, serverIndex int, msgIn []byte, tx *transaction, clientSendTimer **time.Timer, clientSendTime *time.Time, clientSendLock *sync.Mutex) {
+	defer s.inflight.Done()
+	defer s.recoverPanic("judging an answer")
+
+	if s.opts.DNSSEC && !s.validated(serverIndex, msgIn) { // before rules, bogus answers adding to no ipset, stats or webhook
+		putBuf(msgIn)
+		return
+	}
+	msgOut, delay, _, _ := s.determine(ctx, serverIndex, msgIn)
+	if delay < 0 {
+		putBuf(msgIn)
+		return
+	}
+	msgIn = msgOut
+	if s.servers[serverIndex-1].trusted { // ends the race, delayed answers of others included
+		delay = 0
+	}
+
+	newClientSendTime := time.Now().Add(delay)
+
+	// Lock to prevent race when answers come in simultaneously. Context is not handy for this
+	clientSendLock.Lock()
+
+	// if planned send time doesn't exist, go ahead.
+	// or if calculated send time is prior to the previously planned one, go ahead.
+	if clientSendTime.IsZero() || newClientSendTime.Before(*clientSendTime) {
+		// if there's no previous timer or stop is successful, set new planned time
+		if *clientSendTimer == nil || (*clientSendTimer).Stop() {
+			if *clientSendTimer != nil { // the stopped one won't run
+				s.inflight.Done()
+			}
+			s.inflight.Add(1)
+			*clientSendTimer = time.AfterFunc(delay, func() {
+				defer s.inflight.Done()
+				defer tx.finish() // once sent, ctx lasting for synthesizeAAAA
+				defer s.recoverPanic("answering a client")
+				if !tx.reply() {
+					putBuf(msgIn)
+					return
+				}
+				msgIn = s.synthesizeAAAA(ctx, serverIndex, msgIn)
+				if s.opts.Flatten {
+					msgIn = flattenCNAME(msgIn)
+				}
+				msgIn = s.stripSVCB(msgIn)
+				msgIn = s.clampTTL(msgIn)
+				s.cacheStore(msgIn, ctx.Value(clientAddrKey).(*net.UDPAddr).IP, ctx.Value(clientDOKey).(bool))
+				s.sendToClient(ctx, msgIn) // hands msgIn over to the writer
+			})
+			*clientSendTime = newClientSendTime
+		} // If stop fails, let the previous timer fire
+	}
+
+	clientSendLock.Unlock()
+}
+
+// determine applies rules to an answer, returning it with records removed by FILTER
+// rules, the delay before sending it, negative to drop it, the position of the rule
+// deciding it and the sum of PREFER and PENALIZE scores of rules matched on the way
+func (s *Server) determine(ctx context.Context, serverIndex int, msgIn []byte) (msgOut []byte, delay time.Duration, rank int, score int) {
+	msgOut, rank = msgIn, -1
+	delay = -1 // Assume DROP if parse fails
+
+	var logBuf strings.Builder
+
+	var parser dnsmessage.Parser
+	hdr, err := parser.Start(msgIn)
+	if err != nil {
+		s.logErr.Println(err)
+		return
+	}
+
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		s.logErr.Println(err)
+		return
+	}
+	answers, err := parser.AllAnswers() // parse answers in advance since there are several rules
+	if err != nil {
+		s.logErr.Println(err)
+		return
+	}
+	var sections [3][]dnsmessage.Resource // by section, for rules matching beyond answers
+	sections[0] = answers
+	if sections[1], err = parser.AllAuthorities(); err == nil {
+		sections[2], err = parser.AllAdditionals()
+	}
+	if err != nil { // only rules on those sections are affected
+		s.logErr.Println(err)
+	}
+
+	defer func() {
+		s.servers[serverIndex-1].count(upstreamJudged, 1)
+		if delay < 0 {
+			s.servers[serverIndex-1].count(upstreamDropped, 1)
+		}
+	}()
+
+	var hookDecided, hookVerdict string // plugin or script deciding, for events, stats and traces
+	if s.eventsWanted() || s.opts.Stats || traced(ctx) || s.webhookEvents != nil || s.selftesting(ctx) {
+		rulesSpan := s.startSpan(ctx, "dns.rules")
+		rulesSpan.set("server.address", s.servers[serverIndex-1].String())
+		defer func() {
+			ruleName, verdict := s.decisionOf(rank, delay, hookDecided, hookVerdict)
+			rulesSpan.set("dnsfilter.rule", ruleName)
+			rulesSpan.set("dnsfilter.verdict", verdict)
+			rulesSpan.finish()
+			if s.opts.Stats {
+				s.recordVerdict(questions, verdict)
+			}
+			if s.eventsWanted() {
+				s.publishAnswer(hdr.ID, serverIndex, questions, msgOut, delay, ruleName, verdict)
+			}
+			if hookDecided == "" {
+				s.notify(ctx, serverIndex, questions, rank, verdict)
+			}
+			if s.selftesting(ctx) {
+				s.recordSelftest(questions, verdict)
+			}
+		}()
+	}
+
+	if s.verbose() {
+		fmt.Fprintf(&logBuf, "%d %s Answer len %d", hdr.ID, s.servers[serverIndex-1], len(msgIn))
+		if hdr.RCode != dnsmessage.RCodeSuccess {
+			fmt.Fprintf(&logBuf, " %s", hdr.RCode)
+		}
+		for _, ans := range answers {
+			fmt.Fprintf(&logBuf, " %s %s TTL %d %v", ans.Header.Name, typeName(ans.Header.Type), ans.Header.TTL, ans.Body)
+		}
+	}
+
+	filtered := false
+	// checkRebind strips private addresses off answers per -rebind, telling false if
+	// the answer is to be dropped instead
+	checkRebind := func() bool {
+		kept, rebound := s.rebindCheck(questions, answers)
+		if rebound == 0 {
+			return true
+		}
+		s.logErr.Printf("%d %s answered %s with %d private addresses, possible DNS rebinding", hdr.ID, s.servers[serverIndex-1], questions[0].Name, rebound)
+		if s.opts.Rebind == "drop" {
+			if s.verbose() {
+				fmt.Fprintf(&logBuf, " [REBIND DROP]")
+				s.logStd.Println(&logBuf)
+			}
+			return false
+		}
+		sections[0], answers, filtered = kept, kept, true
+		if s.verbose() {
+			fmt.Fprintf(&logBuf, " [REBIND %d]", rebound)
+		}
+		return true
+	}
+
+	clientIP := ctx.Value(clientAddrKey).(*net.UDPAddr).IP
+	verdict, replyMsg := s.pluginsOnResponse(clientIP, serverIndex, msgIn)
+	hookName := "PLUGIN"
+	var rewritten []dnsmessage.Resource
+	if verdict == filter.Continue {
+		if verdict, rewritten, err = s.scriptVerdict(questions, clientIP, serverIndex, hdr.RCode, answers); err != nil {
+			s.logErr.Println(err) // rules decide
+		}
+		hookName = "SCRIPT"
+	}
+	if verdict != filter.Continue {
+		hookDecided, hookVerdict = hookName, verdictNames[verdict]
+		if s.verbose() {
+			fmt.Fprintf(&logBuf, " [%s %s]", hookName, verdictNames[verdict])
+		}
+		if verdict == filter.Accept && !checkRebind() { // rules are skipped, -rebind isn't
+			hookDecided, hookVerdict = "", ""
+			return msgIn, -1, -1, 0
+		}
+		if s.verbose() {
+			s.logStd.Println(&logBuf)
+		}
+		switch verdict {
+		case filter.Drop:
+			return msgIn, -1, -1, 0
+		case filter.Block:
+			if msgOut, err = blockedReply(hdr, questions, nil); err != nil {
+				s.logErr.Println(err)
+				return msgIn, -1, -1, 0
+			}
+		case filter.Reply:
+			if len(replyMsg) < 12 { // dropped without a header to give the ID
+				return msgIn, -1, -1, 0
+			}
+			binary.BigEndian.PutUint16(replyMsg, hdr.ID)
+			msgOut = replyMsg
+		case filter.Accept:
+			if filtered {
+				hdr.AuthenticData = false // no longer what was signed
+				m := dnsmessage.Message{Header: hdr, Questions: questions, Answers: sections[0], Authorities: sections[1], Additionals: sections[2]}
+				if msgOut, err = m.Pack(); err != nil {
+					s.logErr.Println(err)
+					return msgIn, -1, -1, 0
+				}
+			}
+		}
+		return msgOut, 0, 0, 0
+	}
+	if rewritten != nil {
+		sections[0], answers, filtered = rewritten, rewritten, true
+		if s.verbose() {
+			fmt.Fprintf(&logBuf, " [SCRIPT %d RECORDS]", len(rewritten))
+		}
+	}
+	if !checkRebind() {
+		return msgIn, -1, -1, 0
+	}
+
+	hasOther := false // looked up beforehand, not to hold configLock meanwhile
+	if len(questions) == 1 && s.needsOtherFamily(questions[0].Type) {
+		hasOther = s.otherFamilyExists(ctx, serverIndex, questions[0])
+	}
+
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	profile := s.profileOf(clientIP)
+	aliases := aliasesOf(answers)
+	now := time.Now()
+
+	var traceBuf strings.Builder // why each rule considered did or didn't match, with -trace
+	trace := func(rule *rule, reason string) {
+		if s.opts.Trace {
+			fmt.Fprintf(&traceBuf, "\n\t%s: %s", rule.name, reason)
+		}
+	}
+
+	for pos, rule := range s.rules { // rule by rule. continue if match failed
+		match := &rule.match
+
+		if match.client != nil && !match.client.containsIP(clientIP) {
+			trace(rule, "client mismatch")
+			continue
+		}
+
+		if match.server != 0 && match.server != uint(serverIndex) {
+			trace(rule, "server mismatch")
+			continue
+		}
+
+		if match.profiles != nil && !containsString(match.profiles, profile) {
+			trace(rule, "profile not active")
+			continue
+		}
+
+		if !match.activeAt(now) {
+			trace(rule, "time or days mismatch")
+			continue
+		}
+
+		if match.rcodes != nil && !containsRCode(match.rcodes, hdr.RCode) {
+			trace(rule, "rcode mismatch")
+			continue
+		}
+
+		if match.blocklist != 0 && (len(questions) != 1 || !s.blocklists[match.blocklist-1].blocked(questions[0].Name.String())) {
+			trace(rule, "blocklist miss")
+			continue
+		}
+
+		if match.allowlist != 0 && (len(questions) != 1 || !s.allowlists[match.allowlist-1].blocked(questions[0].Name.String())) {
+			trace(rule, "allowlist miss")
+			continue
+		}
+
+		var policy *rpzPolicy
+		if match.rpz != 0 {
+			if policy = s.rpzs[match.rpz-1].check(questions, sections); policy == nil {
+				trace(rule, "rpz miss")
+				continue
+			}
+		}
+
+		if len(answers) < match.minAnswers || match.maxAnswers >= 0 && len(answers) > match.maxAnswers {
+			trace(rule, "answer count mismatch")
+			continue
+		}
+
+		if score, _ := ctx.Value(tunnelKey).(int); match.tunnel > 0 && score < match.tunnel {
+			trace(rule, "tunnel score "+strconv.Itoa(score))
+			continue
+		}
+
+		if rule.target == targetFilter {
+			removed := 0
+			for i := range sections {
+				if match.sections&(1<<i) == 0 {
+					continue
+				}
+				kept := sections[i][:0:0]
+				for _, rr := range sections[i] {
+					if rr.Header.Type != dnsmessage.TypeOPT && s.matchAnswer(match, rr, aliases) {
+						removed++
+					} else {
+						kept = append(kept, rr)
+					}
+				}
+				sections[i] = kept
+			}
+			if removed > 0 {
+				if s.verbose() {
+					fmt.Fprintf(&logBuf, " [FILTER %d]", removed)
+				}
+				atomic.AddUint64(&rule.hits, 1)
+				answers, aliases, filtered = sections[0], aliasesOf(sections[0]), true
+				trace(rule, "filtered, continuing")
+			} else {
+				trace(rule, "nothing to filter")
+			}
+			continue
+		}
+
+		// otherwise it may match without answers, e.g. NXDOMAIN or all filtered out
+		if match.onAnswers() || !match.onMessage() && !filtered {
+			matched, reason := false, "no records"
+		search:
+			for i, records := range sections {
+				if match.sections&(1<<i) == 0 {
+					continue
+				}
+				for _, rr := range records {
+					if rr.Header.Type == dnsmessage.TypeOPT {
+						continue
+					}
+					if reason = s.answerMismatch(match, rr, aliases); reason == "" {
+						matched = true
+						break search
+					}
+				}
+			}
+			if !matched {
+				trace(rule, reason)
+				continue
+			}
+		}
+
+		if rule.target == targetStripAAAA || rule.target == targetStripA {
+			if rule.ifOther && !hasOther {
+				trace(rule, "no records of the other family")
+				continue
+			}
+			stripType := dnsmessage.TypeAAAA
+			if rule.target == targetStripA {
+				stripType = dnsmessage.TypeA
+			}
+			kept := answers[:0:0]
+			for _, ans := range answers {
+				if ans.Header.Type != stripType {
+					kept = append(kept, ans)
+				}
+			}
+			if removed := len(answers) - len(kept); removed > 0 {
+				if s.verbose() {
+					fmt.Fprintf(&logBuf, " [STRIP_%s %d]", typeName(stripType), removed)
+				}
+				atomic.AddUint64(&rule.hits, 1)
+				sections[0] = kept
+				answers, aliases, filtered = kept, aliasesOf(kept), true
+				trace(rule, "stripped, continuing")
+			} else {
+				trace(rule, "nothing to strip")
+			}
+			continue
+		}
+
+		if s.verbose() {
+			switch rule.target {
+			case targetDrop:
+				logBuf.WriteString(" [DROP]")
+			case targetAccept:
+				logBuf.WriteString(" [ACCEPT]")
+			case targetAllow:
+				logBuf.WriteString(" [ALLOW]")
+			case targetDelay:
+				fmt.Fprintf(&logBuf, " [DELAY %v]", rule.delay)
+			case targetIPSetAdd:
+				fmt.Fprintf(&logBuf, " [IPSET_ADD %s]", rule.kset.name)
+			case targetBlock:
+				logBuf.WriteString(" [BLOCK]")
+			case targetRPZ:
+				fmt.Fprintf(&logBuf, " [RPZ %s]", rpzActionNames[policy.action])
+			case targetPrefer, targetPenalize:
+				fmt.Fprintf(&logBuf, " [SCORE %+d]", rule.score)
+			}
+			if rule.cont {
+				logBuf.WriteString(" CONTINUE")
+			}
+		}
+
+		if rule.target == targetPrefer || rule.target == targetPenalize {
+			atomic.AddUint64(&rule.hits, 1)
+			score += rule.score
+			trace(rule, "scored, continuing")
+			continue
+		}
+
+		if rule.cont {
+			atomic.AddUint64(&rule.hits, 1)
+			trace(rule, "matched, continuing")
+			if rule.target == targetIPSetAdd {
+				go s.addToKernelSet(rule.kset, answers)
+			}
+			continue
+		}
+
+		if s.verbose() {
+			trace(rule, "matched")
+			logBuf.WriteString(traceBuf.String())
+			s.logStd.Println(&logBuf)
+		}
+
+		if rule.target == targetIPSetAdd {
+			go s.addToKernelSet(rule.kset, answers)
+		}
+
+		if rule.target == targetBlock {
+			atomic.AddUint64(&rule.hits, 1)
+			if msgOut, err = blockedReply(hdr, questions, rule.blockWith); err != nil {
+				s.logErr.Println(err)
+				return msgIn, -1, -1, score
+			}
+			return msgOut, 0, pos, score
+		}
+
+		atomic.AddUint64(&rule.hits, 1)
+		if filtered {
+			hdr.AuthenticData = false // no longer what was signed
+			m := dnsmessage.Message{Header: hdr, Questions: questions, Answers: sections[0], Authorities: sections[1], Additionals: sections[2]}
+			if msgOut, err = m.Pack(); err != nil {
+				s.logErr.Println(err)
+				return msgIn, -1, -1, score
+			}
+		}
+		if rule.target == targetRPZ {
+			if msgOut, delay, err = policy.apply(hdr, questions, msgOut); err != nil {
+				s.logErr.Println(err)
+				return msgIn, -1, -1, score
+			}
+			return msgOut, delay, pos, score
+		}
+		return msgOut, rule.delay, pos, score // if everything goes smoothly
+	}
+
+	if s.verbose() {
+		logBuf.WriteString(" [DROP]")
+		logBuf.WriteString(traceBuf.String())
+		s.logStd.Println(&logBuf)
+	}
+	return
+}
+
+// decisionOf names what decided on an answer judged by determine, and the verdict:
+// a plugin or the script if hookName is set, the rule at rank otherwise
+func (s *Server) decisionOf(rank int, delay time.Duration, hookName, hookVerdict string) (string, string) {
+	if hookName != "" {
+		return hookName, hookVerdict
+	}
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	if rank >= 0 && rank < len(s.rules) {
+		return s.rules[rank].name, targetNames[s.rules[rank].target]
+	}
+	return "", "DROP"
+}
+
+// matchAnswer tells if a single record meets the conditions of match on answers,
+// aliases being used for names with follow_cname. Callers hold configLock.
+func (s *Server) matchAnswer(match *match, ans dnsmessage.Resource, aliases map[string][]dnsmessage.Name) bool {
+	return s.answerMismatch(match, ans, aliases) == ""
+}
+
+// answerMismatch tells the first condition of match on answers a single record fails,
+// empty if none
+func (s *Server) answerMismatch(match *match, ans dnsmessage.Resource, aliases map[string][]dnsmessage.Name) string {
+	if match.name != "" {
+		if !match.followCNAME {
+			if !matchName(ans.Header.Name, match.name) {
+				return "name mismatch"
+			}
+		} else if cname, ok := ans.Body.(*dnsmessage.CNAMEResource); !(ok && matchName(cname.CNAME, match.name)) &&
+			!matchChainName(ans.Header.Name, match.name, aliases, 0) {
+			return "name mismatch"
+		}
+	}
+
+	if match.answerType != 0 && match.answerType != ans.Header.Type {
+		return "type mismatch"
+	}
+
+	if match.txtContains != "" || match.txtRegex != nil {
+		text, ok := recordText(ans)
+		if !ok || match.txtContains != "" && !strings.Contains(strings.ToLower(text), match.txtContains) ||
+			match.txtRegex != nil && !match.txtRegex.MatchString(text) {
+			return "txt mismatch"
+		}
+	}
+
+	if match.ipset != 0 {
+		found := false // neither A nor AAAA nor hints, not match
+		for _, ip := range answerIPs(ans) {
+			if found = s.ipsets[match.ipset-1].containsIP(ip); found {
+				break
+			}
+		}
+		if !found {
+			return "ipset miss"
+		}
+	}
+
+	if match.geoip != nil {
+		found := false
+		for _, ip := range answerIPs(ans) {
+			if found = containsFold(match.geoip, s.geoipDB.country(ip)); found {
+				break
+			}
+		}
+		if !found {
+			return "geoip miss"
+		}
+	}
+	return ""
+}
+
+// answersQuery tells if msg is a response with the given ID to questions qs,
+// names compared case sensitively if exactCase
+func answersQuery(msg []byte, id uint16, qs []dnsmessage.Question, exactCase bool) bool {
+	var parser dnsmessage.Parser
+	hdr, err := parser.Start(msg)
+	if err != nil || !hdr.Response || hdr.ID != id {
+		return false
+	}
+	rqs, err := parser.AllQuestions()
+	if err != nil || len(rqs) != len(qs) {
+		return false
+	}
+	for i, q := range qs {
+		if rqs[i].Type != q.Type || rqs[i].Class != q.Class || !strings.EqualFold(rqs[i].Name.String(), q.Name.String()) ||
+			exactCase && rqs[i].Name.String() != q.Name.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// qnameEnd returns the offset after the first question name, -1 if malformed
+func qnameEnd(msg []byte) int {
+	off := 12
+	for off < len(msg) && msg[off] != 0 {
+		if msg[off] >= 64 { // compression pointer, not expected there
+			return -1
+		}
+		off += int(msg[off]) + 1
+	}
+	if off >= len(msg) {
+		return -1
+	}
+	return off + 1
+}
+
+// randomizeCase flips letters of the first question name at random (DNS 0x20).
+// Length octets are below 64 so never look like letters.
+func randomizeCase(msg []byte) {
+	end := qnameEnd(msg)
+	if end < 0 {
+		return
+	}
+	bits := make([]byte, end)
+	if _, err := rand.Read(bits); err != nil {
+		panic(err)
+	}
+	for i := 12; i < end; i++ {
+		if c := msg[i] | 0x20; c >= 'a' && c <= 'z' && bits[i]&1 != 0 {
+			msg[i] ^= 0x20
+		}
+	}
+}
+
+func randomID() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// answerIP returns the address of an A or AAAA record, nil for other types
+func answerIP(ans dnsmessage.Resource) net.IP {
+	switch body := ans.Body.(type) {
+	case *dnsmessage.AResource:
+		return body.A[:]
+	case *dnsmessage.AAAAResource:
+		return body.AAAA[:]
+	}
+	return nil
+}
+
+const typeSPF dnsmessage.Type = 99
+
+// recordText returns the character strings of a TXT or SPF record joined, as SPF
+// reads them (RFC 7208 section 3.3), false for other types
+func recordText(ans dnsmessage.Resource) (string, bool) {
+	switch body := ans.Body.(type) {
+	case *dnsmessage.TXTResource:
+		return strings.Join(body.TXT, ""), true
+	case *dnsmessage.UnknownResource:
+		if body.Type != typeSPF {
+			return "", false
+		}
+		var text strings.Builder
+		for data := body.Data; len(data) > 0; {
+			n := int(data[0])
+			if 1+n > len(data) {
+				return "", false
+			}
+			text.Write(data[1 : 1+n])
+			data = data[1+n:]
+		}
+		return text.String(), true
+	}
+	return "", false
+}
+
+// answerIPs returns the address of an A or AAAA record, or the address hints of an
+// SVCB or HTTPS one
+func answerIPs(ans dnsmessage.Resource) []net.IP {
+	if ip := answerIP(ans); ip != nil {
+		return []net.IP{ip}
+	}
+	return svcbHints(ans)
+}
+
+// addToKernelSet puts all addresses of the answers into the set, hints included
+func (s *Server) addToKernelSet(kset *kernelSet, answers []dnsmessage.Resource) {
+	var ips []net.IP
+	for _, ans := range answers {
+		ips = append(ips, answerIPs(ans)...)
+	}
+	if err := kset.add(ips); err != nil {
+		s.logErr.Println(err)
+	}
+}
+
+// typeName strips the "Type" prefix, types unknown to dnsmessage taking their name
+// from typeValues, or TYPE and their number
+func typeName(t dnsmessage.Type) string {
+	name := strings.TrimPrefix(t.String(), "Type")
+	if _, err := strconv.Atoi(name); err != nil {
+		return name
+	}
+	for n, value := range typeValues {
+		if value == t {
+			return n
+		}
+	}
+	return "TYPE" + name
+}
+
+// matchName tells if name equals domain or is a subdomain of it
+func matchName(n dnsmessage.Name, domain string) bool {
+	name := bytes.Trim(n.Data[:n.Length], ".")
+	switch ml, l := len(domain), len(name); {
+	case ml > l:
+		return false
+	case ml < l:
+		dotMName := append([]byte("."), domain...)
+		return bytes.EqualFold(name[len(name)-len(dotMName):], dotMName)
+	default: // ml = l
+		return bytes.EqualFold(name, []byte(domain))
+	}
+}
+
+// sleep waits for d, telling false if ctx ends first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,261 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const rotatedTimeFormat = "20060102-150405" // suffix of rotated query log files
+
+// queryLogEntry is a line of the query log, one per reply sent to a client
+type queryLogEntry struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	RCode   string    `json:"rcode"`
+	Answers []string  `json:"answers,omitempty"`
+}
+
+// openQueryLog starts writing the query log to opts.QueryLog, rotating and compressing
+// it by opts.QueryLogSize and opts.QueryLogRotate
+func (s *Server) openQueryLog() error {
+	file, err := os.OpenFile(s.opts.QueryLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.logStd.Printf("Query log written to %s", s.opts.QueryLog)
+	s.removeExpiredLogs()
+
+	s.queryLog = make(chan []byte, 4096)
+	s.queryLogDone.Add(1)
+	go s.writeQueryLog(file, info.Size(), info.ModTime())
+	return nil
+}
+
+// logQuery queues a query log line for the reply msg to client, dropping it if the
+// writer falls behind rather than delaying the reply
+func (s *Server) logQuery(client net.IP, msg []byte) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil || len(m.Questions) == 0 {
+		return
+	}
+	entry := queryLogEntry{
+		Time:   time.Now(),
+		Client: client.String(),
+		Name:   m.Questions[0].Name.String(),
+		Type:   typeName(m.Questions[0].Type),
+		RCode:  rcodeName(m.Header.RCode),
+	}
+	for _, ans := range m.Answers {
+		entry.Answers = append(entry.Answers, typeName(ans.Header.Type)+" "+recordData(ans))
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	select {
+	case s.queryLog <- append(line, '\n'):
+	default:
+	}
+}
+
+// closeQueryLog writes the lines queued, then closes the query log
+func (s *Server) closeQueryLog() {
+	if s.queryLog != nil {
+		close(s.queryLog)
+		s.queryLogDone.Wait()
+	}
+}
+
+func (s *Server) writeQueryLog(file *os.File, size int64, opened time.Time) {
+	defer s.queryLogDone.Done()
+	w := bufio.NewWriter(file)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case line, ok := <-s.queryLog:
+			if !ok {
+				w.Flush()
+				file.Close()
+				return
+			}
+			if _, err := w.Write(line); err != nil {
+				s.logErr.Println("Failed to write query log:", err)
+			}
+			size += int64(len(line))
+			if s.opts.QueryLogSize > 0 && size >= int64(s.opts.QueryLogSize)<<20 {
+				file, size, opened = s.rotateQueryLog(w, file, size, opened)
+			}
+		case now := <-flush.C:
+			w.Flush()
+			if s.opts.QueryLogRotate > 0 && size > 0 && now.Sub(opened) >= s.opts.QueryLogRotate {
+				file, size, opened = s.rotateQueryLog(w, file, size, opened)
+			}
+		}
+	}
+}
+
+// rotateQueryLog renames the query log aside to be compressed, going on with a new
+// one. It keeps the current file if that fails.
+func (s *Server) rotateQueryLog(w *bufio.Writer, file *os.File, size int64, opened time.Time) (*os.File, int64, time.Time) {
+	w.Flush()
+	rotated := s.opts.QueryLog + "." + time.Now().Format(rotatedTimeFormat)
+	if err := os.Rename(s.opts.QueryLog, rotated); err != nil {
+		s.logErr.Println("Failed to rotate query log:", err)
+		return file, size, opened
+	}
+	newFile, err := os.OpenFile(s.opts.QueryLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		s.logErr.Println("Failed to rotate query log:", err)
+		return file, size, opened // still writing to the renamed file
+	}
+	file.Close()
+	w.Reset(newFile)
+
+	go func() {
+		if err := gzipFile(rotated); err != nil {
+			s.logErr.Println("Failed to compress query log:", err)
+		}
+		s.removeExpiredLogs()
+	}()
+	return newFile, 0, time.Now()
+}
+
+// gzipFile replaces path with path.gz
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// rotatedLogs lists the rotated query logs of path, oldest first
+func rotatedLogs(path string) []string {
+	files, _ := filepath.Glob(path + ".*")
+	sort.Strings(files) // by the time rotated
+	return files
+}
+
+// removeExpiredLogs removes rotated query logs older than opts.QueryLogKeep
+func (s *Server) removeExpiredLogs() {
+	if s.opts.QueryLogKeep <= 0 {
+		return
+	}
+	for _, file := range rotatedLogs(s.opts.QueryLog) {
+		if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) > s.opts.QueryLogKeep {
+			if err := os.Remove(file); err != nil {
+				s.logErr.Println(err)
+			}
+		}
+	}
+}
+
+// LogSearch selects query log lines for SearchQueryLog, zero fields matching any
+type LogSearch struct {
+	Domain string // also matching subdomains
+	Client string // IP or CIDR
+	From   time.Time
+	To     time.Time
+}
+
+// SearchQueryLog writes to w the lines of the query log at path and its rotated files
+// matching search, oldest first
+func SearchQueryLog(path string, search LogSearch, w io.Writer) error {
+	var client *ipset
+	if search.Client != "" {
+		var err error
+		if client, err = parseIPList(search.Client); err != nil || client.size == 0 {
+			return fmt.Errorf("Invalid client: %s", search.Client)
+		}
+	}
+	domain := strings.Trim(search.Domain, ".")
+
+	for _, file := range append(rotatedLogs(path), path) {
+		if !search.From.IsZero() { // rotated files end at the time in their name
+			stamp := strings.TrimSuffix(strings.TrimPrefix(file, path+"."), ".gz")
+			if end, err := time.ParseInLocation(rotatedTimeFormat, stamp, time.Local); err == nil && end.Before(search.From) {
+				continue
+			}
+		}
+		if err := searchLogFile(file, domain, client, search, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func searchLogFile(file, domain string, client *ipset, search LogSearch, w io.Writer) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var entry queryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !search.From.IsZero() && entry.Time.Before(search.From) || !search.To.IsZero() && entry.Time.After(search.To) {
+			continue
+		}
+		if ip := net.ParseIP(entry.Client); client != nil && (ip == nil || !client.containsIP(ip)) {
+			continue
+		}
+		if domain != "" {
+			if name, err := dnsmessage.NewName(entry.Name); err != nil || !matchName(name, domain) {
+				continue
+			}
+		}
+		fmt.Fprintf(w, "%s\n", scanner.Bytes())
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,204 @@
+package dnsfilter
+
+import (
+	"dnsfilter/pkg/testserver"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rules of config.ini: trust the domestic server for domestic addresses only, and
+// the foreign one after a delay. Other clients than 127.0.0.1 are refused.
+const raceRules = `
+[allow_clients]
+cidr = 127.0.0.1/32
+
+[rule.domestic]
+server = 1
+ipset = 1
+target = ACCEPT
+
+[rule.untrusted]
+server = 1
+target = DROP
+
+[rule.foreign]
+server = 2
+target = DELAY
+delay = 200ms
+`
+
+const raceDelay = 200 * time.Millisecond
+
+// mockServer starts a mock upstream answering by answers, living as long as the
+// test process, as the Server asking it
+func mockServer(answers ...string) (*testserver.Server, error) {
+	var script []testserver.Answer
+	for _, spec := range answers {
+		answer, err := testserver.ParseAnswer(spec)
+		if err != nil {
+			return nil, err
+		}
+		script = append(script, answer)
+	}
+	server, err := testserver.Listen("127.0.0.1:0", script)
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	return server, nil
+}
+
+// quietServer makes a Server of the defaults loading nothing, logging nowhere
+func quietServer() *Server {
+	cfg := DefaultConfig()
+	cfg.Log, cfg.ErrorLog = log.New(io.Discard, "", 0), log.New(io.Discard, "", 0)
+	return newServer(cfg)
+}
+
+var (
+	raceOnce  sync.Once
+	raceSrv   *Server
+	raceErr   error
+	raceRelay *net.UDPConn // UPDATE queries are forwarded to
+)
+
+// raceServer starts the Server shared by the tests of this package, raceSrv, returning
+// its address. Its domestic upstream answers
+// domestic addresses but for poisoned.test, 60 of them for big.test, the foreign one
+// foreign addresses. UPDATE queries are forwarded to raceRelay.
+func raceServer(tb testing.TB) *net.UDPAddr {
+	raceOnce.Do(func() { raceSrv, raceErr = startRaceServer() })
+	if raceErr != nil {
+		tb.Fatal(raceErr)
+	}
+	return raceSrv.conn(0).LocalAddr().(*net.UDPAddr)
+}
+
+func startRaceServer() (*Server, error) {
+	big := "big.test ip=1.0.1.1" // too large for UDP without EDNS0
+	for i := 2; i <= 60; i++ {
+		big += ",1.0.1." + strconv.Itoa(i)
+	}
+	domestic, err := mockServer(
+		"cn.test ip=1.0.1.1",
+		"poisoned.test poison=8.7.198.45 drop",
+		"abroad.test ip=93.184.216.34",
+		big,
+		"* ip=1.0.1.2")
+	if err != nil {
+		return nil, err
+	}
+	foreign, err := mockServer(
+		"cn.test ip=8.8.8.8",
+		"poisoned.test ip=104.244.42.1 delay=20ms",
+		"abroad.test ip=93.184.216.34",
+		"* ip=8.8.4.4")
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "dnsfilter")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir) // loaded by New
+	ipsetFile, configFile := filepath.Join(dir, "cn.txt"), filepath.Join(dir, "config.ini")
+	if err := os.WriteFile(ipsetFile, []byte("1.0.1.0/24\n"), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(configFile, []byte(raceRules), 0644); err != nil {
+		return nil, err
+	}
+	if raceRelay, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		return nil, err
+	}
+	cfg := DefaultConfig()
+	cfg.Listen, cfg.ConfigFile, cfg.IPsets = "127.0.0.1:0", configFile, []string{ipsetFile}
+	cfg.OpCodes = []string{"update=forward:" + raceRelay.LocalAddr().String()}
+	cfg.Servers = []string{domestic.Addr().String(), foreign.Addr().String()}
+	cfg.Timeout, cfg.CacheSize = time.Second, 0
+	cfg.Log, cfg.ErrorLog = log.New(io.Discard, "", 0), log.New(io.Discard, "", 0)
+	server, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	return server, nil
+}
+
+// ask queries addr for the A records of name, returning the reply and its time
+func ask(t *testing.T, addr *net.UDPAddr, name string) (*dnsmessage.Message, time.Duration) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	q := dnsmessage.Message{Header: dnsmessage.Header{ID: 4242, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}}
+	packed, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := conn.Write(packed); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	var m dnsmessage.Message
+	if err := m.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return &m, elapsed
+}
+
+func firstA(m *dnsmessage.Message) string {
+	for _, ans := range m.Answers {
+		if a, ok := ans.Body.(*dnsmessage.AResource); ok {
+			return net.IP(a.A[:]).String()
+		}
+	}
+	return ""
+}
+
+// the domestic answer wins when domestic, the foreign one after its delay when the
+// domestic one is poisoned or foreign
+func TestRace(t *testing.T) {
+	addr := raceServer(t)
+	for _, test := range []struct {
+		name    string
+		ip      string
+		rcode   dnsmessage.RCode
+		delayed bool // by rule.foreign
+	}{
+		{"cn.test.", "1.0.1.1", dnsmessage.RCodeSuccess, false},
+		{"poisoned.test.", "104.244.42.1", dnsmessage.RCodeSuccess, true},
+		{"abroad.test.", "93.184.216.34", dnsmessage.RCodeSuccess, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m, elapsed := ask(t, addr, test.name)
+			if m.RCode != test.rcode || firstA(m) != test.ip {
+				t.Errorf("got %s %s, want %s %s", m.RCode, firstA(m), test.rcode, test.ip)
+			}
+			if test.delayed && elapsed < raceDelay {
+				t.Errorf("answered after %s, before the delay of %s", elapsed, raceDelay)
+			}
+			if !test.delayed && elapsed >= raceDelay {
+				t.Errorf("answered after %s, not before the delay of %s", elapsed, raceDelay)
+			}
+		})
+	}
+}
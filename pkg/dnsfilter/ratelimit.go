@@ -0,0 +1,57 @@
+package dnsfilter
+
+import (
+	"net"
+	"time"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// clientRateOK takes a token from the client's bucket, refilled at -qps up to -burst
+func (s *Server) clientRateOK(ip net.IP) bool {
+	if s.opts.QPS <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	key := ip.String()
+
+	s.bucketsLock.Lock()
+	defer s.bucketsLock.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{float64(s.opts.Burst), now}
+		s.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * s.opts.QPS
+		if b.tokens > float64(s.opts.Burst) {
+			b.tokens = float64(s.opts.Burst)
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// purgeBuckets forgets clients whose bucket would have been refilled by now
+func (s *Server) purgeBuckets() {
+	idle := time.Duration(float64(s.opts.Burst) / s.opts.QPS * float64(time.Second))
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		s.bucketsLock.Lock()
+		for key, b := range s.buckets {
+			if now.Sub(b.last) > idle {
+				delete(s.buckets, key)
+			}
+		}
+		s.bucketsLock.Unlock()
+	}
+}
@@ -0,0 +1,48 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+)
+
+// privateAddress tells if an A/AAAA record or the hints of an SVCB or HTTPS record
+// give an address of the local network or host: RFC 1918 and RFC 4193, link-local or
+// loopback. Unspecified ones answered for blocked names are not.
+func privateAddress(ans dnsmessage.Resource) bool {
+	for _, ip := range answerIPs(ans) {
+		if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// rebindAllowed tells if name may resolve to private addresses: localhost and
+// domains of -rebind-allow, at split DNS
+func (s *Server) rebindAllowed(name dnsmessage.Name) bool {
+	if matchName(name, "localhost") {
+		return true
+	}
+	for _, domain := range s.opts.RebindAllow {
+		if matchName(name, strings.ToLower(strings.Trim(domain, " ."))) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebindCheck returns answers without records giving private addresses for names
+// not allowed them with -rebind, as DNS rebinding turns clients against their own
+// network with, and how many were removed
+func (s *Server) rebindCheck(questions []dnsmessage.Question, answers []dnsmessage.Resource) ([]dnsmessage.Resource, int) {
+	if s.opts.Rebind == "" || len(questions) != 1 || s.rebindAllowed(questions[0].Name) {
+		return answers, 0
+	}
+	kept := answers[:0:0]
+	for _, ans := range answers {
+		if !privateAddress(ans) {
+			kept = append(kept, ans)
+		}
+	}
+	return kept, len(answers) - len(kept)
+}
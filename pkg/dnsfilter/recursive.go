@@ -0,0 +1,504 @@
+package dnsfilter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	recursorName     = "recursive" // of the upstream standing for -recursive
+	maxReferrals     = 16          // followed per name, against loops
+	maxResolveDepth  = 4           // of nameserver names resolved to resolve a name
+	maxServerQueries = 64          // sent per query of a client
+	maxMinimized     = 10          // queries for names minimized per name, RFC 9156
+	resolveTimeouts  = 5           // of -t, the longest a resolution takes
+	maxDelegations   = 10000
+)
+
+// rootHints are the addresses of the root servers, a.root-servers.net to m.
+var rootHints = []string{
+	"198.41.0.4", "2001:503:ba3e::2:30", "170.247.170.2", "2801:1b8:10::b", "192.33.4.12", "2001:500:2::c",
+	"199.7.91.13", "2001:500:2d::d", "192.203.230.10", "2001:500:a8::e", "192.5.5.241", "2001:500:2f::f",
+	"192.112.36.4", "2001:500:12::d0d", "198.97.190.53", "2001:500:1::53", "192.36.148.17", "2001:7fe::53",
+	"192.58.128.30", "2001:503:c27::2:30", "193.0.14.129", "2001:7fd::1", "199.7.83.42", "2001:500:9f::42",
+	"202.12.27.33", "2001:dc3::35",
+}
+
+// delegation is the nameserver addresses of a zone learned from a referral
+type delegation struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+// addRecursor adds the upstream standing for the recursive resolver after the others,
+// so that rules can name it
+func (s *Server) addRecursor() error {
+	if _, exist := s.lookupServerName(recursorName); exist {
+		return fmt.Errorf("Nameserver name exists: %s", recursorName)
+	}
+	s.recursor = &upstream{srv: s, name: recursorName, weight: 1}
+	s.recursor.setAddr(&net.UDPAddr{})
+	s.servers = append(s.servers, s.recursor)
+	s.logStd.Println("Resolving recursively from the root servers")
+	return nil
+}
+
+// resolution is the state of resolving a query of a client
+type resolution struct {
+	srv     *Server
+	queries int             // sent so far
+	ctx     context.Context // ending with the resolution
+}
+
+// queryRecursive resolves qs from the root servers, then judges the answer by rules as
+// query does for upstreams
+func (s *Server) queryRecursive(ctx context.Context, clientPayload []byte, qs []dnsmessage.Question) {
+	var parser dnsmessage.Parser
+	hdr, err := parser.Start(clientPayload)
+	if err != nil || len(qs) != 1 {
+		return
+	}
+	span := s.startSpan(ctx, "dns.recursion")
+	s.recursor.count(upstreamSent, 1)
+	start := time.Now()
+	resolveCtx, cancel := context.WithDeadline(ctx, start.Add(s.opts.Timeout*resolveTimeouts))
+	defer cancel()
+	r := &resolution{srv: s, ctx: resolveCtx}
+	rcode, answers, authorities, err := r.resolve(qs[0].Name, qs[0].Type, 0)
+	if err != nil {
+		span.fail(err.Error())
+		span.finish()
+		s.recursor.count(upstreamTimeouts, 1)
+		if s.verbose() {
+			s.logStd.Printf("%d Recursion for %s %s failed: %s", hdr.ID, qs[0].Name, typeName(qs[0].Type), err)
+		}
+		if msg, err := reply(hdr, qs, dnsmessage.RCodeServerFailure); err == nil {
+			s.sendToClient(ctx, msg)
+		}
+		return
+	}
+	span.finish()
+	rtt := time.Since(start)
+	s.recursor.count(upstreamAnswered, 1)
+	s.recursor.recordRTT(rtt)
+	s.recursor.count(upstreamRTTTotal, uint64(rtt))
+	s.recursor.count(upstreamRTTCount, 1)
+
+	hdr.Response, hdr.Authoritative, hdr.Truncated, hdr.RecursionAvailable = true, false, false, true
+	hdr.RCode = rcode
+	m := dnsmessage.Message{Header: hdr, Questions: qs, Answers: answers, Authorities: authorities}
+	msg, err := m.Pack()
+	if err != nil {
+		s.logErr.Println(err)
+		return
+	}
+
+	msgOut, delay, _, _ := s.determine(ctx, len(s.servers), msg)
+	if delay < 0 {
+		return
+	}
+	msgOut = s.synthesizeAAAA(ctx, len(s.servers), msgOut)
+	if s.opts.Flatten {
+		msgOut = flattenCNAME(msgOut)
+	}
+	msgOut = s.stripSVCB(msgOut)
+	msgOut = s.clampTTL(msgOut)
+	s.cacheStore(msgOut, ctx.Value(clientAddrKey).(*net.UDPAddr).IP, ctx.Value(clientDOKey).(bool))
+	s.sendToClient(ctx, msgOut)
+}
+
+// lookupRecursive resolves name for lookup
+func (s *Server) lookupRecursive(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout*resolveTimeouts)
+	defer cancel()
+	r := &resolution{srv: s, ctx: ctx}
+	rcode, answers, authorities, err := r.resolve(name, qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+	q := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+	return &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: rcode},
+		Questions: []dnsmessage.Question{q}, Answers: answers, Authorities: authorities}, nil
+}
+
+// resolve follows referrals from the closest zone known, then CNAMEs, returning the
+// rcode, answers and authority records of the last answer
+func (r *resolution) resolve(name dnsmessage.Name, qtype dnsmessage.Type, depth int) (dnsmessage.RCode, []dnsmessage.Resource, []dnsmessage.Resource, error) {
+	var chain []dnsmessage.Resource
+	for i := 0; i <= maxCNAMEs; i++ {
+		m, err := r.iterate(name, qtype, depth)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		chain = append(chain, m.Answers...)
+
+		target, answered := name, false // follows CNAMEs within the answer
+		for j := 0; j < maxCNAMEs; j++ {
+			next := -1
+			for k, ans := range m.Answers {
+				if !strings.EqualFold(ans.Header.Name.String(), target.String()) {
+					continue
+				}
+				if ans.Header.Type == qtype {
+					answered = true
+				} else if ans.Header.Type == dnsmessage.TypeCNAME {
+					next = k
+				}
+			}
+			if next < 0 || answered {
+				break
+			}
+			target = m.Answers[next].Body.(*dnsmessage.CNAMEResource).CNAME
+		}
+		if answered || qtype == dnsmessage.TypeCNAME || target == name || m.RCode != dnsmessage.RCodeSuccess {
+			return m.RCode, chain, m.Authorities, nil
+		}
+		name = target
+	}
+	return 0, nil, nil, errors.New("CNAME chain too long")
+}
+
+// iterate asks nameservers from the closest zone known down to the one answering
+// name, keeping the records of the answer within the zone asked. The servers of a zone
+// are asked for the NS records of the name one label below it (RFC 7816), so that only
+// those of the closest zone get the name and type asked. Servers failing such queries,
+// or denying names they serve the children of, are asked the full name instead.
+func (r *resolution) iterate(name dnsmessage.Name, qtype dnsmessage.Type, depth int) (*dnsmessage.Message, error) {
+	qname := strings.ToLower(name.String())
+	zone, addrs := r.srv.closestDelegation(qname)
+	known := zone // longest ancestor of qname known to exist
+	for referrals, minimizedLeft := 0, maxMinimized; referrals < maxReferrals; {
+		sname, stype, minimized := name, qtype, false
+		next := childToward(qname, known)
+		if next != qname && minimizedLeft > 0 {
+			if n, err := dnsmessage.NewName(next); err == nil {
+				sname, stype, minimized = n, dnsmessage.TypeNS, true
+				minimizedLeft--
+			}
+		}
+		m, err := r.ask(sname, stype, addrs)
+		if minimized && (err != nil || m.RCode == dnsmessage.RCodeNameError) {
+			minimizedLeft = 0 // refused, failed or timed out, or an empty non-terminal taken for a missing name
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s at %s", err, zone)
+		}
+		m.Answers = inZone(m.Answers, zone)
+		m.Authorities = inZone(m.Authorities, zone)
+		if !minimized && (m.RCode == dnsmessage.RCodeNameError || len(m.Answers) > 0 || m.Authoritative) {
+			return m, nil
+		}
+
+		child, nsNames, ttl := referral(m, zone, qname)
+		if child == "" && minimized {
+			if !m.Authoritative { // lame for NS queries maybe
+				minimizedLeft = 0
+			} else if hasNS(m.Answers, next) { // a zone of the same servers
+				zone, known = next, next
+			} else {
+				known = next
+			}
+			continue
+		}
+		if child == "" {
+			return nil, fmt.Errorf("Lame delegation of %s", zone)
+		}
+		addrs = glue(m, zone, nsNames)
+		if len(addrs) == 0 {
+			if depth >= maxResolveDepth {
+				return nil, fmt.Errorf("Nameservers of %s too deep to resolve", child)
+			}
+			for _, nsName := range nsNames {
+				if addrs = r.resolveAddrs(nsName, depth+1); len(addrs) > 0 {
+					break
+				}
+			}
+			if len(addrs) == 0 {
+				return nil, fmt.Errorf("No address of nameservers of %s", child)
+			}
+		}
+		r.srv.cacheDelegation(child, addrs, ttl)
+		zone, known = child, child
+		referrals++
+	}
+	return nil, fmt.Errorf("Too many referrals for %s", qname)
+}
+
+// childToward returns the name one label longer than its ancestor known toward qname
+func childToward(qname, known string) string {
+	labels := labelsOf(qname)
+	if n := len(labelsOf(known)); n < len(labels) {
+		return joinLabels(labels[len(labels)-n-1:])
+	}
+	return qname
+}
+
+// hasNS tells if records include NS ones of name
+func hasNS(records []dnsmessage.Resource, name string) bool {
+	for _, rr := range records {
+		if rr.Header.Type == dnsmessage.TypeNS && strings.EqualFold(rr.Header.Name.String(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveAddrs resolves the addresses of a nameserver, IPv4 first
+func (r *resolution) resolveAddrs(nsName string, depth int) []net.IP {
+	name, err := dnsmessage.NewName(nsName)
+	if err != nil {
+		return nil
+	}
+	var addrs []net.IP
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		_, answers, _, err := r.resolve(name, qtype, depth)
+		if err != nil {
+			continue
+		}
+		for _, ans := range answers {
+			switch body := ans.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(body.AAAA[:]))
+			}
+		}
+		if len(addrs) > 0 {
+			break
+		}
+	}
+	return addrs
+}
+
+// ask sends the query to nameservers in random order until one answers NOERROR or
+// NXDOMAIN, over TCP again if truncated
+func (r *resolution) ask(name dnsmessage.Name, qtype dnsmessage.Type, addrs []net.IP) (*dnsmessage.Message, error) {
+	q := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+	err := errors.New("No nameserver")
+	for _, i := range rand.Perm(len(addrs)) {
+		if r.queries >= maxServerQueries || r.ctx.Err() != nil {
+			return nil, errors.New("Gave up resolving")
+		}
+		r.queries++
+		var m *dnsmessage.Message
+		if m, err = r.srv.exchangeUDP(r.ctx, q, addrs[i]); err == nil && m.Truncated {
+			m, err = r.srv.exchangeTCP(r.ctx, q, addrs[i])
+		}
+		if err != nil {
+			continue
+		}
+		if m.RCode == dnsmessage.RCodeSuccess || m.RCode == dnsmessage.RCodeNameError {
+			return m, nil
+		}
+		err = fmt.Errorf("%s answered %s", addrs[i], rcodeName(m.RCode))
+	}
+	return nil, err
+}
+
+// iterativeQuery packs q with RD clear, an ID and an EDNS0 payload size
+func (s *Server) iterativeQuery(id uint16, q dnsmessage.Question) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(s.opts.EDNS, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	return b.Finish()
+}
+
+func (s *Server) exchangeUDP(ctx context.Context, q dnsmessage.Question, ip net.IP) (*dnsmessage.Message, error) {
+	tx := s.newTransaction(ctx, []dnsmessage.Question{q})
+	defer tx.finish()
+	query, err := s.iterativeQuery(tx.id, q)
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.UDPAddr{IP: ip, Port: 53}
+	if err := tx.send(query, addr); err != nil {
+		return nil, err
+	}
+
+	deadline := time.NewTimer(s.opts.Timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-deadline.C:
+			return nil, fmt.Errorf("%s timed out", ip)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case a := <-tx.answers:
+			var m dnsmessage.Message
+			err = m.Unpack(a.msg)
+			putBuf(a.msg)
+			if err == nil {
+				return &m, nil
+			}
+		}
+	}
+}
+
+func (s *Server) exchangeTCP(ctx context.Context, q dnsmessage.Question, ip net.IP) (*dnsmessage.Message, error) {
+	id := randomID()
+	query, err := s.iterativeQuery(id, q)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+	conn, err := s.outboundDialer().DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), "53"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	framed := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	if !answersQuery(msg, id, []dnsmessage.Question{q}, false) {
+		return nil, fmt.Errorf("Answer from %s not matching query", ip)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// referral finds the child zone of zone delegated toward qname, its nameserver names
+// and the TTL of the delegation, an empty zone if m isn't such a referral
+func referral(m *dnsmessage.Message, zone, qname string) (string, []string, uint32) {
+	var child string
+	var nsNames []string
+	ttl := ^uint32(0)
+	for _, rr := range m.Authorities {
+		ns, ok := rr.Body.(*dnsmessage.NSResource)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(rr.Header.Name.String())
+		if owner == zone || !withinZone(owner, zone) || !withinZone(qname, owner) || child != "" && owner != child {
+			continue // not a step down toward qname
+		}
+		child = owner
+		nsNames = append(nsNames, strings.ToLower(ns.NS.String()))
+		if rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+		}
+	}
+	return child, nsNames, ttl
+}
+
+// glue returns the addresses of nameservers given along a referral by servers of zone,
+// those of names outside it being ignored as they may be forged
+func glue(m *dnsmessage.Message, zone string, nsNames []string) []net.IP {
+	var addrs []net.IP
+	for _, rr := range m.Additionals {
+		owner := strings.ToLower(rr.Header.Name.String())
+		if !withinZone(owner, zone) || !containsName(nsNames, owner) {
+			continue
+		}
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, net.IP(body.AAAA[:]))
+		}
+	}
+	return addrs
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withinZone tells if name is zone or below, both lower case with the final dot
+func withinZone(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// inZone keeps the records of names within zone, which its servers are authoritative for
+func inZone(records []dnsmessage.Resource, zone string) []dnsmessage.Resource {
+	kept := records[:0]
+	for _, rr := range records {
+		if withinZone(strings.ToLower(rr.Header.Name.String()), zone) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// closestDelegation returns the closest enclosing zone of qname with nameservers known,
+// the root at least
+func (s *Server) closestDelegation(qname string) (string, []net.IP) {
+	now := time.Now()
+	s.delegationLock.Lock()
+	defer s.delegationLock.Unlock()
+	for zone := qname; zone != "."; {
+		if d, ok := s.delegations[zone]; ok {
+			if now.Before(d.expires) {
+				return zone, d.addrs
+			}
+			delete(s.delegations, zone)
+		}
+		if i := strings.IndexByte(zone, '.'); i >= 0 && i < len(zone)-1 {
+			zone = zone[i+1:]
+		} else {
+			zone = "."
+		}
+	}
+	addrs := make([]net.IP, len(rootHints))
+	for i, hint := range rootHints {
+		addrs[i] = net.ParseIP(hint)
+	}
+	return ".", addrs
+}
+
+func (s *Server) cacheDelegation(zone string, addrs []net.IP, ttl uint32) {
+	if ttl > 86400 {
+		ttl = 86400
+	}
+	now := time.Now()
+	s.delegationLock.Lock()
+	if len(s.delegations) >= maxDelegations {
+		for z, d := range s.delegations { // purge expired ones first
+			if now.After(d.expires) {
+				delete(s.delegations, z)
+			}
+		}
+		for z := range s.delegations { // still full, evict an arbitrary one
+			if len(s.delegations) < maxDelegations {
+				break
+			}
+			delete(s.delegations, z)
+		}
+	}
+	s.delegations[zone] = delegation{addrs, now.Add(time.Duration(ttl) * time.Second)}
+	s.delegationLock.Unlock()
+}
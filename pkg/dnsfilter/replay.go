@@ -0,0 +1,237 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+// pcap link types read
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+// Replay loads what cfg names as New does, without binding sockets, then judges the DNS
+// responses captured in a pcap file by the rules, printing the statistics of verdicts
+// per rule. Responses from port 53 of unknown servers are judged as from the first
+// one. Plugins and the script are not run.
+func Replay(cfg Config, pcapFile string) error {
+	file, err := os.Open(pcapFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	order, linkType, err := readPcapHeader(r)
+	if err != nil {
+		return fmt.Errorf("%s: %s", pcapFile, err)
+	}
+	s := newServer(cfg)
+	if err := s.loadOffline(); err != nil {
+		return err
+	}
+
+	var judged, skipped, unknown int
+	decided := make(map[int]int) // by rank, -1 for none
+	verdicts := make(map[string]int)
+	packet := make([]byte, 65536)
+	for {
+		n, err := readPcapPacket(r, order, packet)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", pcapFile, err)
+		}
+		src, dst, payload, ok := udpPayload(packet[:n], linkType)
+		if !ok || len(payload) < 12 || payload[2]&0x80 == 0 { // QR bit of responses
+			skipped++
+			continue
+		}
+		serverIndex, known := s.lookupServer(src)
+		if !known {
+			if src.Port != 53 {
+				skipped++
+				continue
+			}
+			serverIndex = 0
+			unknown++
+		}
+
+		ctx := context.WithValue(context.Background(), clientAddrKey, dst)
+		msgOut, delay, rank, _ := s.determine(ctx, serverIndex+1, payload)
+		judged++
+		decided[rank]++
+		if delay < 0 {
+			verdicts["DROP"]++
+		} else if hdr, err := new(dnsmessage.Parser).Start(msgOut); err == nil {
+			verdicts["REPLY "+rcodeName(hdr.RCode)]++
+		}
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "#\tRULE\tHITS\tDECIDED\tMATCH [TARGET]")
+	s.configLock.RLock()
+	for i, rule := range s.rules {
+		fmt.Fprintf(table, "%d\t%s\t%d\t%d\t%s\n", i+1, rule.name, atomic.LoadUint64(&rule.hits), decided[i], rule.desc)
+	}
+	s.configLock.RUnlock()
+	fmt.Fprintf(table, "-\tnone\t-\t%d\t[DROP]\n", decided[-1])
+	table.Flush()
+
+	names := make([]string, 0, len(verdicts))
+	for name := range verdicts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s %d", name, verdicts[name])
+	}
+	fmt.Printf("%d responses judged, %d from unknown servers, %d packets skipped\n", judged, unknown, skipped)
+	if len(names) > 0 {
+		fmt.Printf("Verdicts: %s\n", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// readPcapHeader reads the global header of a pcap file, telling its byte order and link type
+func readPcapHeader(r io.Reader) (binary.ByteOrder, uint32, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, 0, errors.New("not a pcap file")
+	}
+	var order binary.ByteOrder
+	switch magic := binary.LittleEndian.Uint32(hdr[:4]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d: // microsecond or nanosecond timestamps
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, 0, errors.New("not a pcap file, pcapng is not supported")
+	}
+	linkType := order.Uint32(hdr[20:24])
+	switch linkType {
+	case linkNull, linkEthernet, linkRaw, linkLinuxSLL:
+	default:
+		return nil, 0, fmt.Errorf("unsupported link type %d", linkType)
+	}
+	return order, linkType, nil
+}
+
+// readPcapPacket reads the next packet into buf, truncating it to buf's size
+func readPcapPacket(r io.Reader, order binary.ByteOrder, buf []byte) (int, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, errors.New("truncated packet header")
+		}
+		return 0, err
+	}
+	caplen := int(order.Uint32(hdr[8:12]))
+	n := caplen
+	if n > len(buf) {
+		n = len(buf)
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, errors.New("truncated packet")
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(caplen-n)); err != nil {
+		return 0, errors.New("truncated packet")
+	}
+	return n, nil
+}
+
+// udpPayload takes the addresses and payload of a UDP packet over IPv4 or IPv6,
+// telling false for anything else including fragments
+func udpPayload(frame []byte, linkType uint32) (src, dst *net.UDPAddr, payload []byte, ok bool) {
+	var ethType uint16
+	switch linkType {
+	case linkNull:
+		if len(frame) < 4 {
+			return
+		}
+		family := binary.LittleEndian.Uint32(frame) // in the byte order of the host capturing
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(frame)
+		}
+		switch family {
+		case 2:
+			ethType = 0x0800
+		case 10, 24, 28, 30:
+			ethType = 0x86dd
+		}
+		frame = frame[4:]
+	case linkEthernet:
+		if len(frame) < 14 {
+			return
+		}
+		ethType, frame = binary.BigEndian.Uint16(frame[12:14]), frame[14:]
+		for ethType == 0x8100 && len(frame) >= 4 { // VLAN tags
+			ethType, frame = binary.BigEndian.Uint16(frame[2:4]), frame[4:]
+		}
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return
+		}
+		ethType, frame = binary.BigEndian.Uint16(frame[14:16]), frame[16:]
+	case linkRaw:
+		if len(frame) > 0 && frame[0]>>4 == 6 {
+			ethType = 0x86dd
+		} else {
+			ethType = 0x0800
+		}
+	}
+
+	var srcIP, dstIP net.IP
+	switch ethType {
+	case 0x0800:
+		if len(frame) < 20 || frame[0]>>4 != 4 || frame[9] != 17 {
+			return
+		}
+		if binary.BigEndian.Uint16(frame[6:8])&0x3fff != 0 { // more fragments or an offset
+			return
+		}
+		ihl := int(frame[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(frame[2:4]))
+		if ihl < 20 || total < ihl || total > len(frame) {
+			return
+		}
+		srcIP, dstIP = net.IP(frame[12:16]), net.IP(frame[16:20])
+		frame = frame[ihl:total]
+	case 0x86dd:
+		if len(frame) < 40 || frame[0]>>4 != 6 || frame[6] != 17 { // extension headers not followed
+			return
+		}
+		length := int(binary.BigEndian.Uint16(frame[4:6]))
+		if 40+length > len(frame) {
+			return
+		}
+		srcIP, dstIP = net.IP(frame[8:24]), net.IP(frame[24:40])
+		frame = frame[40 : 40+length]
+	default:
+		return
+	}
+
+	if len(frame) < 8 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(frame[4:6]))
+	if length < 8 || length > len(frame) {
+		return
+	}
+	src = &net.UDPAddr{IP: append(net.IP(nil), srcIP...), Port: int(binary.BigEndian.Uint16(frame[0:2]))}
+	dst = &net.UDPAddr{IP: append(net.IP(nil), dstIP...), Port: int(binary.BigEndian.Uint16(frame[2:4]))}
+	return src, dst, frame[8:length], true
+}
@@ -0,0 +1,38 @@
+package dnsfilter
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+const soReusePort = 0xf // not in syscall, from asm-generic/socket.h
+
+// listenReusePort opens n sockets on the same address for the kernel to balance among
+func listenReusePort(addr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	var conns []*net.UDPConn
+	for i := 0; i < n; i++ {
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn.(*net.UDPConn))
+	}
+	return conns, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package dnsfilter
+
+import (
+	"errors"
+	"net"
+)
+
+func listenReusePort(addr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	return nil, errors.New("-reuseport is only supported on Linux")
+}
@@ -0,0 +1,171 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/go-ini/ini.v1"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// reverseZone answers PTR queries for addresses of networks from a [reverse.xxx]
+// section: from a hosts(5) file, or by a name template, NXDOMAIN otherwise
+type reverseZone struct {
+	networks []*net.IPNet
+	template string            // {ip} standing for the address with dashes, empty for none
+	ptrs     map[string]string // of the file, see hostsZone
+	ttl      uint32
+}
+
+func (s *Server) loadReverses(cfg *ini.File) ([]*reverseZone, error) {
+	reverseSections := cfg.ChildSections("reverse")
+	reverses := make([]*reverseZone, len(reverseSections))
+
+	for i, section := range reverseSections {
+		sectionName := section.Name()
+
+		r := reverseZone{template: strings.TrimSpace(section.Key("name").String()), ttl: uint32(section.Key("ttl").MustUint(300))}
+		for _, cidr := range section.Key("networks").Strings(",") {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("%s invalid network %s!", sectionName, cidr)
+			}
+			r.networks = append(r.networks, network)
+		}
+		if len(r.networks) == 0 {
+			return nil, fmt.Errorf("%s networks must exist in a reverse!", sectionName)
+		}
+		if r.template != "" {
+			if !strings.Contains(r.template, "{ip}") {
+				return nil, fmt.Errorf("%s name must contain {ip}!", sectionName)
+			}
+			if _, err := dnsmessage.NewName(synthesizedPTR(r.template, net.IPv6loopback)); err != nil {
+				return nil, fmt.Errorf("%s invalid name %s!", sectionName, r.template)
+			}
+		}
+		if file := strings.TrimSpace(section.Key("file").String()); file != "" {
+			zone := &hostsZone{make(map[string][]net.IP), make(map[string]string)}
+			count, err := zone.load(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s", sectionName, err)
+			}
+			s.logStd.Printf("Loaded %d addresses from hosts file %s", count, file)
+			r.ptrs = zone.ptrs
+		}
+
+		s.logStd.Printf("%s: REVERSE %s", sectionName, section.Key("networks").String())
+		reverses[i] = &r
+	}
+	return reverses, nil
+}
+
+// synthesizedPTR fills template with ip, dots or colons turned into dashes
+func synthesizedPTR(template string, ip net.IP) string {
+	dashed := strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	return strings.ToLower(strings.TrimSuffix(strings.ReplaceAll(template, "{ip}", dashed), ".")) + "."
+}
+
+// reverseAnswer answers PTR queries for addresses of [reverse.xxx] networks, nil for
+// other queries
+func (s *Server) reverseAnswer(hdr dnsmessage.Header, qs []dnsmessage.Question) []byte {
+	if len(qs) != 1 || qs[0].Type != dnsmessage.TypePTR || qs[0].Class != dnsmessage.ClassINET {
+		return nil
+	}
+	name := strings.ToLower(qs[0].Name.String())
+	ip := reverseIP(name)
+	if ip == nil {
+		return nil
+	}
+	if ptr, ok := s.sinkholePTR(ip); ok {
+		return s.ptrReply(hdr, qs, ptr, hostsTTL)
+	}
+
+	s.configLock.RLock()
+	var found *reverseZone
+	for _, r := range s.reverses {
+		for _, network := range r.networks {
+			if network.Contains(ip) {
+				found = r
+				break
+			}
+		}
+		if found != nil {
+			break
+		}
+	}
+	s.configLock.RUnlock()
+	if found == nil {
+		return nil
+	}
+
+	ptr, ok := found.ptrs[name]
+	if !ok && found.template != "" {
+		ptr, ok = synthesizedPTR(found.template, ip), true
+	}
+	hdr.Response, hdr.Authoritative, hdr.RecursionAvailable, hdr.Truncated = true, true, true, false
+	if !ok {
+		msg, err := reply(hdr, qs, dnsmessage.RCodeNameError)
+		if err != nil {
+			return nil
+		}
+		return msg
+	}
+	return s.ptrReply(hdr, qs, ptr, found.ttl)
+}
+
+// ptrReply answers the PTR query of qs with ptr
+func (s *Server) ptrReply(hdr dnsmessage.Header, qs []dnsmessage.Question, ptr string, ttl uint32) []byte {
+	target, err := dnsmessage.NewName(ptr)
+	if err != nil {
+		return nil
+	}
+
+	hdr.Response, hdr.Authoritative, hdr.RecursionAvailable, hdr.Truncated = true, true, true, false
+	hdr.RCode = dnsmessage.RCodeSuccess
+	rh := dnsmessage.ResourceHeader{Name: qs[0].Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl}
+	m := dnsmessage.Message{Header: hdr, Questions: qs,
+		Answers: []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.PTRResource{PTR: target}}}}
+	msg, err := m.Pack()
+	if err != nil {
+		s.logErr.Println(err)
+		return nil
+	}
+	return msg
+}
+
+// reverseIP parses the address of a full in-addr.arpa or ip6.arpa name, lower case
+// with the final dot, nil for others
+func reverseIP(name string) net.IP {
+	if labels := strings.TrimSuffix(name, ".in-addr.arpa."); labels != name {
+		fields := strings.Split(labels, ".")
+		if len(fields) != 4 {
+			return nil
+		}
+		ip := make(net.IP, 4)
+		for i, field := range fields {
+			b, err := strconv.ParseUint(field, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[3-i] = byte(b)
+		}
+		return ip
+	}
+	if labels := strings.TrimSuffix(name, ".ip6.arpa."); labels != name {
+		fields := strings.Split(labels, ".")
+		if len(fields) != 32 {
+			return nil
+		}
+		ip := make(net.IP, 16)
+		for i, field := range fields {
+			nibble, err := strconv.ParseUint(field, 16, 4)
+			if err != nil || len(field) != 1 {
+				return nil
+			}
+			ip[15-i/2] |= byte(nibble) << (4 * uint(i%2))
+		}
+		return ip
+	}
+	return nil
+}
@@ -0,0 +1,509 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type rpzAction int
+
+const (
+	rpzLocalData rpzAction = iota // records replacing the answer
+	rpzNXDomain                   // CNAME .
+	rpzNoData                     // CNAME *.
+	rpzPassthru                   // CNAME rpz-passthru.
+	rpzDrop                       // CNAME rpz-drop.
+	rpzTCPOnly                    // CNAME rpz-tcp-only.
+)
+
+var rpzActionNames = [...]string{"LOCAL DATA", "NXDOMAIN", "NODATA", "PASSTHRU", "DROP", "TCP-ONLY"}
+
+type rpzPolicy struct {
+	action  rpzAction
+	records []dnsmessage.Resource // for local data, owner to be replaced by the question name
+}
+
+type rpzIPTrigger struct {
+	net    *net.IPNet
+	policy *rpzPolicy
+}
+
+// rpz is a Response Policy Zone, its triggers indexed by kind
+type rpz struct {
+	origin   string // lower case with a trailing dot
+	serial   uint32
+	qnames   map[string]*rpzPolicy // names as is, *.name for names below
+	nsdnames map[string]*rpzPolicy
+	ips      []rpzIPTrigger // longest prefix first
+	nsips    []rpzIPTrigger
+	size     int
+}
+
+func isAXFR(spec string) bool {
+	return strings.HasPrefix(spec, "axfr://")
+}
+
+func (s *Server) loadRPZs() ([]*rpz, error) {
+	zones := make([]*rpz, len(s.opts.RPZs))
+	for i, spec := range s.opts.RPZs {
+		z, err := s.loadRPZ(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load RPZ %s: %s", spec, err)
+		}
+		zones[i] = z
+		s.logStd.Printf("RPZ %d loaded from %s, serial %d, %d triggers", i+1, spec, z.serial, z.size)
+	}
+	return zones, nil
+}
+
+// loadRPZ reads a zone file, or transfers the zone for axfr://host[:port]/zone
+func (s *Server) loadRPZ(spec string) (*rpz, error) {
+	if !isAXFR(spec) {
+		return s.readRPZFile(spec)
+	}
+
+	hostZone := strings.TrimPrefix(spec, "axfr://")
+	i := strings.IndexByte(hostZone, '/')
+	if i < 0 {
+		return nil, fmt.Errorf("zone name missing in %s", spec)
+	}
+	host, origin := hostZone[:i], strings.ToLower(strings.Trim(hostZone[i+1:], "."))+"."
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "53")
+	}
+
+	records, err := s.axfr(host, origin)
+	if err != nil {
+		return nil, err
+	}
+	z := newRPZ(origin)
+	for _, rr := range records {
+		z.add(rr)
+	}
+	return z, nil
+}
+
+func newRPZ(origin string) *rpz {
+	return &rpz{origin: origin, qnames: make(map[string]*rpzPolicy), nsdnames: make(map[string]*rpzPolicy)}
+}
+
+// add turns a record of the zone into a trigger and its action
+func (z *rpz) add(rr dnsmessage.Resource) {
+	owner := strings.ToLower(rr.Header.Name.String())
+	if rr.Header.Type == dnsmessage.TypeSOA {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok && owner == z.origin {
+			z.serial = soa.Serial
+		}
+		return
+	}
+	if rr.Header.Type == dnsmessage.TypeNS || !strings.HasSuffix(owner, "."+z.origin) {
+		return
+	}
+	trigger := strings.TrimSuffix(owner, "."+z.origin)
+
+	policy := &rpzPolicy{action: rpzLocalData}
+	if cname, ok := rr.Body.(*dnsmessage.CNAMEResource); ok {
+		switch target := strings.ToLower(cname.CNAME.String()); target {
+		case ".":
+			policy.action = rpzNXDomain
+		case "*.":
+			policy.action = rpzNoData
+		case "rpz-passthru.":
+			policy.action = rpzPassthru
+		case "rpz-drop.":
+			policy.action = rpzDrop
+		case "rpz-tcp-only.":
+			policy.action = rpzTCPOnly
+		}
+	}
+	if policy.action == rpzLocalData {
+		policy.records = []dnsmessage.Resource{rr}
+	}
+
+	switch {
+	case strings.HasSuffix(trigger, ".rpz-ip"):
+		z.addIP(&z.ips, strings.TrimSuffix(trigger, ".rpz-ip"), policy)
+	case strings.HasSuffix(trigger, ".rpz-nsip"):
+		z.addIP(&z.nsips, strings.TrimSuffix(trigger, ".rpz-nsip"), policy)
+	case strings.HasSuffix(trigger, ".rpz-nsdname"):
+		z.addName(z.nsdnames, strings.TrimSuffix(trigger, ".rpz-nsdname")+".", policy)
+	case strings.HasSuffix(trigger, ".rpz-client-ip"), strings.Contains(trigger, ".rpz-"):
+		// not supported
+	default:
+		z.addName(z.qnames, trigger+".", policy)
+	}
+}
+
+// addName merges local data of several records for the same name
+func (z *rpz) addName(names map[string]*rpzPolicy, name string, policy *rpzPolicy) {
+	if old, ok := names[name]; ok {
+		if old.action == rpzLocalData && policy.action == rpzLocalData {
+			old.records = append(old.records, policy.records...)
+		}
+		return
+	}
+	names[name] = policy
+	z.size++
+}
+
+// addIP reads "prefixlen.reversed.address", IPv6 groups reversed with zz for ::
+func (z *rpz) addIP(triggers *[]rpzIPTrigger, trigger string, policy *rpzPolicy) {
+	labels := strings.Split(trigger, ".")
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil || len(labels) < 2 {
+		return
+	}
+	for i, j := 1, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	var ip net.IP
+	if len(labels) == 5 && bits <= 32 && !strings.Contains(trigger, "zz") {
+		ip = net.ParseIP(strings.Join(labels[1:], "."))
+	} else {
+		ip = net.ParseIP(strings.Replace(strings.Join(labels[1:], ":"), "zz", "", 1))
+	}
+	if ip == nil {
+		return
+	}
+	size := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil && len(labels) == 5 {
+		ip, size = ip4, 8*net.IPv4len
+	}
+	if bits > size {
+		return
+	}
+
+	t := rpzIPTrigger{&net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}, policy}
+	i := len(*triggers)
+	for i > 0 { // keep longest prefixes first
+		if ones, _ := (*triggers)[i-1].net.Mask.Size(); ones >= bits {
+			break
+		}
+		i--
+	}
+	*triggers = append(*triggers, rpzIPTrigger{})
+	copy((*triggers)[i+1:], (*triggers)[i:])
+	(*triggers)[i] = t
+	z.size++
+}
+
+func lookupName(names map[string]*rpzPolicy, name string) *rpzPolicy {
+	if policy, ok := names[name]; ok {
+		return policy
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0 && i < len(name)-1; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if policy, ok := names["*."+name]; ok {
+			return policy
+		}
+	}
+	return nil
+}
+
+func lookupIP(triggers []rpzIPTrigger, ip net.IP) *rpzPolicy {
+	for _, t := range triggers {
+		if t.net.Contains(ip) {
+			return t.policy
+		}
+	}
+	return nil
+}
+
+// check returns the policy of the first trigger hit by the question name, then
+// addresses in answers, then NS names, then NS addresses, nil if none
+func (z *rpz) check(qs []dnsmessage.Question, sections [3][]dnsmessage.Resource) *rpzPolicy {
+	if len(qs) == 1 {
+		if policy := lookupName(z.qnames, strings.ToLower(qs[0].Name.String())); policy != nil {
+			return policy
+		}
+	}
+	if len(z.ips) > 0 {
+		for _, rr := range sections[0] {
+			if ip := answerIP(rr); ip != nil {
+				if policy := lookupIP(z.ips, ip); policy != nil {
+					return policy
+				}
+			}
+		}
+	}
+	if len(z.nsdnames) > 0 {
+		for _, section := range sections {
+			for _, rr := range section {
+				if ns, ok := rr.Body.(*dnsmessage.NSResource); ok {
+					if policy := lookupName(z.nsdnames, strings.ToLower(ns.NS.String())); policy != nil {
+						return policy
+					}
+				}
+			}
+		}
+	}
+	if len(z.nsips) > 0 {
+		for _, rr := range sections[2] { // glue
+			if ip := answerIP(rr); ip != nil {
+				if policy := lookupIP(z.nsips, ip); policy != nil {
+					return policy
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// apply returns the response to send per the policy and its delay, negative to drop
+func (policy *rpzPolicy) apply(hdr dnsmessage.Header, qs []dnsmessage.Question, msg []byte) ([]byte, time.Duration, error) {
+	switch policy.action {
+	case rpzNXDomain:
+		out, err := reply(hdr, qs, dnsmessage.RCodeNameError)
+		return out, 0, err
+	case rpzNoData:
+		out, err := reply(hdr, qs, dnsmessage.RCodeSuccess)
+		return out, 0, err
+	case rpzPassthru:
+		return msg, 0, nil
+	case rpzDrop:
+		return msg, -1, nil
+	case rpzTCPOnly:
+		out, err := truncated(msg)
+		return out, 0, err
+	}
+
+	hdr.Response, hdr.Authoritative, hdr.Truncated, hdr.RecursionAvailable = true, false, false, true
+	hdr.RCode = dnsmessage.RCodeSuccess
+	out := dnsmessage.Message{Header: hdr, Questions: qs}
+	if len(qs) == 1 {
+		for _, rr := range policy.records {
+			if rr.Header.Type == qs[0].Type || rr.Header.Type == dnsmessage.TypeCNAME || qs[0].Type == dnsmessage.TypeALL {
+				rr.Header.Name = qs[0].Name
+				out.Answers = append(out.Answers, rr)
+			}
+		}
+	}
+	packed, err := out.Pack()
+	return packed, 0, err
+}
+
+// readRPZFile reads a zone in master file format, taking $ORIGIN and $TTL, owners
+// relative to the origin, and A, AAAA, CNAME, TXT and SOA records
+func (s *Server) readRPZFile(filename string) (*rpz, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		z       *rpz
+		origin  = "."
+		owner   string
+		pending string // lines joined within parentheses
+		zoneTTL = uint32(300)
+	)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := pending + stripComment(scanner.Text())
+		if strings.Count(line, "(") > strings.Count(line, ")") {
+			pending = line + " "
+			continue
+		}
+		pending = ""
+		line = strings.NewReplacer("(", " ", ")", " ").Replace(line)
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) > 1 {
+				origin = absName(fields[1], origin)
+			}
+			continue
+		case "$TTL":
+			if len(fields) > 1 && isNumber(fields[1]) {
+				ttl, _ := strconv.ParseUint(fields[1], 10, 32)
+				zoneTTL = uint32(ttl)
+			}
+			continue
+		case "$INCLUDE":
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			owner, fields = absName(fields[0], origin), fields[1:]
+		}
+		ttl := zoneTTL
+		for len(fields) > 0 && (isNumber(fields[0]) || strings.EqualFold(fields[0], "IN")) {
+			if n, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				ttl = uint32(n)
+			}
+			fields = fields[1:] // TTL and class
+		}
+		if len(fields) < 2 || owner == "" {
+			continue
+		}
+
+		rrType := strings.ToUpper(fields[0])
+		if rrType == "SOA" {
+			if z == nil && len(fields) >= 4 {
+				z = newRPZ(owner)
+				serial, _ := strconv.ParseUint(fields[3], 10, 32)
+				z.serial = uint32(serial)
+			}
+			continue
+		}
+		if z == nil {
+			return nil, fmt.Errorf("%s:%d record before SOA", filename, lineNo)
+		}
+		if rrType == "NS" {
+			continue
+		}
+
+		name, err := dnsmessage.NewName(owner)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d invalid name %s", filename, lineNo, owner)
+		}
+		data := strings.Join(fields[1:], " ")
+		if rrType == "CNAME" {
+			data = absName(data, origin)
+		}
+		t, body, err := parseRecord(rrType+" "+data, origin)
+		if err != nil {
+			s.logErr.Printf("%s:%d %s, skipped", filename, lineNo, err)
+			continue
+		}
+		z.add(dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: name, Type: t, Class: dnsmessage.ClassINET, TTL: ttl}, Body: body})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if z == nil {
+		return nil, fmt.Errorf("%s has no SOA record", filename)
+	}
+	return z, nil
+}
+
+// stripComment removes what follows a ; outside of quotes
+func stripComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// absName makes name absolute, lower case with a trailing dot, @ being origin
+func absName(name, origin string) string {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return name
+	case origin == ".":
+		return name + "."
+	}
+	return name + "." + origin
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
+
+// axfr transfers zone origin from a primary over TCP
+func (s *Server) axfr(host, origin string) ([]dnsmessage.Resource, error) {
+	name, err := dnsmessage.NewName(origin)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 2, 512), dnsmessage.Header{ID: randomID()})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeAXFR, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(query, uint16(len(query)-2))
+
+	conn, err := s.outboundDialer().Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	var records []dnsmessage.Resource
+	for soas := 0; soas < 2; { // the zone starts and ends with its SOA
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+
+		var m dnsmessage.Message
+		if err := m.Unpack(buf); err != nil {
+			return nil, err
+		}
+		if m.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("zone transfer refused: %s", m.RCode)
+		}
+		if len(m.Answers) == 0 {
+			return nil, fmt.Errorf("empty zone transfer")
+		}
+		for _, rr := range m.Answers {
+			if rr.Header.Type == dnsmessage.TypeSOA {
+				soas++
+			}
+			records = append(records, rr)
+		}
+	}
+	return records, nil
+}
+
+// refreshRPZs transfers zones again, swapping those with a new serial
+func (s *Server) refreshRPZs() {
+	for range time.Tick(s.opts.Refresh) {
+		for i, spec := range s.opts.RPZs {
+			if !isAXFR(spec) {
+				continue
+			}
+
+			z, err := s.loadRPZ(spec)
+			if err != nil {
+				s.logErr.Printf("Failed to refresh RPZ %s: %s", spec, err)
+				continue
+			}
+
+			s.configLock.Lock()
+			changed := s.rpzs[i].serial != z.serial
+			if changed {
+				s.rpzs[i] = z
+			}
+			s.configLock.Unlock()
+			if changed {
+				s.cacheFlush()
+				s.logStd.Printf("RPZ %d refreshed from %s, serial %d, %d triggers", i+1, spec, z.serial, z.size)
+			}
+		}
+	}
+}
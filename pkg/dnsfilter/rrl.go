@@ -0,0 +1,128 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+	"time"
+)
+
+type rrlAction int
+
+const (
+	rrlPass     rrlAction = iota
+	rrlTruncate           // send a truncated reply so genuine clients retry over TCP
+	rrlDrop
+)
+
+type rrlKey struct {
+	prefix string // client network, /24 for IPv4 and /56 for IPv6
+	name   string
+	qtype  dnsmessage.Type
+	class  int // 0 answer, 1 NXDOMAIN, 2 error
+}
+
+type rrlBucket struct {
+	balance float64
+	last    time.Time
+	limited uint // responses limited in a row, for slip / leak
+}
+
+// rrlCheck does BIND-style response rate limiting. Balance of each bucket is
+// credited -rrl per second up to -rrl and may be owed down to -rrl-window of it.
+func (s *Server) rrlCheck(client net.IP, msg []byte) rrlAction {
+	if s.opts.RRL <= 0 {
+		return rrlPass
+	}
+
+	var parser dnsmessage.Parser
+	hdr, err := parser.Start(msg)
+	if err != nil {
+		return rrlPass
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return rrlPass
+	}
+
+	key := rrlKey{name: strings.ToLower(q.Name.String()), qtype: q.Type}
+	if ip := client.To4(); ip != nil {
+		key.prefix = ip.Mask(net.CIDRMask(24, 32)).String()
+	} else {
+		key.prefix = client.Mask(net.CIDRMask(56, 128)).String()
+	}
+	switch hdr.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		key.class = 1
+	default:
+		key.class = 2
+	}
+
+	now := time.Now()
+
+	s.rrlBucketsLock.Lock()
+	defer s.rrlBucketsLock.Unlock()
+
+	b, ok := s.rrlBuckets[key]
+	if !ok {
+		b = &rrlBucket{s.opts.RRL, now, 0}
+		s.rrlBuckets[key] = b
+	} else {
+		b.balance += now.Sub(b.last).Seconds() * s.opts.RRL
+		if b.balance > s.opts.RRL {
+			b.balance = s.opts.RRL
+		}
+		b.last = now
+	}
+
+	if b.balance--; b.balance >= 0 {
+		b.limited = 0
+		return rrlPass
+	}
+	if debt := -s.opts.RRL * s.opts.RRLWindow.Seconds(); b.balance < debt {
+		b.balance = debt
+	}
+
+	b.limited++
+	switch {
+	case s.opts.RRLLeak > 0 && b.limited%uint(s.opts.RRLLeak) == 0:
+		return rrlPass
+	case s.opts.TCP && s.opts.RRLSlip > 0 && b.limited%uint(s.opts.RRLSlip) == 0: // dropped without TCP to retry over
+		return rrlTruncate
+	}
+	return rrlDrop
+}
+
+// purgeRRLBuckets forgets buckets idle for longer than the window
+func (s *Server) purgeRRLBuckets() {
+	for range time.Tick(s.opts.RRLWindow) {
+		now := time.Now()
+		s.rrlBucketsLock.Lock()
+		for key, b := range s.rrlBuckets {
+			if now.Sub(b.last) > s.opts.RRLWindow {
+				delete(s.rrlBuckets, key)
+			}
+		}
+		s.rrlBucketsLock.Unlock()
+	}
+}
+
+// truncated strips the message down to its question and OPT record with TC set,
+// so that EDNS0 clients still learn the payload size (RFC 6891 section 7)
+func truncated(msg []byte) ([]byte, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return nil, err
+	}
+	var additionals []dnsmessage.Resource
+	for _, rr := range m.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+
+	m.Header.Truncated = true
+	m = dnsmessage.Message{Header: m.Header, Questions: m.Questions, Additionals: additionals}
+	return m.Pack()
+}
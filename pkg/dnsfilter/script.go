@@ -0,0 +1,239 @@
+package dnsfilter
+
+import (
+	"dnsfilter/filter"
+	"fmt"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const scriptSteps = 1000000 // per call, against scripts looping forever
+
+// script holds the functions defined by -script, nil if not defined
+type script struct {
+	verdict   starlark.Callable // verdict(query, answer)
+	upstreams starlark.Callable // upstreams(query)
+	srv       *Server
+}
+
+func (s *Server) loadScript() (*script, error) {
+	if s.opts.Script == "" {
+		return nil, nil
+	}
+
+	thread := &starlark.Thread{Name: "load", Print: s.scriptPrint}
+	globals, err := starlark.ExecFile(thread, s.opts.Script, nil, nil) // globals come frozen
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load script: %s", err)
+	}
+	sc := &script{srv: s}
+	sc.verdict, _ = globals["verdict"].(starlark.Callable)
+	sc.upstreams, _ = globals["upstreams"].(starlark.Callable)
+	if sc.verdict == nil && sc.upstreams == nil {
+		return nil, fmt.Errorf("Script %s defines neither verdict nor upstreams", s.opts.Script)
+	}
+	s.logStd.Printf("Script loaded from %s", s.opts.Script)
+	return sc, nil
+}
+
+func (s *Server) scriptPrint(thread *starlark.Thread, msg string) {
+	s.logStd.Printf("%s: %s", thread.Name, msg)
+}
+
+func (s *script) call(fn starlark.Callable, args ...starlark.Value) (starlark.Value, error) {
+	thread := &starlark.Thread{Name: fn.Name(), Print: s.srv.scriptPrint}
+	thread.SetMaxExecutionSteps(scriptSteps)
+	return starlark.Call(thread, fn, args, nil)
+}
+
+func (s *Server) currentScript() *script {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.hook
+}
+
+// queryValue is the query as a struct of name, type and client
+func queryValue(qs []dnsmessage.Question, client net.IP) starlark.Value {
+	fields := starlark.StringDict{"name": starlark.String(""), "type": starlark.String(""), "client": starlark.String(client.String())}
+	if len(qs) > 0 {
+		fields["name"], fields["type"] = starlark.String(qs[0].Name.String()), starlark.String(typeName(qs[0].Type))
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, fields)
+}
+
+// recordData is the data of rr the way local zones are written, empty for other types
+func recordData(rr dnsmessage.Resource) string {
+	switch body := rr.Body.(type) {
+	case *dnsmessage.AResource, *dnsmessage.AAAAResource:
+		return answerIP(rr).String()
+	case *dnsmessage.CNAMEResource:
+		return body.CNAME.String()
+	case *dnsmessage.NSResource:
+		return body.NS.String()
+	case *dnsmessage.PTRResource:
+		return body.PTR.String()
+	case *dnsmessage.MXResource:
+		return strconv.Itoa(int(body.Pref)) + " " + body.MX.String()
+	case *dnsmessage.TXTResource:
+		quoted := make([]string, len(body.TXT))
+		for i, txt := range body.TXT {
+			quoted[i] = strconv.Quote(txt)
+		}
+		return strings.Join(quoted, " ")
+	}
+	return ""
+}
+
+// scriptUpstreams calls upstreams(query), returning the servers picked by 1-based
+// index, nil to leave it to forwards
+func (s *Server) scriptUpstreams(qs []dnsmessage.Question, client net.IP) []*upstream {
+	sc := s.currentScript()
+	if sc == nil || sc.upstreams == nil {
+		return nil
+	}
+
+	v, err := sc.call(sc.upstreams, queryValue(qs, client))
+	if err != nil {
+		s.logErr.Printf("Script upstreams failed: %s", err)
+		return nil
+	}
+	if v == starlark.None {
+		return nil
+	}
+	list, ok := v.(*starlark.List)
+	if !ok {
+		s.logErr.Printf("Script upstreams returned %s, not a list", v.Type())
+		return nil
+	}
+
+	var picked []*upstream
+	for i := 0; i < list.Len(); i++ {
+		var index int
+		if err := starlark.AsInt(list.Index(i), &index); err != nil || index < 1 || index > len(s.servers) {
+			s.logErr.Printf("Script upstreams returned invalid server %s", list.Index(i))
+			return nil
+		}
+		picked = append(picked, s.servers[index-1])
+	}
+	return picked
+}
+
+// scriptVerdict calls verdict(query, answer). answer has server (1-based index), rcode and
+// records, each with name, type, ttl and data. The script returns None to let rules
+// decide, "ACCEPT", "DROP", "BLOCK", or a list of records replacing the answers before
+// rules: those it was given, or new ones of types local zones take.
+func (s *Server) scriptVerdict(qs []dnsmessage.Question, client net.IP, serverIndex int, rcode dnsmessage.RCode, answers []dnsmessage.Resource) (filter.Verdict, []dnsmessage.Resource, error) {
+	sc := s.currentScript()
+	if sc == nil || sc.verdict == nil {
+		return filter.Continue, nil, nil
+	}
+
+	given := make(map[starlark.Value]dnsmessage.Resource, len(answers))
+	records := make([]starlark.Value, len(answers))
+	for i, rr := range answers {
+		records[i] = starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"name": starlark.String(rr.Header.Name.String()),
+			"type": starlark.String(typeName(rr.Header.Type)),
+			"ttl":  starlark.MakeUint(uint(rr.Header.TTL)),
+			"data": starlark.String(recordData(rr)),
+		})
+		given[records[i]] = rr
+	}
+	answer := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"server":  starlark.MakeInt(serverIndex),
+		"rcode":   starlark.String(rcodeName(rcode)),
+		"records": starlark.NewList(records),
+	})
+
+	v, err := sc.call(sc.verdict, queryValue(qs, client), answer)
+	if err != nil {
+		return filter.Continue, nil, fmt.Errorf("Script verdict failed: %s", err)
+	}
+
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return filter.Continue, nil, nil
+	case starlark.String:
+		switch strings.ToUpper(string(v)) {
+		case "ACCEPT":
+			return filter.Accept, nil, nil
+		case "DROP":
+			return filter.Drop, nil, nil
+		case "BLOCK":
+			return filter.Block, nil, nil
+		}
+		return filter.Continue, nil, fmt.Errorf("Script verdict %s unknown", v)
+	case *starlark.List:
+		rewritten := make([]dnsmessage.Resource, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if rr, ok := given[v.Index(i)]; ok {
+				rewritten = append(rewritten, rr)
+				continue
+			}
+			rr, err := scriptRecord(v.Index(i), qs)
+			if err != nil {
+				return filter.Continue, nil, fmt.Errorf("Script verdict record %s: %s", v.Index(i), err)
+			}
+			rewritten = append(rewritten, rr)
+		}
+		return filter.Continue, rewritten, nil
+	}
+	return filter.Continue, nil, fmt.Errorf("Script verdict returned %s", v.Type())
+}
+
+// scriptRecord builds a record from a struct or dict of type and data, name defaulting
+// to the question and ttl to the one of hosts files
+func scriptRecord(v starlark.Value, qs []dnsmessage.Question) (dnsmessage.Resource, error) {
+	field := func(key string) (starlark.Value, bool) {
+		switch v := v.(type) {
+		case *starlark.Dict:
+			value, found, _ := v.Get(starlark.String(key))
+			return value, found
+		case starlark.HasAttrs: // structs
+			attr, err := v.Attr(key)
+			return attr, err == nil && attr != nil
+		}
+		return nil, false
+	}
+
+	var rr dnsmessage.Resource
+	rr.Header.Class, rr.Header.TTL = dnsmessage.ClassINET, hostsTTL
+	if len(qs) > 0 {
+		rr.Header.Name = qs[0].Name
+	}
+	if name, ok := field("name"); ok {
+		str, _ := starlark.AsString(name)
+		if !strings.HasSuffix(str, ".") {
+			str += "."
+		}
+		n, err := dnsmessage.NewName(str)
+		if err != nil {
+			return rr, err
+		}
+		rr.Header.Name = n
+	}
+	if ttl, ok := field("ttl"); ok {
+		var t int
+		if err := starlark.AsInt(ttl, &t); err != nil || t < 0 {
+			return rr, fmt.Errorf("invalid ttl")
+		}
+		rr.Header.TTL = uint32(t)
+	}
+
+	rrType, ok1 := field("type")
+	data, ok2 := field("data")
+	typeStr, _ := starlark.AsString(rrType)
+	dataStr, _ := starlark.AsString(data)
+	if !ok1 || !ok2 {
+		return rr, fmt.Errorf("type and data needed")
+	}
+	var err error
+	if rr.Header.Type, rr.Body, err = parseRecord(typeStr+" "+dataStr, ""); err != nil {
+		return rr, err
+	}
+	return rr, nil
+}
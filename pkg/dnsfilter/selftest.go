@@ -0,0 +1,182 @@
+package dnsfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+	"time"
+)
+
+// canary is a name of -selftest and the verdict expected on its answer
+type canary struct {
+	name    dnsmessage.Name
+	verdict string
+}
+
+// parseCanaries reads the name=VERDICT entries of -selftest
+func (s *Server) parseCanaries() error {
+	s.canaries = nil
+	for _, entry := range s.opts.SelfTest {
+		str, verdict, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		name, err := dnsmessage.NewName(strings.ToLower(strings.Trim(str, " .")) + ".")
+		verdict = strings.ToUpper(strings.TrimSpace(verdict))
+		if !ok || err != nil || str == "" || !knownVerdict(verdict) {
+			return fmt.Errorf("Invalid self-test canary: %s", entry)
+		}
+		s.canaries = append(s.canaries, canary{name, verdict})
+	}
+	return nil
+}
+
+func knownVerdict(verdict string) bool {
+	for _, name := range targetNames {
+		if name == verdict {
+			return true
+		}
+	}
+	return false
+}
+
+// selftesting tells if the query of ctx comes from the self-test
+func (s *Server) selftesting(ctx context.Context) bool {
+	client, _ := s.selftestClient.Load().(string)
+	addr, ok := ctx.Value(clientAddrKey).(*net.UDPAddr)
+	return client != "" && ok && addr.String() == client
+}
+
+// recordSelftest keeps the verdict on an answer to a canary, those of answers
+// dropped giving way to others, as the client gets these
+func (s *Server) recordSelftest(qs []dnsmessage.Question, verdict string) {
+	if len(qs) == 0 {
+		return
+	}
+	key := strings.ToLower(qs[0].Name.String())
+	s.selftestLock.Lock()
+	if old, ok := s.selftestVerdicts[key]; !ok || old == "DROP" {
+		s.selftestVerdicts[key] = verdict
+	}
+	s.selftestLock.Unlock()
+}
+
+// mockAnswer answers msg as server would with -selftest-mock, by TEST-NET addresses
+// for A and AAAA queries and no records for other types, without asking it
+func mockAnswer(msg []byte, server *upstream) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return nil
+	}
+	m.Response, m.RecursionAvailable, m.RCode = true, true, dnsmessage.RCodeSuccess
+	for _, q := range m.Questions {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: hostsTTL}
+		switch q.Type {
+		case dnsmessage.TypeA:
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+		case dnsmessage.TypeAAAA:
+			aaaa := dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: rh, Body: &aaaa})
+		}
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+// SelfTest queries the names of Config.SelfTest through the listener once Serve
+// runs, as a client on this host, checking the verdicts of the rules on their answers.
+// Upstreams are asked unless Config.SelfTestMock is set. It returns an error if any
+// verdict is not the one expected, or the answer was not judged by the rules, as
+// answers from the cache, hosts or local zones aren't.
+func (s *Server) SelfTest() error {
+	target := s.conn(0).LocalAddr().(*net.UDPAddr)
+	if target.IP.IsUnspecified() { // listening on any
+		if target.IP.To4() != nil {
+			target = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: target.Port}
+		} else {
+			target = &net.UDPAddr{IP: net.IPv6loopback, Port: target.Port}
+		}
+	}
+	conn, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		return fmt.Errorf("Self-test failed: %s", err)
+	}
+	defer conn.Close()
+	s.selftestClient.Store(conn.LocalAddr().String())
+	defer s.selftestClient.Store("")
+
+	failed := 0
+	buf := make([]byte, 65535)
+	for _, c := range s.canaries {
+		got, err := s.selftestQuery(conn, buf, c.name)
+		switch {
+		case err != nil:
+			s.logErr.Printf("Self-test %s failed: %s", c.name, err)
+			failed++
+		case got != c.verdict:
+			s.logErr.Printf("Self-test %s failed: %s, expected %s", c.name, got, c.verdict)
+			failed++
+		default:
+			s.logStd.Printf("Self-test %s passed: %s", c.name, got)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Self-test failed for %d of %d canaries", failed, len(s.canaries))
+	}
+	s.logStd.Printf("Self-test passed for %d canaries", len(s.canaries))
+	return nil
+}
+
+// selftestQuery asks for the A records of name over conn, telling the verdict on
+// the answer judged
+func (s *Server) selftestQuery(conn *net.UDPConn, buf []byte, name dnsmessage.Name) (string, error) {
+	key := strings.ToLower(name.String())
+	s.selftestLock.Lock()
+	delete(s.selftestVerdicts, key)
+	s.selftestLock.Unlock()
+
+	id := randomID()
+	q := dnsmessage.Message{Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}}
+	packed, err := q.Pack()
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(packed); err != nil {
+		return "", err
+	}
+
+	wait := s.opts.Deadline // for the reply, none coming if dropped
+	if wait <= 0 {
+		for _, server := range s.servers {
+			if server.queryTimeout() > wait {
+				wait = server.queryTimeout()
+			}
+		}
+	}
+	deadline := time.Now().Add(wait + time.Second)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				break // dropped, if judged
+			}
+			return "", err
+		}
+		if n >= 2 && uint16(buf[0])<<8|uint16(buf[1]) == id {
+			break
+		}
+	}
+
+	s.selftestLock.Lock()
+	verdict, ok := s.selftestVerdicts[key]
+	s.selftestLock.Unlock()
+	if !ok {
+		return "", errors.New("no answer judged by rules, upstreams unanswering or answered from the cache, hosts or local zones")
+	}
+	return verdict, nil
+}
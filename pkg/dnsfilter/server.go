@@ -0,0 +1,604 @@
+// Package dnsfilter is the core of the dnsfilter command: a DNS forwarder judging the
+// answers of its upstreams by rules.
+package dnsfilter
+
+import (
+	"dnsfilter/filter"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the options of a Server, those of the dnsfilter command line. Filtering
+// rules, forwards and zones are read from ConfigFile.
+type Config struct {
+	Listen     string   // address and UDP port
+	Servers    []string // nameservers, more in [server.xxx] sections
+	ConfigFile string
+	Timeout    time.Duration // per upstream, unless set in its section
+	Deadline   time.Duration // for the answer to a client, 0 for the longest timeout of upstreams asked
+	Verbose    bool
+	Trace      bool // verbose, telling why each rule did or didn't match
+
+	CacheSize int           // answers, 0 disables caching
+	CacheFile string        // saving the cache across restarts, disabled if empty
+	CacheSave time.Duration // interval of saving it besides shutdown, 0 disables
+	MinTTL    time.Duration // of relayed answers, 0 disables
+	Any       string        // answering ANY queries: forward, hinfo or notimp
+	Recursive bool          // resolving from the root servers instead of forwarding
+	MDNS      []string      // suffixes resolved by multicast DNS
+	MDNSIface string        // interface to send mDNS queries on, the default one if empty
+	DNS64     string        // prefix to synthesize AAAA records with, disabled if empty
+	OpCodes   []string      // opcode=policy for other opcodes than QUERY, answered NOTIMP if absent
+	SVCBStrip []string      // parameters removed from SVCB and HTTPS records: ipv4hint, ipv6hint or ech
+	MaxTTL    time.Duration
+	QPS       float64
+	Burst     int
+	QPSDrop   bool // drop over-limit queries instead of REFUSED
+	RRL       float64
+	RRLWindow time.Duration
+	RRLSlip   int
+	RRLLeak   int
+
+	IPsets     []string // files or URLs as path[#format[=filter+...]]
+	Hosts      []string
+	Blocklists []string
+	Allowlists []string
+	RPZs       []string // zone files or axfr://host[:port]/zone
+	CacheDir   string   // keeping downloaded lists
+	Refresh    time.Duration
+	GeoIP      string // .mmdb file
+
+	Strategy    string // all, failover, roundrobin, weighted or fastest
+	Subset      int    // upstreams asked per query at random with all, 0 for all of them
+	Failover    time.Duration
+	Pick        string // earliest or best
+	RaceWindow  time.Duration
+	Consensus   int // agreeing answers waited for with -pick best, 0 disables
+	Flatten     bool
+	Retries     int
+	RetryAfter  time.Duration
+	EDNS        int
+	MaxSize     int // of answers over TCP, which truncated ones over UDP are asked again by if above EDNS
+	Case0x20    bool
+	FastAnswers string // log or drop answers under half the RTT floor of their upstream, disabled if empty
+	DNSSEC      bool
+	Drain       time.Duration
+	User        string
+	Group       string
+	Chroot      string
+	ReusePort   bool
+	Transparent bool // answering queries diverted by TPROXY from their original destination
+	TCP         bool // answering queries over TCP on the listening port too, as truncated ones are retried
+	Sockets     int  // to upstreams
+	Workers     int
+	Queue       int
+	QueuePolicy string // drop or oldest
+	Script      string
+	Plugins     []string
+	Profile     string
+	Admin       string // HTTP API address, disabled if empty
+	Stats       bool   // top domains, clients and verdicts of the last 24 hours
+	StatsDB     string // keeping their hourly counts across restarts, disabled if empty
+	StatsEvery  time.Duration
+	StatsKeep   time.Duration
+	Tunnel      bool    // scoring queries for DNS tunneling, matched by rules with tunnel
+	TunnelAlert int     // score logging queries at, 0 disables
+	OTLP        string  // OTLP/HTTP endpoint to export traces to, disabled if empty
+	OTLPSample  float64 // ratio of queries traced
+	Webhook     string  // URL to post answers judged by rules with notify to, disabled if empty
+
+	OutboundIP    string // source address of queries to upstreams, any if empty
+	OutboundIface string // interface to send them on, any if empty
+
+	XFR        string // server to pass zone transfers to over TCP, disabled if empty
+	XFRClients string // networks allowed to transfer zones
+
+	Bootstrap        string        // nameserver resolving hostnames of upstreams, the system's if empty
+	BootstrapRefresh time.Duration // of their addresses, 0 disables
+	PreferFamily     string        // v4 or v6 for those resolving to both, either if empty
+	Stagger          time.Duration // before asking them at the other family too, 0 disables
+
+	Rebind      string   // strip or drop answers with private addresses for public names, disabled if empty
+	RebindAllow []string // domains allowed them, for split DNS
+	SinkholePTR string   // name answering PTR queries of block_with addresses, disabled if empty
+
+	SelfTest     []string // name=VERDICT canaries checked by Server.SelfTest
+	SelfTestMock bool     // answering them by a built-in mock instead of upstreams
+
+	QueryLog       string // JSON lines file, disabled if empty
+	QueryLogSize   int    // MB to rotate at, 0 disables
+	QueryLogRotate time.Duration
+	QueryLogKeep   time.Duration // of rotated files, 0 keeps them forever
+
+	Log      *log.Logger // nil for stdout
+	ErrorLog *log.Logger // nil for stderr
+}
+
+// DefaultConfig returns the defaults of the command line
+func DefaultConfig() Config {
+	return Config{
+		Listen:      "localhost:5353",
+		Timeout:     time.Second,
+		Burst:       20,
+		CacheSave:   10 * time.Minute,
+		Any:         "forward",
+		RRLWindow:   15 * time.Second,
+		RRLSlip:     2,
+		CacheDir:    defaultCacheDir(),
+		Refresh:     24 * time.Hour,
+		Strategy:    "all",
+		Failover:    200 * time.Millisecond,
+		Pick:        "earliest",
+		RaceWindow:  100 * time.Millisecond,
+		RetryAfter:  250 * time.Millisecond,
+		EDNS:        1232,
+		MaxSize:     65535,
+		Case0x20:    true,
+		TCP:         true,
+		Drain:       5 * time.Second,
+		Sockets:     16,
+		Workers:     1024,
+		Queue:       4096,
+		QueuePolicy: "drop",
+		StatsEvery:  time.Minute,
+		StatsKeep:   90 * 24 * time.Hour,
+		OTLPSample:  1,
+
+		QueryLogSize:   100,
+		QueryLogRotate: 24 * time.Hour,
+		QueryLogKeep:   7 * 24 * time.Hour,
+
+		BootstrapRefresh: time.Hour,
+		Stagger:          50 * time.Millisecond,
+	}
+}
+
+// Server answers queries on its sockets. It holds all it loaded, so several can run
+// in a process.
+type Server struct {
+	// counters accessed atomically, first for their 64-bit alignment
+	answersDivergent     uint64 // queries upstreams answered differently with -consensus
+	answersFast          uint64 // arriving under half the RTT floor of their upstream
+	answersUnexpected    uint64 // from addresses not asked
+	duplicatesSuppressed uint64 // second answers to a client
+	jobsDropped          uint64
+	listenerRestarts     uint64
+	panicsRecovered      uint64
+	webhookDropped       uint64 // events lost to a full queue or failed posts
+	restartWait          int64  // before reopening a listener the first time
+
+	conns    []*net.UDPConn
+	tcp      *net.TCPListener // nil without -tcp
+	quit     chan struct{}
+	shutdown sync.Once
+	lock     sync.Mutex // guards conns, reopened by superviseListener
+
+	opts        Config
+	logStd      *log.Logger
+	logErr      *log.Logger
+	verboseMode int32          // opts.Verbose, switched by the admin API, accessed atomically
+	inflight    sync.WaitGroup // queries being handled and answers waiting to be sent
+	jobs        chan job
+
+	configLock    sync.RWMutex // guards config which can be reloaded at runtime
+	servers       []*upstream
+	rules         []*rule
+	ipsets        []*ipset
+	blocklists    []*domainTrie
+	allowlists    []*domainTrie // in the formats of blocklists, names listed reading as blocked
+	rpzs          []*rpz
+	hosts         *hostsZone
+	forwards      []*forward
+	zones         []*zone
+	reverses      []*reverseZone
+	views         []*view
+	clientACL     *acl // nil allows everyone
+	hook          *script
+	geoipDB       *mmdb    // nil if -geoip not given
+	profiles      []string // named by rules, in config order
+	activeProfile string   // rules with a profile only match when it's in theirs
+
+	systemServers     []*upstream // of -d system, in the order of the nameservers they're set to
+	recursor          *upstream   // set with -recursive, answering through rules like other upstreams
+	upstreamConns     []*upstreamConn
+	bootstrapResolver *net.Resolver                      // of hostnames of upstreams
+	outboundIP        net.IP                             // source address of upstream queries, nil for any
+	mdnsIface         *net.Interface                     // nil for the default one
+	roundRobin        uint32                             // accessed atomically
+	plugins           []filter.Filter                    // loaded once, Go plugins can't be unloaded
+	dns64Prefix       *net.IPNet                         // nil without -dns64
+	opcodePolicies    map[dnsmessage.OpCode]opcodePolicy // NOTIMP for absent ones
+	svcbStrip         map[uint16]bool                    // SvcParamKeys removed from answers
+	sinkholes         map[string]bool                    // addresses of block_with, answered PTR queries with -sinkhole-ptr
+	xfrServer         string                             // host:port zone transfers are passed to
+	xfrClients        *ipset
+
+	cache     map[cacheKey]*cacheEntry
+	cacheLock sync.Mutex
+
+	dnssecLock  sync.Mutex
+	zoneCache   map[string]zoneKeys
+	anchors     []*trustAnchor
+	dnssecQuery func(name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) // askDNSSEC, tests replace it
+
+	delegations    map[string]delegation // by zone, lower case with the final dot
+	delegationLock sync.Mutex
+
+	buckets           map[string]*bucket
+	bucketsLock       sync.Mutex
+	rrlBuckets        map[rrlKey]*rrlBucket
+	rrlBucketsLock    sync.Mutex
+	tunnelDomains     map[string]*tunnelDomain
+	tunnelDomainsLock sync.Mutex
+	replySockets      map[string]int // by source address, with -transparent
+	replyLock         sync.Mutex
+
+	canaries         []canary
+	selftestClient   atomic.Value // string, address of the socket the self-test queries from
+	selftestLock     sync.Mutex
+	selftestVerdicts map[string]string // by lower-case name, guarded by selftestLock
+
+	statsLock     sync.Mutex
+	statsRing     [statsBuckets]*statsBucket
+	statsSnapshot atomic.Value // *statsReport
+
+	streams     map[chan []byte]bool // of /events clients
+	streamsLock sync.Mutex
+	streamCount int32 // accessed atomically, for publishers to skip work when 0
+
+	queryLog      chan []byte // lines to write, nil if there is no query log
+	queryLogDone  sync.WaitGroup
+	spans         chan *span        // finished ones to export, nil without -otlp
+	webhookEvents chan webhookEvent // to post, nil without -webhook
+}
+
+// newServer makes a Server of cfg, loading nothing yet
+func newServer(cfg Config) *Server {
+	s := &Server{
+		restartWait:       int64(time.Second),
+		quit:              make(chan struct{}),
+		opts:              cfg,
+		logStd:            log.New(os.Stdout, "", log.Ldate|log.Lmicroseconds),
+		logErr:            log.New(os.Stderr, "", log.Ldate|log.Lmicroseconds),
+		bootstrapResolver: net.DefaultResolver,
+		opcodePolicies:    make(map[dnsmessage.OpCode]opcodePolicy),
+		svcbStrip:         make(map[uint16]bool),
+		cache:             make(map[cacheKey]*cacheEntry),
+		zoneCache:         make(map[string]zoneKeys),
+		anchors:           append([]*trustAnchor(nil), builtinAnchors...), // updateAnchors filters them in place
+		delegations:       make(map[string]delegation),
+		buckets:           make(map[string]*bucket),
+		rrlBuckets:        make(map[rrlKey]*rrlBucket),
+		tunnelDomains:     make(map[string]*tunnelDomain),
+		replySockets:      make(map[string]int),
+		selftestVerdicts:  make(map[string]string),
+		streams:           make(map[chan []byte]bool),
+	}
+	s.dnssecQuery = s.askDNSSEC
+	if cfg.Log != nil {
+		s.logStd = cfg.Log
+	}
+	if cfg.ErrorLog != nil {
+		s.logErr = cfg.ErrorLog
+	}
+	s.setVerbose(cfg.Verbose || cfg.Trace)
+	return s
+}
+
+// New checks cfg and loads all it names, binds the listening sockets, then drops
+// privileges if asked to
+func New(cfg Config) (*Server, error) {
+	s := newServer(cfg)
+	if err := s.checkOptions(); err != nil {
+		return nil, err
+	}
+	setBufSize(s.opts.EDNS)
+
+	if s.opts.DNSSEC {
+		if err := s.loadAnchors(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.loadPlugins(); err != nil {
+		return nil, err
+	}
+	if err := s.parseServers(); err != nil {
+		return nil, err
+	}
+	if s.systemServers != nil {
+		go s.watchSystemServers()
+	}
+	if s.opts.BootstrapRefresh > 0 {
+		go s.refreshUpstreamHosts()
+	}
+	if err := s.openUpstreamConns(s.opts.Sockets); err != nil {
+		return nil, err
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	if s.opts.Profile != "" {
+		if err := s.setProfile(s.opts.Profile); err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.CacheFile != "" && s.opts.CacheSize > 0 {
+		if err := s.cacheLoad(); err != nil {
+			return nil, err
+		}
+		if s.opts.CacheSave > 0 {
+			go s.saveCache(s.opts.CacheSave)
+		}
+	}
+	if s.opts.Refresh > 0 {
+		go s.refreshIPsets()
+		go s.refreshBlocklists()
+		go s.refreshRPZs()
+	}
+	if s.opts.QPS > 0 {
+		go s.purgeBuckets()
+	}
+	if s.opts.RRL > 0 {
+		go s.purgeRRLBuckets()
+	}
+	if len(s.opts.MDNS) > 0 {
+		if err := s.openMDNS(); err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.DNS64 != "" {
+		if err := s.parseDNS64(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.parseOpCodes(); err != nil {
+		return nil, err
+	}
+	if err := s.parseSVCBStrip(); err != nil {
+		return nil, err
+	}
+	if s.opts.OTLP != "" {
+		if err := s.startOTLP(); err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.Webhook != "" {
+		if err := s.startWebhook(); err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.Tunnel {
+		go s.purgeTunnelDomains()
+	}
+	if s.opts.Stats {
+		if s.opts.StatsEvery <= 0 {
+			return nil, errors.New("Statistics snapshot interval must be positive")
+		}
+		if s.opts.StatsDB != "" {
+			if err := s.loadStatsDB(); err != nil {
+				return nil, err
+			}
+		}
+		go s.snapshotStats(s.opts.StatsEvery)
+	}
+	if s.opts.Admin != "" {
+		if err := s.serveAdmin(s.opts.Admin); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.opts.QueryLog != "" {
+		if err := s.openQueryLog(); err != nil {
+			return nil, err
+		}
+	}
+
+	listenAddr, err := parseUdpAddr(s.opts.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid binding address: %s", s.opts.Listen)
+	}
+	if s.opts.ReusePort {
+		s.conns, err = listenReusePort(listenAddr, runtime.GOMAXPROCS(0))
+	} else if s.opts.Transparent {
+		var conn *net.UDPConn
+		conn, err = listenTransparent(listenAddr)
+		s.conns = []*net.UDPConn{conn}
+	} else {
+		var conn *net.UDPConn
+		conn, err = net.ListenUDP("udp", listenAddr)
+		s.conns = []*net.UDPConn{conn}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.logStd.Printf("Listening on UDP %s with %d socket(s)", listenAddr, len(s.conns))
+	if s.opts.TCP {
+		if s.tcp, err = s.listenTCP(s.conns[0].LocalAddr().(*net.UDPAddr)); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	if s.opts.XFR != "" {
+		if err = s.loadXFR(); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+
+	if err := s.dropPrivileges(); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkOptions validates options taking one of a few values or a range
+func (s *Server) checkOptions() error {
+	switch s.opts.Strategy {
+	case "all", "failover", "roundrobin", "weighted", "fastest":
+	default:
+		return fmt.Errorf("Unknown strategy: %s", s.opts.Strategy)
+	}
+	if s.opts.FastAnswers != "" && s.opts.FastAnswers != "log" && s.opts.FastAnswers != "drop" {
+		return fmt.Errorf("Unknown fast answers policy: %s", s.opts.FastAnswers)
+	}
+	if err := s.parseCanaries(); err != nil {
+		return err
+	}
+	if s.opts.SinkholePTR != "" {
+		if err := s.parseSinkholePTR(); err != nil {
+			return err
+		}
+	}
+	if s.opts.PreferFamily != "" && s.opts.PreferFamily != "v4" && s.opts.PreferFamily != "v6" {
+		return fmt.Errorf("Unknown family: %s", s.opts.PreferFamily)
+	}
+	if s.opts.Rebind != "" && s.opts.Rebind != "strip" && s.opts.Rebind != "drop" {
+		return fmt.Errorf("Unknown rebind policy: %s", s.opts.Rebind)
+	}
+	if s.opts.Pick != "earliest" && s.opts.Pick != "best" {
+		return fmt.Errorf("Unknown pick: %s", s.opts.Pick)
+	}
+	if s.opts.Subset < 0 || s.opts.Subset > 0 && s.opts.Strategy != "all" {
+		return errors.New("Subset needs -strategy all")
+	}
+	if s.opts.Subset > 0 && s.opts.Consensus > s.opts.Subset {
+		return errors.New("Consensus can't wait for more answers than upstreams in the subset")
+	}
+	if s.opts.Consensus < 0 || s.opts.Consensus > 0 && (s.opts.Pick != "best" || s.opts.Strategy != "all") {
+		return errors.New("Consensus needs -pick best and -strategy all")
+	}
+	if s.opts.EDNS < minUDPSize || s.opts.EDNS > 65535 {
+		return fmt.Errorf("EDNS0 payload size must be between %d and 65535", minUDPSize)
+	}
+	if s.opts.MaxSize < s.opts.EDNS || s.opts.MaxSize > 65535 {
+		return errors.New("Maximum message size must be between the EDNS0 payload size and 65535")
+	}
+	if s.opts.Workers < 1 || s.opts.Queue < 1 {
+		return errors.New("Workers and queue size must be at least 1")
+	}
+	if s.opts.QueuePolicy != "drop" && s.opts.QueuePolicy != "oldest" {
+		return fmt.Errorf("Unknown queue policy: %s", s.opts.QueuePolicy)
+	}
+	if s.opts.Transparent && s.opts.ReusePort {
+		return errors.New("Transparent mode does not support multiple sockets")
+	}
+	if s.opts.XFR != "" && !s.opts.TCP {
+		return errors.New("Zone transfers need -tcp")
+	}
+	if s.opts.Recursive && s.opts.DNSSEC {
+		return errors.New("DNSSEC validation is not supported with recursive resolution")
+	}
+	if s.opts.Any != "forward" && s.opts.Any != "hinfo" && s.opts.Any != "notimp" {
+		return fmt.Errorf("Unknown ANY policy: %s", s.opts.Any)
+	}
+	if s.opts.MinTTL < 0 || s.opts.MaxTTL < 0 || s.opts.MaxTTL > 0 && s.opts.MinTTL > s.opts.MaxTTL {
+		return errors.New("TTL bounds must be positive, minimum up to maximum")
+	}
+	if s.opts.Timeout <= 0 || s.opts.Deadline < 0 {
+		return errors.New("Timeout must be positive, deadline too if set")
+	}
+	if s.opts.OTLPSample < 0 || s.opts.OTLPSample > 1 {
+		return errors.New("OTLP sample ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// Serve answers queries until Shutdown, then waits for those in flight up to Config.Drain
+func (s *Server) Serve() {
+	defer s.close()
+	s.startWorkers(s.opts.Workers, s.opts.Queue)
+	if s.tcp != nil {
+		go s.serveTCP(s.tcp, s.quit)
+	}
+	var serving sync.WaitGroup
+	bcs := make([]*batchConn, len(s.conns))
+	for i := range s.conns {
+		bcs[i] = s.newBatchConn(s.conn(i))
+		serving.Add(1)
+		go func(i int) {
+			defer serving.Done()
+			s.superviseListener(i, bcs[i])
+		}(i)
+	}
+	serving.Wait()
+	s.drain()
+	for _, bc := range bcs {
+		bc.close()
+	}
+	s.closeQueryLog()
+	if s.opts.Stats && s.opts.StatsDB != "" {
+		if err := s.saveStatsDB(); err != nil {
+			s.logErr.Println("Failed to save statistics:", err)
+		}
+	}
+	if s.opts.CacheFile != "" && s.opts.CacheSize > 0 {
+		if err := s.cacheSave(); err != nil {
+			s.logErr.Println("Failed to save cache:", err)
+		}
+	}
+}
+
+// Shutdown stops accepting queries, Serve returning once those in flight are answered
+func (s *Server) Shutdown() {
+	s.shutdown.Do(func() {
+		close(s.quit)
+		s.lock.Lock()
+		for _, conn := range s.conns {
+			conn.SetReadDeadline(time.Now()) // stop accepting while still able to answer
+		}
+		s.lock.Unlock()
+		if s.tcp != nil {
+			s.tcp.Close() // connections stop reading on quit, transfers finish by themselves
+		}
+	})
+}
+
+func (s *Server) close() {
+	s.lock.Lock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+}
+
+// Reload reads lists and ConfigFile again, swapping them in atomically
+func (s *Server) Reload() error {
+	return s.reload()
+}
+
+// SetProfile switches the active rule profile, none if empty
+func (s *Server) SetProfile(name string) error {
+	return s.setProfile(name)
+}
+
+// NextProfile switches to the rule profile after the active one, none after the last
+func (s *Server) NextProfile() {
+	s.nextProfile()
+}
+
+// drain waits for queries in flight, up to -drain
+func (s *Server) drain() {
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(s.opts.Drain):
+		s.logErr.Println("Timed out waiting for queries in flight")
+	}
+}
@@ -0,0 +1,51 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a second Server of other rules answers by its own, the first one by its own, before
+// and after the second shuts down
+func TestServersCoexist(t *testing.T) {
+	addr := raceServer(t)
+	configFile := filepath.Join(t.TempDir(), "config.ini")
+	if err := os.WriteFile(configFile, []byte("[rule.block]\nname = cn.test\ntarget = BLOCK\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Listen, cfg.ConfigFile, cfg.CacheSize = "127.0.0.1:0", configFile, 0
+	cfg.Servers = []string{raceSrv.servers[0].addr().String()}
+	cfg.Log, cfg.ErrorLog = log.New(io.Discard, "", 0), log.New(io.Discard, "", 0)
+	other, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		other.Serve()
+		close(served)
+	}()
+
+	if m, _ := ask(t, other.conn(0).LocalAddr().(*net.UDPAddr), "cn.test."); m.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("second Server: got %s %s, want NXDOMAIN", m.RCode, firstA(m))
+	}
+	if m, _ := ask(t, addr, "cn.test."); m.RCode != dnsmessage.RCodeSuccess || firstA(m) != "1.0.1.1" {
+		t.Errorf("first Server: got %s %s, want 1.0.1.1", m.RCode, firstA(m))
+	}
+	other.Shutdown()
+	select {
+	case <-served:
+	case <-time.After(cfg.Drain + time.Second):
+		t.Fatal("second Server still serving")
+	}
+	if m, _ := ask(t, addr, "cn.test."); firstA(m) != "1.0.1.1" {
+		t.Errorf("first Server after the second shut down: got %s, want 1.0.1.1", firstA(m))
+	}
+}
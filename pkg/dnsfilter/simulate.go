@@ -0,0 +1,159 @@
+package dnsfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// Simulation is a synthetic answer run through the rules by Simulate
+type Simulation struct {
+	Name   string
+	Type   string   // of the question, A if empty
+	IPs    []string // answered as A or AAAA records of Name
+	Server string   // name or 1-based index of the server answering, the first if empty
+	Client string   // IP of the client asking, 127.0.0.1 if empty
+	RCode  string   // NOERROR if empty
+}
+
+// Simulate loads what cfg names as New does, without binding sockets, then judges the
+// answer of sim by the rules, printing the trace, the rule matched and the verdict.
+// Plugins and the script are not run. It tells false if the answer could not be judged.
+func Simulate(cfg Config, sim Simulation) bool {
+	s := newServer(cfg)
+	msg, client, err := simulatedAnswer(sim)
+	if err != nil {
+		s.logErr.Println(err)
+		return false
+	}
+	if err := s.loadOffline(); err != nil {
+		s.logErr.Println(err)
+		return false
+	}
+	serverIndex := uint(1)
+	if sim.Server != "" {
+		var ok bool
+		if serverIndex, ok = s.lookupServerName(sim.Server); !ok {
+			s.logErr.Printf("Unknown server %s", sim.Server)
+			return false
+		}
+	}
+
+	s.opts.Trace = true
+	s.setVerbose(true)
+	s.logStd = log.New(os.Stdout, "", 0)
+	if cfg.Log != nil {
+		s.logStd = cfg.Log
+	}
+	ctx := context.WithValue(context.Background(), clientAddrKey, &net.UDPAddr{IP: client})
+	msgOut, delay, rank, _ := s.determine(ctx, int(serverIndex), msg)
+
+	s.configLock.RLock()
+	if rank >= 0 && rank < len(s.rules) {
+		s.logStd.Printf("Rule: %s (#%d) %s", s.rules[rank].name, rank+1, s.rules[rank].desc)
+	} else {
+		s.logStd.Println("Rule: none")
+	}
+	s.configLock.RUnlock()
+
+	if delay < 0 {
+		s.logStd.Println("Verdict: DROP")
+		return true
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(msgOut); err != nil {
+		s.logErr.Println(err)
+		return false
+	}
+	var verdict strings.Builder
+	fmt.Fprintf(&verdict, "Verdict: reply %s after %s", rcodeName(m.Header.RCode), delay)
+	for _, ans := range m.Answers {
+		fmt.Fprintf(&verdict, ", %s %s %s", ans.Header.Name, typeName(ans.Header.Type), recordData(ans))
+	}
+	s.logStd.Println(verdict.String())
+	return true
+}
+
+// loadOffline loads what cfg names as New does, without binding sockets. Plugins and
+// the script are not loaded, their verdicts not telling the rule matched.
+func (s *Server) loadOffline() error {
+	s.opts.Script, s.opts.Plugins = "", nil
+	s.logStd = log.New(io.Discard, "", 0) // loading is not of interest
+
+	if err := s.parseServers(); err != nil {
+		return err
+	}
+	if len(s.servers) == 0 {
+		return errors.New("No nameserver to answer")
+	}
+	if err := s.openUpstreamConns(s.opts.Sockets); err != nil { // for STRIP if_other looking up the other family
+		return err
+	}
+	if err := s.reload(); err != nil {
+		return err
+	}
+	if s.opts.Profile != "" {
+		return s.setProfile(s.opts.Profile)
+	}
+	return nil
+}
+
+// simulatedAnswer packs the answer of sim, telling the client IP too
+func simulatedAnswer(sim Simulation) ([]byte, net.IP, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(sim.Name, ".") + ".")
+	if err != nil || sim.Name == "" {
+		return nil, nil, fmt.Errorf("Invalid name: %s", sim.Name)
+	}
+	qtype := dnsmessage.TypeA
+	if sim.Type != "" {
+		var ok bool
+		if qtype, ok = parseType(sim.Type); !ok {
+			return nil, nil, fmt.Errorf("Invalid type: %s", sim.Type)
+		}
+	}
+	rcode := dnsmessage.RCodeSuccess
+	if sim.RCode != "" {
+		rcodes, ok := parseRCodes([]string{sim.RCode})
+		if !ok {
+			return nil, nil, fmt.Errorf("Invalid rcode: %s", sim.RCode)
+		}
+		rcode = rcodes[0]
+	}
+	client := net.IPv4(127, 0, 0, 1)
+	if sim.Client != "" {
+		if client = net.ParseIP(sim.Client); client == nil {
+			return nil, nil, fmt.Errorf("Invalid client IP: %s", sim.Client)
+		}
+	}
+
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionDesired: true, RecursionAvailable: true, RCode: rcode},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	for _, ipStr := range sim.IPs {
+		ip := net.ParseIP(strings.TrimSpace(ipStr))
+		if ip == nil {
+			return nil, nil, fmt.Errorf("Invalid IP: %s", ipStr)
+		}
+		rtype := "AAAA "
+		if ip.To4() != nil {
+			rtype = "A "
+		}
+		t, body, err := parseRecord(rtype+ip.String(), "")
+		if err != nil {
+			return nil, nil, err
+		}
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: t, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   body,
+		})
+	}
+	msg, err := m.Pack()
+	return msg, client, err
+}
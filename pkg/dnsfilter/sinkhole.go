@@ -0,0 +1,62 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+)
+
+// parseBlockWith reads the answer of BLOCK: nil for NXDOMAIN, unspecified addresses
+// for null, else a comma-separated list of sinkhole addresses
+func parseBlockWith(str string) ([]net.IP, bool) {
+	switch {
+	case str == "", strings.EqualFold(str, "nxdomain"):
+		return nil, true
+	case strings.EqualFold(str, "null"):
+		return []net.IP{net.IPv4zero, net.IPv6unspecified}, true
+	}
+	var addrs []net.IP
+	for _, field := range strings.Split(str, ",") {
+		ip := net.ParseIP(strings.TrimSpace(field))
+		if ip == nil || ip.IsUnspecified() {
+			return nil, false
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs, true
+}
+
+// sinkholesOf collects the sinkhole addresses of rules
+func sinkholesOf(rules []*rule) map[string]bool {
+	addrs := make(map[string]bool)
+	for _, rule := range rules {
+		for _, ip := range rule.blockWith {
+			if !ip.IsUnspecified() {
+				addrs[ip.String()] = true
+			}
+		}
+	}
+	return addrs
+}
+
+// parseSinkholePTR checks the name of -sinkhole-ptr
+func (s *Server) parseSinkholePTR() error {
+	if _, err := dnsmessage.NewName(strings.TrimSuffix(s.opts.SinkholePTR, ".") + "."); err != nil {
+		return fmt.Errorf("Invalid sinkhole PTR name: %s", s.opts.SinkholePTR)
+	}
+	return nil
+}
+
+// sinkholePTR tells the name answered for ip, if a sinkhole address with -sinkhole-ptr
+func (s *Server) sinkholePTR(ip net.IP) (string, bool) {
+	if s.opts.SinkholePTR == "" {
+		return "", false
+	}
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	if !s.sinkholes[ip.String()] {
+		return "", false
+	}
+	return strings.ToLower(strings.TrimSuffix(s.opts.SinkholePTR, ".")) + ".", true
+}
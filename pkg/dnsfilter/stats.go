@@ -0,0 +1,239 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	statsBuckets  = 24 // hours of the rolling window
+	statsKeys     = 10000
+	statsTop      = 100 // entries kept in snapshots
+	statsOtherKey = "(other)"
+)
+
+// statsBucket counts an hour of queries, keys beyond statsKeys counted as statsOtherKey
+type statsBucket struct {
+	start     time.Time
+	queries   uint64
+	domains   map[string]uint64
+	blocked   map[string]uint64
+	clients   map[string]uint64
+	verdicts  map[string]uint64 // of answers judged
+	upstreams map[*upstream]*upstreamCounts
+}
+
+type statsCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// statsReport is a snapshot of the rolling window served by /stats
+type statsReport struct {
+	Since      time.Time         `json:"since"`
+	Taken      time.Time         `json:"taken"`
+	Queries    uint64            `json:"queries"`
+	TopDomains []statsCount      `json:"top_domains"`
+	TopBlocked []statsCount      `json:"top_blocked"`
+	TopClients []statsCount      `json:"top_clients"`
+	Verdicts   map[string]uint64 `json:"verdicts"`
+	Upstreams  []upstreamStats   `json:"upstreams"`
+}
+
+// upstreamStats sums up the counts of an upstream
+type upstreamStats struct {
+	Server      string  `json:"server"`
+	Sent        uint64  `json:"sent"`
+	Answered    uint64  `json:"answered"`
+	Timeouts    uint64  `json:"timeouts"`
+	Judged      uint64  `json:"judged"`
+	Dropped     uint64  `json:"dropped"`
+	RTTAverage  float64 `json:"rtt_avg_ms"`
+	TimeoutRate float64 `json:"timeout_rate"` // of queries sent
+	DropRate    float64 `json:"drop_rate"`    // of answers judged, the pollution of the upstream
+	WonV4       uint64  `json:"won_v4"`       // answers first over IPv4 with -stagger
+	WonV6       uint64  `json:"won_v6"`
+}
+
+func newUpstreamStats(server *upstream, counts *upstreamCounts) upstreamStats {
+	ratio := func(n, of uint64) float64 {
+		if of == 0 {
+			return 0
+		}
+		return float64(n) / float64(of)
+	}
+	return upstreamStats{server.String(), counts[upstreamSent], counts[upstreamAnswered], counts[upstreamTimeouts],
+		counts[upstreamJudged], counts[upstreamDropped],
+		ratio(counts[upstreamRTTTotal], counts[upstreamRTTCount]) / float64(time.Millisecond),
+		ratio(counts[upstreamTimeouts], counts[upstreamSent]), ratio(counts[upstreamDropped], counts[upstreamJudged]),
+		counts[upstreamWonV4], counts[upstreamWonV6]}
+}
+
+// currentBucket returns the bucket of this hour, reusing the one of a day ago. Callers
+// hold statsLock.
+func (s *Server) currentBucket() *statsBucket {
+	hour := time.Now().Truncate(time.Hour)
+	i := int(hour.Unix()/3600) % statsBuckets
+	if b := s.statsRing[i]; b != nil && b.start.Equal(hour) {
+		return b
+	}
+	b := &statsBucket{start: hour, domains: make(map[string]uint64), blocked: make(map[string]uint64),
+		clients: make(map[string]uint64), verdicts: make(map[string]uint64), upstreams: make(map[*upstream]*upstreamCounts)}
+	s.statsRing[i] = b
+	return b
+}
+
+func countKey(counts map[string]uint64, key string) {
+	if _, ok := counts[key]; !ok && len(counts) >= statsKeys {
+		key = statsOtherKey
+	}
+	counts[key]++
+}
+
+// recordQuery counts a query of client
+func (s *Server) recordQuery(client net.IP, qs []dnsmessage.Question) {
+	if len(qs) == 0 {
+		return
+	}
+	name := strings.ToLower(qs[0].Name.String())
+	s.statsLock.Lock()
+	b := s.currentBucket()
+	b.queries++
+	countKey(b.domains, name)
+	countKey(b.clients, client.String())
+	s.statsLock.Unlock()
+}
+
+// recordVerdict counts the verdict on an answer, see decisionOf
+func (s *Server) recordVerdict(qs []dnsmessage.Question, verdict string) {
+	s.statsLock.Lock()
+	b := s.currentBucket()
+	b.verdicts[verdict]++
+	if (verdict == "BLOCK" || verdict == "RPZ") && len(qs) > 0 {
+		countKey(b.blocked, strings.ToLower(qs[0].Name.String()))
+	}
+	s.statsLock.Unlock()
+}
+
+// recordUpstream adds n to a counter of server, see upstream.count
+func (s *Server) recordUpstream(server *upstream, counter int, n uint64) {
+	s.statsLock.Lock()
+	b := s.currentBucket()
+	counts := b.upstreams[server]
+	if counts == nil {
+		counts = new(upstreamCounts)
+		b.upstreams[server] = counts
+	}
+	counts[counter] += n
+	s.statsLock.Unlock()
+}
+
+// snapshotStats sums up the rolling window into the snapshot served, every interval,
+// saving it in -stats-db too
+func (s *Server) snapshotStats(interval time.Duration) {
+	for {
+		s.takeStatsSnapshot()
+		if s.opts.StatsDB != "" {
+			if err := s.saveStatsDB(); err != nil {
+				s.logErr.Println("Failed to save statistics:", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (s *Server) takeStatsSnapshot() {
+	report := &statsReport{Taken: time.Now(), Verdicts: make(map[string]uint64)}
+	domains, blocked, clients := make(map[string]uint64), make(map[string]uint64), make(map[string]uint64)
+	upstreams := make([]upstreamCounts, len(s.servers))
+	index := make(map[*upstream]int, len(s.servers))
+	for i, server := range s.servers {
+		index[server] = i
+	}
+	since := report.Taken.Add(-statsBuckets * time.Hour)
+	report.Since = report.Taken
+
+	s.statsLock.Lock()
+	for _, b := range s.statsRing {
+		if b == nil || !b.start.After(since) {
+			continue
+		}
+		if b.start.Before(report.Since) {
+			report.Since = b.start
+		}
+		report.Queries += b.queries
+		for key, n := range b.domains {
+			domains[key] += n
+		}
+		for key, n := range b.blocked {
+			blocked[key] += n
+		}
+		for key, n := range b.clients {
+			clients[key] += n
+		}
+		for key, n := range b.verdicts {
+			report.Verdicts[key] += n
+		}
+		for server, counts := range b.upstreams {
+			for counter, n := range counts {
+				upstreams[index[server]][counter] += n
+			}
+		}
+	}
+	s.statsLock.Unlock()
+
+	report.TopDomains, report.TopBlocked, report.TopClients = topCounts(domains), topCounts(blocked), topCounts(clients)
+	report.Upstreams = make([]upstreamStats, len(s.servers))
+	for i, server := range s.servers {
+		report.Upstreams[i] = newUpstreamStats(server, &upstreams[i])
+	}
+	s.statsSnapshot.Store(report)
+}
+
+// topCounts sorts counts descending, keeping statsTop of them
+func topCounts(counts map[string]uint64) []statsCount {
+	list := make([]statsCount, 0, len(counts))
+	for key, n := range counts {
+		list = append(list, statsCount{key, n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Key < list[j].Key
+	})
+	if len(list) > statsTop {
+		list = list[:statsTop]
+	}
+	return list
+}
+
+// adminStats serves the last snapshot, top lists cut to ?n= entries (10)
+func (s *Server) adminStats(w http.ResponseWriter, r *http.Request) {
+	report, _ := s.statsSnapshot.Load().(*statsReport)
+	if report == nil {
+		http.Error(w, "Statistics disabled, see -stats", http.StatusNotFound)
+		return
+	}
+	n := 10
+	if str := r.URL.Query().Get("n"); str != "" {
+		var err error
+		if n, err = strconv.Atoi(str); err != nil || n < 0 {
+			http.Error(w, "Invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+	cut := func(list []statsCount) []statsCount {
+		if len(list) > n {
+			return list[:n]
+		}
+		return list
+	}
+	writeJSON(w, statsReport{report.Since, report.Taken, report.Queries, cut(report.TopDomains),
+		cut(report.TopBlocked), cut(report.TopClients), report.Verdicts, report.Upstreams})
+}
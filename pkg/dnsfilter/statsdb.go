@@ -0,0 +1,340 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const statsDBTimeout = 5 * time.Second // waiting for the lock of the file held by another process
+
+var statsDBBucket = []byte("hours")
+
+// statsHour is a statsBucket as stored in -stats-db, keyed by its start in UTC
+type statsHour struct {
+	Queries  uint64            `json:"queries"`
+	Domains  map[string]uint64 `json:"domains"`
+	Blocked  map[string]uint64 `json:"blocked"`
+	Clients  map[string]uint64 `json:"clients"`
+	Verdicts map[string]uint64 `json:"verdicts"`
+}
+
+func statsDBKey(start time.Time) []byte {
+	return []byte(start.UTC().Format(time.RFC3339))
+}
+
+// openStatsDB opens the database at path only for as long as needed, so that the
+// stats subcommand can read it while the server runs
+func openStatsDB(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: statsDBTimeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open statistics database %s: %s", path, err)
+	}
+	return db, nil
+}
+
+// loadStatsDB restores the hours of the rolling window from -stats-db, upstream
+// counts aside
+func (s *Server) loadStatsDB() error {
+	db, err := openStatsDB(s.opts.StatsDB, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	since := time.Now().Truncate(time.Hour).Add(-(statsBuckets - 1) * time.Hour)
+	restored := 0
+	err = db.Update(func(dbtx *bolt.Tx) error {
+		bucket, err := dbtx.CreateBucketIfNotExists(statsDBBucket)
+		if err != nil {
+			return err
+		}
+		s.statsLock.Lock()
+		defer s.statsLock.Unlock()
+		c := bucket.Cursor()
+		for k, v := c.Seek(statsDBKey(since)); k != nil; k, v = c.Next() {
+			start, err := time.Parse(time.RFC3339, string(k))
+			if err != nil {
+				continue
+			}
+			var hour statsHour
+			if err := json.Unmarshal(v, &hour); err != nil {
+				return fmt.Errorf("Corrupt statistics of %s: %s", k, err)
+			}
+			start = start.Local()
+			s.statsRing[int(start.Unix()/3600)%statsBuckets] = &statsBucket{start: start, queries: hour.Queries,
+				domains: nonNil(hour.Domains), blocked: nonNil(hour.Blocked), clients: nonNil(hour.Clients),
+				verdicts: nonNil(hour.Verdicts), upstreams: make(map[*upstream]*upstreamCounts)}
+			restored++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.logStd.Printf("Restored statistics of %d hour(s) from %s", restored, s.opts.StatsDB)
+	return nil
+}
+
+func nonNil(counts map[string]uint64) map[string]uint64 {
+	if counts == nil {
+		return make(map[string]uint64)
+	}
+	return counts
+}
+
+// saveStatsDB stores the current and previous hours in -stats-db, the latter
+// possibly counted on since the last save, and removes those older than -stats-keep
+func (s *Server) saveStatsDB() error {
+	since := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	hours := make(map[string][]byte)
+	s.statsLock.Lock()
+	for _, b := range s.statsRing {
+		if b == nil || b.start.Before(since) {
+			continue
+		}
+		v, err := json.Marshal(statsHour{b.queries, b.domains, b.blocked, b.clients, b.verdicts})
+		if err != nil {
+			s.statsLock.Unlock()
+			return err
+		}
+		hours[string(statsDBKey(b.start))] = v
+	}
+	s.statsLock.Unlock()
+
+	db, err := openStatsDB(s.opts.StatsDB, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(dbtx *bolt.Tx) error {
+		bucket, err := dbtx.CreateBucketIfNotExists(statsDBBucket)
+		if err != nil {
+			return err
+		}
+		for k, v := range hours {
+			if err := bucket.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		if s.opts.StatsKeep <= 0 {
+			return nil
+		}
+		expired := string(statsDBKey(time.Now().Add(-s.opts.StatsKeep)))
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < expired; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// StatsQuery selects the hours of -stats-db summed up by StatsHistory, zero fields
+// matching any
+type StatsQuery struct {
+	Domain string // counting only queries of it, subdomains included
+	Client string // IP or CIDR, counting only queries of its clients
+	From   time.Time
+	To     time.Time
+	By     string // hour or day to count queries by, their total only if empty
+	Top    int    // entries of top lists
+}
+
+// statsPeriod sums up the hours of an hour or day
+type statsPeriod struct {
+	start    time.Time
+	queries  uint64
+	verdicts map[string]uint64
+}
+
+// StatsHistory writes to w the counts in the statistics database at path over the
+// hours selected by query: queries by period, top lists and verdicts
+func StatsHistory(path string, query StatsQuery, w io.Writer) error {
+	var client *ipset
+	if query.Client != "" {
+		var err error
+		if client, err = parseIPList(query.Client); err != nil || client.size == 0 {
+			return fmt.Errorf("Invalid client: %s", query.Client)
+		}
+	}
+	domain := strings.ToLower(strings.Trim(query.Domain, "."))
+	if domain != "" && client != nil {
+		return errors.New("Domains and clients are counted apart, select one of them")
+	}
+	if query.By != "" && query.By != "hour" && query.By != "day" {
+		return fmt.Errorf("Unknown period: %s", query.By)
+	}
+	// domains and clients are counted apart, so that only those selected are listed
+	matchDomain := func(key string) bool {
+		if client != nil {
+			return false
+		}
+		if domain == "" {
+			return true
+		}
+		name, err := dnsmessage.NewName(key)
+		return err == nil && matchName(name, domain)
+	}
+	matchClient := func(key string) bool {
+		if domain != "" {
+			return false
+		}
+		ip := net.ParseIP(key)
+		return client == nil || ip != nil && client.containsIP(ip)
+	}
+	all := domain == "" && client == nil
+
+	db, err := openStatsDB(path, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var periods []*statsPeriod
+	var queries uint64
+	domains, blocked, clients, verdicts := make(map[string]uint64), make(map[string]uint64), make(map[string]uint64), make(map[string]uint64)
+	err = db.View(func(dbtx *bolt.Tx) error {
+		bucket := dbtx.Bucket(statsDBBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		k, v := c.First()
+		if !query.From.IsZero() {
+			k, v = c.Seek(statsDBKey(query.From.Truncate(time.Hour)))
+		}
+		for ; k != nil; k, v = c.Next() {
+			start, err := time.Parse(time.RFC3339, string(k))
+			if err != nil {
+				continue
+			}
+			if !query.To.IsZero() && start.After(query.To) {
+				break
+			}
+			var hour statsHour
+			if err := json.Unmarshal(v, &hour); err != nil {
+				return fmt.Errorf("Corrupt statistics of %s: %s", k, err)
+			}
+
+			n := hour.Queries // of the selected domain or clients only, if any
+			if !all {
+				n = 0
+			}
+			for key, count := range hour.Domains {
+				if matchDomain(key) {
+					domains[key] += count
+					if domain != "" {
+						n += count
+					}
+				}
+			}
+			for key, count := range hour.Blocked {
+				if matchDomain(key) {
+					blocked[key] += count
+				}
+			}
+			for key, count := range hour.Clients {
+				if matchClient(key) {
+					clients[key] += count
+					if client != nil {
+						n += count
+					}
+				}
+			}
+			queries += n
+
+			if query.By != "" {
+				start = start.Local()
+				if query.By == "day" {
+					start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.Local)
+				}
+				if len(periods) == 0 || !periods[len(periods)-1].start.Equal(start) {
+					periods = append(periods, &statsPeriod{start: start, verdicts: make(map[string]uint64)})
+				}
+				p := periods[len(periods)-1]
+				p.queries += n
+				if all { // verdicts are counted for all queries only
+					for key, count := range hour.Verdicts {
+						p.verdicts[key] += count
+					}
+				}
+			}
+			if all {
+				for key, count := range hour.Verdicts {
+					verdicts[key] += count
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if len(periods) > 0 {
+		layout := "2006-01-02 15:00"
+		if query.By == "day" {
+			layout = "2006-01-02"
+		}
+		if all {
+			fmt.Fprintln(tw, "PERIOD\tQUERIES\tVERDICTS")
+		} else {
+			fmt.Fprintln(tw, "PERIOD\tQUERIES")
+		}
+		for _, p := range periods {
+			if all {
+				fmt.Fprintf(tw, "%s\t%d\t%s\n", p.start.Format(layout), p.queries, formatVerdicts(p.verdicts))
+			} else {
+				fmt.Fprintf(tw, "%s\t%d\n", p.start.Format(layout), p.queries)
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+	for _, list := range []struct {
+		title  string
+		counts map[string]uint64
+	}{{"DOMAIN", domains}, {"BLOCKED", blocked}, {"CLIENT", clients}} {
+		top := topCounts(list.counts)
+		if len(top) > query.Top {
+			top = top[:query.Top]
+		}
+		if len(top) == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\tCOUNT\n", list.title)
+		for _, count := range top {
+			fmt.Fprintf(tw, "%s\t%d\n", count.Key, count.Count)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	if len(verdicts) > 0 {
+		fmt.Fprintf(w, "Verdicts: %s\n", formatVerdicts(verdicts))
+	}
+	fmt.Fprintf(w, "%d queries\n", queries)
+	return nil
+}
+
+// formatVerdicts lists counts of verdicts as BLOCK=n ACCEPT=n, sorted by verdict
+func formatVerdicts(verdicts map[string]uint64) string {
+	keys := make([]string, 0, len(verdicts))
+	for key := range verdicts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		keys[i] = fmt.Sprintf("%s=%d", key, verdicts[key])
+	}
+	return strings.Join(keys, " ")
+}
@@ -0,0 +1,88 @@
+package dnsfilter
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// pickUpstreams orders upstreams by strategy. Except for "all", they are then
+// tried one after another every -failover until an answer is accepted.
+func (s *Server) pickUpstreams(upstreams []*upstream, strategy string) []*upstream {
+	order := append([]*upstream(nil), upstreams...)
+
+	switch strategy {
+	case "roundrobin":
+		if n := len(order); n > 0 {
+			k := int(atomic.AddUint32(&s.roundRobin, 1) % uint32(n))
+			order = append(order[k:], order[:k]...)
+		}
+
+	case "weighted": // weighted random order without replacement
+		for i := range order {
+			total := 0
+			for _, u := range order[i:] {
+				total += u.weight
+			}
+			r := rand.Intn(total)
+			for j, u := range order[i:] {
+				if r -= u.weight; r < 0 {
+					order[i], order[i+j] = order[i+j], order[i]
+					break
+				}
+			}
+		}
+
+	case "fastest": // unmeasured ones come first to get measured
+		sort.SliceStable(order, func(i, j int) bool {
+			return atomic.LoadInt64(&order[i].rtt) < atomic.LoadInt64(&order[j].rtt)
+		})
+	}
+	return order
+}
+
+// subsetUpstreams picks -subset of upstreams at random for a query with strategy
+// "all", all of them without
+func (s *Server) subsetUpstreams(upstreams []*upstream) []*upstream {
+	if s.opts.Subset <= 0 || s.opts.Subset >= len(upstreams) {
+		return upstreams
+	}
+	subset := make([]*upstream, s.opts.Subset)
+	for i, k := range rand.Perm(len(upstreams))[:s.opts.Subset] {
+		subset[i] = upstreams[k]
+	}
+	return subset
+}
+
+// count adds n to a counter of the upstream, and to the statistics with -stats
+func (u *upstream) count(counter int, n uint64) {
+	atomic.AddUint64(&u.counts[counter], n)
+	switch counter {
+	case upstreamTimeouts:
+		u.recordFailure()
+	case upstreamAnswered:
+		atomic.StoreInt32(&u.failures, 0)
+	}
+	if u.srv.opts.Stats {
+		u.srv.recordUpstream(u, counter, n)
+	}
+}
+
+// recordRTT updates the exponentially weighted moving average of response time
+func (u *upstream) recordRTT(rtt time.Duration) {
+	for {
+		old := atomic.LoadInt64(&u.rtt)
+		ewma := int64(rtt)
+		if old != 0 {
+			ewma = (old*7 + int64(rtt)*3) / 10
+		}
+		if atomic.CompareAndSwapInt64(&u.rtt, old, ewma) {
+			return
+		}
+	}
+}
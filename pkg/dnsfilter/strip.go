@@ -0,0 +1,41 @@
+package dnsfilter
+
+import (
+	"context"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// needsOtherFamily tells if a rule strips qtype records only when the other family exists
+func (s *Server) needsOtherFamily(qtype dnsmessage.Type) bool {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	for _, rule := range s.rules {
+		if rule.ifOther && (rule.target == targetStripAAAA && qtype == dnsmessage.TypeAAAA ||
+			rule.target == targetStripA && qtype == dnsmessage.TypeA) {
+			return true
+		}
+	}
+	return false
+}
+
+// otherFamilyExists asks the upstream which answered q whether the name has
+// A records if q is for AAAA, or AAAA records if q is for A
+func (s *Server) otherFamilyExists(ctx context.Context, serverIndex int, q dnsmessage.Question) bool {
+	other := dnsmessage.TypeA
+	if q.Type == dnsmessage.TypeA {
+		other = dnsmessage.TypeAAAA
+	}
+
+	m, err := s.lookup(ctx, q.Name.String(), other, []*upstream{s.servers[serverIndex-1]}, false)
+	if err != nil {
+		s.logErr.Println(err)
+		return false
+	}
+	for _, ans := range m.Answers {
+		if ans.Header.Type == other {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package dnsfilter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	readFailures   = 100         // in a row before a listener is reopened
+	maxRestartWait = time.Minute // between attempts to reopen a listener
+)
+
+// recoverPanic is deferred by goroutines handling queries and answers, so that a
+// panic costs the query it was handling rather than the process. It logs the stack.
+func (s *Server) recoverPanic(what string) {
+	if r := recover(); r != nil {
+		atomic.AddUint64(&s.panicsRecovered, 1)
+		s.logErr.Printf("Recovered from panic %s: %v\n%s", what, r, debug.Stack())
+	}
+}
+
+// conn returns the i-th listening socket, as reopened by superviseListener
+func (s *Server) conn(i int) *net.UDPConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conns[i]
+}
+
+// superviseListener reads queries on the i-th socket through bc until quit. When
+// reading fails for good or the loop panics, the socket is reopened at the same
+// address, waiting restartWait, then longer after each failure up to maxRestartWait.
+// Reopening privileged ports fails once privileges are dropped, so such listeners
+// keep failing until restarted by hand.
+func (s *Server) superviseListener(i int, bc *batchConn) {
+	addr := s.conn(i).LocalAddr().(*net.UDPAddr)
+	var wait time.Duration
+	for {
+		started := time.Now()
+		err := s.serveListener(bc, s.quit)
+		if err == nil {
+			return
+		}
+		atomic.AddUint64(&s.listenerRestarts, 1)
+		if wait == 0 || time.Since(started) > maxRestartWait { // first failure, or served well since the last one
+			wait = time.Duration(atomic.LoadInt64(&s.restartWait))
+		}
+		for {
+			s.logErr.Printf("Listener on %s failed: %s, reopening in %s", addr, err, wait)
+			select {
+			case <-s.quit:
+				return
+			case <-time.After(wait):
+			}
+			if wait *= 2; wait > maxRestartWait {
+				wait = maxRestartWait
+			}
+			s.conn(i).Close()
+			var conn *net.UDPConn
+			if conn, err = s.relisten(addr); err == nil {
+				if !s.replaceConn(i, conn) {
+					return
+				}
+				bc.reset(conn)
+				break
+			}
+		}
+		s.logStd.Printf("Listener on %s reopened", addr)
+	}
+}
+
+// serveListener reads queries through bc until quit, telling why it stopped otherwise
+func (s *Server) serveListener(bc *batchConn, quit chan struct{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&s.panicsRecovered, 1)
+			s.logErr.Printf("Recovered from panic reading queries: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return bc.serve(quit)
+}
+
+// replaceConn swaps in the reopened i-th socket, unless shutting down
+func (s *Server) replaceConn(i int, conn *net.UDPConn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.quit:
+		conn.Close()
+		return false
+	default:
+	}
+	s.conns[i] = conn
+	return true
+}
+
+// relisten opens a listening socket at addr the way New did
+func (s *Server) relisten(addr *net.UDPAddr) (*net.UDPConn, error) {
+	switch {
+	case s.opts.ReusePort:
+		conns, err := listenReusePort(addr, 1)
+		if err != nil {
+			return nil, err
+		}
+		return conns[0], nil
+	case s.opts.Transparent:
+		return listenTransparent(addr)
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+// fatalReadError tells if reading a listener failed for good
+func fatalReadError(err error, failures int) bool {
+	return errors.Is(err, net.ErrClosed) || failures >= readFailures
+}
@@ -0,0 +1,63 @@
+package dnsfilter
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a handler panicking costs its query only
+func TestPanicRecovered(t *testing.T) {
+	raceServer(t)
+	before := atomic.LoadUint64(&raceSrv.panicsRecovered)
+	raceSrv.inflight.Add(1)
+	raceSrv.work(job{context.Background(), getBuf()}) // without a client address
+	if got := atomic.LoadUint64(&raceSrv.panicsRecovered) - before; got != 1 {
+		t.Errorf("%d panics recovered, want 1", got)
+	}
+}
+
+// restartListener closes the first listener of the shared Server, waiting for it to
+// be reopened
+func restartListener(t *testing.T) {
+	closed := raceSrv.conn(0)
+	closed.Close()
+	for deadline := time.Now().Add(5 * time.Second); raceSrv.conn(0) == closed; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("listener not reopened")
+		}
+	}
+}
+
+// a listener failing to read is reopened at the same address
+func TestListenerRestart(t *testing.T) {
+	addr := raceServer(t)
+	defer atomic.StoreInt64(&raceSrv.restartWait, atomic.SwapInt64(&raceSrv.restartWait, int64(10*time.Millisecond)))
+	before := atomic.LoadUint64(&raceSrv.listenerRestarts)
+	restartListener(t)
+	if got := atomic.LoadUint64(&raceSrv.listenerRestarts) - before; got != 1 {
+		t.Errorf("%d restarts, want 1", got)
+	}
+	if m, _ := ask(t, addr, "cn.test."); firstA(m) != "1.0.1.1" {
+		t.Errorf("got %s, want 1.0.1.1", firstA(m))
+	}
+}
+
+// restarts keep the writer of the listener, rather than leaving one behind each
+func TestListenerRestartLeak(t *testing.T) {
+	addr := raceServer(t)
+	defer atomic.StoreInt64(&raceSrv.restartWait, atomic.SwapInt64(&raceSrv.restartWait, int64(10*time.Millisecond)))
+	restartListener(t)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ { // each waiting twice as long
+		restartListener(t)
+	}
+	if got := runtime.NumGoroutine() - before; got >= 3 {
+		t.Errorf("%d more goroutines after 5 restarts", got)
+	}
+	if m, _ := ask(t, addr, "cn.test."); firstA(m) != "1.0.1.1" {
+		t.Errorf("got %s, want 1.0.1.1", firstA(m))
+	}
+}
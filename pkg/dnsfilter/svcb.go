@@ -0,0 +1,135 @@
+package dnsfilter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+)
+
+const (
+	typeSVCB  dnsmessage.Type = 64
+	typeHTTPS dnsmessage.Type = 65
+)
+
+// svcParamKeys are SvcParamKeys -svcb-strip can name (RFC 9460 section 14.3.2)
+var svcParamKeys = map[string]uint16{"ech": 5, "ipv4hint": 4, "ipv6hint": 6}
+
+// parseSVCBStrip checks the parameters of -svcb-strip
+func (s *Server) parseSVCBStrip() error {
+	for _, name := range s.opts.SVCBStrip {
+		key, ok := svcParamKeys[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return fmt.Errorf("Unknown SVCB parameter: %s", name)
+		}
+		s.svcbStrip[key] = true
+	}
+	return nil
+}
+
+// svcbParams splits the RDATA of an SVCB or HTTPS record after its priority and
+// target name, which is never compressed (RFC 9460 section 2.2), into its
+// SvcParams. ok is false if data is malformed.
+func svcbParams(data []byte) (params [][]byte, start int, ok bool) {
+	off := 2
+	for off < len(data) && data[off] != 0 {
+		if data[off] >= 64 {
+			return nil, 0, false
+		}
+		off += int(data[off]) + 1
+	}
+	if off >= len(data) {
+		return nil, 0, false
+	}
+	start = off + 1
+	for off = start; off < len(data); {
+		if off+4 > len(data) {
+			return nil, 0, false
+		}
+		end := off + 4 + int(binary.BigEndian.Uint16(data[off+2:]))
+		if end > len(data) {
+			return nil, 0, false
+		}
+		params, off = append(params, data[off:end]), end
+	}
+	return params, start, true
+}
+
+// svcbHints returns the ipv4hint and ipv6hint addresses of an SVCB or HTTPS record,
+// nil for other types
+func svcbHints(ans dnsmessage.Resource) []net.IP {
+	body, ok := ans.Body.(*dnsmessage.UnknownResource)
+	if !ok || body.Type != typeSVCB && body.Type != typeHTTPS {
+		return nil
+	}
+	params, _, ok := svcbParams(body.Data)
+	if !ok {
+		return nil
+	}
+	var ips []net.IP
+	for _, param := range params {
+		size := 0
+		switch binary.BigEndian.Uint16(param) {
+		case svcParamKeys["ipv4hint"]:
+			size = net.IPv4len
+		case svcParamKeys["ipv6hint"]:
+			size = net.IPv6len
+		default:
+			continue
+		}
+		for value := param[4:]; len(value) >= size; value = value[size:] {
+			ips = append(ips, net.IP(value[:size]))
+		}
+	}
+	return ips
+}
+
+// stripSVCB removes the parameters of -svcb-strip from SVCB and HTTPS records of
+// msg, which is returned as is if it has none
+func (s *Server) stripSVCB(msg []byte) []byte {
+	if len(s.svcbStrip) == 0 {
+		return msg
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return msg
+	}
+	stripped := false
+	for _, section := range [][]dnsmessage.Resource{m.Answers, m.Additionals} {
+		for _, rr := range section {
+			body, ok := rr.Body.(*dnsmessage.UnknownResource)
+			if !ok || body.Type != typeSVCB && body.Type != typeHTTPS {
+				continue
+			}
+			params, start, ok := svcbParams(body.Data)
+			if !ok || binary.BigEndian.Uint16(body.Data) == 0 { // AliasMode has no parameters
+				continue
+			}
+			data := append([]byte(nil), body.Data[:start]...)
+			for _, param := range params {
+				if s.svcbStrip[binary.BigEndian.Uint16(param)] {
+					stripped = true
+					continue
+				}
+				data = append(data, param...)
+			}
+			body.Data = data
+		}
+	}
+	if !stripped {
+		return msg
+	}
+	for _, rr := range m.Answers {
+		if rr.Header.Type == typeRRSIG {
+			return msg // signatures would no longer match
+		}
+	}
+	out, err := m.Pack()
+	if err != nil {
+		s.logErr.Println(err)
+		return msg
+	}
+	putBuf(msg)
+	return out
+}
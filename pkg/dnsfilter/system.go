@@ -0,0 +1,110 @@
+package dnsfilter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	maxSystemServers = 3 // nameservers the C library takes from resolv.conf
+	systemPoll       = 5 * time.Second
+)
+
+// addSystemServers adds upstreams for -d system, named system1 to system3, set to the
+// system nameservers from then on
+func (s *Server) addSystemServers() error {
+	if s.systemServers != nil {
+		return errors.New("Nameserver exists: system")
+	}
+	addrs, err := systemNameservers()
+	if err != nil {
+		return fmt.Errorf("Failed to read system nameservers: %s", err)
+	}
+	for i := 0; i < maxSystemServers; i++ {
+		server := &upstream{srv: s, name: fmt.Sprintf("system%d", i+1), weight: 1, system: true}
+		if _, exist := s.lookupServerName(server.name); exist {
+			return fmt.Errorf("Nameserver name exists: %s", server.name)
+		}
+		server.setAddr(&net.UDPAddr{})
+		s.servers = append(s.servers, server)
+		s.systemServers = append(s.systemServers, server)
+	}
+	s.setSystemServers(addrs)
+	return nil
+}
+
+// idle tells if u is of -d system without a nameserver for now
+func (u *upstream) idle() bool {
+	return u.system && u.addr().IP == nil
+}
+
+// activeUpstreams returns upstreams without idle ones of -d system
+func (s *Server) activeUpstreams(upstreams []*upstream) []*upstream {
+	if s.systemServers == nil {
+		return upstreams
+	}
+	active := make([]*upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if !u.idle() {
+			active = append(active, u)
+		}
+	}
+	return active
+}
+
+// setSystemServers sets upstreams of -d system to addrs in order, skipping those of
+// other upstreams and its own, the others being idle. It tells if any changed.
+func (s *Server) setSystemServers(addrs []*net.UDPAddr) bool {
+	listenAddr, _ := parseUdpAddr(s.opts.Listen)
+	var usable []*net.UDPAddr
+	for _, addr := range addrs {
+		if i, exist := s.lookupServer(addr); exist && !s.servers[i].system {
+			continue
+		}
+		if listenAddr != nil && addr.Port == listenAddr.Port &&
+			(listenAddr.IP.Equal(addr.IP) || listenAddr.IP.IsUnspecified() && addr.IP.IsLoopback()) {
+			continue // forwarding to itself
+		}
+		usable = append(usable, addr)
+		if len(usable) == len(s.systemServers) {
+			break
+		}
+	}
+
+	changed, names := false, make([]string, len(usable))
+	for i, server := range s.systemServers {
+		addr := &net.UDPAddr{}
+		if i < len(usable) {
+			addr, names[i] = usable[i], usable[i].String()
+		}
+		if server.moveTo(addr) {
+			changed = true
+		}
+	}
+	if changed {
+		if len(usable) == 0 {
+			s.logErr.Println("No system nameserver")
+		} else {
+			s.logStd.Printf("Using system nameservers %s", strings.Join(names, ", "))
+		}
+	}
+	return changed
+}
+
+// watchSystemServers follows changes of the system nameservers, for roaming between
+// networks, flushing the cache of answers from the previous ones
+func (s *Server) watchSystemServers() {
+	for range time.Tick(systemPoll) {
+		addrs, err := systemNameservers()
+		if err != nil {
+			s.logErr.Println("Failed to read system nameservers:", err)
+			continue
+		}
+		if s.setSystemServers(addrs) {
+			s.cacheFlush()
+		}
+	}
+}
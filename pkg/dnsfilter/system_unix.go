@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package dnsfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+// systemNameservers reads the nameservers of resolv.conf(5), kept up to date by DHCP
+// clients and network managers
+func systemNameservers() ([]*net.UDPAddr, error) {
+	data, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*net.UDPAddr
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		host, zone := fields[1], ""
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			host, zone = host[:i], host[i+1:]
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			addrs = append(addrs, &net.UDPAddr{IP: ip, Port: 53, Zone: zone})
+		}
+	}
+	return addrs, nil
+}
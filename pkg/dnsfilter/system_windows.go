@@ -0,0 +1,46 @@
+package dnsfilter
+
+import (
+	"golang.org/x/sys/windows"
+	"net"
+	"os"
+	"strconv"
+	"unsafe"
+)
+
+// systemNameservers returns the DNS servers of network adapters up, as set by DHCP or
+// by hand
+func systemNameservers() ([]*net.UDPAddr, error) {
+	size := uint32(15000)
+	for {
+		buf := make([]byte, size)
+		first := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0]))
+		flags := uint32(windows.GAA_FLAG_SKIP_UNICAST | windows.GAA_FLAG_SKIP_ANYCAST | windows.GAA_FLAG_SKIP_MULTICAST)
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, flags, 0, first, &size)
+		if err == windows.ERROR_BUFFER_OVERFLOW {
+			continue // size is that needed now
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("getadaptersaddresses", err)
+		}
+
+		var addrs []*net.UDPAddr
+		for aa := first; aa != nil; aa = aa.Next {
+			if aa.OperStatus != windows.IfOperStatusUp {
+				continue
+			}
+			for dns := aa.FirstDnsServerAddress; dns != nil; dns = dns.Next {
+				ip := dns.Address.IP()
+				if ip == nil || ip.To4() == nil && ip[0] == 0xfe && ip[1] == 0xc0 { // deprecated site-local defaults
+					continue
+				}
+				addr := &net.UDPAddr{IP: ip, Port: 53}
+				if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+					addr.Zone = strconv.Itoa(int(aa.Ipv6IfIndex))
+				}
+				addrs = append(addrs, addr)
+			}
+		}
+		return addrs, nil
+	}
+}
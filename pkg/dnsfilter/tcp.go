@@ -0,0 +1,78 @@
+package dnsfilter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// sendTCP asks server for msg over TCP in the background, the answer coming in on
+// tx.answers, for proxied upstreams or answers truncated over UDP
+func (tx *transaction) sendTCP(ctx context.Context, msg []byte, server *upstream) {
+	query := append([]byte(nil), msg...)
+	go func() {
+		defer tx.srv.recoverPanic("asking over TCP")
+		answerMsg, err := tx.srv.tcpExchange(ctx, query, server)
+		if err != nil {
+			tx.srv.logErr.Printf("%s: %s", server, err)
+			return
+		}
+		if !answersQuery(answerMsg, tx.id, tx.qs, false) {
+			tx.mismatch(server.addr(), true)
+			putBuf(answerMsg)
+			return
+		}
+		select {
+		case tx.answers <- answer{server.addr(), answerMsg}:
+		case <-tx.done:
+		}
+	}()
+}
+
+// tcpExchange sends msg to server over TCP, through its proxy if it has one, which
+// most proxies carry unlike UDP. It returns the answer, up to -max-size.
+func (s *Server) tcpExchange(ctx context.Context, msg []byte, server *upstream) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, server.queryTimeout())
+	defer cancel()
+	var (
+		conn net.Conn
+		r    io.Reader
+		err  error
+	)
+	if server.proxy != nil {
+		conn, r, err = s.dialProxy(ctx, server.proxy, server.addr().String())
+	} else {
+		conn, err = s.outboundDialer().DialContext(ctx, "tcp", server.addr().String())
+		r = conn
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	framed := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	if _, err := conn.Write(append(framed, msg...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, framed[:2]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(framed))
+	if size > s.opts.MaxSize {
+		return nil, fmt.Errorf("Answer of %d bytes over the maximum size", size)
+	}
+	buf := getBuf()
+	if size > len(buf) {
+		buf = make([]byte, size)
+	}
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		putBuf(buf)
+		return nil, err
+	}
+	return buf[:size], nil
+}
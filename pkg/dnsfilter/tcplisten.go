@@ -0,0 +1,126 @@
+package dnsfilter
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxTCPClients   = 256              // connections served at once, others waiting to be accepted
+	maxTCPPipelined = 16               // queries of a connection handled at once
+	tcpIdle         = 10 * time.Second // before closing a connection without queries (RFC 7766)
+)
+
+// tcpClient is a connection of a client over TCP, answers being written back to it
+// in the order they are ready (RFC 7766 section 6.2.1.1)
+type tcpClient struct {
+	srv  *Server
+	conn *net.TCPConn
+	lock sync.Mutex // of writes
+}
+
+func (c *tcpClient) write(msg []byte) {
+	c.lock.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.srv.opts.Timeout))
+	writeFramed(c.conn, msg) // the client is gone if it fails
+	c.lock.Unlock()
+	putBuf(msg)
+}
+
+// listenTCP binds TCP on the port of the UDP socket at addr, for clients retrying
+// answers truncated over UDP and zone transfers
+func (s *Server) listenTCP(addr *net.UDPAddr) (*net.TCPListener, error) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+	if err != nil {
+		return nil, err
+	}
+	s.logStd.Printf("Listening on TCP %s", addr)
+	return ln, nil
+}
+
+// serveTCP takes connections until ln is closed, reading their queries until quit
+func (s *Server) serveTCP(ln *net.TCPListener, quit chan struct{}) {
+	clients := make(chan struct{}, maxTCPClients)
+	for {
+		clients <- struct{}{}
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			<-clients
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logErr.Println(err)
+			time.Sleep(100 * time.Millisecond) // out of descriptors most likely
+			continue
+		}
+		go func() {
+			defer func() { <-clients }()
+			defer s.recoverPanic("serving a TCP client")
+			s.serveTCPClient(conn, quit)
+		}()
+	}
+}
+
+// serveTCPClient handles the queries of conn like those over UDP, but for zone
+// transfers passed to -xfr, until the client is idle for tcpIdle or quit
+func (s *Server) serveTCPClient(conn *net.TCPConn, quit chan struct{}) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	ctx := context.WithValue(context.Background(), clientAddrKey, &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+	ctx = context.WithValue(ctx, tcpClientKey, &tcpClient{srv: s, conn: conn})
+
+	read := make(chan struct{})
+	defer close(read)
+	go func() {
+		select {
+		case <-quit:
+			conn.SetReadDeadline(time.Now()) // still answering queries being handled
+		case <-read:
+		}
+	}()
+
+	var handling sync.WaitGroup
+	defer handling.Wait() // before closing
+	pipelined := make(chan struct{}, maxTCPPipelined)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdle))
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		query, err := readFramed(conn)
+		if err != nil {
+			return
+		}
+		if isTransfer(query) {
+			handling.Wait()
+			s.passXFR(conn, query)
+			return
+		}
+
+		pipelined <- struct{}{}
+		handling.Add(1)
+		s.inflight.Add(1)
+		go func() {
+			defer handling.Done()
+			defer func() { <-pipelined }()
+			s.work(job{ctx, query})
+		}()
+	}
+}
+
+// isTransfer tells if query asks for AXFR or IXFR
+func isTransfer(query []byte) bool {
+	var parser dnsmessage.Parser
+	hdr, err := parser.Start(query)
+	if err != nil || hdr.OpCode != 0 {
+		return false
+	}
+	q, err := parser.Question()
+	return err == nil && (q.Type == dnsmessage.TypeAXFR || q.Type == typeIXFR)
+}
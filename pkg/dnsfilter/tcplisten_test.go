@@ -0,0 +1,43 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"testing"
+	"time"
+)
+
+// an answer too large for UDP is truncated there, and whole over TCP
+func TestTCPAnswer(t *testing.T) {
+	addr := raceServer(t)
+	m, _ := ask(t, addr, "big.test.")
+	if !m.Truncated || len(m.Answers) != 0 {
+		t.Fatalf("got TC %v and %d answers over UDP, want TC and none", m.Truncated, len(m.Answers))
+	}
+
+	conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	q := dnsmessage.Message{Header: dnsmessage.Header{ID: 4242, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("big.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}}
+	packed, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFramed(conn, packed); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readFramed(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unpack(msg); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 4242 || m.Truncated || len(m.Answers) != 60 {
+		t.Errorf("got ID %d, TC %v and %d answers over TCP, want 4242, no TC and 60", m.ID, m.Truncated, len(m.Answers))
+	}
+}
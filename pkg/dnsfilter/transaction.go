@@ -0,0 +1,244 @@
+package dnsfilter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamConn is a long-lived socket shared by queries to upstreams, answers
+// being routed to the query by ID, then checked against its questions and the
+// addresses it was sent to
+type upstreamConn struct {
+	srv     *Server
+	conn    *net.UDPConn
+	lock    sync.Mutex
+	pending map[uint16]*transaction
+}
+
+// transaction is a query in flight on an upstreamConn
+type transaction struct {
+	srv     *Server
+	uc      *upstreamConn
+	id      uint16
+	ctx     context.Context       // of the query, with the client address unless asked on its own behalf
+	qs      []dnsmessage.Question // names matched in any case
+	sentTo  map[string]bool       // addresses, guarded by uc.lock
+	answers chan answer
+	done    chan struct{}
+	once    sync.Once
+	replied uint32 // an answer went to the client, accessed atomically
+}
+
+type answer struct {
+	from *net.UDPAddr
+	msg  []byte // from bufPool
+}
+
+func (s *Server) openUpstreamConns(n int) error {
+	if n < 1 {
+		return errors.New("At least one upstream socket is needed")
+	}
+	if err := s.parseOutbound(); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		conn, err := s.listenOutbound()
+		if err != nil {
+			return err
+		}
+		uc := &upstreamConn{srv: s, conn: conn, pending: make(map[uint16]*transaction)}
+		s.upstreamConns = append(s.upstreamConns, uc)
+		go uc.readLoop()
+	}
+	return nil
+}
+
+// readLoop routes answers to their transaction until the socket is closed, waiting
+// longer after each failure in a row, up to a second
+func (uc *upstreamConn) readLoop() {
+	var wait time.Duration
+	for {
+		buf := getBuf()
+		n, addr, err := uc.conn.ReadFromUDP(buf)
+		if err != nil {
+			putBuf(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			uc.srv.logErr.Println(err)
+			if wait = 2 * wait; wait == 0 {
+				wait = 10 * time.Millisecond
+			} else if wait > time.Second {
+				wait = time.Second
+			}
+			time.Sleep(wait)
+			continue
+		}
+		wait = 0
+		if n < 12 {
+			putBuf(buf)
+			continue
+		}
+
+		uc.lock.Lock()
+		tx := uc.pending[binary.BigEndian.Uint16(buf)]
+		asked := tx != nil && tx.sentTo[addr.String()]
+		uc.lock.Unlock()
+
+		if tx == nil { // most likely a late answer to a finished query
+			uc.srv.unsolicited(addr)
+			putBuf(buf)
+			continue
+		}
+		if !asked || !answersQuery(buf[:n], tx.id, tx.qs, false) {
+			tx.mismatch(addr, asked)
+			putBuf(buf)
+			continue
+		}
+		select {
+		case tx.answers <- answer{addr, buf[:n]}:
+		default: // never block other queries
+			putBuf(buf)
+		}
+	}
+}
+
+// mismatch drops an answer to tx from addr not matching its questions or, unless
+// asked, from an address it wasn't sent to, so that forged answers never take the
+// place of genuine ones in tx.answers
+func (tx *transaction) mismatch(addr *net.UDPAddr, asked bool) {
+	tx.srv.startSpan(tx.ctx, "dns.mismatch").finish()
+	if i, ok := tx.srv.lookupServer(addr); ok && asked {
+		atomic.AddUint64(&tx.srv.servers[i].mismatched, 1)
+	} else {
+		atomic.AddUint64(&tx.srv.answersUnexpected, 1)
+	}
+	if client, ok := tx.ctx.Value(clientAddrKey).(*net.UDPAddr); ok {
+		tx.srv.logErr.Printf("Answer from %s not matching query %d of %s, possibly spoofed", addr, tx.id, client)
+	} else {
+		tx.srv.logErr.Printf("Answer from %s not matching query %d, possibly spoofed", addr, tx.id)
+	}
+}
+
+// newTransaction registers a query for qs with an ID unused on a random socket
+func (s *Server) newTransaction(ctx context.Context, qs []dnsmessage.Question) *transaction {
+	tx := &transaction{srv: s,
+		uc:      s.upstreamConns[int(randomID())%len(s.upstreamConns)],
+		ctx:     ctx,
+		qs:      qs,
+		sentTo:  make(map[string]bool),
+		answers: make(chan answer, 16),
+		done:    make(chan struct{}),
+	}
+
+	tx.uc.lock.Lock()
+	for {
+		tx.id = randomID()
+		if _, used := tx.uc.pending[tx.id]; !used {
+			break
+		}
+	}
+	tx.uc.pending[tx.id] = tx
+	tx.uc.lock.Unlock()
+	return tx
+}
+
+func (tx *transaction) send(msg []byte, addr *net.UDPAddr) error {
+	tx.uc.lock.Lock()
+	tx.sentTo[addr.String()] = true
+	tx.uc.lock.Unlock()
+	_, err := tx.uc.conn.WriteToUDP(msg, addr)
+	return err
+}
+
+// reply claims the answer to the client for the caller, false if it was sent already
+func (tx *transaction) reply() bool {
+	if atomic.CompareAndSwapUint32(&tx.replied, 0, 1) {
+		return true
+	}
+	atomic.AddUint64(&tx.srv.duplicatesSuppressed, 1)
+	return false
+}
+
+// finish stops taking answers, it may be called more than once
+func (tx *transaction) finish() {
+	tx.once.Do(func() {
+		close(tx.done)
+		tx.uc.lock.Lock()
+		delete(tx.uc.pending, tx.id)
+		tx.uc.lock.Unlock()
+	})
+}
+
+// lookup asks upstreams one after another for name on its own behalf,
+// with DO and CD set if dnssecOK
+func (s *Server) lookup(ctx context.Context, name string, qtype dnsmessage.Type, upstreams []*upstream, dnssecOK bool) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	q := dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+	tx := s.newTransaction(ctx, []dnsmessage.Question{q})
+	defer tx.finish()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: tx.id, RecursionDesired: true, CheckingDisabled: dnssecOK})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(s.opts.EDNS, dnsmessage.RCodeSuccess, dnssecOK)
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, server := range upstreams {
+		if server == s.recursor {
+			return s.lookupRecursive(ctx, qname, qtype)
+		}
+		serverCtx, cancel := context.WithTimeout(ctx, server.queryTimeout())
+		if err := tx.sendTo(serverCtx, query, server); err != nil {
+			cancel()
+			continue
+		}
+		overTCP := server.proxy != nil
+	wait:
+		for {
+			select {
+			case <-serverCtx.Done():
+				break wait
+			case a := <-tx.answers:
+				var m dnsmessage.Message
+				err := m.Unpack(a.msg)
+				putBuf(a.msg)
+				if !a.from.IP.Equal(server.addr().IP) || err != nil || !m.Response ||
+					len(m.Questions) != 1 || !strings.EqualFold(m.Questions[0].Name.String(), name) {
+					continue
+				}
+				if m.Truncated {
+					if !overTCP && s.opts.MaxSize > s.opts.EDNS { // the whole answer may fit over TCP
+						tx.sendTCP(serverCtx, query, server)
+						overTCP = true
+					}
+					continue
+				}
+				cancel()
+				return &m, nil
+			}
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("No answer for %s %s", name, typeName(qtype))
+}
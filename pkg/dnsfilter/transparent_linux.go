@@ -0,0 +1,127 @@
+package dnsfilter
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+const (
+	ipv6RecvOrigDstAddr = 0x4a // not in syscall, from linux/in6.h
+	ipv6Transparent     = 0x4b
+	maxReplySockets     = 256
+)
+
+// listenTransparent opens a socket receiving queries diverted by TPROXY, telling
+// their original destination and allowed to answer from it
+func listenTransparent(addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setTransparent(int(fd), network == "udp6")
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// setTransparent sets IP_TRANSPARENT and IP_RECVORIGDSTADDR, along with their IPv6
+// counterparts on IPv6 sockets, which get IPv4 queries too
+func setTransparent(fd int, ipv6 bool) error {
+	options := [][2]int{{syscall.SOL_IP, syscall.IP_TRANSPARENT}, {syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR}}
+	if ipv6 {
+		options = append(options, [2]int{syscall.SOL_IPV6, ipv6Transparent}, [2]int{syscall.SOL_IPV6, ipv6RecvOrigDstAddr})
+	}
+	for _, option := range options {
+		if err := syscall.SetsockoptInt(fd, option[0], option[1], 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// origDst returns the original destination of a query from its control messages, nil
+// if absent
+func origDst(oob []byte) *net.UDPAddr {
+	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, cmsg := range cmsgs {
+		data := cmsg.Data
+		switch {
+		case cmsg.Header.Level == syscall.SOL_IP && cmsg.Header.Type == syscall.IP_RECVORIGDSTADDR && len(data) >= syscall.SizeofSockaddrInet4:
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), data[4:8]...)), Port: int(binary.BigEndian.Uint16(data[2:4]))}
+		case cmsg.Header.Level == syscall.SOL_IPV6 && cmsg.Header.Type == ipv6RecvOrigDstAddr && len(data) >= syscall.SizeofSockaddrInet6:
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), data[8:24]...)), Port: int(binary.BigEndian.Uint16(data[2:4]))}
+		}
+	}
+	return nil
+}
+
+// replyFrom sends msg to addr from src, through a transparent socket bound to it kept
+// for the next answers. It needs CAP_NET_ADMIN.
+func (s *Server) replyFrom(src, addr *net.UDPAddr, msg []byte) error {
+	s.replyLock.Lock()
+	defer s.replyLock.Unlock()
+
+	key := src.String()
+	fd, ok := s.replySockets[key]
+	if !ok {
+		if len(s.replySockets) >= maxReplySockets {
+			for oldKey, oldFD := range s.replySockets {
+				syscall.Close(oldFD)
+				delete(s.replySockets, oldKey)
+				break
+			}
+		}
+		var err error
+		if fd, err = transparentSocket(src); err != nil {
+			return err
+		}
+		s.replySockets[key] = fd
+	}
+	return syscall.Sendto(fd, msg, 0, sockaddr(addr, src.IP.To4() != nil))
+}
+
+func transparentSocket(src *net.UDPAddr) (int, error) {
+	family, level, option := syscall.AF_INET6, syscall.SOL_IPV6, ipv6Transparent
+	if src.IP.To4() != nil {
+		family, level, option = syscall.AF_INET, syscall.SOL_IP, syscall.IP_TRANSPARENT
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err == nil {
+		if err = syscall.SetsockoptInt(fd, level, option, 1); err == nil {
+			err = syscall.Bind(fd, sockaddr(src, family == syscall.AF_INET))
+		}
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func sockaddr(addr *net.UDPAddr, ipv4 bool) syscall.Sockaddr {
+	if ipv4 {
+		sa := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], addr.IP.To4())
+		return sa
+	}
+	sa := &syscall.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To16())
+	return sa
+}
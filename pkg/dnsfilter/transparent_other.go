@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package dnsfilter
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparent = errors.New("-transparent is only supported on Linux")
+
+func listenTransparent(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparent
+}
+
+func origDst(oob []byte) *net.UDPAddr {
+	return nil
+}
+
+func (s *Server) replyFrom(src, addr *net.UDPAddr, msg []byte) error {
+	return errTransparent
+}
@@ -0,0 +1,41 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"time"
+)
+
+// clampTTL raises TTLs of records below -min-ttl and lowers those above -max-ttl, returning
+// msg unchanged if none is out of bounds
+func (s *Server) clampTTL(msg []byte) []byte {
+	if s.opts.MinTTL <= 0 && s.opts.MaxTTL <= 0 {
+		return msg
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return msg
+	}
+	minTTL, maxTTL := uint32(s.opts.MinTTL/time.Second), uint32(s.opts.MaxTTL/time.Second)
+
+	changed := false
+	for _, section := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			if section[i].Header.Type == dnsmessage.TypeOPT { // TTL field of OPT holds flags
+				continue
+			}
+			if ttl := section[i].Header.TTL; ttl < minTTL {
+				section[i].Header.TTL, changed = minTTL, true
+			} else if maxTTL > 0 && ttl > maxTTL {
+				section[i].Header.TTL, changed = maxTTL, true
+			}
+		}
+	}
+	if !changed {
+		return msg
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		return msg
+	}
+	return packed
+}
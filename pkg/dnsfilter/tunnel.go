@@ -0,0 +1,123 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	tunnelWindow       = 10 * time.Minute // of subdomain and NXDOMAIN counts
+	maxTunnelNames     = 1000             // distinct subdomains kept per domain
+	maxTunnelDomains   = 10000
+	minTunnelQueries   = 10 // for the NXDOMAIN ratio to count
+	tunnelPartMaxScore = 25
+)
+
+// tunnelDomain counts queries under a domain within the current tunnelWindow
+type tunnelDomain struct {
+	names     map[string]struct{} // distinct subdomains, up to maxTunnelNames
+	queries   int
+	nxdomains int
+}
+
+// tunnelSplit splits name into the domain it's registered under, its last two labels
+// or three for second levels like co.uk, and the subdomain before
+func tunnelSplit(name string) (sub, domain string) {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	n := 2
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		n = 3
+	}
+	if len(labels) <= n {
+		return "", strings.Join(labels, ".")
+	}
+	return strings.Join(labels[:len(labels)-n], "."), strings.Join(labels[len(labels)-n:], ".")
+}
+
+// entropy is the Shannon entropy of the letters of s, dots aside, in bits per letter
+func entropy(s string) float64 {
+	var counts [256]int
+	total := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != '.' {
+			counts[s[i]]++
+			total++
+		}
+	}
+	e := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(total)
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// scale maps v from low to high onto 0 to tunnelPartMaxScore
+func scale(v, low, high float64) float64 {
+	return math.Max(0, math.Min(1, (v-low)/(high-low))) * tunnelPartMaxScore
+}
+
+// tunnelScore counts a query for name and scores it from 0 to 100 by the entropy
+// and length of its subdomain, the distinct subdomains seen under its domain and
+// the ratio of them answered NXDOMAIN, a quarter each
+func (s *Server) tunnelScore(name string) int {
+	sub, domain := tunnelSplit(name)
+	if sub == "" {
+		return 0
+	}
+
+	s.tunnelDomainsLock.Lock()
+	d := s.tunnelDomains[domain]
+	if d == nil {
+		if len(s.tunnelDomains) >= maxTunnelDomains { // counting anew rather than growing
+			s.tunnelDomains = make(map[string]*tunnelDomain)
+		}
+		d = &tunnelDomain{names: make(map[string]struct{})}
+		s.tunnelDomains[domain] = d
+	}
+	d.queries++
+	if len(d.names) < maxTunnelNames {
+		d.names[sub] = struct{}{}
+	}
+	names, nxRatio := len(d.names), 0.0
+	if d.queries >= minTunnelQueries {
+		nxRatio = float64(d.nxdomains) / float64(d.queries)
+	}
+	s.tunnelDomainsLock.Unlock()
+
+	score := scale(entropy(sub), 2.5, 4) + scale(float64(len(sub)), 30, 100) +
+		scale(float64(names), 50, 500) + scale(nxRatio, 0, 1)
+	return int(math.Round(score))
+}
+
+// tunnelObserve counts an answer sent for the NXDOMAIN ratio of its domain
+func (s *Server) tunnelObserve(msg []byte) {
+	var parser dnsmessage.Parser
+	hdr, err := parser.Start(msg)
+	if err != nil || hdr.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return
+	}
+	_, domain := tunnelSplit(q.Name.String())
+	s.tunnelDomainsLock.Lock()
+	if d := s.tunnelDomains[domain]; d != nil {
+		d.nxdomains++
+	}
+	s.tunnelDomainsLock.Unlock()
+}
+
+// purgeTunnelDomains starts counting anew every tunnelWindow
+func (s *Server) purgeTunnelDomains() {
+	for range time.Tick(tunnelWindow) {
+		s.tunnelDomainsLock.Lock()
+		s.tunnelDomains = make(map[string]*tunnelDomain)
+		s.tunnelDomainsLock.Unlock()
+	}
+}
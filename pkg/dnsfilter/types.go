@@ -0,0 +1,210 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"net/url"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+type key int
+
+const (
+	clientAddrKey key = iota
+	clientSizeKey     // UDP payload size the client can receive, 0 without EDNS0
+	clientDOKey       // the client set DO, asking for DNSSEC records
+	listenerKey       // socket the query came in
+	tcpClientKey      // *tcpClient of a query over TCP, answered on it instead of listenerKey
+	dstAddrKey        // address a query was sent to, original with -transparent, on wildcard listeners
+	spanKey           // root span of a traced query
+	tunnelKey         // score of the query with -tunnel
+	stubKey           // upstreamStub answering queries to upstreams, set by tests
+)
+
+// counters of exchanges with an upstream
+const (
+	upstreamSent     = iota // queries, retransmissions not counted
+	upstreamAnswered        // answers matching the query
+	upstreamTimeouts        // queries unanswered when timed out
+	upstreamJudged          // answers judged by rules
+	upstreamDropped         // of those, dropped
+	upstreamRTTTotal        // ns, of the upstreamRTTCount answers with a known RTT
+	upstreamRTTCount
+	upstreamWonV4 // answers of upstreams raced over both families, by the family answering first
+	upstreamWonV6
+	upstreamCounters
+)
+
+type upstreamCounts [upstreamCounters]uint64
+
+type upstream struct {
+	rtt        int64          // moving average in ns, accessed atomically, keep 64-bit aligned
+	floor      int64          // lowest RTT in ns of recent answers, accessed atomically
+	mismatched uint64         // answers not matching the query, accessed atomically
+	counts     upstreamCounts // since start, accessed atomically
+	name       string         // empty for those given by -d
+	host       string         // host:port its address is resolved from, empty if given by address
+	family     string         // v4 or v6 preferred for host, -prefer-family if empty
+	failures   int32          // timeouts in a row, accessed atomically
+	address    atomic.Value   // *net.UDPAddr, changing for those of -d system
+	alt        atomic.Value   // *net.UDPAddr of the other family raced with -stagger, nil if none
+	system     bool           // of -d system, idle while without nameserver
+	weight     int
+	proxy      *url.URL      // reached through over TCP, nil for none
+	timeout    time.Duration // of queries to it, 0 for -t
+	trusted    bool          // its answers accepted by rules are sent at once
+	srv        *Server
+}
+
+type match struct {
+	client      *ipset
+	server      uint
+	ipset       uint
+	geoip       []string // country codes
+	answerType  dnsmessage.Type
+	name        string
+	followCNAME bool               // name also matches records reached through CNAMEs, and CNAME targets
+	txtContains string             // lower case, in the text of TXT and SPF records
+	txtRegex    *regexp.Regexp     // matching their text
+	sections    uint8              // of records conditions on answers apply to
+	blocklist   uint               // matching the question name
+	allowlist   uint               // matching the question name
+	rpz         uint               // with a trigger hit
+	rcodes      []dnsmessage.RCode // nil for any
+	timeFrom    int                // minutes of local time of the day, to excluded, the same for any
+	timeTo      int
+	days        uint8    // bits by time.Weekday, 0 for any
+	profiles    []string // nil for any
+	minAnswers  int
+	maxAnswers  int // -1 for any
+	tunnel      int // score of the query from 1, 0 for any
+}
+
+type target int
+
+const (
+	targetAccept target = iota
+	targetDrop
+	targetDelay
+	targetIPSetAdd // accept and add addresses to a kernel set
+	targetPrefer   // add score to the answer and go on with the next rules
+	targetPenalize // subtract score from the answer and go on with the next rules
+	targetFilter   // remove matching records and go on with the next rules
+	targetStripAAAA
+	targetStripA
+	targetBlock // answer NXDOMAIN, or the addresses of block_with
+	targetRPZ   // apply the action of the policy hit
+	targetAllow // accept, evaluated before other rules
+)
+
+var targetNames = [...]string{"ACCEPT", "DROP", "DELAY", "IPSET_ADD", "PREFER", "PENALIZE", "FILTER",
+	"STRIP_AAAA", "STRIP_A", "BLOCK", "RPZ", "ALLOW"}
+
+// kernelSet is a Linux ipset, or an nftables set if table is set
+type kernelSet struct {
+	family  uint8 // nftables table family
+	table   string
+	name    string
+	timeout time.Duration
+}
+
+type rule struct {
+	hits      uint64 // accessed atomically, keep 64-bit aligned
+	name      string
+	desc      string
+	blockWith []net.IP // answered by BLOCK for A and AAAA, NXDOMAIN if nil
+	match     match
+	target    target
+	delay     time.Duration
+	score     int  // for PREFER and PENALIZE
+	ifOther   bool // STRIP_AAAA only if the name has A records, STRIP_A if it has AAAA
+	kset      *kernelSet
+	priority  int  // higher first, then in config order
+	cont      bool // ACCEPT or IPSET_ADD going on with the next rules
+	notify    bool // posting answers judged to -webhook
+}
+
+const (
+	sectionAnswer uint8 = 1 << iota
+	sectionAuthority
+	sectionAdditional
+)
+
+// onAnswers tells if match has conditions on individual answers
+func (m *match) onAnswers() bool {
+	return m.name != "" || m.answerType != 0 || m.ipset != 0 || m.geoip != nil || m.txtContains != "" || m.txtRegex != nil
+}
+
+// onMessage tells if match has conditions on the response as a whole
+func (m *match) onMessage() bool {
+	return m.rcodes != nil || m.minAnswers > 0 || m.maxAnswers >= 0 || m.blocklist != 0 || m.allowlist != 0 || m.rpz != 0 ||
+		m.timeFrom != m.timeTo || m.days != 0 || m.tunnel > 0
+}
+
+// activeAt tells if t is within the time and days of match. Past midnight, a range
+// going over it is in the window of the day before, whose days it is checked against.
+func (m *match) activeAt(t time.Time) bool {
+	day, minute := t.Weekday(), t.Hour()*60+t.Minute()
+	switch {
+	case m.timeFrom == m.timeTo:
+	case m.timeFrom < m.timeTo:
+		if minute < m.timeFrom || minute >= m.timeTo {
+			return false
+		}
+	case minute < m.timeTo: // over midnight
+		day = (day + 6) % 7
+	case minute < m.timeFrom:
+		return false
+	}
+	return m.days == 0 || m.days&(1<<day) != 0
+}
+
+// queryTimeout is how long answers of u are waited for
+func (u *upstream) queryTimeout() time.Duration {
+	if u.timeout > 0 {
+		return u.timeout
+	}
+	return u.srv.opts.Timeout
+}
+
+// addr returns the address of u, set by setAddr
+func (u *upstream) addr() *net.UDPAddr {
+	return u.address.Load().(*net.UDPAddr)
+}
+
+func (u *upstream) setAddr(addr *net.UDPAddr) {
+	u.address.Store(addr)
+}
+
+// altAddr returns the address of the other family of u, nil if none
+func (u *upstream) altAddr() *net.UDPAddr {
+	alt, _ := u.alt.Load().(*net.UDPAddr)
+	return alt
+}
+
+// moveTo sets the address of u to addr if another, measuring its RTT anew, and
+// tells if it did
+func (u *upstream) moveTo(addr *net.UDPAddr) bool {
+	if u.addr().String() == addr.String() {
+		return false
+	}
+	u.setAddr(addr)
+	atomic.StoreInt64(&u.rtt, 0)
+	atomic.StoreInt64(&u.floor, 0)
+	return true
+}
+
+func (u *upstream) String() string {
+	if u == u.srv.recursor {
+		return u.name
+	}
+	if u.name == "" && u.host == "" {
+		return u.addr().String()
+	}
+	if u.name == "" {
+		return u.host + "(" + u.addr().String() + ")"
+	}
+	return u.name + "(" + u.addr().String() + ")"
+}
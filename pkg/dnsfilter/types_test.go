@@ -0,0 +1,45 @@
+package dnsfilter
+
+import (
+	"testing"
+	"time"
+)
+
+// school nights of README, hours past midnight in the window of the evening before
+func TestActiveAt(t *testing.T) {
+	from, to, _ := parseTimeRange("21:00-07:00")
+	days, _ := parseDays([]string{"Sun-Thu"})
+	m := match{timeFrom: from, timeTo: to, days: days}
+	at := func(day, hour, minute int) time.Time { // of October 2026, the 16th a Friday
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.Local)
+	}
+
+	for _, test := range []struct {
+		name   string
+		t      time.Time
+		active bool
+	}{
+		{"Friday night, of Thursday", at(16, 6, 59), true},
+		{"Friday 07:00", at(16, 7, 0), false},
+		{"Friday evening", at(16, 21, 0), false},
+		{"Saturday night, of Friday", at(17, 0, 30), false},
+		{"Saturday evening", at(17, 23, 0), false},
+		{"Sunday night, of Saturday", at(18, 3, 0), false},
+		{"Sunday before 21:00", at(18, 20, 59), false},
+		{"Sunday evening", at(18, 21, 0), true},
+		{"Monday night, of Sunday", at(19, 0, 0), true},
+		{"Monday 06:59, of Sunday", at(19, 6, 59), true},
+		{"Monday midday", at(19, 12, 0), false},
+		{"Monday evening", at(19, 23, 59), true},
+	} {
+		if got := m.activeAt(test.t); got != test.active {
+			t.Errorf("%s (%s): active %t, want %t", test.name, test.t.Format("Mon 15:04"), got, test.active)
+		}
+	}
+
+	days, _ = parseDays([]string{"Mon-Fri"})
+	m = match{timeFrom: 9 * 60, timeTo: 17 * 60, days: days} // not going over midnight
+	if !m.activeAt(at(16, 16, 59)) || m.activeAt(at(17, 10, 0)) || m.activeAt(at(19, 17, 0)) {
+		t.Error("daytime range on the wrong days or hours")
+	}
+}
@@ -0,0 +1,104 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"gopkg.in/go-ini/ini.v1"
+	"net"
+	"strings"
+)
+
+// view serves clients of some networks from a [view.xxx] section with their own
+// upstreams, local zones and profile, for split-horizon setups
+type view struct {
+	name    string
+	clients *ipset
+	servers []*upstream // nil for the default ones
+	profile string      // matched by rules instead of the active one, if set
+}
+
+// loadViews compiles view sections, restricting the zones they name to their clients.
+// Profiles are those named by rules.
+func (s *Server) loadViews(cfg *ini.File, zones []*zone, profiles []string) ([]*view, error) {
+	viewSections := cfg.ChildSections("view")
+	views := make([]*view, len(viewSections))
+
+	for i, section := range viewSections {
+		sectionName := section.Name()
+
+		v := view{name: strings.TrimPrefix(sectionName, "view."), profile: strings.TrimSpace(section.Key("profile").String())}
+		clients, err := parseIPList(section.Key("clients").String())
+		if err != nil {
+			return nil, fmt.Errorf("%s %s", sectionName, err)
+		}
+		if clients.size == 0 {
+			return nil, fmt.Errorf("%s clients must exist in a view!", sectionName)
+		}
+		v.clients = clients
+
+		for _, serverStr := range section.Key("server").Strings(",") {
+			index, ok := s.lookupServerName(serverStr)
+			if !ok {
+				return nil, fmt.Errorf("%s invalid server %s!", sectionName, serverStr)
+			}
+			v.servers = append(v.servers, s.servers[index-1])
+		}
+		for _, name := range section.Key("zones").Strings(",") {
+			name = strings.ToLower(strings.Trim(name, " .")) + "."
+			found := false
+			for _, z := range zones {
+				if z.name == name {
+					z.views, found = append(z.views, &v), true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("%s unknown zone %s!", sectionName, name)
+			}
+		}
+		if v.profile != "" && !containsString(profiles, v.profile) {
+			return nil, fmt.Errorf("%s profile %s is not named by any rule!", sectionName, v.profile)
+		}
+
+		s.logStd.Printf("%s: CLIENT %s", sectionName, strings.Join(strings.Fields(section.Key("clients").String()), ""))
+		views[i] = &v
+	}
+	return views, nil
+}
+
+// viewOf returns the first view of client, nil if none. configLock must be held.
+func (s *Server) viewOf(client net.IP) *view {
+	for _, v := range s.views {
+		if v.clients.containsIP(client) {
+			return v
+		}
+	}
+	return nil
+}
+
+// clientView returns the view of client, nil if none
+func (s *Server) clientView(client net.IP) *view {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.viewOf(client)
+}
+
+// profileOf returns the profile rules match for client. configLock must be held.
+func (s *Server) profileOf(client net.IP) string {
+	if v := s.viewOf(client); v != nil && v.profile != "" {
+		return v.profile
+	}
+	return s.activeProfile
+}
+
+// serves tells if z is answered to clients of v: zones named by views are only
+// answered to theirs
+func (z *zone) serves(v *view) bool {
+	if z.views == nil {
+		return true
+	}
+	for _, zv := range z.views {
+		if zv == v {
+			return true
+		}
+	}
+	return false
+}
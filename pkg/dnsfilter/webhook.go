@@ -0,0 +1,137 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	webhookBatch    = 50
+	webhookInterval = 5 * time.Second // longest wait to post a batch
+	webhookRetries  = 3               // after the first attempt, waiting 1s, 2s then 4s
+)
+
+// webhookEvent is an answer judged by a rule with notify
+type webhookEvent struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Server  string    `json:"server"`
+	Rule    string    `json:"rule"`
+	Verdict string    `json:"verdict"`
+}
+
+// startWebhook starts posting events of rules with notify to opts.Webhook
+func (s *Server) startWebhook() error {
+	u, err := url.Parse(s.opts.Webhook)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("Invalid webhook URL: %s", s.opts.Webhook)
+	}
+	s.webhookEvents = make(chan webhookEvent, 4096)
+	s.logStd.Printf("Posting notifications to %s", u.Host) // paths of chat webhooks are secrets
+	go s.postEvents(s.opts.Webhook)
+	return nil
+}
+
+// notify queues an event for the answer from serverIndex to qs judged by rank if
+// its rule has notify, dropping it if the webhook lags behind
+func (s *Server) notify(ctx context.Context, serverIndex int, qs []dnsmessage.Question, rank int, verdict string) {
+	if s.webhookEvents == nil {
+		return
+	}
+	s.configLock.RLock()
+	if rank < 0 || rank >= len(s.rules) || !s.rules[rank].notify {
+		s.configLock.RUnlock()
+		return
+	}
+	event := webhookEvent{Time: time.Now(), Server: s.servers[serverIndex-1].String(), Rule: s.rules[rank].name, Verdict: verdict}
+	s.configLock.RUnlock()
+	if client, ok := ctx.Value(clientAddrKey).(*net.UDPAddr); ok {
+		event.Client = client.IP.String()
+	}
+	if len(qs) > 0 {
+		event.Name, event.Type = qs[0].Name.String(), typeName(qs[0].Type)
+	}
+	select {
+	case s.webhookEvents <- event:
+	default:
+		atomic.AddUint64(&s.webhookDropped, 1)
+	}
+}
+
+func (s *Server) postEvents(target string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(webhookInterval)
+	defer ticker.Stop()
+
+	batch := make([]webhookEvent, 0, webhookBatch)
+	for {
+		select {
+		case event := <-s.webhookEvents:
+			if batch = append(batch, event); len(batch) < webhookBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := postBatch(client, target, batch); err != nil {
+			atomic.AddUint64(&s.webhookDropped, uint64(len(batch)))
+			s.logErr.Printf("Failed to post %d notification(s): %s", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+// postBatch posts batch as JSON with a text summing it up, as chat webhooks show,
+// retrying on errors of the network or the server
+func postBatch(client *http.Client, target string, batch []webhookEvent) error {
+	var text strings.Builder
+	for i, event := range batch {
+		if i > 0 {
+			text.WriteByte('\n')
+		}
+		fmt.Fprintf(&text, "[%s] %s %s from %s by %s", event.Verdict, event.Name, event.Type, event.Client, event.Rule)
+	}
+	body, err := json.Marshal(struct {
+		Text   string         `json:"text"`
+		Events []webhookEvent `json:"events"`
+	}{text.String(), batch})
+	if err != nil {
+		return err
+	}
+
+	wait := time.Second
+	for i := 0; ; i++ {
+		retry := false
+		resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+		if err == nil {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return nil
+			}
+			err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+			retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		} else {
+			retry = true
+		}
+		if !retry || i == webhookRetries {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
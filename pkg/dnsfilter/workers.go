@@ -0,0 +1,60 @@
+package dnsfilter
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// job is a query read from a listener waiting for a worker
+type job struct {
+	ctx     context.Context
+	payload []byte // from bufPool
+}
+
+// startWorkers runs n handlers taking queries from a queue of size queueSize
+func (s *Server) startWorkers(n, queueSize int) {
+	s.jobs = make(chan job, queueSize)
+	for i := 0; i < n; i++ {
+		go func() {
+			for j := range s.jobs {
+				s.work(j)
+			}
+		}()
+	}
+}
+
+func (s *Server) work(j job) {
+	defer s.inflight.Done()
+	defer putBuf(j.payload) // queries are not kept after handling
+	defer s.recoverPanic("handling a query")
+	s.handle(j.ctx, j.payload)
+}
+
+// enqueue hands a query to the workers, counted as in flight until handled.
+// When the queue is full, either it or the oldest queued one is dropped per -queue-policy.
+func (s *Server) enqueue(ctx context.Context, payload []byte) {
+	s.inflight.Add(1)
+	for {
+		select {
+		case s.jobs <- job{ctx, payload}:
+			return
+		default:
+		}
+
+		if s.opts.QueuePolicy == "drop" {
+			s.dropJob(payload)
+			return
+		}
+		select { // make room, another reader may take it first
+		case old := <-s.jobs:
+			s.dropJob(old.payload)
+		default:
+		}
+	}
+}
+
+func (s *Server) dropJob(payload []byte) {
+	atomic.AddUint64(&s.jobsDropped, 1)
+	putBuf(payload)
+	s.inflight.Done()
+}
@@ -0,0 +1,151 @@
+package dnsfilter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"time"
+)
+
+const typeIXFR dnsmessage.Type = 251
+
+// loadXFR checks -xfr and -xfr-clients
+func (s *Server) loadXFR() error {
+	server, err := parseUdpAddr(s.opts.XFR)
+	if err != nil || server.IP == nil {
+		return fmt.Errorf("Invalid zone transfer server: %s", s.opts.XFR)
+	}
+	clients, err := parseIPList(s.opts.XFRClients)
+	if err != nil {
+		return err
+	}
+	if clients.size == 0 {
+		return errors.New("Zone transfers need -xfr-clients")
+	}
+	s.xfrServer, s.xfrClients = server.String(), clients
+	s.logStd.Printf("Passing zone transfers over TCP to %s", s.xfrServer)
+	return nil
+}
+
+// passXFR relays query, AXFR or IXFR over conn, to -xfr for an allowed client, then
+// the messages of the transfer back until its final SOA. It is refused otherwise.
+func (s *Server) passXFR(conn *net.TCPConn, query []byte) {
+	client := conn.RemoteAddr().(*net.TCPAddr)
+	conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	var parser dnsmessage.Parser
+	hdr, err := parser.Start(query)
+	if err != nil || hdr.Response {
+		return
+	}
+	qs, err := parser.AllQuestions()
+	if err != nil {
+		return
+	}
+
+	if s.xfrServer == "" || len(qs) != 1 || !s.xfrClients.containsIP(client.IP) {
+		if s.verbose() {
+			s.logStd.Printf("%d %s zone transfer over TCP refused", hdr.ID, client)
+		}
+		if msg, err := reply(hdr, qs, dnsmessage.RCodeRefused); err == nil {
+			writeFramed(conn, msg)
+		}
+		return
+	}
+	if s.verbose() {
+		s.logStd.Printf("%d %s %s %s passed to %s", hdr.ID, client, typeName(qs[0].Type), qs[0].Name, s.xfrServer)
+	}
+
+	upstream, err := s.outboundDialer().Dial("tcp", s.xfrServer)
+	if err != nil {
+		s.logErr.Println(err)
+		return
+	}
+	defer upstream.Close()
+	upstream.SetDeadline(time.Now().Add(s.opts.Timeout))
+	if err := writeFramed(upstream, query); err != nil {
+		s.logErr.Println(err)
+		return
+	}
+
+	end := xfrEnd{ixfr: qs[0].Type == typeIXFR}
+	for done := false; !done; {
+		msg, err := readFramed(upstream)
+		if err != nil {
+			s.logErr.Printf("Zone transfer of %s from %s: %s", qs[0].Name, s.xfrServer, err)
+			return
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(msg); err != nil {
+			s.logErr.Printf("Zone transfer of %s from %s: %s", qs[0].Name, s.xfrServer, err)
+			return
+		}
+		done = m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) == 0
+		for _, rr := range m.Answers {
+			done = end.next(rr) || done
+		}
+		if end.ixfr && end.records == 1 { // up to date, the SOA alone
+			done = true
+		}
+
+		conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+		upstream.SetDeadline(time.Now().Add(s.opts.Timeout))
+		if err := writeFramed(conn, msg); err != nil {
+			return
+		}
+	}
+}
+
+// xfrEnd follows the records of a transfer to find its final SOA: the first one again
+// for AXFR, or IXFR answered by the whole zone, and for incremental IXFR the one
+// closing the additions of the last diff, each diff being the old SOA, deleted
+// records, the new SOA and added records (RFC 1995 section 4)
+type xfrEnd struct {
+	ixfr        bool
+	records     int
+	serial      uint32 // of the first SOA, the one the transfer ends with
+	incremental bool   // the second record being an SOA too
+	soas        int    // after the first, of an incremental transfer
+}
+
+// next tells if rr ends the transfer
+func (e *xfrEnd) next(rr dnsmessage.Resource) bool {
+	e.records++
+	soa, ok := rr.Body.(*dnsmessage.SOAResource)
+	switch {
+	case e.records == 1:
+		if ok {
+			e.serial = soa.Serial
+		}
+		return false
+	case e.records == 2:
+		e.incremental = e.ixfr && ok
+	}
+	if !ok {
+		return false
+	}
+	if !e.incremental {
+		return soa.Serial == e.serial
+	}
+	e.soas++ // odd ones start the deletions of a diff, but the final one
+	return e.soas > 1 && e.soas%2 == 1 && soa.Serial == e.serial
+}
+
+func readFramed(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err := io.ReadFull(conn, msg)
+	return msg, err
+}
+
+func writeFramed(conn net.Conn, msg []byte) error {
+	framed := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	_, err := conn.Write(append(framed, msg...))
+	return err
+}
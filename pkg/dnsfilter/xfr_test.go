@@ -0,0 +1,102 @@
+package dnsfilter
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"testing"
+	"time"
+)
+
+func soaRecord(serial uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example."), Class: dnsmessage.ClassINET},
+		Body: &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example."), MBox: dnsmessage.MustNewName("admin.example."), Serial: serial}}
+}
+
+func aRecord(last byte) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.example."), Class: dnsmessage.ClassINET},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, last}}}
+}
+
+// xfrUpstream answers the first transfer asked by the messages of answers
+func xfrUpstream(t *testing.T, answers ...[]dnsmessage.Resource) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		query, err := readFramed(conn)
+		if err != nil {
+			return
+		}
+		var q dnsmessage.Message
+		if q.Unpack(query) != nil {
+			return
+		}
+		for _, rrs := range answers {
+			m := dnsmessage.Message{Header: dnsmessage.Header{ID: q.ID, Response: true, Authoritative: true}, Questions: q.Questions, Answers: rrs}
+			msg, err := m.Pack()
+			if err != nil || writeFramed(conn, msg) != nil {
+				return
+			}
+		}
+		readFramed(conn) // until the transfer is over
+	}()
+	return ln.Addr().String()
+}
+
+// an IXFR of two diffs is relayed until the SOA closing the last one
+func TestIXFRTwoDiffs(t *testing.T) {
+	addr := raceServer(t)
+	server := xfrUpstream(t,
+		[]dnsmessage.Resource{soaRecord(3), soaRecord(1), aRecord(1), soaRecord(2), aRecord(2)},
+		[]dnsmessage.Resource{soaRecord(2), aRecord(2), soaRecord(3), aRecord(3)},
+		[]dnsmessage.Resource{soaRecord(3)})
+	clients, err := parseIPList("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raceSrv.xfrServer, raceSrv.xfrClients = server, clients
+	defer func() { raceSrv.xfrServer, raceSrv.xfrClients = "", nil }()
+
+	conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	q := dnsmessage.Message{Header: dnsmessage.Header{ID: 4242},
+		Questions:   []dnsmessage.Question{{Name: dnsmessage.MustNewName("example."), Type: typeIXFR, Class: dnsmessage.ClassINET}},
+		Authorities: []dnsmessage.Resource{soaRecord(1)}}
+	packed, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := writeFramed(conn, packed); err != nil {
+		t.Fatal(err)
+	}
+	var records int
+	for {
+		msg, err := readFramed(conn)
+		if err != nil {
+			break // closed after the transfer
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(msg); err != nil {
+			t.Fatal(err)
+		}
+		records += len(m.Answers)
+	}
+	if records != 10 {
+		t.Errorf("got %d records, want 10", records)
+	}
+	if elapsed := time.Since(start); elapsed > raceSrv.opts.Timeout/2 {
+		t.Errorf("transfer over after %s, waiting for more", elapsed)
+	}
+}
@@ -0,0 +1,122 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"gopkg.in/go-ini/ini.v1"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configSchema lists the options of each kind of section, nil taking any
+var configSchema = map[string][]string{
+	"global":        nil, // flags, checked by the command line
+	"allow_clients": {"cidr", "action"},
+	"rule": {"client", "server", "ipset", "blocklist", "allowlist", "rpz", "geoip", "type", "name", "follow_cname",
+		"txt_contains", "txt_regex", "section", "rcode", "min_answers", "max_answers", "tunnel", "time", "days", "profile", "priority", "continue", "notify",
+		"target", "delay", "setname", "set_timeout", "block_with", "if_other", "score"},
+	"server":  {"address", "weight", "proxy", "timeout", "trusted", "family"},
+	"forward": {"name", "server", "mode"},
+	"zone":    nil, // names in the zone
+	"reverse": {"networks", "name", "file", "ttl"},
+	"view":    {"clients", "server", "zones", "profile"},
+}
+
+// yamlSections maps top-level YAML keys to INI sections, plural ones holding named children
+var yamlSections = map[string]string{"global": "global", "allow_clients": "allow_clients",
+	"rules": "rule", "servers": "server", "forwards": "forward", "zones": "zone",
+	"reverses": "reverse", "views": "view"}
+
+// LoadConfigFile reads the config file, in YAML if named .yaml or .yml, INI otherwise.
+// YAML is checked against configSchema and turned into the equivalent INI sections,
+// lists becoming comma-separated values.
+func LoadConfigFile(path string) (*ini.File, error) {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".yaml" && ext != ".yml" {
+		return ini.Load(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	cfg := ini.Empty()
+	if len(doc.Content) == 0 { // empty file
+		return cfg, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, yamlError(path, root, "sections expected")
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		kind, ok := yamlSections[key.Value]
+		switch {
+		case !ok:
+			return nil, yamlError(path, key, "unknown section %s", key.Value)
+		case kind == key.Value: // single section
+			if err := yamlSection(cfg, path, kind, kind, value); err != nil {
+				return nil, err
+			}
+		case value.Kind != yaml.MappingNode:
+			return nil, yamlError(path, value, "%s must map names to options", key.Value)
+		default:
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				if err := yamlSection(cfg, path, kind+"."+value.Content[j].Value, kind, value.Content[j+1]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func yamlSection(cfg *ini.File, path, name, kind string, node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return yamlError(path, node, "%s must map options to values", name)
+	}
+	section, err := cfg.NewSection(name)
+	if err != nil {
+		return yamlError(path, node, "%s", err)
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if options := configSchema[kind]; options != nil && !containsString(options, key.Value) {
+			return yamlError(path, key, "unknown %s option %s", kind, key.Value)
+		}
+		if section.HasKey(key.Value) {
+			return yamlError(path, key, "%s %s given twice", name, key.Value)
+		}
+
+		var str string
+		switch value.Kind {
+		case yaml.ScalarNode:
+			str = value.Value
+		case yaml.SequenceNode:
+			items := make([]string, len(value.Content))
+			for j, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					return yamlError(path, item, "%s items must be values", key.Value)
+				}
+				items[j] = item.Value
+			}
+			str = strings.Join(items, ", ")
+		default:
+			return yamlError(path, value, "%s must be a value or a list", key.Value)
+		}
+		if _, err := section.NewKey(key.Value, str); err != nil {
+			return yamlError(path, key, "%s", err)
+		}
+	}
+	return nil
+}
+
+func yamlError(path string, node *yaml.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d:%d: %s", path, node.Line, node.Column, fmt.Sprintf(format, args...))
+}
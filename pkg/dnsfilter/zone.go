@@ -0,0 +1,247 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/go-ini/ini.v1"
+	"net"
+	"strings"
+)
+
+// zone is served authoritatively from a [zone.xxx] section: keys are names relative
+// to it (@ for itself), values comma-separated records like `A 10.0.0.1, TXT "hi"`
+type zone struct {
+	name    string                           // lower case with a trailing dot
+	records map[string][]dnsmessage.Resource // by lower case owner name
+	soa     dnsmessage.Resource              // for negative answers
+	views   []*view                          // answering it, nil for all clients
+}
+
+func (s *Server) loadZones(cfg *ini.File) ([]*zone, error) {
+	zoneSections := cfg.ChildSections("zone")
+	zones := make([]*zone, len(zoneSections))
+
+	for i, section := range zoneSections {
+		sectionName := section.Name()
+
+		origin := strings.ToLower(strings.Trim(section.Key("name").String(), " ."))
+		if origin == "" {
+			origin = strings.ToLower(strings.TrimPrefix(sectionName, "zone."))
+		}
+		originName, err := dnsmessage.NewName(origin + ".")
+		if err != nil {
+			return nil, fmt.Errorf("%s invalid name!", sectionName)
+		}
+		mbox, err := dnsmessage.NewName("hostmaster." + origin + ".")
+		if err != nil {
+			return nil, fmt.Errorf("%s invalid name!", sectionName)
+		}
+		ttl := uint32(section.Key("ttl").MustUint(300))
+
+		z := zone{name: origin + ".", records: make(map[string][]dnsmessage.Resource)}
+		z.soa = dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: originName, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.SOAResource{NS: originName, MBox: mbox, Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: ttl},
+		}
+
+		count := 0
+		for _, key := range section.Keys() {
+			if key.Name() == "name" || key.Name() == "ttl" {
+				continue
+			}
+
+			owner := z.name
+			if key.Name() != "@" {
+				owner = strings.ToLower(strings.Trim(key.Name(), ".")) + "." + owner
+			}
+			ownerName, err := dnsmessage.NewName(owner)
+			if err != nil {
+				return nil, fmt.Errorf("%s invalid name %s!", sectionName, key.Name())
+			}
+
+			for _, rdata := range splitRecords(key.Value()) {
+				rrType, body, err := parseRecord(rdata, z.name)
+				if err != nil {
+					return nil, fmt.Errorf("%s %s %s", sectionName, key.Name(), err)
+				}
+				header := dnsmessage.ResourceHeader{Name: ownerName, Type: rrType, Class: dnsmessage.ClassINET, TTL: ttl}
+				z.records[owner] = append(z.records[owner], dnsmessage.Resource{Header: header, Body: body})
+				count++
+			}
+		}
+
+		s.logStd.Printf("%s: ZONE %s %d records", sectionName, origin, count)
+		zones[i] = &z
+	}
+	return zones, nil
+}
+
+// splitRecords splits by commas outside of double quotes
+func splitRecords(value string) []string {
+	var records []string
+	quoted, start := false, 0
+	for i, c := range value {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			records = append(records, value[start:i])
+			start = i + 1
+		}
+	}
+	records = append(records, value[start:])
+
+	nonEmpty := records[:0]
+	for _, r := range records {
+		if r = strings.TrimSpace(r); r != "" {
+			nonEmpty = append(nonEmpty, r)
+		}
+	}
+	return nonEmpty
+}
+
+// parseRecord reads "TYPE data" for A, AAAA, CNAME and TXT, names relative to origin
+// unless ending with a dot
+func parseRecord(rdata, origin string) (dnsmessage.Type, dnsmessage.ResourceBody, error) {
+	fields := strings.SplitN(rdata, " ", 2)
+	if len(fields) != 2 {
+		return 0, nil, fmt.Errorf("invalid record %s!", rdata)
+	}
+	data := strings.TrimSpace(fields[1])
+
+	switch strings.ToUpper(fields[0]) {
+	case "A":
+		ip := net.ParseIP(data).To4()
+		if ip == nil {
+			return 0, nil, fmt.Errorf("invalid IPv4 address %s!", data)
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+		return dnsmessage.TypeA, &a, nil
+
+	case "AAAA":
+		ip := net.ParseIP(data)
+		if ip == nil || ip.To4() != nil {
+			return 0, nil, fmt.Errorf("invalid IPv6 address %s!", data)
+		}
+		var aaaa dnsmessage.AAAAResource
+		copy(aaaa.AAAA[:], ip)
+		return dnsmessage.TypeAAAA, &aaaa, nil
+
+	case "CNAME":
+		if !strings.HasSuffix(data, ".") {
+			data += "." + origin
+		}
+		target, err := dnsmessage.NewName(strings.ToLower(data))
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid CNAME target %s!", data)
+		}
+		return dnsmessage.TypeCNAME, &dnsmessage.CNAMEResource{CNAME: target}, nil
+
+	case "TXT":
+		var txt []string
+		for _, s := range strings.Split(data, "\"") { // quoted strings
+			if s = strings.TrimSpace(s); s != "" {
+				if len(s) > 255 {
+					return 0, nil, fmt.Errorf("TXT string longer than 255 bytes!")
+				}
+				txt = append(txt, s)
+			}
+		}
+		if len(txt) == 0 {
+			return 0, nil, fmt.Errorf("empty TXT record!")
+		}
+		return dnsmessage.TypeTXT, &dnsmessage.TXTResource{TXT: txt}, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported record type %s!", fields[0])
+}
+
+// zoneAnswer answers queries for names in a local zone authoritatively, following
+// CNAMEs within those zones served to the view v of the client. It returns nil for
+// other names.
+func (s *Server) zoneAnswer(hdr dnsmessage.Header, qs []dnsmessage.Question, v *view) []byte {
+	if len(qs) != 1 || qs[0].Class != dnsmessage.ClassINET {
+		return nil
+	}
+	q := qs[0]
+
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	z := s.zoneOf(strings.ToLower(q.Name.String()), v)
+	if z == nil {
+		return nil
+	}
+
+	hdr.Response, hdr.Authoritative, hdr.RecursionAvailable, hdr.Truncated = true, true, true, false
+	hdr.RCode = dnsmessage.RCodeSuccess
+	msg := dnsmessage.Message{Header: hdr, Questions: qs}
+
+	name := strings.ToLower(q.Name.String())
+	for i := 0; i < maxCNAMEs; i++ {
+		var cname *dnsmessage.Resource
+		for _, rr := range z.records[name] {
+			if rr.Header.Type == q.Type || q.Type == dnsmessage.TypeALL {
+				msg.Answers = append(msg.Answers, rr)
+			} else if rr.Header.Type == dnsmessage.TypeCNAME {
+				rr := rr
+				cname = &rr
+			}
+		}
+		if name == z.name && (q.Type == dnsmessage.TypeSOA || q.Type == dnsmessage.TypeALL) {
+			msg.Answers = append(msg.Answers, z.soa)
+		}
+		if cname == nil {
+			break
+		}
+
+		msg.Answers = append(msg.Answers, *cname)
+		name = cname.Body.(*dnsmessage.CNAMEResource).CNAME.String()
+		if z = s.zoneOf(name, v); z == nil { // the client or upstreams follow it from there
+			break
+		}
+	}
+
+	if len(msg.Answers) == 0 {
+		if !z.exists(name) {
+			msg.RCode = dnsmessage.RCodeNameError
+		}
+		msg.Authorities = []dnsmessage.Resource{z.soa}
+	}
+	for i := range msg.Answers {
+		if strings.EqualFold(msg.Answers[i].Header.Name.String(), q.Name.String()) {
+			msg.Answers[i].Header.Name = q.Name // keep the case of the question
+		}
+	}
+
+	out, err := msg.Pack()
+	if err != nil {
+		s.logErr.Println(err)
+		return nil
+	}
+	return out
+}
+
+// zoneOf returns the local zone served to v name is in. Callers hold configLock.
+func (s *Server) zoneOf(name string, v *view) *zone {
+	var found *zone
+	for _, z := range s.zones { // the longest match wins
+		if z.serves(v) && (name == z.name || strings.HasSuffix(name, "."+z.name)) && (found == nil || len(z.name) > len(found.name)) {
+			found = z
+		}
+	}
+	return found
+}
+
+// exists tells if name owns records or has names below it
+func (z *zone) exists(name string) bool {
+	if name == z.name {
+		return true
+	}
+	for owner := range z.records {
+		if owner == name || strings.HasSuffix(owner, "."+name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+// Package testserver is a mock nameserver answering queries by script, with delays,
+// rcodes and poisoned answers injected ahead of genuine ones, for end-to-end tests of
+// dnsfilter and its mockdns subcommand.
+package testserver
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Answer is how the Server answers queries for a name
+type Answer struct {
+	Name   string          // matching subdomains too, any name if * or .
+	Type   dnsmessage.Type // of queries answered, any if 0
+	IPs    []net.IP        // answered as A or AAAA records by the family queried
+	RCode  dnsmessage.RCode
+	TTL    uint32
+	Delay  time.Duration // before answering
+	Poison []net.IP      // answered at once, ahead of the answer, as on-path injectors do
+	Drop   bool          // no answer, poisoned ones aside
+}
+
+// matches tells if a answers q
+func (a *Answer) matches(q dnsmessage.Question) bool {
+	if a.Type != 0 && a.Type != q.Type {
+		return false
+	}
+	name := strings.ToLower(strings.TrimSuffix(a.Name, "."))
+	if name == "" || name == "*" {
+		return true
+	}
+	qname := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	return qname == name || strings.HasSuffix(qname, "."+name)
+}
+
+// ParseAnswer reads an Answer from a name followed by space-separated fields:
+// ip=ADDR[,ADDR...], poison=ADDR[,ADDR...], rcode=NXDOMAIN, type=AAAA, ttl=SECONDS,
+// delay=DURATION and drop
+func ParseAnswer(spec string) (Answer, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return Answer{}, errors.New("Empty answer")
+	}
+	a := Answer{Name: fields[0], TTL: 60}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		var err error
+		switch strings.ToLower(key) {
+		case "ip":
+			a.IPs, err = parseIPs(value)
+		case "poison":
+			a.Poison, err = parseIPs(value)
+		case "rcode":
+			var ok bool
+			if a.RCode, ok = rcodes[strings.ToUpper(value)]; !ok {
+				err = fmt.Errorf("unknown rcode %s", value)
+			}
+		case "type":
+			var ok bool
+			if a.Type, ok = types[strings.ToUpper(value)]; !ok {
+				err = fmt.Errorf("unknown type %s", value)
+			}
+		case "ttl":
+			var ttl uint64
+			ttl, err = strconv.ParseUint(value, 10, 32)
+			a.TTL = uint32(ttl)
+		case "delay":
+			a.Delay, err = time.ParseDuration(value)
+		case "drop":
+			a.Drop = true
+		default:
+			err = fmt.Errorf("unknown field %s", field)
+		}
+		if err != nil {
+			return Answer{}, fmt.Errorf("Invalid answer %s: %s", spec, err)
+		}
+	}
+	return a, nil
+}
+
+var rcodes = map[string]dnsmessage.RCode{"NOERROR": dnsmessage.RCodeSuccess, "FORMERR": dnsmessage.RCodeFormatError,
+	"SERVFAIL": dnsmessage.RCodeServerFailure, "NXDOMAIN": dnsmessage.RCodeNameError,
+	"NOTIMP": dnsmessage.RCodeNotImplemented, "REFUSED": dnsmessage.RCodeRefused}
+
+var types = map[string]dnsmessage.Type{"A": dnsmessage.TypeA, "AAAA": dnsmessage.TypeAAAA, "CNAME": dnsmessage.TypeCNAME,
+	"MX": dnsmessage.TypeMX, "NS": dnsmessage.TypeNS, "PTR": dnsmessage.TypePTR, "SOA": dnsmessage.TypeSOA,
+	"SRV": dnsmessage.TypeSRV, "TXT": dnsmessage.TypeTXT}
+
+func parseIPs(str string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, field := range strings.Split(str, ",") {
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", field)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// Server answers queries on a UDP socket by the first of its answers matching,
+// NXDOMAIN if none does
+type Server struct {
+	Log *log.Logger // of queries and answers, none if nil
+
+	conn    *net.UDPConn
+	answers []Answer
+	queries uint64 // accessed atomically
+	wg      sync.WaitGroup
+}
+
+// Listen opens the socket of a Server at addr, a random port if 0
+func Listen(addr string, answers []Answer) (*Server, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{conn: conn, answers: answers}, nil
+}
+
+// Addr returns the address s listens at
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Queries returns the number of queries s got
+func (s *Server) Queries() uint64 {
+	return atomic.LoadUint64(&s.queries)
+}
+
+// Serve answers queries until Close, waiting for answers delayed then, which are lost
+func (s *Server) Serve() error {
+	defer s.wg.Wait()
+	for {
+		buf := make([]byte, 65535)
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(buf[:n]); err != nil || m.Response || len(m.Questions) == 0 {
+			continue
+		}
+		atomic.AddUint64(&s.queries, 1)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.answer(m, from)
+		}()
+	}
+}
+
+// Close stops s
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Server) answer(query dnsmessage.Message, from *net.UDPAddr) {
+	q := query.Questions[0]
+	a := Answer{RCode: dnsmessage.RCodeNameError}
+	for _, answer := range s.answers {
+		if answer.matches(q) {
+			a = answer
+			break
+		}
+	}
+
+	if len(a.Poison) > 0 {
+		s.send(query, a.Poison, dnsmessage.RCodeSuccess, a.TTL, from, "poisoned")
+	}
+	if a.Drop {
+		s.logf("%s %s from %s dropped", q.Name, strings.TrimPrefix(q.Type.String(), "Type"), from)
+		return
+	}
+	time.Sleep(a.Delay)
+	s.send(query, a.IPs, a.RCode, a.TTL, from, "answered")
+}
+
+// send answers query with the addresses of ips of the family asked
+func (s *Server) send(query dnsmessage.Message, ips []net.IP, rcode dnsmessage.RCode, ttl uint32, to *net.UDPAddr, what string) {
+	q := query.Questions[0]
+	m := dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true, RecursionDesired: query.RecursionDesired,
+		RecursionAvailable: true, RCode: rcode}, Questions: query.Questions}
+	var records []string
+	for _, ip := range ips {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl}
+		switch ip4 := ip.To4(); {
+		case q.Type == dnsmessage.TypeA && ip4 != nil:
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: rh, Body: &a})
+		case q.Type == dnsmessage.TypeAAAA && ip4 == nil:
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: rh, Body: &aaaa})
+		default:
+			continue
+		}
+		records = append(records, ip.String())
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		s.logf("%s", err)
+		return
+	}
+	if _, err := s.conn.WriteToUDP(packed, to); err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			s.logf("%s", err)
+		}
+		return
+	}
+	s.logf("%s %s from %s %s %s %s", q.Name, strings.TrimPrefix(q.Type.String(), "Type"), to, what,
+		strings.TrimPrefix(rcode.String(), "RCode"), strings.Join(records, ","))
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Log != nil {
+		s.Log.Printf(format, v...)
+	}
+}
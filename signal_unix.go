@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var profileSignal os.Signal = syscall.SIGUSR1 // switches to the next rule profile
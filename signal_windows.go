@@ -0,0 +1,5 @@
+package main
+
+import "os"
+
+var profileSignal os.Signal // no SIGUSR1 on Windows